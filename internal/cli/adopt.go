@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/HammerSpb/aipaca/internal/operations"
+)
+
+var (
+	adoptDryRun   bool
+	adoptProfile  string
+	adoptRepo     string
+	adoptNoBackup bool
+)
+
+var adoptCmd = &cobra.Command{
+	Use:   "adopt <path>...",
+	Short: "Bring unmanaged AI files under management",
+	Long: `Add AI files you created in the repository to the applied profile.
+
+Clean and restore only touch files aipaca manages. Adopting a file copies
+it into the profile and marks it as managed, so later operations treat it
+like the rest of the profile. Directories adopt every file under them.
+
+When several profiles are stacked, files go to the top profile unless
+--profile names another applied profile.
+
+Examples:
+  aipaca adopt ai/notes.md
+  aipaca adopt .claude/commands --profile base`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		result, err := operations.Adopt(cfg, operations.AdoptOptions{
+			Paths:       args,
+			RepoPath:    adoptRepo,
+			ProfileName: adoptProfile,
+			DryRun:      adoptDryRun,
+			NoBackup:    adoptNoBackup,
+		})
+		if err != nil {
+			return err
+		}
+
+		if adoptDryRun {
+			fmt.Println("Dry run - no changes made")
+			fmt.Println()
+			fmt.Printf("Would adopt into profile '%s':\n", result.ProfileName)
+		} else {
+			fmt.Printf("Adopted into profile '%s':\n", result.ProfileName)
+		}
+		for _, f := range result.FilesAdopted {
+			printInfo("+ %s", f)
+		}
+
+		if !adoptDryRun {
+			fmt.Println()
+			if result.BackupName != "" {
+				printSuccess("Created backup of previous profile: %s", result.BackupName)
+			}
+			printSuccess("Updated profile '%s' (v%d)", result.ProfileName, result.Version)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	adoptCmd.Flags().BoolVar(&adoptDryRun, "dry-run", false, "Show what would happen without making changes")
+	adoptCmd.Flags().StringVarP(&adoptProfile, "profile", "p", "", "Applied profile to add the files to")
+	adoptCmd.Flags().StringVar(&adoptRepo, "repo", "", "Repository path (default: current directory)")
+	adoptCmd.Flags().BoolVar(&adoptNoBackup, "no-backup", false, "Skip backing up the profile before changing it")
+}
@@ -2,20 +2,26 @@ package cli
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/spf13/cobra"
 
+	"github.com/HammerSpb/aipaca/internal/config"
 	"github.com/HammerSpb/aipaca/internal/operations"
+	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
 )
 
 var (
 	applyDryRun   bool
 	applyNoBackup bool
 	applyForce    bool
+	applySet      map[string]string
 )
 
 var applyCmd = &cobra.Command{
-	Use:   "apply <profile> [repo-path]",
+	Use:   "apply <profile>... [repo-path]",
 	Short: "Apply a profile to a repository",
 	Long: `Apply a profile to a repository.
 
@@ -24,21 +30,65 @@ This will:
 2. Copy the profile files to the repo
 3. Record the state for future operations
 
-Use --dry-run to preview what would happen.`,
-	Args: cobra.RangeArgs(1, 2),
+Several profiles can be stacked in order; later profiles override earlier
+ones per file. Profiles listed in a profile's "extends" are stacked
+underneath it automatically. The last argument is taken as the repo path
+when it is an existing directory and not a profile name.
+
+Profile files ending in .tmpl, or listed under "templates" in the profile
+manifest, are rendered as Go templates. Variables come from the profile
+manifests, the repo (repo_name, repo_path, git_remote, go_module,
+package_name), the repo's "vars" in the config and --set, in that order.
+
+Examples:
+  aipaca apply default
+  aipaca apply base go personal
+  aipaca apply base go ../api
+  aipaca apply go --set test_command="make test"
+
+Use --dry-run to preview what would happen.
+
+Run on many repos at once with --repos-from, --glob or --with-profile;
+--atomic undoes the apply everywhere if it fails in any repo.`,
+	Args: cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		profileName := args[0]
-		repoPath := ""
-		if len(args) > 1 {
-			repoPath = args[1]
+		profiles, repoPath := splitProfileArgs(args)
+
+		repos, err := bulkRepos(cmd, repoPath)
+		if err != nil {
+			return err
+		}
+		if repos != nil {
+			if bulkAtomic && applyNoBackup {
+				return fmt.Errorf("--atomic undoes changes from backups and cannot be combined with --no-backup")
+			}
+			return runBulk(repos, applyDryRun, func(cfg *config.Config, repoPath string, dryRun bool) (string, error) {
+				result, err := operations.Apply(cfg, operations.ApplyOptions{
+					Profiles: profiles,
+					RepoPath: repoPath,
+					DryRun:   dryRun,
+					NoBackup: applyNoBackup,
+					Force:    applyForce,
+					Set:      applySet,
+				})
+				if err != nil {
+					return "", err
+				}
+				verb := "applied"
+				if dryRun {
+					verb = "would apply"
+				}
+				return fmt.Sprintf("%s %s (%d files)", verb, profileList(result.Layers), len(result.FilesApplied)), nil
+			})
 		}
 
 		result, err := operations.Apply(cfg, operations.ApplyOptions{
-			ProfileName: profileName,
-			RepoPath:    repoPath,
-			DryRun:      applyDryRun,
-			NoBackup:    applyNoBackup,
-			Force:       applyForce,
+			Profiles: profiles,
+			RepoPath: repoPath,
+			DryRun:   applyDryRun,
+			NoBackup: applyNoBackup,
+			Force:    applyForce,
+			Set:      applySet,
 		})
 		if err != nil {
 			return err
@@ -61,14 +111,76 @@ Use --dry-run to preview what would happen.`,
 			fmt.Println()
 		}
 
+		stacked := len(result.Layers) > 1
 		if len(result.FilesApplied) > 0 {
+			what := fmt.Sprintf("profile '%s'", result.ProfileName)
+			if stacked {
+				what = "profiles " + strings.Join(result.Layers, " → ")
+			}
 			if applyDryRun {
-				fmt.Printf("Would apply from profile '%s':\n", result.ProfileName)
+				fmt.Printf("Would apply from %s:\n", what)
 			} else {
-				fmt.Printf("Applied from profile '%s':\n", result.ProfileName)
+				fmt.Printf("Applied from %s:\n", what)
+			}
+			merged := make(map[string]bool, len(result.Merged))
+			for _, f := range result.Merged {
+				merged[f] = true
+			}
+			inBlock := make(map[string]bool, len(result.Blocks))
+			for _, f := range result.Blocks {
+				inBlock[f] = true
+			}
+			rendered := make(map[string]bool, len(result.Rendered))
+			for _, f := range result.Rendered {
+				rendered[f] = true
 			}
 			for _, f := range result.FilesApplied {
-				printInfo("+ %s", f)
+				var notes []string
+				switch {
+				case inBlock[f]:
+					notes = append(notes, "block")
+				case merged[f]:
+					notes = append(notes, "merged")
+				case stacked:
+					notes = append(notes, result.Owners[f])
+				}
+				if rendered[f] {
+					notes = append(notes, "rendered")
+				}
+				note := ""
+				if len(notes) > 0 {
+					note = fmt.Sprintf(" (%s)", strings.Join(notes, ", "))
+				}
+				printInfo("+ %s%s", f, note)
+			}
+			fmt.Println()
+		}
+
+		if len(result.Skipped) > 0 {
+			if applyDryRun {
+				fmt.Println("Would skip (conditions not met):")
+			} else {
+				fmt.Println("Skipped (conditions not met):")
+			}
+			for _, s := range result.Skipped {
+				where := s.Path
+				if stacked {
+					where = fmt.Sprintf("%s (%s)", s.Path, s.Profile)
+				}
+				printInfo("- %s: %s", where, s.Reason)
+			}
+			fmt.Println()
+		}
+
+		if applyDryRun && len(result.Rendered) > 0 {
+			fmt.Println("Template variables:")
+			keys := make([]string, 0, len(result.Vars))
+			for k := range result.Vars {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				printInfo("%s = %s", k, result.Vars[k])
 			}
 			fmt.Println()
 		}
@@ -77,15 +189,34 @@ Use --dry-run to preview what would happen.`,
 			if result.BackupName != "" {
 				printSuccess("Created backup: %s", result.BackupName)
 			}
-			printSuccess("Applied profile '%s'", result.ProfileName)
+			if stacked {
+				printSuccess("Applied profiles %s", strings.Join(result.Layers, " → "))
+			} else {
+				printSuccess("Applied profile '%s'", result.ProfileName)
+			}
 		}
 
 		return nil
 	},
 }
 
+// splitProfileArgs splits apply-style arguments into profile names and an
+// optional trailing repo path. The last argument is the repo path when it
+// is not a profile but an existing directory.
+func splitProfileArgs(args []string) (profiles []string, repoPath string) {
+	if len(args) > 1 {
+		last := args[len(args)-1]
+		if !storage.New(cfg).ProfileExists(last) && fileutil.IsDir(last) {
+			return args[:len(args)-1], last
+		}
+	}
+	return args, ""
+}
+
 func init() {
 	applyCmd.Flags().BoolVar(&applyDryRun, "dry-run", false, "Show what would happen without making changes")
 	applyCmd.Flags().BoolVar(&applyNoBackup, "no-backup", false, "Skip creating backup (dangerous)")
 	applyCmd.Flags().BoolVar(&applyForce, "force", false, "Force apply even if there are issues")
+	applyCmd.Flags().StringToStringVar(&applySet, "set", nil, "Set a template variable (key=value, repeatable)")
+	addBulkFlags(applyCmd, true)
 }
@@ -3,16 +3,16 @@ package cli
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 	"text/tabwriter"
 
 	"github.com/spf13/cobra"
 
+	"github.com/HammerSpb/aipaca/internal/operations"
 	"github.com/HammerSpb/aipaca/internal/storage"
 )
 
 var (
-	backupsRepoPath string
+	backupsRepoPath  string
 	backupsPruneKeep int
 )
 
@@ -35,9 +35,9 @@ Use --repo to filter backups for a specific repository.`,
 		var err error
 
 		if backupsRepoPath != "" {
-			repoPath, err := filepath.Abs(backupsRepoPath)
+			repoPath, err := operations.ResolveRepoPath(cfg, backupsRepoPath)
 			if err != nil {
-				return fmt.Errorf("invalid repo path: %w", err)
+				return err
 			}
 			backups, err = store.GetBackupsForRepo(repoPath)
 			if err != nil {
@@ -56,15 +56,15 @@ Use --repo to filter backups for a specific repository.`,
 		}
 
 		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-		fmt.Fprintln(w, "BACKUP\tFILES\tCREATED")
-		fmt.Fprintln(w, "------\t-----\t-------")
+		fmt.Fprintln(w, "BACKUP\tOPERATION\tPROFILE\tFILES\tCREATED")
+		fmt.Fprintln(w, "------\t---------\t-------\t-----\t-------")
 
 		for _, b := range backups {
 			created := "-"
 			if !b.CreatedAt.IsZero() {
 				created = b.CreatedAt.Format("2006-01-02 15:04:05")
 			}
-			fmt.Fprintf(w, "%s\t%d\t%s\n", b.Name, b.FileCount, created)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", b.Name, orDash(b.Operation), orDash(b.Profile), b.FileCount, created)
 		}
 		w.Flush()
 
@@ -74,7 +74,7 @@ Use --repo to filter backups for a specific repository.`,
 
 var backupsShowCmd = &cobra.Command{
 	Use:   "show <backup>",
-	Short: "Show backup contents",
+	Short: "Show backup manifest and contents",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		backupName := args[0]
@@ -86,18 +86,42 @@ var backupsShowCmd = &cobra.Command{
 		}
 
 		fmt.Printf("Backup: %s\n", backup.Name)
+		if backup.ID != "" {
+			fmt.Printf("ID: %s\n", backup.ID)
+		}
 		if !backup.CreatedAt.IsZero() {
 			fmt.Printf("Created: %s\n", backup.CreatedAt.Format("2006-01-02 15:04:05"))
 		}
+		if backup.Operation != "" {
+			fmt.Printf("Operation: %s\n", backup.Operation)
+		}
+		if backup.Profile != "" {
+			fmt.Printf("Profile: %s\n", backup.Profile)
+		}
+		if backup.RepoPath != "" {
+			fmt.Printf("Repo: %s\n", backup.RepoPath)
+		}
+		if backup.GitRemote != "" {
+			fmt.Printf("Git remote: %s\n", backup.GitRemote)
+		}
 		fmt.Printf("Files: %d\n", backup.FileCount)
 		fmt.Println()
 
-		files, err := store.GetBackupFiles(backupName)
+		fmt.Println("Contents:")
+		if len(backup.Files) > 0 {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			for _, f := range backup.Files {
+				fmt.Fprintf(w, "  %s\t%s\n", f.Path, f.Checksum)
+			}
+			w.Flush()
+			return nil
+		}
+
+		// Backups without a manifest only have their files
+		files, err := store.GetBackupFiles(backup.Name)
 		if err != nil {
 			return err
 		}
-
-		fmt.Println("Contents:")
 		for _, f := range files {
 			fmt.Printf("  %s\n", f)
 		}
@@ -114,17 +138,17 @@ var backupsDeleteCmd = &cobra.Command{
 		backupName := args[0]
 		store := storage.New(cfg)
 
-		// Verify backup exists
-		_, err := store.GetBackup(backupName)
+		// Verify backup exists (it may be given by name or manifest ID)
+		backup, err := store.GetBackup(backupName)
 		if err != nil {
 			return err
 		}
 
-		if err := store.DeleteBackup(backupName); err != nil {
+		if err := store.DeleteBackup(backup.Name); err != nil {
 			return err
 		}
 
-		printSuccess("Deleted backup '%s'", backupName)
+		printSuccess("Deleted backup '%s'", backup.Name)
 		return nil
 	},
 }
@@ -143,9 +167,9 @@ Use --repo to prune backups only for a specific repository.`,
 		var err error
 
 		if backupsRepoPath != "" {
-			repoPath, err := filepath.Abs(backupsRepoPath)
+			repoPath, err := operations.ResolveRepoPath(cfg, backupsRepoPath)
 			if err != nil {
-				return fmt.Errorf("invalid repo path: %w", err)
+				return err
 			}
 			backups, err = store.GetBackupsForRepo(repoPath)
 			if err != nil {
@@ -194,3 +218,11 @@ func init() {
 	backupsCmd.AddCommand(backupsDeleteCmd)
 	backupsCmd.AddCommand(backupsPruneCmd)
 }
+
+// orDash returns s, or "-" when s is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,149 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/operations"
+)
+
+var (
+	bulkReposFrom   string
+	bulkGlob        string
+	bulkWithProfile string
+	bulkJobs        int
+	bulkAtomic      bool
+)
+
+// bulkOp runs a command on one repo of a bulk run, with the config it is
+// given, and describes what it did in a few words. With dryRun it only
+// previews.
+type bulkOp func(cfg *config.Config, repoPath string, dryRun bool) (string, error)
+
+// addBulkFlags registers the flags that run a command on many repos.
+// Atomic runs are only offered for commands restore --step can undo.
+func addBulkFlags(cmd *cobra.Command, atomic bool) {
+	cmd.Flags().StringVar(&bulkReposFrom, "repos-from", "", "Run on the repos listed in a file, one per line (- for stdin)")
+	cmd.Flags().StringVar(&bulkGlob, "glob", "", "Run on the directories matching a pattern (quote it, e.g. '~/code/*')")
+	cmd.Flags().StringVar(&bulkWithProfile, "with-profile", "", "Run on every repo this profile is applied to")
+	cmd.Flags().IntVar(&bulkJobs, "jobs", operations.DefaultJobs, "How many repos to work on at a time")
+	if atomic {
+		cmd.Flags().BoolVar(&bulkAtomic, "atomic", false, "Undo the changes to every repo if any repo fails")
+	}
+}
+
+// bulkRepos returns the repos the bulk flags select, or nil when none are
+// given and the command runs on a single repo
+func bulkRepos(cmd *cobra.Command, repoPath string) ([]string, error) {
+	sel := operations.RepoSelection{
+		ReposFrom:   bulkReposFrom,
+		Glob:        bulkGlob,
+		WithProfile: bulkWithProfile,
+	}
+	if sel.Empty() {
+		if bulkAtomic || cmd.Flags().Changed("jobs") {
+			return nil, fmt.Errorf("--atomic and --jobs need --repos-from, --glob or --with-profile")
+		}
+		return nil, nil
+	}
+	if repoPath != "" {
+		return nil, fmt.Errorf("a repo path cannot be combined with --repos-from, --glob or --with-profile")
+	}
+	if bulkJobs < 1 {
+		return nil, fmt.Errorf("--jobs must be at least 1")
+	}
+
+	repos, err := operations.SelectRepos(cfg, sel)
+	if err != nil {
+		return nil, err
+	}
+	if len(repos) == 0 {
+		return nil, fmt.Errorf("no repos selected")
+	}
+	return repos, nil
+}
+
+// runBulk runs op on every repo and prints a summary table, exiting with
+// status 1 if it failed on any. An atomic run previews every repo first
+// and changes none of them unless every preview succeeds.
+func runBulk(repos []string, dryRun bool, op bulkOp) error {
+	opts := operations.BulkOptions{Jobs: bulkJobs, Atomic: bulkAtomic && !dryRun}
+
+	if opts.Atomic {
+		previews := operations.RunBulk(cfg, repos, operations.BulkOptions{Jobs: bulkJobs}, func(cfg *config.Config, repoPath string) (string, error) {
+			return op(cfg, repoPath, true)
+		})
+		if operations.Failed(previews) {
+			printBulkResults(previews)
+			fmt.Println()
+			printError("Changed nothing: the dry run failed on %d of %d repos", countFailed(previews), len(previews))
+			os.Exit(1)
+		}
+	}
+
+	results := operations.RunBulk(cfg, repos, opts, func(cfg *config.Config, repoPath string) (string, error) {
+		return op(cfg, repoPath, dryRun)
+	})
+	printBulkResults(results)
+	fmt.Println()
+
+	failed := countFailed(results)
+	if failed == 0 {
+		printSuccess("Done in %d repos", len(results))
+		return nil
+	}
+	printError("Failed in %d of %d repos", failed, len(results))
+	if opts.Atomic {
+		for _, r := range results {
+			if r.RollbackErr != nil {
+				printWarning("Could not undo the changes to %s; run 'aipaca restore --step' there", r.RepoPath)
+			}
+		}
+		printInfo("The other repos were put back as they were")
+	}
+	os.Exit(1)
+	return nil
+}
+
+// printBulkResults prints the outcome of a bulk run as a table
+func printBulkResults(results []operations.BulkResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPO\tRESULT\tDETAIL")
+	fmt.Fprintln(w, "----\t------\t------")
+
+	for _, r := range results {
+		outcome, detail := "ok", r.Detail
+		switch {
+		case r.Err != nil:
+			outcome, detail = "failed", firstLine(r.Err.Error())
+		case r.RollbackErr != nil:
+			outcome, detail = "not undone", firstLine(r.RollbackErr.Error())
+		case r.RolledBack:
+			outcome = "undone"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.RepoPath, outcome, orDash(detail))
+	}
+	w.Flush()
+}
+
+// countFailed counts the repos a bulk run failed on
+func countFailed(results []operations.BulkResult) int {
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// firstLine returns the first line of a message
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
@@ -5,25 +5,38 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"github.com/HammerSpb/aipaca/internal/config"
 	"github.com/HammerSpb/aipaca/internal/operations"
 )
 
 var (
-	cleanDryRun   bool
-	cleanNoBackup bool
+	cleanDryRun      bool
+	cleanNoBackup    bool
+	cleanManagedOnly bool
+	cleanAll         bool
 )
 
 var cleanCmd = &cobra.Command{
 	Use:   "clean [repo-path]",
 	Short: "Remove AI files from repository",
-	Long: `Remove all AI files from the repository.
+	Long: `Remove the AI files aipaca manages from the repository.
 
 This is useful for:
 - Creating clean commits/PRs without AI configuration
 - Temporarily disabling AI tools
 
+Only files written by apply, saved by save or taken over with 'aipaca
+adopt' are removed; AI files you created yourself stay. Use --all to remove
+every AI file matching the configured patterns.
+
+Files with aipaca blocks keep their other content; only the blocks are
+removed.
+
 Files are backed up before removal (use --no-backup to skip).
-Use 'aipaca restore' to bring them back.`,
+Use 'aipaca restore' to bring them back.
+
+Run on many repos at once with --repos-from, --glob or --with-profile;
+--atomic undoes the clean everywhere if it fails in any repo.`,
 	Args: cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		repoPath := ""
@@ -31,16 +44,53 @@ Use 'aipaca restore' to bring them back.`,
 			repoPath = args[0]
 		}
 
+		repos, err := bulkRepos(cmd, repoPath)
+		if err != nil {
+			return err
+		}
+		if repos != nil {
+			if bulkAtomic && cleanNoBackup {
+				return fmt.Errorf("--atomic undoes changes from backups and cannot be combined with --no-backup")
+			}
+			return runBulk(repos, cleanDryRun, func(cfg *config.Config, repoPath string, dryRun bool) (string, error) {
+				result, err := operations.Clean(cfg, operations.CleanOptions{
+					RepoPath: repoPath,
+					DryRun:   dryRun,
+					NoBackup: cleanNoBackup,
+					All:      cleanAll || !cleanManagedOnly,
+				})
+				if err != nil {
+					return "", err
+				}
+				n := len(result.FilesRemoved) + len(result.BlocksRemoved)
+				switch {
+				case n == 0:
+					return "nothing to clean", nil
+				case dryRun:
+					return fmt.Sprintf("would remove %d files", n), nil
+				default:
+					return fmt.Sprintf("removed %d files", n), nil
+				}
+			})
+		}
+
 		result, err := operations.Clean(cfg, operations.CleanOptions{
 			RepoPath: repoPath,
 			DryRun:   cleanDryRun,
 			NoBackup: cleanNoBackup,
+			All:      cleanAll || !cleanManagedOnly,
 		})
 		if err != nil {
 			return err
 		}
 
-		if len(result.FilesRemoved) == 0 {
+		if len(result.FilesRemoved) == 0 && len(result.BlocksRemoved) == 0 {
+			if len(result.Unmanaged) > 0 {
+				fmt.Println("No managed AI files found in repository")
+				fmt.Println()
+				printUnmanaged(result.Unmanaged)
+				return nil
+			}
 			fmt.Println("No AI files found in repository")
 			return nil
 		}
@@ -48,13 +98,44 @@ Use 'aipaca restore' to bring them back.`,
 		if cleanDryRun {
 			fmt.Println("Dry run - no changes made")
 			fmt.Println()
-			fmt.Println("Would remove:")
-		} else {
-			fmt.Println("Removed:")
 		}
 
-		for _, f := range result.FilesRemoved {
-			printInfo("- %s", f)
+		if len(result.FilesRemoved) > 0 {
+			if cleanDryRun {
+				fmt.Println("Would remove:")
+			} else {
+				fmt.Println("Removed:")
+			}
+			modified := make(map[string]bool, len(result.Modified))
+			for _, f := range result.Modified {
+				modified[f] = true
+			}
+			for _, f := range result.FilesRemoved {
+				if modified[f] {
+					printInfo("- %s (modified since apply)", f)
+				} else {
+					printInfo("- %s", f)
+				}
+			}
+		}
+
+		if len(result.BlocksRemoved) > 0 {
+			if len(result.FilesRemoved) > 0 {
+				fmt.Println()
+			}
+			if cleanDryRun {
+				fmt.Println("Would remove aipaca blocks from:")
+			} else {
+				fmt.Println("Removed aipaca blocks from:")
+			}
+			for _, f := range result.BlocksRemoved {
+				printInfo("~ %s", f)
+			}
+		}
+
+		if len(result.Unmanaged) > 0 {
+			fmt.Println()
+			printUnmanaged(result.Unmanaged)
 		}
 
 		if !cleanDryRun {
@@ -62,7 +143,7 @@ Use 'aipaca restore' to bring them back.`,
 			if result.BackupName != "" {
 				printSuccess("Created backup: %s", result.BackupName)
 			}
-			printSuccess("Cleaned %d AI files/directories", len(result.FilesRemoved))
+			printSuccess("Cleaned %d AI files/directories", len(result.FilesRemoved)+len(result.BlocksRemoved))
 			fmt.Println()
 			fmt.Println("Run 'aipaca restore' to bring them back 🦙")
 		}
@@ -71,7 +152,22 @@ Use 'aipaca restore' to bring them back.`,
 	},
 }
 
+// printUnmanaged lists the AI files an operation left alone because aipaca
+// does not manage them
+func printUnmanaged(files []string) {
+	if len(files) == 0 {
+		return
+	}
+	fmt.Println("Left unmanaged AI files in place (use --all to remove them):")
+	for _, f := range files {
+		printInfo("%s", f)
+	}
+}
+
 func init() {
 	cleanCmd.Flags().BoolVar(&cleanDryRun, "dry-run", false, "Show what would happen without making changes")
 	cleanCmd.Flags().BoolVar(&cleanNoBackup, "no-backup", false, "Skip creating backup (dangerous)")
+	cleanCmd.Flags().BoolVar(&cleanManagedOnly, "managed-only", true, "Only remove files aipaca manages")
+	cleanCmd.Flags().BoolVar(&cleanAll, "all", false, "Remove every AI file (same as --managed-only=false)")
+	addBulkFlags(cleanCmd, true)
 }
@@ -2,39 +2,130 @@ package cli
 
 import (
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 
 	"github.com/HammerSpb/aipaca/internal/operations"
+	"github.com/HammerSpb/aipaca/pkg/structdiff"
+	"github.com/HammerSpb/aipaca/pkg/textdiff"
+)
+
+var (
+	diffContext    int
+	diffStat       bool
+	diffNameOnly   bool
+	diffNameStatus bool
+	diffColor      string
+	diffNoSemantic bool
 )
 
 var diffCmd = &cobra.Command{
-	Use:   "diff [profile] [repo-path]",
-	Short: "Show differences between repo and profile",
+	Use:   "diff [profile|left] [repo-path|right]",
+	Short: "Show differences between repo and profile, or any two sources",
 	Long: `Show differences between the AI files in a repository and a profile.
 
-If no profile is specified, compares against the currently applied profile.`,
+If no profile is specified, compares against the currently applied profile.
+Changes are shown as unified diffs from the profile (a/) to the repo (b/).
+
+Any two sources can be compared by giving source specs:
+  profile:NAME         A stored profile
+  backup:NAME|ID       A backup, by directory name or manifest ID
+  repo:PATH            The AI files of a repository (repo: alone = current dir)
+
+With specs, changes go from left (a/) to right (b/). A bare name is taken
+as a profile, and a missing right side means the current repository.
+
+Examples:
+  aipaca diff profile:minimal profile:default
+  aipaca diff backup:api-2026-10-01-120000 repo:.
+  aipaca diff repo:../api repo:../web
+
+Output modes:
+  --stat          Summary of changed lines per file
+  --name-only     Only the names of changed files
+  --name-status   Names with A (added in repo), D (missing from repo) or M
+
+JSON and YAML files are compared by key path, so reformatting or reordering
+keys is not a change. Use --no-semantic to see line diffs instead.
+
+Files holding aipaca blocks are compared block by block, with changes to
+the content around the blocks reported separately.`,
 	Args: cobra.MaximumNArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		profileName := ""
-		repoPath := ""
+		opts := operations.DiffOptions{
+			Context:    diffContext,
+			NoSemantic: diffNoSemantic,
+		}
 
-		if len(args) > 0 {
-			profileName = args[0]
+		specMode := false
+		for _, arg := range args {
+			if operations.IsSourceSpec(arg) {
+				specMode = true
+			}
 		}
-		if len(args) > 1 {
-			repoPath = args[1]
+
+		switch {
+		case specMode:
+			opts.Left = args[0]
+			if len(args) > 1 {
+				opts.Right = args[1]
+			}
+		default:
+			if len(args) > 0 {
+				opts.ProfileName = args[0]
+			}
+			if len(args) > 1 {
+				opts.RepoPath = args[1]
+			}
 		}
 
-		result, err := operations.Diff(cfg, operations.DiffOptions{
-			ProfileName: profileName,
-			RepoPath:    repoPath,
-		})
+		modes := 0
+		for _, set := range []bool{diffStat, diffNameOnly, diffNameStatus} {
+			if set {
+				modes++
+			}
+		}
+		if modes > 1 {
+			return fmt.Errorf("--stat, --name-only and --name-status are mutually exclusive")
+		}
+
+		color, err := useColor(diffColor)
+		if err != nil {
+			return err
+		}
+
+		result, err := operations.Diff(cfg, opts)
 		if err != nil {
 			return err
 		}
 
-		fmt.Printf("Comparing against profile '%s'\n", result.ProfileName)
+		switch {
+		case diffNameOnly:
+			printed := make(map[string]bool)
+			for _, change := range result.Changes {
+				if !printed[change.Path] {
+					printed[change.Path] = true
+					fmt.Println(change.Path)
+				}
+			}
+			return nil
+		case diffNameStatus:
+			for _, change := range result.Changes {
+				fmt.Printf("%s\t%s\n", changeStatusLetter(change.Type), change.Label())
+			}
+			return nil
+		}
+
+		switch {
+		case specMode:
+			fmt.Printf("Comparing %s with %s\n", result.Left.Label(), result.Right.Label())
+		case len(result.Left.Layers) > 1:
+			fmt.Printf("Comparing against profiles %s\n", strings.Join(result.Left.Layers, " → "))
+		default:
+			fmt.Printf("Comparing against profile '%s'\n", result.ProfileName)
+		}
 		fmt.Println()
 
 		if !result.HasChanges {
@@ -42,18 +133,161 @@ If no profile is specified, compares against the currently applied profile.`,
 			return nil
 		}
 
-		fmt.Println("Changes:")
+		if diffStat {
+			printDiffStat(result.Changes, color)
+			return nil
+		}
+
 		for _, change := range result.Changes {
-			switch change.Type {
-			case "added":
-				fmt.Printf("  \033[32m+ %s\033[0m (added in repo)\n", change.Path)
-			case "removed":
-				fmt.Printf("  \033[31m- %s\033[0m (missing from repo)\n", change.Path)
-			case "modified":
-				fmt.Printf("  \033[33mM %s\033[0m (modified)\n", change.Path)
-			}
+			printFileDiff(change, color)
 		}
 
 		return nil
 	},
 }
+
+// changeStatusLetter maps a change type to its git-style status letter
+func changeStatusLetter(changeType string) string {
+	switch changeType {
+	case "added":
+		return "A"
+	case "removed":
+		return "D"
+	default:
+		return "M"
+	}
+}
+
+// printFileDiff prints a change as a unified diff
+func printFileDiff(change operations.FileChange, color bool) {
+	oldName, newName := "a/"+change.Path, "b/"+change.Path
+	switch change.Type {
+	case "added":
+		oldName = "/dev/null"
+	case "removed":
+		newName = "/dev/null"
+	}
+
+	fmt.Println(paint(color, "1", fmt.Sprintf("diff --aipaca a/%s b/%s", change.Path, change.Path)))
+	switch {
+	case change.Block != "":
+		fmt.Println(paint(color, "1", "block "+change.Block))
+	case change.UserContent:
+		fmt.Println(paint(color, "1", "outside blocks"))
+	}
+	if change.Owner != "" {
+		fmt.Println(paint(color, "1", "layer "+change.Owner))
+	}
+
+	if change.Binary {
+		fmt.Printf("Binary files %s and %s differ\n", oldName, newName)
+		return
+	}
+
+	fmt.Println(paint(color, "1", "--- "+oldName))
+	fmt.Println(paint(color, "1", "+++ "+newName))
+
+	if len(change.Semantic) > 0 {
+		for _, c := range change.Semantic {
+			fmt.Println(paint(color, semanticColor(c.Kind), c.String()))
+		}
+		return
+	}
+
+	for _, hunk := range change.Hunks {
+		fmt.Println(paint(color, "36", hunk.Header()))
+		for _, line := range hunk.Lines {
+			text := strings.TrimSuffix(textdiff.FormatLine(line), "\n")
+			switch line.Op {
+			case textdiff.Insert:
+				text = paint(color, "32", text)
+			case textdiff.Delete:
+				text = paint(color, "31", text)
+			}
+			fmt.Println(text)
+		}
+	}
+}
+
+// semanticColor picks the color of a key path change
+func semanticColor(kind structdiff.Kind) string {
+	switch kind {
+	case structdiff.Added, structdiff.Inserted:
+		return "32"
+	case structdiff.Removed, structdiff.Deleted:
+		return "31"
+	default:
+		return "33"
+	}
+}
+
+// printDiffStat prints a git-style --stat summary
+func printDiffStat(changes []operations.FileChange, color bool) {
+	const barWidth = 40
+
+	width, maxChanged := 0, 0
+	for _, change := range changes {
+		if len(change.Label()) > width {
+			width = len(change.Label())
+		}
+		inserted, deleted := change.Stats()
+		if inserted+deleted > maxChanged {
+			maxChanged = inserted + deleted
+		}
+	}
+
+	totalInserted, totalDeleted := 0, 0
+	for _, change := range changes {
+		if change.Binary {
+			fmt.Printf(" %-*s | Bin\n", width, change.Label())
+			continue
+		}
+
+		inserted, deleted := change.Stats()
+		totalInserted += inserted
+		totalDeleted += deleted
+
+		// Scale the bar down when the largest change does not fit
+		plus, minus := inserted, deleted
+		if maxChanged > barWidth {
+			plus = inserted * barWidth / maxChanged
+			minus = deleted * barWidth / maxChanged
+		}
+
+		bar := paint(color, "32", strings.Repeat("+", plus)) + paint(color, "31", strings.Repeat("-", minus))
+		fmt.Printf(" %-*s | %d %s\n", width, change.Label(), inserted+deleted, bar)
+	}
+
+	fmt.Printf(" %d file(s) changed, %d insertion(s)(+), %d deletion(s)(-)\n", len(changes), totalInserted, totalDeleted)
+}
+
+// useColor resolves a --color setting
+func useColor(mode string) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto", "":
+		return isTerminal(os.Stdout), nil
+	default:
+		return false, fmt.Errorf("invalid --color value '%s' (use auto, always or never)", mode)
+	}
+}
+
+// paint wraps text in an ANSI color code when color is enabled
+func paint(color bool, code, text string) string {
+	if !color || text == "" {
+		return text
+	}
+	return "\033[" + code + "m" + text + "\033[0m"
+}
+
+func init() {
+	diffCmd.Flags().IntVarP(&diffContext, "unified", "U", 3, "Number of context lines around each change")
+	diffCmd.Flags().BoolVar(&diffStat, "stat", false, "Show a summary of changed lines per file")
+	diffCmd.Flags().BoolVar(&diffNameOnly, "name-only", false, "Show only the names of changed files")
+	diffCmd.Flags().BoolVar(&diffNameStatus, "name-status", false, "Show names and status of changed files")
+	diffCmd.Flags().BoolVar(&diffNoSemantic, "no-semantic", false, "Compare JSON and YAML files line by line")
+	diffCmd.Flags().StringVar(&diffColor, "color", "auto", "When to use colors: auto, always or never")
+}
@@ -0,0 +1,143 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/HammerSpb/aipaca/internal/operations"
+)
+
+var (
+	installHooksGuard            bool
+	installHooksAutoClean        bool
+	installHooksBranchProfiles   bool
+	installHooksNoBranchProfiles bool
+)
+
+var gitCmd = &cobra.Command{
+	Use:   "git",
+	Short: "Set up git to work with aipaca",
+	Long:  `Set up git repositories to work with aipaca.`,
+}
+
+var installHooksCmd = &cobra.Command{
+	Use:   "install-hooks [repo-path]",
+	Short: "Stop commits and pushes that include AI files",
+	Long: `Install pre-commit and pre-push hooks that run 'aipaca guard'.
+
+The hooks reject commits staging AI files, and pushes of commits adding
+them: files matching the AI patterns and files aipaca manages in the repo.
+Repos that keep their AI files in git opt out by setting commit_ai_files
+for themselves in the config (see 'aipaca guard').
+
+Hooks already installed keep working: they are renamed to
+<hook>.aipaca-chained and run after the guard passes.
+
+With --auto-clean the pre-commit hook leaves the AI files out of the commit
+instead of rejecting it, and a post-commit hook stages them again.
+
+With --branch-profiles a post-checkout hook runs 'aipaca switch' after
+every branch checkout, applying the profile the branch rules pick;
+--no-branch-profiles removes it. Add --guard=false to leave the guard hooks
+out, or as they are when installed before.
+
+Run it again to change modes; 'aipaca git uninstall-hooks' removes the
+hooks.
+
+Examples:
+  aipaca git install-hooks
+  aipaca git install-hooks ~/code/client-app --auto-clean
+  aipaca git install-hooks --branch-profiles
+  aipaca git install-hooks --branch-profiles --guard=false`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repoPath := ""
+		if len(args) > 0 {
+			repoPath = args[0]
+		}
+
+		executable, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to find the aipaca binary: %w", err)
+		}
+
+		result, err := operations.InstallHooks(operations.HooksOptions{
+			RepoPath:         repoPath,
+			Executable:       executable,
+			Guard:            installHooksGuard,
+			AutoClean:        installHooksAutoClean,
+			BranchProfiles:   installHooksBranchProfiles,
+			NoBranchProfiles: installHooksNoBranchProfiles,
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(result.Hooks) > 0 {
+			printSuccess("Installed %s hooks in %s", strings.Join(result.Hooks, ", "), result.HooksDir)
+		}
+		if len(result.Removed) > 0 {
+			printSuccess("Removed %s hooks from %s", strings.Join(result.Removed, ", "), result.HooksDir)
+		}
+		if len(result.Chained) > 0 {
+			printInfo("Existing %s hooks run after the aipaca ones", strings.Join(result.Chained, ", "))
+		}
+		switch {
+		case !installHooksGuard:
+		case installHooksAutoClean:
+			printInfo("AI files are left out of commits and staged again afterwards")
+		default:
+			printInfo("Commits staging AI files are rejected")
+		}
+		if installHooksBranchProfiles {
+			printInfo("Checking out a branch applies its profile (see 'aipaca switch')")
+		}
+		if installHooksGuard && cfg.ForRepo(result.Root).CommitAIFiles {
+			printWarning("commit_ai_files is set for %s, so the hooks let AI files through", result.Root)
+		}
+		return nil
+	},
+}
+
+var uninstallHooksCmd = &cobra.Command{
+	Use:   "uninstall-hooks [repo-path]",
+	Short: "Remove the hooks installed by install-hooks",
+	Long: `Remove the hooks installed by 'aipaca git install-hooks'.
+
+Hooks they ran afterwards are put back in their place.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repoPath := ""
+		if len(args) > 0 {
+			repoPath = args[0]
+		}
+
+		result, err := operations.UninstallHooks(repoPath)
+		if err != nil {
+			return err
+		}
+
+		if len(result.Hooks) == 0 {
+			fmt.Printf("No aipaca hooks in %s\n", result.HooksDir)
+			return nil
+		}
+		printSuccess("Removed %s hooks from %s", strings.Join(result.Hooks, ", "), result.HooksDir)
+		if len(result.Chained) > 0 {
+			printInfo("Put back the previous %s hooks", strings.Join(result.Chained, ", "))
+		}
+		return nil
+	},
+}
+
+func init() {
+	installHooksCmd.Flags().BoolVar(&installHooksAutoClean, "auto-clean", false, "Leave AI files out of commits instead of rejecting them")
+	installHooksCmd.Flags().BoolVar(&installHooksGuard, "guard", true, "Install the pre-commit and pre-push hooks running 'aipaca guard'")
+	installHooksCmd.Flags().BoolVar(&installHooksBranchProfiles, "branch-profiles", false, "Apply the profile of a branch when it is checked out")
+	installHooksCmd.Flags().BoolVar(&installHooksNoBranchProfiles, "no-branch-profiles", false, "Remove the hook applying the profile of a branch")
+
+	gitCmd.AddCommand(installHooksCmd)
+	gitCmd.AddCommand(uninstallHooksCmd)
+}
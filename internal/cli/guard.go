@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/HammerSpb/aipaca/internal/operations"
+	"github.com/HammerSpb/aipaca/pkg/gitutil"
+)
+
+var (
+	guardHook      string
+	guardAutoClean bool
+)
+
+var guardCmd = &cobra.Command{
+	Use:   "guard [repo-path]",
+	Short: "Check that no AI files are staged for commit",
+	Long: `Check the files staged for commit for AI files: files matching the
+AI patterns and files aipaca manages in the repo. Exits with status 1 if
+there are any.
+
+The hooks of 'aipaca git install-hooks' run it before every commit and
+push. To let a repo commit its AI files, set commit_ai_files for it in
+the config:
+
+  repos:
+    ~/code/dotfiles:
+      commit_ai_files: true`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repoPath := ""
+		if len(args) > 0 {
+			repoPath = args[0]
+		}
+
+		opts := operations.GuardOptions{RepoPath: repoPath}
+		switch guardHook {
+		case "", "pre-commit":
+			if guardAutoClean && guardHook == "" {
+				return fmt.Errorf("--auto-clean only works from the pre-commit hook; install it with 'aipaca git install-hooks --auto-clean'")
+			}
+			opts.AutoClean = guardAutoClean
+		case "pre-push":
+			refs, err := gitutil.ParsePushRefs(os.Stdin)
+			if err != nil {
+				return err
+			}
+			opts.Push = refs
+		case "post-commit":
+			restored, err := operations.RestoreStripped(repoPath)
+			if err != nil {
+				return err
+			}
+			if len(restored) > 0 {
+				printInfo("aipaca: staged %d AI files left out of the commit again", len(restored))
+			}
+			return nil
+		default:
+			return fmt.Errorf("unknown hook '%s'", guardHook)
+		}
+
+		result, err := operations.Guard(cfg, opts)
+		if err != nil {
+			return err
+		}
+
+		if result.Stripped {
+			printWarning("aipaca: left %d AI files out of the commit; they stay staged", len(result.Files))
+			for _, f := range result.Files {
+				printInfo("%s", f)
+			}
+			return nil
+		}
+		if !result.Blocked() {
+			return nil
+		}
+
+		if opts.Push != nil {
+			printError("aipaca: the push includes commits adding AI files:")
+		} else {
+			printError("aipaca: AI files are staged for commit:")
+		}
+		for _, f := range result.Files {
+			fmt.Fprintf(os.Stderr, "  %s\n", f)
+		}
+		fmt.Fprintln(os.Stderr)
+
+		switch {
+		case opts.Push != nil:
+			fmt.Fprintln(os.Stderr, "Take them out of those commits (git rm --cached, then amend or rebase).")
+		case result.OnlyAIFiles:
+			fmt.Fprintln(os.Stderr, "Only AI files are staged, so nothing would be left to commit.")
+		default:
+			fmt.Fprintln(os.Stderr, "Unstage them with 'git restore --staged <file>', or let the hook do it:")
+			fmt.Fprintln(os.Stderr, "  aipaca git install-hooks --auto-clean")
+		}
+		fmt.Fprintf(os.Stderr, "To commit AI files in this repo, set commit_ai_files for %s in the config.\n", result.Root)
+		os.Exit(1)
+		return nil
+	},
+}
+
+func init() {
+	guardCmd.Flags().StringVar(&guardHook, "hook", "", "Git hook running the guard (pre-commit, pre-push or post-commit)")
+	guardCmd.Flags().BoolVar(&guardAutoClean, "auto-clean", false, "Leave AI files out of the commit instead of rejecting it")
+	guardCmd.Flags().MarkHidden("hook")
+}
@@ -2,11 +2,11 @@ package cli
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/spf13/cobra"
 
 	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/operations"
 	"github.com/HammerSpb/aipaca/internal/storage"
 )
 
@@ -48,12 +48,15 @@ Use --import to also import AI files from the current repository as the "default
 
 		// Import current repo as default profile if requested
 		if initImport {
-			repoPath, err := os.Getwd()
+			if cmd.Flags().Changed("no-git-root") {
+				cfg.NoGitRoot = noGitRoot
+			}
+			repoPath, err := operations.ResolveRepoPath(cfg, "")
 			if err != nil {
-				return fmt.Errorf("failed to get current directory: %w", err)
+				return err
 			}
 
-			err = store.SaveToProfile("default", repoPath, cfg.AIPatterns, true)
+			err = store.SaveToProfile("default", repoPath, cfg.AIPatterns)
 			if err != nil {
 				printWarning("No AI files found in current directory to import")
 			} else {
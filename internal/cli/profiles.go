@@ -3,6 +3,7 @@ package cli
 import (
 	"fmt"
 	"os"
+	"strings"
 	"text/tabwriter"
 
 	"github.com/spf13/cobra"
@@ -10,6 +11,18 @@ import (
 	"github.com/HammerSpb/aipaca/internal/storage"
 )
 
+var (
+	profilesListTags []string
+
+	profilesSetDescription string
+	profilesSetAuthor      string
+	profilesSetTags        []string
+	profilesSetAddTags     []string
+	profilesSetRemoveTags  []string
+	profilesSetTools       []string
+	profilesSetExtends     []string
+)
+
 var profilesCmd = &cobra.Command{
 	Use:   "profiles",
 	Short: "List and manage profiles 🦙",
@@ -19,6 +32,9 @@ var profilesCmd = &cobra.Command{
 var profilesListCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all profiles",
+	Long: `List all profiles.
+
+Use --tag to only list profiles carrying a tag; repeat it to require several.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		store := storage.New(cfg)
 
@@ -27,6 +43,20 @@ var profilesListCmd = &cobra.Command{
 			return err
 		}
 
+		if len(profilesListTags) > 0 {
+			var tagged []storage.Profile
+			for _, p := range profiles {
+				if hasAllTags(&p.Manifest, profilesListTags) {
+					tagged = append(tagged, p)
+				}
+			}
+			if len(tagged) == 0 {
+				fmt.Printf("No profiles tagged %s\n", strings.Join(profilesListTags, ", "))
+				return nil
+			}
+			profiles = tagged
+		}
+
 		if len(profiles) == 0 {
 			fmt.Println("No profiles found in the herd 🦙")
 			fmt.Println()
@@ -36,8 +66,8 @@ var profilesListCmd = &cobra.Command{
 		}
 
 		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-		fmt.Fprintln(w, "PROFILE\tDESCRIPTION\tFILES")
-		fmt.Fprintln(w, "-------\t-----------\t-----")
+		fmt.Fprintln(w, "PROFILE\tDESCRIPTION\tTAGS\tVERSION\tFILES")
+		fmt.Fprintln(w, "-------\t-----------\t----\t-------\t-----")
 
 		for _, p := range profiles {
 			desc := p.Description
@@ -47,7 +77,7 @@ var profilesListCmd = &cobra.Command{
 			if desc == "" {
 				desc = "-"
 			}
-			fmt.Fprintf(w, "%s\t%s\t%d\n", p.Name, desc, p.FileCount)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", p.Name, desc, orDash(strings.Join(p.Manifest.Tags, ",")), versionString(p.Manifest.Version), p.FileCount)
 		}
 		w.Flush()
 
@@ -68,10 +98,30 @@ var profilesShowCmd = &cobra.Command{
 			return err
 		}
 
+		m := profile.Manifest
 		fmt.Printf("Profile: %s\n", profile.Name)
 		if profile.Description != "" {
 			fmt.Printf("Description: %s\n", profile.Description)
 		}
+		if m.Author != "" {
+			fmt.Printf("Author: %s\n", m.Author)
+		}
+		if len(m.Tags) > 0 {
+			fmt.Printf("Tags: %s\n", strings.Join(m.Tags, ", "))
+		}
+		if len(m.Tools) > 0 {
+			fmt.Printf("Tools: %s\n", strings.Join(m.Tools, ", "))
+		}
+		if len(m.Extends) > 0 {
+			fmt.Printf("Extends: %s\n", strings.Join(m.Extends, ", "))
+		}
+		fmt.Printf("Version: %s\n", versionString(m.Version))
+		if !m.Created.IsZero() {
+			fmt.Printf("Created: %s\n", m.Created.Format("2006-01-02 15:04:05"))
+		}
+		if !m.Updated.IsZero() {
+			fmt.Printf("Updated: %s\n", m.Updated.Format("2006-01-02 15:04:05"))
+		}
 		fmt.Printf("Files: %d\n", profile.FileCount)
 		fmt.Println()
 
@@ -103,6 +153,19 @@ var profilesDeleteCmd = &cobra.Command{
 			return err
 		}
 
+		// Profiles stacked on this one will fail to apply afterwards
+		profiles, err := store.ListProfiles()
+		if err != nil {
+			return err
+		}
+		for _, p := range profiles {
+			for _, parent := range p.Manifest.Extends {
+				if parent == profileName {
+					printWarning("Profile '%s' extends '%s'", p.Name, profileName)
+				}
+			}
+		}
+
 		if err := store.DeleteProfile(profileName); err != nil {
 			return err
 		}
@@ -130,9 +193,112 @@ var profilesCopyCmd = &cobra.Command{
 	},
 }
 
+var profilesSetCmd = &cobra.Command{
+	Use:   "set <profile>",
+	Short: "Set profile metadata",
+	Long: `Set the metadata stored in a profile's aipaca-profile.yaml manifest.
+
+Examples:
+  aipaca profiles set default --description "Team defaults" --tags go,backend
+  aipaca profiles set default --add-tag experimental
+  aipaca profiles set default --tools claude,cursor
+  aipaca profiles set personal --extends base,go`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		profileName := args[0]
+		store := storage.New(cfg)
+
+		flags := cmd.Flags()
+		if flags.NFlag() == 0 {
+			return fmt.Errorf("nothing to set (see --help for the available flags)")
+		}
+
+		if flags.Changed("extends") {
+			if err := store.CheckExtends(profileName, profilesSetExtends); err != nil {
+				return err
+			}
+		}
+
+		err := store.UpdateProfileManifest(profileName, func(m *storage.ProfileManifest) {
+			if flags.Changed("description") {
+				m.Description = profilesSetDescription
+			}
+			if flags.Changed("author") {
+				m.Author = profilesSetAuthor
+			}
+			if flags.Changed("tags") {
+				m.Tags = nil
+				addTags(m, profilesSetTags)
+			}
+			addTags(m, profilesSetAddTags)
+			for _, tag := range profilesSetRemoveTags {
+				kept := m.Tags[:0]
+				for _, t := range m.Tags {
+					if !strings.EqualFold(t, tag) {
+						kept = append(kept, t)
+					}
+				}
+				m.Tags = kept
+			}
+			if flags.Changed("tools") {
+				m.Tools = profilesSetTools
+			}
+			if flags.Changed("extends") {
+				m.Extends = profilesSetExtends
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		printSuccess("Updated profile '%s'", profileName)
+		return nil
+	},
+}
+
+// addTags adds tags to a manifest, skipping ones it already has
+func addTags(m *storage.ProfileManifest, tags []string) {
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !m.HasTag(tag) {
+			m.Tags = append(m.Tags, tag)
+		}
+	}
+}
+
+// hasAllTags reports whether a manifest carries every one of tags
+func hasAllTags(m *storage.ProfileManifest, tags []string) bool {
+	for _, tag := range tags {
+		if !m.HasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// versionString formats a profile version, which is 0 for profiles that
+// were never saved with a manifest
+func versionString(version int) string {
+	if version == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("v%d", version)
+}
+
 func init() {
+	profilesListCmd.Flags().StringSliceVar(&profilesListTags, "tag", nil, "Only list profiles with this tag (repeatable)")
+
+	profilesSetCmd.Flags().StringVar(&profilesSetDescription, "description", "", "Profile description")
+	profilesSetCmd.Flags().StringVar(&profilesSetAuthor, "author", "", "Profile author")
+	profilesSetCmd.Flags().StringSliceVar(&profilesSetTags, "tags", nil, "Replace the tags (comma-separated)")
+	profilesSetCmd.Flags().StringSliceVar(&profilesSetAddTags, "add-tag", nil, "Add a tag (repeatable)")
+	profilesSetCmd.Flags().StringSliceVar(&profilesSetRemoveTags, "remove-tag", nil, "Remove a tag (repeatable)")
+	profilesSetCmd.Flags().StringSliceVar(&profilesSetTools, "tools", nil, "Target AI tools, e.g. claude,cursor")
+	profilesSetCmd.Flags().StringSliceVar(&profilesSetExtends, "extends", nil, "Profiles to stack underneath this one, bottom first")
+
 	profilesCmd.AddCommand(profilesListCmd)
 	profilesCmd.AddCommand(profilesShowCmd)
 	profilesCmd.AddCommand(profilesDeleteCmd)
 	profilesCmd.AddCommand(profilesCopyCmd)
+	profilesCmd.AddCommand(profilesSetCmd)
 }
@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/HammerSpb/aipaca/internal/storage"
+)
+
+var (
+	recoverForward  bool
+	recoverRollback bool
+)
+
+var recoverCmd = &cobra.Command{
+	Use:   "recover [transaction-id]",
+	Short: "Resolve interrupted operations",
+	Long: `Resolve apply, restore, clean or save operations that were interrupted.
+
+Every operation that changes files is recorded in a journal before it
+touches anything. If aipaca is killed part-way, the journal is left behind
+and the operation can be finished (--forward) or undone (--rollback).
+
+Without flags, lists interrupted operations.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if recoverForward && recoverRollback {
+			return fmt.Errorf("--forward and --rollback are mutually exclusive")
+		}
+
+		store := storage.New(cfg)
+
+		journals, err := store.PendingTransactions()
+		if err != nil {
+			return err
+		}
+
+		if len(args) > 0 {
+			var selected []*storage.Journal
+			for _, j := range journals {
+				if j.ID == args[0] {
+					selected = append(selected, j)
+				}
+			}
+			if len(selected) == 0 {
+				return fmt.Errorf("transaction '%s' not found", args[0])
+			}
+			journals = selected
+		}
+
+		if len(journals) == 0 {
+			fmt.Println("No interrupted operations found")
+			return nil
+		}
+
+		if !recoverForward && !recoverRollback {
+			fmt.Println("Interrupted operations:")
+			for _, j := range journals {
+				printInfo("%s  %s  %s (%s)", j.ID, j.Operation, j.TargetDir, j.Phase)
+			}
+			fmt.Println()
+			fmt.Println("Run 'aipaca recover --forward' or 'aipaca recover --rollback' to resolve them")
+			return nil
+		}
+
+		for _, j := range journals {
+			if err := store.RecoverTransaction(j.ID, recoverForward); err != nil {
+				return err
+			}
+			printSuccess("%s '%s' on %s", recoveryVerb(recoverForward), j.Operation, j.TargetDir)
+		}
+
+		return nil
+	},
+}
+
+// checkInterruptedTransactions offers to resolve interrupted operations
+// before running a command
+func checkInterruptedTransactions() error {
+	store := storage.New(cfg)
+
+	journals, err := store.PendingTransactions()
+	if err != nil {
+		return err
+	}
+
+	for _, j := range journals {
+		printWarning("Interrupted '%s' on %s (started %s)", j.Operation, j.TargetDir, j.CreatedAt.Format("2006-01-02 15:04:05"))
+
+		answer := prompt("  Roll [f]orward, roll [b]ack, or [s]kip? ")
+		switch answer {
+		case "f", "forward":
+			if err := store.RecoverTransaction(j.ID, true); err != nil {
+				return err
+			}
+			printSuccess("%s '%s' on %s", recoveryVerb(true), j.Operation, j.TargetDir)
+		case "b", "back", "rollback":
+			if err := store.RecoverTransaction(j.ID, false); err != nil {
+				return err
+			}
+			printSuccess("%s '%s' on %s", recoveryVerb(false), j.Operation, j.TargetDir)
+		default:
+			printInfo("Skipped; run 'aipaca recover' to resolve it later")
+		}
+	}
+
+	return nil
+}
+
+// recoveryVerb describes a recovery direction
+func recoveryVerb(forward bool) string {
+	if forward {
+		return "Completed"
+	}
+	return "Rolled back"
+}
+
+func init() {
+	recoverCmd.Flags().BoolVar(&recoverForward, "forward", false, "Finish interrupted operations")
+	recoverCmd.Flags().BoolVar(&recoverRollback, "rollback", false, "Undo interrupted operations")
+}
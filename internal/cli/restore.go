@@ -5,25 +5,36 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"github.com/HammerSpb/aipaca/internal/config"
 	"github.com/HammerSpb/aipaca/internal/operations"
 )
 
 var (
 	restoreDryRun bool
 	restoreBackup string
+	restoreStep   bool
+	restoreAll    bool
 )
 
 var restoreCmd = &cobra.Command{
 	Use:   "restore [repo-path]",
 	Short: "Restore original AI files from backup",
-	Long: `Restore the original AI files from the backup created during the last apply.
+	Long: `Restore the original AI files, as they were before the first aipaca
+operation on this repository.
 
 This will:
 1. Remove currently applied profile files
-2. Restore files from the backup
+2. Restore files from the baseline backup
 3. Clear the applied state
 
-Use --backup to restore from a specific backup instead of the latest.`,
+Use --step to undo only the most recent apply or clean, returning to the
+previously applied profile. Repeat it to walk back one layer at a time.
+Use --backup to restore from a specific backup instead.
+
+Only files aipaca wrote are removed; AI files you created yourself stay
+unless the backup replaces them. Use --all to remove every AI file first.
+
+Run on many repos at once with --repos-from, --glob or --with-profile.`,
 	Args: cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		repoPath := ""
@@ -31,10 +42,45 @@ Use --backup to restore from a specific backup instead of the latest.`,
 			repoPath = args[0]
 		}
 
+		if restoreStep && restoreBackup != "" {
+			return fmt.Errorf("--step and --backup are mutually exclusive")
+		}
+
+		repos, err := bulkRepos(cmd, repoPath)
+		if err != nil {
+			return err
+		}
+		if repos != nil {
+			if restoreBackup != "" {
+				return fmt.Errorf("--backup names the backup of a single repo and cannot be used with several")
+			}
+			return runBulk(repos, restoreDryRun, func(cfg *config.Config, repoPath string, dryRun bool) (string, error) {
+				result, err := operations.Restore(cfg, operations.RestoreOptions{
+					RepoPath: repoPath,
+					Step:     restoreStep,
+					DryRun:   dryRun,
+					All:      restoreAll,
+				})
+				if err != nil {
+					return "", err
+				}
+				verb := "restored"
+				if dryRun {
+					verb = "would restore"
+				}
+				if result.BackupName == "" {
+					return fmt.Sprintf("%s (no files to bring back)", verb), nil
+				}
+				return fmt.Sprintf("%s %d files from %s", verb, len(result.FilesRestored), result.BackupName), nil
+			})
+		}
+
 		result, err := operations.Restore(cfg, operations.RestoreOptions{
 			RepoPath:   repoPath,
 			BackupName: restoreBackup,
+			Step:       restoreStep,
 			DryRun:     restoreDryRun,
+			All:        restoreAll,
 		})
 		if err != nil {
 			return err
@@ -59,9 +105,9 @@ Use --backup to restore from a specific backup instead of the latest.`,
 
 		if len(result.FilesRestored) > 0 {
 			if restoreDryRun {
-				fmt.Println("Would restore from backup '%s':", result.BackupName)
+				fmt.Printf("Would restore from backup '%s':\n", result.BackupName)
 			} else {
-				fmt.Println("Restored from backup '%s':", result.BackupName)
+				fmt.Printf("Restored from backup '%s':\n", result.BackupName)
 			}
 			for _, f := range result.FilesRestored {
 				printInfo("+ %s", f)
@@ -69,7 +115,22 @@ Use --backup to restore from a specific backup instead of the latest.`,
 			fmt.Println()
 		}
 
+		if len(result.Unmanaged) > 0 {
+			printUnmanaged(result.Unmanaged)
+			fmt.Println()
+		}
+
 		if !restoreDryRun {
+			if result.Step && result.LayersLeft > 0 {
+				if result.NowApplied != "" {
+					printSuccess("Stepped back to profile '%s'", result.NowApplied)
+				} else {
+					printSuccess("Stepped back to the files before the last operation")
+				}
+				printInfo("%d more step(s) back to the original files", result.LayersLeft)
+				return nil
+			}
+
 			printSuccess("Restored original AI files")
 			if result.PreviousState != "" {
 				printInfo("Previously applied profile '%s' has been cleared", result.PreviousState)
@@ -83,4 +144,7 @@ Use --backup to restore from a specific backup instead of the latest.`,
 func init() {
 	restoreCmd.Flags().BoolVar(&restoreDryRun, "dry-run", false, "Show what would happen without making changes")
 	restoreCmd.Flags().StringVar(&restoreBackup, "backup", "", "Restore from a specific backup")
+	restoreCmd.Flags().BoolVar(&restoreStep, "step", false, "Undo only the most recent apply or clean")
+	restoreCmd.Flags().BoolVar(&restoreAll, "all", false, "Remove every AI file, not only those aipaca manages")
+	addBulkFlags(restoreCmd, false)
 }
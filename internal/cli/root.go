@@ -1,17 +1,23 @@
 package cli
 
 import (
+	"bufio"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
 )
 
 var (
-	cfgFile string
-	cfg     *config.Config
+	cfgFile   string
+	cfg       *config.Config
+	lockWait  time.Duration
+	noGitRoot bool
 )
 
 // rootCmd represents the base command
@@ -42,7 +48,28 @@ No more copy-pasting configs between repos. Let aipaca do the heavy lifting! 
 		if err != nil {
 			return err
 		}
-		return nil
+		if cmd.Flags().Changed("wait") {
+			cfg.LockWait = lockWait
+		}
+		if cmd.Flags().Changed("no-git-root") {
+			cfg.NoGitRoot = noGitRoot
+		}
+
+		// The recover command handles interrupted transactions itself, and
+		// the guard runs in git hooks, where it must not touch the repo
+		if cmd.Name() == "recover" || cmd.Name() == "guard" {
+			return nil
+		}
+
+		if len(cfg.ProfileDescriptions) > 0 {
+			if err := migrateProfileDescriptions(); err != nil {
+				return err
+			}
+		}
+		if err := checkInterruptedTransactions(); err != nil {
+			return err
+		}
+		return checkStaleSessions()
 	},
 }
 
@@ -53,17 +80,48 @@ func Execute() error {
 
 func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is ~/.aipaca.yaml)")
+	rootCmd.PersistentFlags().DurationVar(&lockWait, "wait", 0, "how long to wait for another aipaca process to finish (e.g. 30s)")
+	rootCmd.PersistentFlags().BoolVar(&noGitRoot, "no-git-root", false, "work on the directory given, not the root of its git repository")
 
 	// Add subcommands
 	rootCmd.AddCommand(initCmd)
 	rootCmd.AddCommand(applyCmd)
+	rootCmd.AddCommand(updateCmd)
+	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(switchCmd)
 	rootCmd.AddCommand(saveCmd)
+	rootCmd.AddCommand(syncCmd)
 	rootCmd.AddCommand(restoreCmd)
 	rootCmd.AddCommand(cleanCmd)
+	rootCmd.AddCommand(adoptCmd)
 	rootCmd.AddCommand(statusCmd)
 	rootCmd.AddCommand(profilesCmd)
 	rootCmd.AddCommand(backupsCmd)
 	rootCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(recoverCmd)
+	rootCmd.AddCommand(gitCmd)
+	rootCmd.AddCommand(guardCmd)
+}
+
+// migrateProfileDescriptions moves descriptions from the config file into
+// profile manifests
+func migrateProfileDescriptions() error {
+	store := storage.New(cfg)
+
+	migrated, err := store.MigrateProfileDescriptions(cfg.ProfileDescriptions)
+	if err != nil {
+		return err
+	}
+
+	if err := config.RemoveProfileDescriptions(cfgFile); err != nil {
+		return err
+	}
+	cfg.ProfileDescriptions = nil
+
+	if migrated > 0 {
+		fmt.Fprintf(os.Stderr, "Moved %d profile description(s) from the config file into profile manifests\n", migrated)
+	}
+	return nil
 }
 
 // printSuccess prints a success message in green
@@ -85,3 +143,27 @@ func printInfo(format string, args ...interface{}) {
 func printWarning(format string, args ...interface{}) {
 	fmt.Printf("\033[33m!\033[0m "+format+"\n", args...)
 }
+
+// prompt asks a question on stdin and returns the trimmed, lower-cased answer.
+// It returns an empty answer when stdin is not interactive.
+func prompt(format string, args ...interface{}) string {
+	if !isTerminal(os.Stdin) {
+		return ""
+	}
+
+	fmt.Printf(format, args...)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(answer))
+}
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,232 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/HammerSpb/aipaca/internal/operations"
+	"github.com/HammerSpb/aipaca/internal/storage"
+)
+
+var (
+	runProfiles []string
+	runSet      map[string]string
+)
+
+// runSignals are relayed to the command; aipaca itself keeps running so
+// it can restore the repo once the command exits
+var runSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+var runCmd = &cobra.Command{
+	Use:   "run -p <profile> [repo-path] -- <command> [args...]",
+	Short: "Apply a profile only while a command runs",
+	Long: `Apply a profile for the life of a command, then put the repository back.
+
+This will:
+1. Backup existing AI files in the repo
+2. Apply the profile (repeat -p to stack several)
+3. Run the command in the repo, relaying SIGINT, SIGTERM, SIGHUP and SIGQUIT
+4. Restore the repo to how it was when the command exits, however it exits
+
+The profile files never stay in the repo, so they cannot end up in a
+commit. If aipaca itself is killed, the next aipaca command cleans up.
+
+aipaca exits with the command's exit code.
+
+Examples:
+  aipaca run -p claude -- claude
+  aipaca run -p base -p go ../api -- cursor .`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		dash := cmd.ArgsLenAtDash()
+		if dash < 0 || dash == len(args) {
+			return fmt.Errorf("no command given; put it after --")
+		}
+		if dash > 1 {
+			return fmt.Errorf("expected at most one repo path before --, got %d arguments", dash)
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(runProfiles) == 0 {
+			return fmt.Errorf("no profile given; use -p <profile>")
+		}
+		dash := cmd.ArgsLenAtDash()
+		repoPath := ""
+		if dash == 1 {
+			repoPath = args[0]
+		}
+		command := args[dash:]
+
+		// Catch signals from here on, so an interrupted apply still gets
+		// restored
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, runSignals...)
+		defer signal.Stop(signals)
+
+		run, err := operations.StartRun(cfg, operations.RunOptions{
+			Profiles: runProfiles,
+			RepoPath: repoPath,
+			Command:  command,
+			Set:      runSet,
+		})
+		if err != nil {
+			return err
+		}
+
+		if run.Apply.BackupName != "" {
+			printSuccess("Created backup: %s", run.Apply.BackupName)
+		}
+		printSuccess("Applied %s for: %s", profileList(run.Apply.Layers), strings.Join(command, " "))
+		fmt.Println()
+
+		exitCode := 0
+		var runErr error
+		select {
+		case sig := <-signals:
+			runErr = fmt.Errorf("interrupted (%s) before the command started", sig)
+		default:
+			child := exec.Command(command[0], command[1:]...)
+			child.Dir = run.Session.RepoPath
+			child.Stdin, child.Stdout, child.Stderr = os.Stdin, os.Stdout, os.Stderr
+			exitCode, runErr = runChild(child, signals)
+		}
+
+		fmt.Println()
+		ended, err := operations.EndRun(cfg, run.Session)
+		if err != nil {
+			printError("%v", err)
+			return fmt.Errorf("the repo was not restored; the next aipaca command tries once more, then leaves it to 'aipaca restore %s'", run.Session.RepoPath)
+		}
+		printEndRun(ended)
+
+		if runErr != nil {
+			return runErr
+		}
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+		return nil
+	},
+}
+
+// runChild runs a command to completion, relaying signals to it, and
+// returns its exit code
+func runChild(child *exec.Cmd, signals <-chan os.Signal) (int, error) {
+	if err := child.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start %s: %w", child.Args[0], err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- child.Wait() }()
+
+	// Keys typed at a terminal signal its whole foreground process group,
+	// the command included; relaying those would deliver them twice
+	fromTerminal := isTerminal(os.Stdin)
+	for {
+		select {
+		case sig := <-signals:
+			if fromTerminal && (sig == os.Interrupt || sig == syscall.SIGQUIT) {
+				continue
+			}
+			child.Process.Signal(sig)
+		case err := <-done:
+			if err == nil {
+				return 0, nil
+			}
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				return 0, fmt.Errorf("failed to run %s: %w", child.Args[0], err)
+			}
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				return 128 + int(status.Signal()), nil
+			}
+			return exitErr.ExitCode(), nil
+		}
+	}
+}
+
+// profileList describes applied profiles
+func profileList(layers []string) string {
+	if len(layers) > 1 {
+		return "profiles " + strings.Join(layers, " → ")
+	}
+	return fmt.Sprintf("profile '%s'", layers[0])
+}
+
+// printEndRun reports how a run session left the repo
+func printEndRun(ended *operations.EndRunResult) {
+	if ended.Steps == 0 {
+		printSuccess("Nothing to restore in %s", ended.RepoPath)
+		return
+	}
+	for _, f := range ended.FilesRemoved {
+		printInfo("- %s", f)
+	}
+	for _, f := range ended.FilesRestored {
+		printInfo("+ %s", f)
+	}
+	printSuccess("Restored %s", ended.RepoPath)
+}
+
+// checkStaleSessions ends the run sessions of aipaca processes that died
+// before they could. Repos with an interrupted transaction are left until
+// it is resolved.
+func checkStaleSessions() error {
+	store := storage.New(cfg)
+
+	sessions, err := store.StaleSessions()
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	journals, err := store.PendingTransactions()
+	if err != nil {
+		for _, session := range sessions {
+			store.ReleaseSession(session)
+		}
+		return err
+	}
+	pending := make(map[string]bool, len(journals))
+	for _, j := range journals {
+		pending[j.TargetDir] = true
+	}
+
+	for _, session := range sessions {
+		if pending[session.RepoPath] {
+			store.ReleaseSession(session)
+			continue
+		}
+
+		printWarning("Cleaning up after an interrupted 'aipaca run %s' in %s (started %s)",
+			strings.Join(session.Command, " "), session.RepoPath, session.StartedAt.Format("2006-01-02 15:04:05"))
+		ended, err := operations.EndRun(cfg, session)
+		if err != nil {
+			// Retrying would fail the same way on every command
+			printError("%v", err)
+			printInfo("Run 'aipaca restore %s' to remove the profile files yourself", session.RepoPath)
+			if err := store.EndSession(session); err != nil {
+				return err
+			}
+			continue
+		}
+		printEndRun(ended)
+	}
+	fmt.Println()
+
+	return nil
+}
+
+func init() {
+	runCmd.Flags().StringArrayVarP(&runProfiles, "profile", "p", nil, "Profile to apply (repeatable, bottom first)")
+	runCmd.Flags().StringToStringVar(&runSet, "set", nil, "Set a template variable (key=value, repeatable)")
+}
@@ -2,16 +2,24 @@ package cli
 
 import (
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 
+	"github.com/HammerSpb/aipaca/internal/config"
 	"github.com/HammerSpb/aipaca/internal/operations"
+	"github.com/HammerSpb/aipaca/internal/storage"
 )
 
 var (
-	saveDryRun bool
-	saveAsName string
-	saveForce  bool
+	saveDryRun    bool
+	saveAsName    string
+	saveForce     bool
+	saveNoBackup  bool
+	saveMarkers   bool
+	saveCheck     bool
+	savePropagate bool
 )
 
 var saveCmd = &cobra.Command{
@@ -19,13 +27,27 @@ var saveCmd = &cobra.Command{
 	Short: "Save repo AI files to a profile",
 	Long: `Save AI files from a repository to a profile.
 
-If no profile is specified, saves to the currently applied profile.
+If no profile is specified, saves to the currently applied profile. When
+several profiles are stacked in the repo, each file is saved back to the
+profile it came from, and new files go to the top profile.
 Use --as to save as a new profile.
 
+When the profile changed since it was applied (say, a teammate updated it),
+those changes are merged with yours. Files changed on both sides are merged
+line by line; if the same lines changed, save refuses and lists the
+conflicts. Use --conflict-markers to save them with conflict markers, or
+--force to overwrite the profile's changes.
+
 Examples:
   aiconfig save                    # Update currently applied profile
   aiconfig save default            # Update 'default' profile
-  aiconfig save --as my-project    # Create new 'my-project' profile`,
+  aiconfig save --as my-project    # Create new 'my-project' profile
+  aipaca save --check              # Exit 1 if the repo has unsaved changes
+
+--check also runs on many repos with --repos-from, --glob or --with-profile.
+
+Use --propagate to then bring the saved profile into the other repos that
+use it, as 'aipaca sync' does.`,
 	Args: cobra.MaximumNArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		profileName := ""
@@ -38,12 +60,51 @@ Examples:
 			repoPath = args[1]
 		}
 
+		if saveCheck && saveAsName != "" {
+			return fmt.Errorf("--check and --as are mutually exclusive")
+		}
+
+		repos, err := bulkRepos(cmd, repoPath)
+		if err != nil {
+			return err
+		}
+		if repos != nil {
+			if !saveCheck {
+				return fmt.Errorf("save only runs on several repos with --check")
+			}
+			return runBulk(repos, true, func(cfg *config.Config, repoPath string, _ bool) (string, error) {
+				summary, changed, err := checkSave(cfg, profileName, repoPath)
+				if err != nil {
+					return "", err
+				}
+				if changed {
+					return "", fmt.Errorf("%s", summary)
+				}
+				return summary, nil
+			})
+		}
+
+		if saveCheck {
+			summary, changed, err := checkSave(cfg, profileName, repoPath)
+			if err != nil {
+				return err
+			}
+			if changed {
+				printWarning("The repo has %s", summary)
+				os.Exit(1)
+			}
+			printSuccess("The %s", summary)
+			return nil
+		}
+
 		result, err := operations.Save(cfg, operations.SaveOptions{
-			ProfileName: profileName,
-			AsName:      saveAsName,
-			RepoPath:    repoPath,
-			DryRun:      saveDryRun,
-			Force:       saveForce,
+			ProfileName:     profileName,
+			AsName:          saveAsName,
+			RepoPath:        repoPath,
+			DryRun:          saveDryRun,
+			Force:           saveForce,
+			NoBackup:        saveNoBackup,
+			ConflictMarkers: saveMarkers,
 		})
 		if err != nil {
 			return err
@@ -54,6 +115,16 @@ Examples:
 			fmt.Println()
 		}
 
+		if len(result.Layers) > 0 {
+			printLayeredSave(result, saveDryRun)
+			return propagateSave(result)
+		}
+
+		if !result.Changed {
+			fmt.Printf("Profile '%s' is unchanged (%d files)\n", result.ProfileName, len(result.FilesSaved))
+			return propagateSave(result)
+		}
+
 		action := "Saved"
 		if result.IsNew {
 			action = "Created new profile"
@@ -69,21 +140,145 @@ Examples:
 		for _, f := range result.FilesSaved {
 			printInfo("  %s", f)
 		}
+		printMerge(result.Merged, result.Conflicts, saveDryRun)
 
 		if !saveDryRun {
+			if result.BackupName != "" {
+				printSuccess("Created backup of previous profile: %s", result.BackupName)
+			}
 			if result.IsNew {
-				printSuccess("Created new profile '%s'", result.ProfileName)
+				printSuccess("Created new profile '%s' (v%d)", result.ProfileName, result.Version)
 			} else {
-				printSuccess("Updated profile '%s'", result.ProfileName)
+				printSuccess("Updated profile '%s' (v%d)", result.ProfileName, result.Version)
 			}
 		}
 
-		return nil
+		return propagateSave(result)
 	},
 }
 
+// propagateSave updates the other repos using the saved profiles, for
+// --propagate
+func propagateSave(result *operations.SaveResult) error {
+	if !savePropagate || saveDryRun {
+		return nil
+	}
+
+	profiles := []string{result.ProfileName}
+	if len(result.Layers) > 0 {
+		profiles = nil
+		for _, layer := range result.Layers {
+			profiles = append(profiles, layer.Profile)
+		}
+	}
+	fmt.Println()
+	return syncProfiles(profiles)
+}
+
+// checkSave works out whether saving a repo would change its profiles,
+// for --check, and describes the outcome
+func checkSave(cfg *config.Config, profileName, repoPath string) (string, bool, error) {
+	if profileName != "" && !storage.New(cfg).ProfileExists(profileName) {
+		return "", false, fmt.Errorf("profile '%s' not found", profileName)
+	}
+	result, err := operations.Save(cfg, operations.SaveOptions{
+		ProfileName: profileName,
+		RepoPath:    repoPath,
+		DryRun:      true,
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	if len(result.Layers) == 0 {
+		if result.Changed {
+			return fmt.Sprintf("changes not saved to profile '%s'", result.ProfileName), true, nil
+		}
+		return fmt.Sprintf("profile '%s' matches the repo", result.ProfileName), false, nil
+	}
+
+	var changed, all []string
+	for _, layer := range result.Layers {
+		if layer.Changed || len(layer.Conflicts) > 0 {
+			changed = append(changed, layer.Profile)
+		}
+		all = append(all, layer.Profile)
+	}
+	if len(changed) > 0 {
+		return fmt.Sprintf("changes not saved to profiles %s", strings.Join(changed, ", ")), true, nil
+	}
+	return fmt.Sprintf("profiles %s match the repo", strings.Join(all, ", ")), false, nil
+}
+
+// printLayeredSave reports a save back to stacked profiles
+func printLayeredSave(result *operations.SaveResult, dryRun bool) {
+	for _, layer := range result.Layers {
+		if !layer.Changed && len(layer.Conflicts) == 0 {
+			fmt.Printf("Profile '%s' is unchanged (%d files)\n", layer.Profile, len(layer.Files))
+			continue
+		}
+
+		if dryRun {
+			fmt.Printf("Would update profile '%s' with %d files:\n", layer.Profile, len(layer.Files))
+		} else {
+			fmt.Printf("Updated profile '%s' with %d files:\n", layer.Profile, len(layer.Files))
+		}
+		for _, f := range layer.Files {
+			printInfo("  %s", f)
+		}
+		printMerge(layer.Merged, layer.Conflicts, dryRun)
+	}
+
+	if dryRun {
+		return
+	}
+
+	fmt.Println()
+	for _, layer := range result.Layers {
+		if !layer.Changed {
+			continue
+		}
+		if layer.BackupName != "" {
+			printSuccess("Created backup of profile '%s': %s", layer.Profile, layer.BackupName)
+		}
+		printSuccess("Updated profile '%s' (v%d)", layer.Profile, layer.Version)
+	}
+}
+
+// printMerge reports the files a save merged with changes made to the
+// profile since it was applied
+func printMerge(merged []string, conflicts []operations.FileConflict, dryRun bool) {
+	if len(merged) > 0 {
+		fmt.Println()
+		fmt.Println("Merged with changes made to the profile since apply:")
+		for _, f := range merged {
+			printInfo("~ %s", f)
+		}
+	}
+	if len(conflicts) > 0 {
+		fmt.Println()
+		switch {
+		case dryRun && !saveMarkers:
+			fmt.Println("Would refuse to save, conflicting with changes made to the profile since apply:")
+		case dryRun:
+			fmt.Println("Would save with conflict markers:")
+		default:
+			fmt.Println("Saved with conflict markers (resolve them in the profile):")
+		}
+		for _, c := range conflicts {
+			printWarning("%s: %s", c.Path, c.Reason)
+		}
+	}
+}
+
 func init() {
 	saveCmd.Flags().BoolVar(&saveDryRun, "dry-run", false, "Show what would happen without making changes")
 	saveCmd.Flags().StringVar(&saveAsName, "as", "", "Save as a new profile with this name")
-	saveCmd.Flags().BoolVar(&saveForce, "force", false, "Overwrite existing profile without confirmation")
+	saveCmd.Flags().BoolVar(&saveForce, "force", false, "Overwrite existing profile, including changes made to it since apply")
+	saveCmd.Flags().BoolVar(&saveNoBackup, "no-backup", false, "Skip backing up the profile before overwriting it")
+	saveCmd.Flags().BoolVar(&saveMarkers, "conflict-markers", false, "Save conflicting changes with conflict markers instead of refusing")
+	saveCmd.Flags().BoolVar(&saveCheck, "check", false, "Only check for changes not saved to the profile; exit 1 if there are")
+	saveCmd.Flags().BoolVar(&savePropagate, "propagate", false, "Then update the other repos using the profile (see 'aipaca sync')")
+	saveCmd.Flags().BoolVarP(&syncYes, "yes", "y", false, "With --propagate, update the repos without asking")
+	addBulkFlags(saveCmd, false)
 }
@@ -1,15 +1,24 @@
 package cli
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
-	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	"github.com/HammerSpb/aipaca/internal/config"
 	"github.com/HammerSpb/aipaca/internal/operations"
 	"github.com/HammerSpb/aipaca/internal/storage"
-	"github.com/HammerSpb/aipaca/pkg/fileutil"
+)
+
+var (
+	statusPorcelain string
+	statusJSON      bool
+	statusShort     bool
+	statusIgnored   bool
 )
 
 var statusCmd = &cobra.Command{
@@ -19,9 +28,28 @@ var statusCmd = &cobra.Command{
 
 Displays:
 - Currently applied profile (if any)
-- Whether files have been modified since apply
-- List of AI files in the repo
-- Available backups`,
+- Which side moved since apply: files you edited in the repo, profiles
+  updated since you applied them, or both
+- The state of every AI file, sorted by path
+- Available backups
+
+Each file is in one of these states:
+  managed-clean     as aipaca wrote it
+  managed-modified  edited since aipaca wrote it            (M)
+  managed-deleted   removed since aipaca wrote it           (D)
+  unmanaged         matches the AI patterns, not from a profile (??)
+  ignored           unmanaged and ignored by git, shown with --ignored (!!)
+
+Use -s for a short listing, --json for every detail, or --porcelain for a
+stable, line-based form for scripts:
+
+  ## profile <name>            applied profile (top one when stacked)
+  ## layers <name>...          stacked profiles, bottom first
+  ## drift <none|local|upstream|both>
+  ## upstream <name>           a profile updated since apply
+  XY <path>                    a file that is not managed-clean
+
+Use --repos-from, --glob or --with-profile for a summary of many repos.`,
 	Args: cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		repoPath := ""
@@ -29,88 +57,94 @@ Displays:
 			repoPath = args[0]
 		}
 
-		// Resolve repo path
-		if repoPath == "" {
-			var err error
-			repoPath, err = os.Getwd()
-			if err != nil {
-				return fmt.Errorf("failed to get current directory: %w", err)
+		if statusPorcelain != "" && statusPorcelain != "v1" {
+			return fmt.Errorf("unsupported porcelain version '%s' (supported: v1)", statusPorcelain)
+		}
+
+		repos, err := bulkRepos(cmd, repoPath)
+		if err != nil {
+			return err
+		}
+		if repos != nil {
+			if statusJSON || statusPorcelain != "" || statusShort {
+				return fmt.Errorf("--json, --porcelain and --short describe a single repo")
 			}
+			return runBulk(repos, false, func(cfg *config.Config, repoPath string, _ bool) (string, error) {
+				status, err := operations.Status(cfg, operations.StatusOptions{RepoPath: repoPath})
+				if err != nil {
+					return "", err
+				}
+				return statusSummary(status), nil
+			})
 		}
-		repoPath, err := filepath.Abs(repoPath)
+
+		status, err := operations.Status(cfg, operations.StatusOptions{RepoPath: repoPath})
 		if err != nil {
-			return fmt.Errorf("failed to resolve repo path: %w", err)
+			return err
+		}
+		if !statusIgnored {
+			shown := status.Files[:0]
+			for _, f := range status.Files {
+				if f.State != operations.FileIgnored {
+					shown = append(shown, f)
+				}
+			}
+			status.Files = shown
+		}
+
+		switch {
+		case statusJSON:
+			return printJSONStatus(status)
+		case statusPorcelain != "":
+			printPorcelainStatus(status)
+			return nil
+		case statusShort:
+			printShortStatus(status)
+			return nil
 		}
+		repoPath = status.RepoPath
 
 		store := storage.New(cfg)
 
 		fmt.Printf("Repo: %s\n", repoPath)
 		fmt.Println()
 
-		// Get repo state
-		state, err := store.GetRepoState(repoPath)
-		if err != nil {
-			return fmt.Errorf("failed to get repo state: %w", err)
-		}
-
+		state := status.State
 		if state != nil && state.AppliedProfile != "" {
-			// Check for modifications
-			diffResult, _ := operations.Diff(cfg, operations.DiffOptions{
-				ProfileName: state.AppliedProfile,
-				RepoPath:    repoPath,
-			})
-
-			modifiedStr := ""
-			if diffResult != nil && diffResult.HasChanges {
-				modifiedStr = " \033[33m(modified)\033[0m"
+			fmt.Printf("Applied profile: \033[36m%s\033[0m%s\n", state.AppliedProfile, driftLabel(status.Drift))
+			if len(state.Layers) > 1 {
+				fmt.Printf("Stacked profiles: %s\n", strings.Join(state.Layers, " → "))
 			}
-
-			fmt.Printf("Applied profile: \033[36m%s\033[0m%s\n", state.AppliedProfile, modifiedStr)
 			fmt.Printf("Applied at: %s\n", state.AppliedAt.Format("2006-01-02 15:04:05"))
-			if state.BackupPath != "" {
-				fmt.Printf("Backup: %s\n", state.BackupPath)
-			}
+			printStateLayers(state)
 			fmt.Println()
 
-			// Show changes if any
-			if diffResult != nil && diffResult.HasChanges {
-				fmt.Println("Changes since apply:")
-				for _, change := range diffResult.Changes {
-					switch change.Type {
-					case "added":
-						fmt.Printf("  \033[32mA\033[0m %s\n", change.Path)
-					case "removed":
-						fmt.Printf("  \033[31mD\033[0m %s\n", change.Path)
-					case "modified":
-						fmt.Printf("  \033[33mM\033[0m %s\n", change.Path)
-					}
-				}
-				fmt.Println()
-			}
+			printUpstream(status)
+		} else if state != nil {
+			fmt.Println("No profile currently applied (AI files cleaned)")
+			printStateLayers(state)
+			fmt.Println()
 		} else {
 			fmt.Println("No profile currently applied")
 			fmt.Println()
 		}
 
-		// Show AI files in repo
-		aiFiles, err := fileutil.ExpandPatterns(repoPath, cfg.AIPatterns)
-		if err != nil {
-			return fmt.Errorf("failed to find AI files: %w", err)
-		}
-
-		if len(aiFiles) > 0 {
-			fmt.Println("AI files in repo:")
-			for relPath, fullPath := range aiFiles {
-				info, err := os.Stat(fullPath)
-				if err != nil {
-					continue
-				}
-				if info.IsDir() {
-					count, _ := fileutil.CountFiles(fullPath)
-					fmt.Printf("  %s/ (%d files)\n", relPath, count)
-				} else {
-					fmt.Printf("  %s\n", relPath)
+		// Show the state of every AI file
+		if len(status.Files) > 0 {
+			fmt.Println("AI files:")
+			stacked := state != nil && len(state.Layers) > 1
+			unmanaged := false
+			color := isTerminal(os.Stdout)
+			for _, f := range status.Files {
+				owner := ""
+				if stacked && f.Profile != "" {
+					owner = fmt.Sprintf(" (%s)", f.Profile)
 				}
+				fmt.Printf("  %s %s%s\n", coloredCode(color, f.State), f.Path, owner)
+				unmanaged = unmanaged || f.State == operations.FileUnmanaged
+			}
+			if unmanaged {
+				fmt.Println("  (?? = not managed by aipaca; 'aipaca adopt' adds them to the profile)")
 			}
 		} else {
 			fmt.Println("No AI files in repo")
@@ -133,3 +167,207 @@ Displays:
 		return nil
 	},
 }
+
+// statusSummary describes the status of a repo in a few words
+func statusSummary(status *operations.StatusResult) string {
+	state := status.State
+	if state == nil || state.AppliedProfile == "" {
+		return "no profile applied"
+	}
+
+	summary := strings.Join(state.AppliedLayers(), " → ")
+	switch status.Drift {
+	case operations.DriftLocal:
+		summary += ": edited locally"
+	case operations.DriftUpstream:
+		summary += ": profile updated"
+	case operations.DriftBoth:
+		summary += ": edited locally, profile updated"
+	default:
+		summary += ": up to date"
+	}
+	if n := len(status.Modified) + len(status.Deleted); n > 0 {
+		summary += fmt.Sprintf(" (%d modified, %d deleted)", len(status.Modified), len(status.Deleted))
+	}
+	return summary
+}
+
+// driftLabel returns the indicator shown next to the applied profile
+func driftLabel(drift operations.Drift) string {
+	switch drift {
+	case operations.DriftLocal:
+		return " \033[33m(edited locally)\033[0m"
+	case operations.DriftUpstream:
+		return " \033[33m(profile updated)\033[0m"
+	case operations.DriftBoth:
+		return " \033[31m(edited locally, profile updated)\033[0m"
+	default:
+		return " \033[32m(up to date)\033[0m"
+	}
+}
+
+// printUpstream explains which profiles moved since apply
+func printUpstream(status *operations.StatusResult) {
+	if len(status.Updated) > 0 {
+		fmt.Println("Profiles updated since you applied them:")
+		for _, p := range status.Updated {
+			fmt.Printf("  \033[36m↓\033[0m %s\n", p)
+		}
+		if status.Drift == operations.DriftBoth {
+			fmt.Println("  Run 'aipaca update' to merge them with your edits")
+		} else {
+			fmt.Println("  Run 'aipaca update' to bring them in")
+		}
+		fmt.Println()
+	}
+
+	if len(status.Untracked) > 0 {
+		fmt.Printf("Applied before aipaca tracked profile changes: %s\n", strings.Join(status.Untracked, ", "))
+		fmt.Println("  Apply again to track them")
+		fmt.Println()
+	}
+}
+
+// statusCode returns the two-letter porcelain code of a file state
+func statusCode(state operations.FileState) string {
+	switch state {
+	case operations.FileModified:
+		return " M"
+	case operations.FileDeleted:
+		return " D"
+	case operations.FileUnmanaged:
+		return "??"
+	case operations.FileIgnored:
+		return "!!"
+	default:
+		return "  "
+	}
+}
+
+// coloredCode returns the status code of a file state, colored when color
+// is enabled
+func coloredCode(color bool, state operations.FileState) string {
+	code := statusCode(state)
+	switch state {
+	case operations.FileModified:
+		return paint(color, "33", code)
+	case operations.FileDeleted:
+		return paint(color, "31", code)
+	case operations.FileUnmanaged, operations.FileIgnored:
+		return paint(color, "90", code)
+	default:
+		return code
+	}
+}
+
+// printPorcelainStatus prints the status in the stable --porcelain form
+func printPorcelainStatus(status *operations.StatusResult) {
+	state := status.State
+	if state != nil && state.AppliedProfile != "" {
+		fmt.Printf("## profile %s\n", state.AppliedProfile)
+		if len(state.Layers) > 1 {
+			fmt.Printf("## layers %s\n", strings.Join(state.Layers, " "))
+		}
+	}
+	fmt.Printf("## drift %s\n", status.Drift)
+	for _, p := range status.Updated {
+		fmt.Printf("## upstream %s\n", p)
+	}
+	for _, f := range status.Files {
+		if f.State != operations.FileClean {
+			fmt.Printf("%s %s\n", statusCode(f.State), f.Path)
+		}
+	}
+}
+
+// printShortStatus prints the status in the -s form
+func printShortStatus(status *operations.StatusResult) {
+	if state := status.State; state != nil && state.AppliedProfile != "" {
+		line := "## " + state.AppliedProfile
+		if status.Drift != operations.DriftNone {
+			line += " [" + string(status.Drift) + "]"
+		}
+		fmt.Println(line)
+	}
+	color := isTerminal(os.Stdout)
+	for _, f := range status.Files {
+		if f.State != operations.FileClean {
+			fmt.Printf("%s %s\n", coloredCode(color, f.State), f.Path)
+		}
+	}
+}
+
+// jsonStatus is the --json form of a repo status
+type jsonStatus struct {
+	Repo      string           `json:"repo"`
+	Profile   string           `json:"profile,omitempty"`
+	Layers    []string         `json:"layers,omitempty"`
+	AppliedAt *time.Time       `json:"applied_at,omitempty"`
+	Drift     string           `json:"drift"`
+	Upstream  []string         `json:"upstream"`
+	Files     []jsonStatusFile `json:"files"`
+}
+
+// jsonStatusFile is the --json form of a file status
+type jsonStatusFile struct {
+	Path    string `json:"path"`
+	State   string `json:"state"`
+	Profile string `json:"profile,omitempty"`
+}
+
+// printJSONStatus prints the status as JSON
+func printJSONStatus(status *operations.StatusResult) error {
+	out := jsonStatus{
+		Repo:     status.RepoPath,
+		Drift:    string(status.Drift),
+		Upstream: append([]string{}, status.Updated...),
+		Files:    make([]jsonStatusFile, 0, len(status.Files)),
+	}
+	if state := status.State; state != nil && state.AppliedProfile != "" {
+		out.Profile = state.AppliedProfile
+		out.Layers = state.AppliedLayers()
+		out.AppliedAt = &state.AppliedAt
+	}
+	for _, f := range status.Files {
+		out.Files = append(out.Files, jsonStatusFile{Path: f.Path, State: string(f.State), Profile: f.Profile})
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return fmt.Errorf("failed to write status: %w", err)
+	}
+	return nil
+}
+
+func init() {
+	statusCmd.Flags().StringVar(&statusPorcelain, "porcelain", "", "Machine-readable output (format version, default v1)")
+	statusCmd.Flags().Lookup("porcelain").NoOptDefVal = "v1"
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Output the status as JSON")
+	statusCmd.Flags().BoolVarP(&statusShort, "short", "s", false, "Show the status in short format")
+	statusCmd.Flags().BoolVar(&statusIgnored, "ignored", false, "Also show AI files ignored by git")
+	addBulkFlags(statusCmd, false)
+}
+
+// printStateLayers prints the baseline and stacked operations of a repo state
+func printStateLayers(state *storage.RepoState) {
+	if state.Baseline != nil && state.Baseline.Backup != "" {
+		fmt.Printf("Baseline: %s\n", state.Baseline.Backup)
+	} else if state.Baseline != nil && !state.Baseline.NoBackup {
+		fmt.Println("Baseline: no AI files")
+	}
+
+	if len(state.Stack) > 0 {
+		fmt.Printf("Layers: %d (use 'aipaca restore --step' to walk back)\n", len(state.Stack))
+		for i := len(state.Stack) - 1; i >= 0; i-- {
+			layer := state.Stack[i]
+			from := "no profile"
+			if len(layer.Layers) > 1 {
+				from = "profiles " + strings.Join(layer.Layers, " → ")
+			} else if layer.Profile != "" {
+				from = fmt.Sprintf("profile '%s'", layer.Profile)
+			}
+			fmt.Printf("  %s at %s (over %s)\n", layer.Operation, layer.At.Format("2006-01-02 15:04:05"), from)
+		}
+	}
+}
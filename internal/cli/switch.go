@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/HammerSpb/aipaca/internal/operations"
+	"github.com/HammerSpb/aipaca/pkg/gitutil"
+)
+
+var (
+	switchDryRun bool
+	switchHook   string
+)
+
+var switchCmd = &cobra.Command{
+	Use:   "switch [repo-path]",
+	Short: "Apply the profile of the branch checked out",
+	Long: `Apply the profile the branch rules in the config pick for the branch
+checked out:
+
+  branch_rules:
+    - branch: "spike/**"
+      profile: experimental
+
+Rules of a repo (under repos in the config) come first, and the first
+matching rule wins. A branch no rule matches gets back the profiles it had
+when it was last left; without any, the repo is left as it is.
+
+Edits made to the files of the profiles applied before are kept first.
+With branch_edits: stash (the default) they go to a backup and come back
+when that branch is checked out again; with branch_edits: save they are
+saved to the profiles. When the branch left is not known, they are only
+kept in the backup of the apply, for 'aipaca restore --step'.
+
+'aipaca git install-hooks --branch-profiles' runs this after every branch
+checkout. Consecutive switches take a single step of 'aipaca restore
+--step' to undo.
+
+Examples:
+  aipaca switch
+  aipaca switch --dry-run`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repoPath := ""
+		if len(args) > 0 {
+			repoPath = args[0]
+		}
+
+		opts := operations.SwitchOptions{RepoPath: repoPath, DryRun: switchDryRun}
+		switch switchHook {
+		case "":
+		case "post-checkout":
+			// Hooks run in the root of the work tree
+			branch, err := gitutil.CurrentBranch(".")
+			if err != nil || branch == "" {
+				return err // Nothing to switch to on a detached HEAD
+			}
+			opts.Branch, opts.From = branch, gitutil.PreviousBranch(".")
+		default:
+			return fmt.Errorf("unknown hook '%s'", switchHook)
+		}
+
+		result, err := operations.Switch(cfg, opts)
+		if err != nil {
+			return err
+		}
+
+		if result.LostStash != "" {
+			printWarning("The edits kept for %s are gone with backup '%s'", result.To, result.LostStash)
+		}
+		if result.Unchanged {
+			switch {
+			case switchHook != "":
+				// Checkouts that change nothing stay quiet
+			case len(result.Layers) == 0:
+				fmt.Printf("No profile for branch %s; the repo stays as it is\n", result.To)
+			default:
+				fmt.Printf("Branch %s already has %s\n", result.To, profileList(result.Layers))
+			}
+			return nil
+		}
+
+		if switchDryRun {
+			fmt.Printf("Would apply %s for branch %s\n", profileList(result.Layers), result.To)
+			if result.Edited {
+				printInfo("The edits to %s would be kept first", profileList(result.Left))
+			}
+			fmt.Println("\nDry run - no changes made")
+			return nil
+		}
+
+		switch {
+		case result.Saved != nil:
+			printSuccess("Saved the edits to %s", profileList(result.Left))
+		case result.Stash != "":
+			printSuccess("Stashed the edits made on %s until it is checked out again", result.From)
+		case result.Edited && result.Apply.BackupName != "":
+			printSuccess("Kept the edits made before in backup '%s'", result.Apply.BackupName)
+		}
+		printSuccess("Applied %s for branch %s", profileList(result.Apply.Layers), result.To)
+		if result.Unstashed != "" {
+			printSuccess("Put back the edits stashed on %s", result.To)
+		}
+		return nil
+	},
+}
+
+func init() {
+	switchCmd.Flags().BoolVar(&switchDryRun, "dry-run", false, "Preview the switch without making changes")
+	switchCmd.Flags().StringVar(&switchHook, "hook", "", "Git hook running the switch (post-checkout)")
+	switchCmd.Flags().MarkHidden("hook")
+}
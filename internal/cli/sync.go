@@ -0,0 +1,187 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/operations"
+)
+
+var (
+	syncDryRun bool
+	syncForce  bool
+	syncYes    bool
+)
+
+var syncCmd = &cobra.Command{
+	Use:   "sync <profile>",
+	Short: "Update every repo a profile is applied to",
+	Long: `Bring the current files of a profile into every repo it is applied to.
+
+After improving a profile in one repo and saving it, the other repos using
+it still have the old files. sync finds them all, shows a plan, and runs
+'aipaca update' in each after you confirm:
+- Repos you did not edit since apply get the profile's new files
+- Repos edited since apply are left alone; use --force to merge the
+  profile's changes with the edits, as 'aipaca update' does
+
+Every repo is backed up first, so 'aipaca restore --step' undoes the
+update there.
+
+Examples:
+  aipaca sync default
+  aipaca sync default --dry-run    # Only show the plan
+  aipaca sync default --yes        # Do not ask`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return syncProfiles(args)
+	},
+}
+
+// syncProfiles plans updating every repo the profiles are applied to,
+// shows the plan and carries it out once confirmed
+func syncProfiles(profiles []string) error {
+	var plan []operations.SyncRepo
+	planned := make(map[string]bool)
+	for _, profile := range profiles {
+		repos, err := operations.PlanSync(cfg, operations.SyncOptions{
+			Profile: profile,
+			Force:   syncForce,
+			Jobs:    bulkJobs,
+		})
+		if err != nil {
+			return err
+		}
+		// A repo with several of the profiles is updated once
+		for _, repo := range repos {
+			if !planned[repo.RepoPath] || repo.Action == operations.SyncUpdate {
+				plan = replaceSyncRepo(plan, repo)
+			}
+			planned[repo.RepoPath] = true
+		}
+	}
+
+	sort.Slice(plan, func(i, j int) bool { return plan[i].RepoPath < plan[j].RepoPath })
+
+	what := fmt.Sprintf("profile '%s'", profiles[0])
+	if len(profiles) > 1 {
+		what = "profiles " + strings.Join(profiles, ", ")
+	}
+	if len(plan) == 0 {
+		fmt.Printf("No repos use %s\n", what)
+		return nil
+	}
+
+	var repos []string
+	skipped := 0
+	for _, repo := range plan {
+		switch repo.Action {
+		case operations.SyncUpdate:
+			repos = append(repos, repo.RepoPath)
+		case operations.SyncSkip:
+			skipped++
+		}
+	}
+
+	fmt.Printf("Plan for %s (%d repos):\n", what, len(plan))
+	printSyncPlan(plan)
+	fmt.Println()
+
+	if len(repos) == 0 {
+		printSuccess("Nothing to update")
+		return nil
+	}
+	if syncDryRun {
+		fmt.Println("Dry run - no changes made")
+		return nil
+	}
+	if !syncYes {
+		if !isTerminal(os.Stdin) {
+			return fmt.Errorf("not updating without confirmation; use --yes")
+		}
+		if answer := prompt("Update %d repos? [y/N] ", len(repos)); answer != "y" && answer != "yes" {
+			fmt.Println("Aborted")
+			return nil
+		}
+		fmt.Println()
+	}
+
+	if skipped > 0 {
+		printInfo("Skipping %d repos, see the plan above", skipped)
+		fmt.Println()
+	}
+	return runBulk(repos, false, func(cfg *config.Config, repoPath string, _ bool) (string, error) {
+		result, err := operations.Update(cfg, operations.UpdateOptions{RepoPath: repoPath})
+		if err != nil {
+			return "", err
+		}
+		return updateSummary(result), nil
+	})
+}
+
+// replaceSyncRepo puts repo into plan, in place of the plan of the same
+// repo if there is one
+func replaceSyncRepo(plan []operations.SyncRepo, repo operations.SyncRepo) []operations.SyncRepo {
+	for i := range plan {
+		if plan[i].RepoPath == repo.RepoPath {
+			plan[i] = repo
+			return plan
+		}
+	}
+	return append(plan, repo)
+}
+
+// printSyncPlan prints what a sync is about to do to every repo
+func printSyncPlan(plan []operations.SyncRepo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPO\tACTION\tDETAIL")
+	fmt.Fprintln(w, "----\t------\t------")
+
+	for _, repo := range plan {
+		detail := repo.Reason
+		if repo.Action == operations.SyncUpdate {
+			detail = updateSummary(repo.Update)
+			if repo.Edited {
+				detail += ", keeping local edits"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", repo.RepoPath, repo.Action, orDash(detail))
+	}
+	w.Flush()
+}
+
+// updateSummary describes the files an update changes in a few words
+func updateSummary(result *operations.UpdateResult) string {
+	var parts []string
+	for _, count := range []struct {
+		n    int
+		what string
+	}{
+		{len(result.FilesAdded), "added"},
+		{len(result.FilesUpdated), "updated"},
+		{len(result.FilesRemoved), "removed"},
+		{len(result.Merged), "merged"},
+		{len(result.Conflicts), "conflicting"},
+	} {
+		if count.n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", count.n, count.what))
+		}
+	}
+	if len(parts) == 0 {
+		return "no file changes"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func init() {
+	syncCmd.Flags().BoolVar(&syncDryRun, "dry-run", false, "Only show the plan")
+	syncCmd.Flags().BoolVar(&syncForce, "force", false, "Also update repos edited since apply, merging the edits")
+	syncCmd.Flags().BoolVarP(&syncYes, "yes", "y", false, "Update without asking")
+	syncCmd.Flags().IntVar(&bulkJobs, "jobs", operations.DefaultJobs, "How many repos to work on at a time")
+}
@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/HammerSpb/aipaca/internal/operations"
+)
+
+var (
+	updateDryRun   bool
+	updateNoBackup bool
+)
+
+var updateCmd = &cobra.Command{
+	Use:   "update [repo-path]",
+	Short: "Pull profile changes into a repository",
+	Long: `Bring changes made to the applied profiles into the repository while
+keeping your local edits.
+
+aipaca compares three versions of every file: the profile as it was
+applied, the profile now and the repository now.
+- Files you did not touch are updated to the profile's new version
+- Files changed both locally and in the profile are merged line by line
+- Where the same lines changed, both versions are kept between conflict
+  markers for you to resolve
+
+The files are backed up first (use --no-backup to skip), and
+'aipaca restore --step' undoes the update.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repoPath := ""
+		if len(args) > 0 {
+			repoPath = args[0]
+		}
+
+		result, err := operations.Update(cfg, operations.UpdateOptions{
+			RepoPath: repoPath,
+			DryRun:   updateDryRun,
+			NoBackup: updateNoBackup,
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(result.Changed) == 0 {
+			printSuccess("Profiles %s have not changed since they were applied", strings.Join(result.Layers, ", "))
+			return nil
+		}
+		if result.UpToDate() {
+			printSuccess("Repository already has the changes to %s", strings.Join(result.Changed, ", "))
+			return nil
+		}
+
+		if updateDryRun {
+			fmt.Println("Dry run - no changes made")
+			fmt.Println()
+		}
+
+		sections := []struct {
+			would, did string
+			mark       string
+			files      []string
+		}{
+			{"Would add:", "Added:", "+", result.FilesAdded},
+			{"Would update:", "Updated:", "~", result.FilesUpdated},
+			{"Would merge with your edits:", "Merged with your edits:", "~", result.Merged},
+			{"Would remove:", "Removed:", "-", result.FilesRemoved},
+		}
+		for _, section := range sections {
+			if len(section.files) == 0 {
+				continue
+			}
+			if updateDryRun {
+				fmt.Println(section.would)
+			} else {
+				fmt.Println(section.did)
+			}
+			for _, f := range section.files {
+				printInfo("%s %s", section.mark, f)
+			}
+			fmt.Println()
+		}
+
+		if len(result.Conflicts) > 0 {
+			if updateDryRun {
+				fmt.Println("Would conflict:")
+			} else {
+				fmt.Println("Conflicts (resolve the marked lines):")
+			}
+			for _, c := range result.Conflicts {
+				printWarning("%s: %s", c.Path, c.Reason)
+			}
+			fmt.Println()
+		}
+
+		if !updateDryRun {
+			if result.BackupName != "" {
+				printSuccess("Created backup: %s", result.BackupName)
+			}
+			printSuccess("Updated from %s", strings.Join(result.Changed, ", "))
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	updateCmd.Flags().BoolVar(&updateDryRun, "dry-run", false, "Show what would happen without making changes")
+	updateCmd.Flags().BoolVar(&updateNoBackup, "no-backup", false, "Skip creating backup (dangerous)")
+}
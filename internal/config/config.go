@@ -4,17 +4,83 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/bmatcuk/doublestar/v4"
 	"gopkg.in/yaml.v3"
 )
 
 // Config represents the main configuration file
 type Config struct {
-	Version             string            `yaml:"version"`
-	Storage             StorageConfig     `yaml:"storage"`
-	AIPatterns          []string          `yaml:"ai_patterns"`
-	DefaultProfile      string            `yaml:"default_profile"`
-	ProfileDescriptions map[string]string `yaml:"profile_descriptions"`
+	Version        string        `yaml:"version"`
+	Storage        StorageConfig `yaml:"storage"`
+	AIPatterns     []string      `yaml:"ai_patterns"`
+	DefaultProfile string        `yaml:"default_profile"`
+
+	// ProfileDescriptions is only read to migrate old configs; descriptions
+	// now live in each profile's manifest
+	ProfileDescriptions map[string]string `yaml:"profile_descriptions,omitempty"`
+
+	// MergeRules pick how files provided by several sources (stacked
+	// profiles, or a profile and the repo's own content) are combined.
+	// Profile manifests can add their own rules, which take precedence.
+	MergeRules []MergeRule `yaml:"merge_rules,omitempty"`
+
+	// Repos holds per-repository settings, keyed by repository path
+	Repos map[string]RepoConfig `yaml:"repos,omitempty"`
+
+	// LockWait is how long to wait for another aipaca process to finish
+	// before giving up. Zero fails immediately.
+	LockWait time.Duration `yaml:"lock_wait,omitempty"`
+
+	// GitExclude lists the files aipaca manages in each repo's
+	// .git/info/exclude, so git status does not offer them for commit.
+	// Repos can turn it on or off for themselves.
+	GitExclude bool `yaml:"git_exclude,omitempty"`
+
+	// NoGitRoot makes commands work on the directory they are given (or
+	// the current one) instead of the root of the git work tree holding it
+	NoGitRoot bool `yaml:"no_git_root,omitempty"`
+
+	// BranchRules pick the profile 'aipaca switch' applies for a branch.
+	// The first matching rule wins; rules of a repo come before these.
+	BranchRules []BranchRule `yaml:"branch_rules,omitempty"`
+
+	// BranchEdits is what 'aipaca switch' does with edits to the applied
+	// profile's files when leaving a branch: "stash" (the default) keeps
+	// them for when the branch is checked out again, "save" saves them to
+	// the profile
+	BranchEdits string `yaml:"branch_edits,omitempty"`
+}
+
+// Ways of handling edits when switching branches
+const (
+	BranchEditsStash = "stash"
+	BranchEditsSave  = "save"
+)
+
+// BranchRule applies a profile on the branches matching a pattern
+type BranchRule struct {
+	Branch  string `yaml:"branch"`  // Branch name or glob, e.g. spike/*
+	Profile string `yaml:"profile"` // Profile to apply
+}
+
+// MergeRule picks a merge strategy for files matching a path pattern
+type MergeRule struct {
+	Path     string `yaml:"path"`     // Relative path or glob, e.g. .mcp.json or **/*.md
+	Strategy string `yaml:"strategy"` // replace, deep-merge, union, append, sections or block
+}
+
+// RepoConfig holds the settings of one repository
+type RepoConfig struct {
+	Vars       map[string]string `yaml:"vars,omitempty"`        // Template variables
+	GitExclude *bool             `yaml:"git_exclude,omitempty"` // Overrides the global setting
+
+	// CommitAIFiles lets commits and pushes include AI files despite the
+	// hooks of 'aipaca git install-hooks'
+	CommitAIFiles bool `yaml:"commit_ai_files,omitempty"`
+
+	BranchRules []BranchRule `yaml:"branch_rules,omitempty"` // Checked before the global rules
 }
 
 // StorageConfig represents storage configuration
@@ -40,8 +106,12 @@ func DefaultConfig() *Config {
 			"ai/**",
 			".ai*",
 		},
-		DefaultProfile:      "default",
-		ProfileDescriptions: map[string]string{},
+		DefaultProfile: "default",
+		MergeRules: []MergeRule{
+			{Path: ".claude/settings.json", Strategy: "union"},
+			{Path: ".mcp.json", Strategy: "union"},
+			{Path: ".cursor/mcp.json", Strategy: "union"},
+		},
 	}
 }
 
@@ -74,7 +144,7 @@ func Load(path string) (*Config, error) {
 	}
 
 	// Expand ~ in storage path
-	cfg.Storage.Path = expandPath(cfg.Storage.Path)
+	cfg.Storage.Path = ExpandPath(cfg.Storage.Path)
 
 	return &cfg, nil
 }
@@ -103,9 +173,102 @@ func (c *Config) Save(path string) error {
 	return nil
 }
 
+// RemoveProfileDescriptions deletes the profile_descriptions section from
+// the config file, keeping the rest of the file as written. A file without
+// it is left untouched.
+func RemoveProfileDescriptions(path string) error {
+	if path == "" {
+		path = ConfigPath()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+
+	root := doc.Content[0]
+	found := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "profile_descriptions" {
+			root.Content = append(root.Content[:i], root.Content[i+2:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	data, err = yaml.Marshal(&doc)
+	if err != nil {
+		return fmt.Errorf("failed to serialize config: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	return nil
+}
+
+// ForRepo returns the settings of a repository
+func (c *Config) ForRepo(repoPath string) RepoConfig {
+	for path, repoCfg := range c.Repos {
+		if filepath.Clean(ExpandPath(path)) == filepath.Clean(repoPath) {
+			return repoCfg
+		}
+	}
+	return RepoConfig{}
+}
+
+// GitExcludeFor reports whether aipaca keeps the managed files of a repo
+// in its .git/info/exclude
+func (c *Config) GitExcludeFor(repoPath string) bool {
+	if exclude := c.ForRepo(repoPath).GitExclude; exclude != nil {
+		return *exclude
+	}
+	return c.GitExclude
+}
+
+// BranchProfile returns the profile the branch rules pick for a branch of
+// a repo, or an empty string when no rule matches
+func (c *Config) BranchProfile(repoPath, branch string) (string, error) {
+	rules := append(append([]BranchRule{}, c.ForRepo(repoPath).BranchRules...), c.BranchRules...)
+	for _, rule := range rules {
+		matched, err := doublestar.Match(rule.Branch, branch)
+		if err != nil {
+			return "", fmt.Errorf("invalid branch pattern '%s': %w", rule.Branch, err)
+		}
+		if matched {
+			return rule.Profile, nil
+		}
+	}
+	return "", nil
+}
+
+// BranchEditsMode returns how edits are handled when switching branches
+func (c *Config) BranchEditsMode() (string, error) {
+	switch c.BranchEdits {
+	case "", BranchEditsStash:
+		return BranchEditsStash, nil
+	case BranchEditsSave:
+		return BranchEditsSave, nil
+	default:
+		return "", fmt.Errorf("invalid branch_edits '%s' in config (expected stash or save)", c.BranchEdits)
+	}
+}
+
 // StoragePath returns the expanded storage path
 func (c *Config) StoragePath() string {
-	return expandPath(c.Storage.Path)
+	return ExpandPath(c.Storage.Path)
 }
 
 // ProfilesPath returns the path to the profiles directory
@@ -123,8 +286,28 @@ func (c *Config) StatePath() string {
 	return filepath.Join(c.StoragePath(), "state")
 }
 
-// expandPath expands ~ to home directory
-func expandPath(path string) string {
+// TransactionsPath returns the path to the transactions directory
+func (c *Config) TransactionsPath() string {
+	return filepath.Join(c.StoragePath(), "transactions")
+}
+
+// SnapshotsPath returns the path to the profile snapshots directory
+func (c *Config) SnapshotsPath() string {
+	return filepath.Join(c.StoragePath(), "snapshots")
+}
+
+// SessionsPath returns the path to the run sessions directory
+func (c *Config) SessionsPath() string {
+	return filepath.Join(c.StoragePath(), "sessions")
+}
+
+// LocksPath returns the path to the locks directory
+func (c *Config) LocksPath() string {
+	return filepath.Join(c.StoragePath(), "locks")
+}
+
+// ExpandPath expands ~ to home directory
+func ExpandPath(path string) string {
 	if len(path) == 0 {
 		return path
 	}
@@ -0,0 +1,180 @@
+package operations
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+)
+
+// AdoptOptions contains options for the adopt operation
+type AdoptOptions struct {
+	Paths       []string // Repo files or directories to adopt
+	RepoPath    string
+	ProfileName string // Applied profile to adopt into (empty = top layer)
+	DryRun      bool
+	NoBackup    bool
+}
+
+// AdoptResult contains the result of an adopt operation
+type AdoptResult struct {
+	ProfileName  string
+	FilesAdopted []string
+	BackupName   string
+	Version      int // Profile version after the adopt
+}
+
+// Adopt brings unmanaged AI files of a repo under management by adding
+// them to an applied profile
+func Adopt(cfg *config.Config, opts AdoptOptions) (*AdoptResult, error) {
+	store := storage.New(cfg)
+	result := &AdoptResult{}
+
+	// Resolve repo path
+	repoPath, err := ResolveRepoPath(cfg, opts.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hold the repo for the whole operation; a dry run only reads
+	if !opts.DryRun {
+		lock, err := store.LockRepo(repoPath)
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Release()
+	}
+
+	state, err := store.GetRepoState(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repo state: %w", err)
+	}
+	if state == nil || state.AppliedProfile == "" {
+		return nil, fmt.Errorf("no profile currently applied to this repo")
+	}
+
+	layers := state.AppliedLayers()
+	profileName := opts.ProfileName
+	if profileName == "" {
+		profileName = layers[len(layers)-1]
+	} else if !slices.Contains(layers, profileName) {
+		return nil, fmt.Errorf("profile '%s' is not applied to this repo", profileName)
+	}
+	result.ProfileName = profileName
+
+	managed, err := managedFiles(cfg, store, repoPath, state)
+	if err != nil {
+		return nil, err
+	}
+
+	adopted, err := adoptedFiles(cfg, repoPath, opts.Paths)
+	if err != nil {
+		return nil, err
+	}
+	for relPath := range adopted {
+		if _, ok := managed[relPath]; ok {
+			return nil, fmt.Errorf("%s is already managed by aipaca", relPath)
+		}
+		result.FilesAdopted = append(result.FilesAdopted, relPath)
+	}
+	sort.Strings(result.FilesAdopted)
+
+	current, err := store.GetProfileFiles(profileName)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string, len(current)+len(adopted))
+	for _, relPath := range current {
+		files[relPath] = filepath.Join(store.ProfilePath(profileName), relPath)
+	}
+	for relPath, fullPath := range adopted {
+		if _, ok := files[relPath]; ok {
+			return nil, fmt.Errorf("profile '%s' already has %s", profileName, relPath)
+		}
+		files[relPath] = fullPath
+	}
+
+	// If dry run, return here
+	if opts.DryRun {
+		return result, nil
+	}
+
+	// Back up the profile before it is changed (unless --no-backup)
+	if !opts.NoBackup {
+		result.BackupName, err = store.CreateProfileBackup(profileName, repoPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create backup: %w", err)
+		}
+	}
+
+	if err := store.SaveFilesToProfile(profileName, files); err != nil {
+		return nil, fmt.Errorf("failed to save profile: %w", err)
+	}
+
+	sums, err := fileChecksums(adopted)
+	if err != nil {
+		return nil, err
+	}
+	if managed == nil {
+		managed = make(map[string]string, len(sums))
+	}
+	for relPath, sum := range sums {
+		managed[relPath] = sum
+	}
+	state.Managed = managed
+	if err := store.SetRepoState(repoPath, state); err != nil {
+		return nil, fmt.Errorf("failed to update repo state: %w", err)
+	}
+
+	if manifest, err := store.GetProfileManifest(profileName); err == nil {
+		result.Version = manifest.Version
+	}
+
+	return result, nil
+}
+
+// adoptedFiles resolves paths given on the command line to the AI files of
+// the repo they name (relative path -> full path). Directories stand for
+// the files under them.
+func adoptedFiles(cfg *config.Config, repoPath string, paths []string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, p := range paths {
+		fullPath, err := filepath.Abs(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", p, err)
+		}
+		relPath, err := filepath.Rel(repoPath, fullPath)
+		if err != nil || relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%s is not inside the repo", p)
+		}
+
+		var found []string
+		switch {
+		case fileutil.IsDir(fullPath):
+			dirFiles, err := fileutil.ListAllFiles(fullPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list %s: %w", p, err)
+			}
+			for _, f := range dirFiles {
+				found = append(found, filepath.Join(relPath, f))
+			}
+		case fileutil.IsFile(fullPath):
+			found = append(found, relPath)
+		default:
+			return nil, fmt.Errorf("%s does not exist", p)
+		}
+
+		for _, f := range found {
+			if !fileutil.IsAIFile(filepath.ToSlash(f), cfg.AIPatterns) {
+				return nil, fmt.Errorf("%s does not match the AI file patterns", f)
+			}
+			files[f] = filepath.Join(repoPath, f)
+		}
+	}
+	return files, nil
+}
@@ -2,62 +2,133 @@ package operations
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/HammerSpb/aipaca/internal/config"
 	"github.com/HammerSpb/aipaca/internal/storage"
 	"github.com/HammerSpb/aipaca/pkg/fileutil"
+	"github.com/HammerSpb/aipaca/pkg/merge"
 )
 
 // ApplyOptions contains options for the apply operation
 type ApplyOptions struct {
 	ProfileName string
+	Profiles    []string // Profiles to stack, bottom first (instead of ProfileName)
 	RepoPath    string
 	DryRun      bool
 	NoBackup    bool
 	Force       bool
+	Set         map[string]string // Template variables overriding all others
+
+	// Switch records the apply as a branch switch. A switch right after
+	// another takes its place instead of stacking on it, so restore --step
+	// undoes every switch since the last other operation at once.
+	Switch bool
 }
 
 // ApplyResult contains the result of an apply operation
 type ApplyResult struct {
 	ProfileName  string
+	Layers       []string              // All stacked profiles, bottom first, including extends
+	Owners       map[string]string     // Applied file -> layer it comes from
+	Merged       []string              // Applied files combined from several sources
+	Blocks       []string              // Applied files in which profiles only manage blocks
+	Rendered     []string              // Applied files rendered from templates
+	Vars         map[string]string     // Template variables
+	Skipped      []storage.SkippedFile // Profile files left out by their conditions
 	BackupName   string
 	FilesApplied []string
 	FilesRemoved []string
 }
 
-// Apply applies a profile to a repository
+// Apply applies a profile, or several stacked profiles, to a repository
 func Apply(cfg *config.Config, opts ApplyOptions) (*ApplyResult, error) {
 	store := storage.New(cfg)
-	result := &ApplyResult{ProfileName: opts.ProfileName}
+
+	profiles := opts.Profiles
+	if len(profiles) == 0 {
+		profiles = []string{opts.ProfileName}
+	}
+	result := &ApplyResult{ProfileName: profiles[len(profiles)-1]}
 
 	// Resolve repo path
-	repoPath := opts.RepoPath
-	if repoPath == "" {
-		var err error
-		repoPath, err = os.Getwd()
+	repoPath, err := ResolveRepoPath(cfg, opts.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hold the repo for the whole operation; a dry run only reads
+	if !opts.DryRun {
+		lock, err := store.LockRepo(repoPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get current directory: %w", err)
+			return nil, err
 		}
+		defer lock.Release()
 	}
-	repoPath, err := filepath.Abs(repoPath)
+
+	// Resolve extends into the full list of layers; this also checks
+	// that every profile exists
+	result.Layers, err = store.ResolveProfiles(profiles)
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve repo path: %w", err)
+		return nil, err
 	}
 
-	// Check if profile exists
-	profile, err := store.GetProfile(opts.ProfileName)
+	prevState, err := store.GetRepoState(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repo state: %w", err)
+	}
+
+	// Merge rules combine profile files with the repo's own content: the
+	// original files kept in the baseline, or what is there on first apply
+	var base map[string]string
+	if prevState != nil {
+		base, err = baselineFiles(store, prevState)
+	} else {
+		var repoTree *Tree
+		repoTree, err = RepoTree(repoPath, cfg.AIPatterns)
+		if repoTree != nil {
+			base = repoTree.Files
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.Vars, err = TemplateVars(cfg, store, repoPath, result.Layers, opts.Set)
 	if err != nil {
 		return nil, err
 	}
+	composeOpts := storage.ComposeOptions{Base: base, Vars: result.Vars, RepoPath: repoPath}
 
 	// Get list of files that will be applied
-	profileFiles, err := store.GetProfileFiles(opts.ProfileName)
+	comp, err := store.Compose(result.Layers, composeOpts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list profile files: %w", err)
 	}
-	result.FilesApplied = profileFiles
+	result.Owners = comp.Owners()
+	result.Skipped = comp.Skipped
+	for relPath, f := range comp.Files {
+		result.FilesApplied = append(result.FilesApplied, relPath)
+		switch {
+		case f.Strategy == merge.Block:
+			result.Blocks = append(result.Blocks, relPath)
+		case f.Merged():
+			result.Merged = append(result.Merged, relPath)
+		}
+		if f.Rendered() {
+			// Catch template errors before anything is touched
+			if _, err := f.Content(); err != nil {
+				return nil, err
+			}
+			result.Rendered = append(result.Rendered, relPath)
+		}
+	}
+	sort.Strings(result.FilesApplied)
+	sort.Strings(result.Merged)
+	sort.Strings(result.Blocks)
+	sort.Strings(result.Rendered)
 
 	// Find existing AI files in repo that will be removed/replaced
 	existingFiles, err := fileutil.ExpandPatterns(repoPath, cfg.AIPatterns)
@@ -65,40 +136,87 @@ func Apply(cfg *config.Config, opts ApplyOptions) (*ApplyResult, error) {
 		return nil, fmt.Errorf("failed to find existing AI files: %w", err)
 	}
 	for relPath := range existingFiles {
+		// Files with blocks are updated in place
+		if f, ok := comp.Files[relPath]; ok && f.Strategy == merge.Block {
+			continue
+		}
 		result.FilesRemoved = append(result.FilesRemoved, relPath)
 	}
+	sort.Strings(result.FilesRemoved)
 
 	// If dry run, return here
 	if opts.DryRun {
 		return result, nil
 	}
 
-	// Create backup of existing files (unless --no-backup)
-	if !opts.NoBackup && len(existingFiles) > 0 {
-		backupName, err := store.CreateBackup(repoPath, cfg.AIPatterns)
+	operation := "apply"
+	if opts.Switch {
+		operation = "switch"
+	}
+	replace := opts.Switch && prevState.TopOperation() == "switch"
+
+	txn, err := store.BeginTransaction(operation, repoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Abort()
+
+	// Create backup of existing files (unless --no-backup). A replaced
+	// switch keeps the backup of the files from before it.
+	if !opts.NoBackup && !replace && len(existingFiles) > 0 {
+		backupName, err := store.CreateBackup(repoPath, cfg.AIPatterns, storage.BackupOptions{
+			Operation: operation,
+			Profile:   strings.Join(result.Layers, "+"),
+		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to create backup: %w", err)
 		}
 		result.BackupName = backupName
 	}
 
-	// Remove existing AI files from repo
-	for _, fullPath := range existingFiles {
-		if err := os.RemoveAll(fullPath); err != nil {
-			return nil, fmt.Errorf("failed to remove %s: %w", fullPath, err)
-		}
+	// Stage the swap: existing AI files out, profile files in
+	for _, relPath := range result.FilesRemoved {
+		txn.Remove(relPath)
 	}
 
-	// Copy profile files to repo
-	if err := store.ApplyProfile(opts.ProfileName, repoPath); err != nil {
-		return nil, fmt.Errorf("failed to apply profile: %w", err)
+	if err := store.ApplyProfiles(result.Layers, composeOpts, txn); err != nil {
+		return nil, fmt.Errorf("failed to stage profile: %w", err)
 	}
 
-	// Record the state
-	if err := store.RecordApply(repoPath, opts.ProfileName, result.BackupName); err != nil {
-		return nil, fmt.Errorf("failed to record state: %w", err)
+	// The state is recorded as part of the transaction. The first apply
+	// keeps the original files as the baseline; later ones stack on top.
+	layer := storage.StateLayer{
+		Operation: operation,
+		Backup:    result.BackupName,
+		NoBackup:  opts.NoBackup && len(existingFiles) > 0,
+		At:        time.Now(),
+	}
+	before := prevState
+	if replace {
+		layer, before = storage.PopRepoState(prevState)
+	}
+	nextState := storage.NextRepoState(before, layer, result.Layers)
+	if replace {
+		// Popping the first operation drops the state, branches included
+		nextState.Branch, nextState.Branches = prevState.Branch, prevState.Branches
+	}
+	nextState.Vars = result.Vars
+	nextState.Managed, err = composedChecksums(comp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshot the profiles so save and update can later tell the repo's
+	// changes from the profiles' own
+	nextState.Snapshots, err = snapshotLayers(store, result.Layers)
+	if err != nil {
+		return nil, err
+	}
+	txn.RecordState(repoPath, nextState)
+
+	if err := txn.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to apply profile: %w", err)
 	}
 
-	_ = profile // Use profile variable
 	return result, nil
 }
@@ -0,0 +1,228 @@
+package operations
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+)
+
+const (
+	// DefaultJobs is how many repos a bulk operation works on at a time by
+	// default
+	DefaultJobs = 4
+
+	// bulkLockWait is the minimum wait for locks during a bulk operation.
+	// Its workers take the same profile and storage locks, each briefly.
+	bulkLockWait = time.Minute
+)
+
+// RepoSelection picks the repos a bulk operation runs on. Repos picked by
+// several of its fields are only taken once.
+type RepoSelection struct {
+	ReposFrom   string // File listing repo paths, one per line ("-" for stdin)
+	Glob        string // Pattern matching repo directories, e.g. ~/code/*
+	WithProfile string // Every repo aipaca applied this profile to
+}
+
+// Empty reports whether the selection picks no repos at all, so the
+// operation runs on a single repo
+func (s RepoSelection) Empty() bool {
+	return s.ReposFrom == "" && s.Glob == "" && s.WithProfile == ""
+}
+
+// SelectRepos returns the absolute paths of the repos a selection picks,
+// sorted
+func SelectRepos(cfg *config.Config, sel RepoSelection) ([]string, error) {
+	var repos []string
+
+	if sel.ReposFrom != "" {
+		listed, err := readRepoList(sel.ReposFrom)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, listed...)
+	}
+
+	if sel.Glob != "" {
+		matches, err := doublestar.FilepathGlob(config.ExpandPath(sel.Glob))
+		if err != nil {
+			return nil, fmt.Errorf("invalid repo pattern '%s': %w", sel.Glob, err)
+		}
+		for _, match := range matches {
+			if fileutil.IsDir(match) {
+				repos = append(repos, match)
+			}
+		}
+	}
+
+	// Listed and matched directories stand for the repos holding them
+	for i, repoPath := range repos {
+		root, err := ResolveRepoPath(cfg, repoPath)
+		if err != nil {
+			return nil, err
+		}
+		repos[i] = root
+	}
+
+	if sel.WithProfile != "" {
+		states, err := storage.New(cfg).ListRepoStates()
+		if err != nil {
+			return nil, err
+		}
+		for repoPath, state := range states {
+			for _, layer := range state.AppliedLayers() {
+				if layer == sel.WithProfile {
+					repos = append(repos, repoPath)
+					break
+				}
+			}
+		}
+	}
+
+	return dedupe(repos), nil
+}
+
+// readRepoList reads repo paths from a file, one per line. Blank lines
+// and lines starting with # are skipped.
+func readRepoList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(config.ExpandPath(path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open repo list: %w", err)
+		}
+		defer file.Close()
+		r = file
+	}
+
+	var repos []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		repos = append(repos, config.ExpandPath(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read repo list: %w", err)
+	}
+	return repos, nil
+}
+
+// BulkOptions contains options for running an operation on many repos
+type BulkOptions struct {
+	Jobs int // Repos worked on at a time (DefaultJobs when zero)
+
+	// Atomic undoes the operation on every repo it succeeded on when it
+	// failed on any. Only operations that restore --step can undo qualify.
+	Atomic bool
+}
+
+// BulkResult is the outcome of an operation on one repo
+type BulkResult struct {
+	RepoPath string
+	Detail   string // What the operation did, in a few words
+	Err      error
+
+	// RolledBack is set when the repo was put back because the operation
+	// failed on another repo (Atomic); RollbackErr when that failed
+	RolledBack  bool
+	RollbackErr error
+}
+
+// Failed reports whether the operation failed on a repo of results
+func Failed(results []BulkResult) bool {
+	for _, r := range results {
+		if r.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// RunBulk runs op on every repo, at most opts.Jobs at a time, and returns
+// the outcomes in the order of repos. Operations running at the same time
+// each open their own storage, and the repo and storage locks keep them
+// apart; op gets a copy of cfg that waits for those locks.
+func RunBulk(cfg *config.Config, repos []string, opts BulkOptions, op func(cfg *config.Config, repoPath string) (string, error)) []BulkResult {
+	results := make([]BulkResult, len(repos))
+
+	if cfg.LockWait < bulkLockWait {
+		waiting := *cfg
+		waiting.LockWait = bulkLockWait
+		cfg = &waiting
+	}
+
+	// Note how deep every repo's state is, so that atomic runs know how
+	// far to step back
+	depths := make([]int, len(repos))
+	if opts.Atomic {
+		store := storage.New(cfg)
+		for i, repoPath := range repos {
+			state, err := store.GetRepoState(repoPath)
+			if err != nil {
+				results[i] = BulkResult{RepoPath: repoPath, Err: err}
+				continue
+			}
+			depths[i] = state.Depth()
+		}
+		if Failed(results) {
+			return results
+		}
+	}
+
+	forEach(len(repos), opts.Jobs, func(i int) {
+		detail, err := op(cfg, repos[i])
+		results[i] = BulkResult{RepoPath: repos[i], Detail: detail, Err: err}
+	})
+
+	if opts.Atomic && Failed(results) {
+		forEach(len(repos), opts.Jobs, func(i int) {
+			if results[i].Err != nil {
+				return
+			}
+			if _, err := stepBack(cfg, repos[i], depths[i]); err != nil {
+				results[i].RollbackErr = err
+				return
+			}
+			results[i].RolledBack = true
+		})
+	}
+
+	return results
+}
+
+// forEach calls fn with 0 to n-1, at most jobs at a time
+func forEach(n, jobs int, fn func(i int)) {
+	if jobs <= 0 {
+		jobs = DefaultJobs
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
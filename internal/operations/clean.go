@@ -4,10 +4,15 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/HammerSpb/aipaca/internal/config"
 	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/blocks"
 	"github.com/HammerSpb/aipaca/pkg/fileutil"
+	"github.com/HammerSpb/aipaca/pkg/merge"
 )
 
 // CleanOptions contains options for the clean operation
@@ -15,12 +20,16 @@ type CleanOptions struct {
 	RepoPath string
 	DryRun   bool
 	NoBackup bool
+	All      bool // Remove every AI file, not only those aipaca manages
 }
 
 // CleanResult contains the result of a clean operation
 type CleanResult struct {
-	BackupName   string
-	FilesRemoved []string
+	BackupName    string
+	FilesRemoved  []string
+	BlocksRemoved []string // Files that only had their aipaca blocks taken out
+	Modified      []string // Removed managed files that were edited since aipaca wrote them
+	Unmanaged     []string // AI files left in place because aipaca does not manage them
 }
 
 // Clean removes AI files from a repository
@@ -29,17 +38,18 @@ func Clean(cfg *config.Config, opts CleanOptions) (*CleanResult, error) {
 	result := &CleanResult{}
 
 	// Resolve repo path
-	repoPath := opts.RepoPath
-	if repoPath == "" {
-		var err error
-		repoPath, err = os.Getwd()
+	repoPath, err := ResolveRepoPath(cfg, opts.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hold the repo for the whole operation; a dry run only reads
+	if !opts.DryRun {
+		lock, err := store.LockRepo(repoPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get current directory: %w", err)
+			return nil, err
 		}
-	}
-	repoPath, err := filepath.Abs(repoPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to resolve repo path: %w", err)
+		defer lock.Release()
 	}
 
 	// Find AI files in repo
@@ -48,42 +58,184 @@ func Clean(cfg *config.Config, opts CleanOptions) (*CleanResult, error) {
 		return nil, fmt.Errorf("failed to find AI files: %w", err)
 	}
 
-	if len(aiFiles) == 0 {
+	prevState, err := store.GetRepoState(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repo state: %w", err)
+	}
+
+	// Only the files aipaca wrote are removed, unless all AI files are
+	// asked for
+	candidates := aiFiles
+	if !opts.All {
+		candidates, err = managedCandidates(cfg, store, repoPath, prevState, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Files with aipaca blocks keep the user's content around them
+	stripped, emptied, err := strippedBlockFiles(cfg, store, repoPath, prevState, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(candidates) == 0 && len(stripped) == 0 && len(emptied) == 0 {
 		return result, nil // Nothing to clean
 	}
 
 	// Get list of files
-	for relPath := range aiFiles {
-		result.FilesRemoved = append(result.FilesRemoved, relPath)
+	for relPath := range candidates {
+		if _, ok := stripped[relPath]; !ok {
+			result.FilesRemoved = append(result.FilesRemoved, relPath)
+		}
 	}
+	result.FilesRemoved = append(result.FilesRemoved, emptied...)
+	for relPath := range stripped {
+		result.BlocksRemoved = append(result.BlocksRemoved, relPath)
+	}
+	sort.Strings(result.FilesRemoved)
+	sort.Strings(result.BlocksRemoved)
+
+	modified := result.Modified[:0]
+	for _, relPath := range result.Modified {
+		if _, ok := stripped[relPath]; !ok {
+			modified = append(modified, relPath)
+		}
+	}
+	result.Modified = modified
 
 	// If dry run, return here
 	if opts.DryRun {
 		return result, nil
 	}
 
+	txn, err := store.BeginTransaction("clean", repoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Abort()
+
 	// Create backup (unless --no-backup)
 	if !opts.NoBackup {
-		backupName, err := store.CreateBackup(repoPath, cfg.AIPatterns)
+		backupOpts := storage.BackupOptions{Operation: "clean"}
+		if prevState != nil {
+			backupOpts.Profile = prevState.AppliedProfile
+		}
+		backupName, err := store.CreateBackup(repoPath, cfg.AIPatterns, backupOpts)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create backup: %w", err)
 		}
 		result.BackupName = backupName
-
-		// Record clean state (so restore knows the backup)
-		if err := store.SetRepoState(repoPath, &storage.RepoState{
-			BackupPath: backupName,
-		}); err != nil {
-			return nil, fmt.Errorf("failed to record state: %w", err)
-		}
 	}
 
+	// Record clean state (so restore knows the backup). The applied
+	// profile moves onto the stack, where restore --step can return to it.
+	txn.RecordState(repoPath, storage.NextRepoState(prevState, storage.StateLayer{
+		Operation: "clean",
+		Backup:    result.BackupName,
+		NoBackup:  opts.NoBackup,
+		At:        time.Now(),
+	}, nil))
+
 	// Remove AI files
-	for _, fullPath := range aiFiles {
-		if err := os.RemoveAll(fullPath); err != nil {
-			return nil, fmt.Errorf("failed to remove %s: %w", fullPath, err)
+	for _, relPath := range result.FilesRemoved {
+		txn.Remove(relPath)
+	}
+	for _, relPath := range result.BlocksRemoved {
+		info, err := os.Stat(filepath.Join(repoPath, relPath))
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", relPath, err)
+		}
+		if err := txn.PlaceData(relPath, stripped[relPath], info.Mode().Perm()); err != nil {
+			return nil, err
 		}
 	}
 
+	if err := txn.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to remove AI files: %w", err)
+	}
+	fileutil.RemoveEmptyParents(repoPath, result.FilesRemoved)
+
 	return result, nil
 }
+
+// managedCandidates returns the managed files present in a repo (relative
+// path -> full path). It records in result which of them were edited since
+// aipaca wrote them and which AI files are not managed.
+func managedCandidates(cfg *config.Config, store *storage.Storage, repoPath string, state *storage.RepoState, result *CleanResult) (map[string]string, error) {
+	managed, err := managedFiles(cfg, store, repoPath, state)
+	if err != nil {
+		return nil, err
+	}
+	existing, modified, err := existingManaged(repoPath, managed)
+	if err != nil {
+		return nil, err
+	}
+	result.Modified = modified
+
+	candidates := make(map[string]string, len(existing))
+	for _, relPath := range existing {
+		candidates[relPath] = filepath.Join(repoPath, relPath)
+	}
+
+	repoTree, err := RepoTree(repoPath, cfg.AIPatterns)
+	if err != nil {
+		return nil, err
+	}
+	for relPath := range repoTree.Files {
+		if _, ok := managed[relPath]; !ok {
+			result.Unmanaged = append(result.Unmanaged, relPath)
+		}
+	}
+	sort.Strings(result.Unmanaged)
+
+	return candidates, nil
+}
+
+// strippedBlockFiles returns the content left of repo files holding aipaca
+// blocks once the blocks are taken out, for files with content of the
+// user's besides the blocks. Emptied lists files outside removed that hold
+// nothing but blocks. Candidates are the files to be removed and the files
+// the applied profiles keep blocks in.
+func strippedBlockFiles(cfg *config.Config, store *storage.Storage, repoPath string, state *storage.RepoState, removed map[string]string) (stripped map[string][]byte, emptied []string, err error) {
+	candidates := make(map[string]bool, len(removed))
+	for relPath := range removed {
+		candidates[relPath] = true
+	}
+	if state != nil && state.AppliedProfile != "" {
+		applied, err := AppliedTree(cfg, store, repoPath, state)
+		if err != nil {
+			return nil, nil, err
+		}
+		for relPath, f := range applied.generated {
+			if f.Strategy == merge.Block {
+				candidates[relPath] = true
+			}
+		}
+	}
+
+	stripped = make(map[string][]byte)
+	for relPath := range candidates {
+		fullPath := filepath.Join(repoPath, relPath)
+		if !fileutil.IsFile(fullPath) {
+			continue
+		}
+		data, err := os.ReadFile(fullPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", relPath, err)
+		}
+
+		text := string(data)
+		if !blocks.Has(text) {
+			continue
+		}
+		if rest := blocks.Strip(text); strings.TrimSpace(rest) != "" {
+			stripped[relPath] = []byte(rest)
+		} else if _, ok := removed[relPath]; !ok {
+			// Nothing but blocks, in a file not removed otherwise
+			emptied = append(emptied, relPath)
+		}
+	}
+
+	return stripped, emptied, nil
+}
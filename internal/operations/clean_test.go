@@ -0,0 +1,37 @@
+package operations
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestCleanOnlyManagedFiles(t *testing.T) {
+	cfg := newTestConfig(t)
+	newTestProfile(t, cfg, "go", map[string]string{
+		"CLAUDE.md":             "go\n",
+		".claude/settings.json": `{"go": true}`,
+	})
+	repo := t.TempDir()
+	writeFiles(t, repo, map[string]string{"main.go": "package main\n"})
+	if _, err := Apply(cfg, ApplyOptions{ProfileName: "go", RepoPath: repo}); err != nil {
+		t.Fatal(err)
+	}
+	// Added after the apply, so not aipaca's
+	writeFiles(t, repo, map[string]string{".claude/local.md": "mine\n"})
+
+	result, err := Clean(cfg, CleanOptions{RepoPath: repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{".claude/settings.json", "CLAUDE.md"}; !slices.Equal(result.FilesRemoved, want) {
+		t.Errorf("FilesRemoved = %v, want %v", result.FilesRemoved, want)
+	}
+	if want := []string{".claude/local.md"}; !slices.Equal(result.Unmanaged, want) {
+		t.Errorf("Unmanaged = %v, want %v", result.Unmanaged, want)
+	}
+	want := map[string]string{"main.go": "package main\n", ".claude/local.md": "mine\n"}
+	if got := readFiles(t, repo); !maps.Equal(got, want) {
+		t.Errorf("files after clean = %v, want %v", got, want)
+	}
+}
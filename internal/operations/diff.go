@@ -4,145 +4,347 @@ import (
 	"bytes"
 	"fmt"
 	"os"
-	"path/filepath"
+	"sort"
 
 	"github.com/HammerSpb/aipaca/internal/config"
 	"github.com/HammerSpb/aipaca/internal/storage"
-	"github.com/HammerSpb/aipaca/pkg/fileutil"
+	"github.com/HammerSpb/aipaca/pkg/blocks"
+	"github.com/HammerSpb/aipaca/pkg/structdiff"
+	"github.com/HammerSpb/aipaca/pkg/textdiff"
 )
 
 // DiffOptions contains options for the diff operation
 type DiffOptions struct {
 	ProfileName string // Profile to compare against (empty = currently applied)
 	RepoPath    string
+	Context     int  // Lines of context around each hunk
+	NoSemantic  bool // Compare JSON/YAML files line by line only
+
+	// Left and Right are source specs (e.g. "profile:default", "backup:x",
+	// "repo:../other") to compare instead of ProfileName and RepoPath
+	Left  string
+	Right string
 }
 
-// FileChange represents a change to a file
+// FileChange represents a change to a file. Hunks describe the change from
+// the left (old) version to the right (new) version; by default that is
+// from the profile to the repo. Semantic is set for modified JSON/YAML
+// files and lists the changes by key path.
 type FileChange struct {
-	Path   string
-	Type   string // "added", "removed", "modified"
+	Path     string
+	Type     string // "added", "removed", "modified"
+	Binary   bool
+	Hunks    []textdiff.Hunk
+	Semantic []structdiff.Change
+	Owner    string // Layer the left file comes from, when profiles are stacked
+
+	// Files holding aipaca blocks are compared part by part: Block names
+	// the profile of a changed block, and UserContent marks a change to the
+	// text around the blocks
+	Block       string
+	UserContent bool
+}
+
+// Label names the file, and the part of it that changed
+func (c FileChange) Label() string {
+	switch {
+	case c.Block != "":
+		return fmt.Sprintf("%s (block %s)", c.Path, c.Block)
+	case c.UserContent:
+		return c.Path + " (outside blocks)"
+	default:
+		return c.Path
+	}
+}
+
+// Stats returns the number of inserted and deleted lines of the change
+func (c FileChange) Stats() (inserted, deleted int) {
+	for _, h := range c.Hunks {
+		i, d := h.Stats()
+		inserted += i
+		deleted += d
+	}
+	return inserted, deleted
 }
 
 // DiffResult contains the result of a diff operation
 type DiffResult struct {
 	ProfileName string
+	Left        *Tree
+	Right       *Tree
 	Changes     []FileChange
 	HasChanges  bool
 }
 
-// Diff shows differences between repo and a profile
+// Diff shows differences between repo and a profile, or between any two
+// sources given as Left and Right
 func Diff(cfg *config.Config, opts DiffOptions) (*DiffResult, error) {
+	if opts.Left != "" {
+		return diffSources(cfg, opts)
+	}
+
 	store := storage.New(cfg)
-	result := &DiffResult{}
 
 	// Resolve repo path
-	repoPath := opts.RepoPath
-	if repoPath == "" {
-		var err error
-		repoPath, err = os.Getwd()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get current directory: %w", err)
-		}
-	}
-	repoPath, err := filepath.Abs(repoPath)
+	repoPath, err := ResolveRepoPath(cfg, opts.RepoPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve repo path: %w", err)
+		return nil, err
 	}
 
-	// Determine profile to compare against
+	// Determine profile to compare against: the named one, or all the
+	// layers currently applied
 	profileName := opts.ProfileName
+	var profileTree *Tree
 	if profileName == "" {
-		appliedProfile, err := store.GetAppliedProfile(repoPath)
+		state, err := store.GetRepoState(repoPath)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get applied profile: %w", err)
 		}
-		if appliedProfile == "" {
+		if state == nil || state.AppliedProfile == "" {
 			return nil, fmt.Errorf("no profile specified and no profile currently applied to this repo")
 		}
-		profileName = appliedProfile
+		profileName = state.AppliedProfile
+
+		profileTree, err = AppliedTree(cfg, store, repoPath, state)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Compose the profile as it would be applied to this repo
+		layers, err := store.ResolveProfiles([]string{profileName})
+		if err != nil {
+			return nil, err
+		}
+		vars, err := TemplateVars(cfg, store, repoPath, layers, nil)
+		if err != nil {
+			return nil, err
+		}
+		profileTree, err = LayersTree(store, layers, storage.ComposeOptions{Vars: vars, RepoPath: repoPath})
+		if err != nil {
+			return nil, err
+		}
+		profileTree.Name = profileName
 	}
 
-	result.ProfileName = profileName
+	repoTree, err := RepoTree(repoPath, cfg.AIPatterns)
+	if err != nil {
+		return nil, err
+	}
+	addBlockFiles(profileTree, repoTree)
 
-	// Check if profile exists
-	_, err = store.GetProfile(profileName)
+	result, err := DiffTrees(profileTree, repoTree, opts)
 	if err != nil {
 		return nil, err
 	}
+	result.ProfileName = profileName
 
-	profilePath := store.ProfilePath(profileName)
+	return result, nil
+}
 
-	// Get files in profile
-	profileFiles, err := fileutil.ListAllFiles(profilePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to list profile files: %w", err)
+// diffSources compares two source specs
+func diffSources(cfg *config.Config, opts DiffOptions) (*DiffResult, error) {
+	right := opts.Right
+	if right == "" {
+		right = SourceRepo + ":" + opts.RepoPath
 	}
-	profileFileSet := make(map[string]bool)
-	for _, f := range profileFiles {
-		profileFileSet[f] = true
+
+	leftTree, err := LoadTree(cfg, opts.Left)
+	if err != nil {
+		return nil, err
 	}
 
-	// Get AI files in repo
-	aiFilesMap, err := fileutil.ExpandPatterns(repoPath, cfg.AIPatterns)
+	rightTree, err := LoadTree(cfg, right)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find AI files: %w", err)
+		return nil, err
+	}
+
+	return DiffTrees(leftTree, rightTree, opts)
+}
+
+// DiffTrees compares two trees. Files only in right are "added", files
+// only in left are "removed". Structured files that differ only in
+// formatting or key order are not reported unless opts.NoSemantic is set.
+func DiffTrees(left, right *Tree, opts DiffOptions) (*DiffResult, error) {
+	result := &DiffResult{Left: left, Right: right}
+
+	// Files only in right = added
+	for f := range right.Files {
+		if _, ok := left.Files[f]; !ok {
+			result.Changes = append(result.Changes, FileChange{Path: f, Type: "added"})
+		}
 	}
 
-	// Get all files in repo AI directories
-	repoFiles := make(map[string]bool)
-	for relPath, fullPath := range aiFilesMap {
-		info, err := os.Stat(fullPath)
+	// Files only in left = removed
+	for f := range left.Files {
+		if _, ok := right.Files[f]; !ok {
+			result.Changes = append(result.Changes, FileChange{Path: f, Type: "removed"})
+		}
+	}
+
+	// Files in both = check if modified
+	for f := range right.Files {
+		if _, ok := left.Files[f]; !ok {
+			continue
+		}
+
+		oldContent, err := left.Read(f)
+		if err != nil {
+			continue
+		}
+		newContent, err := right.Read(f)
 		if err != nil {
 			continue
 		}
-		if info.IsDir() {
-			files, err := fileutil.ListAllFiles(fullPath)
-			if err != nil {
+		if bytes.Equal(oldContent, newContent) {
+			continue
+		}
+
+		if blocks.Has(string(oldContent)) || blocks.Has(string(newContent)) {
+			result.Changes = append(result.Changes, blockChanges(f, oldContent, newContent, opts.Context)...)
+			continue
+		}
+
+		change := FileChange{Path: f, Type: "modified"}
+		if !opts.NoSemantic && structdiff.IsStructured(f) {
+			semantic, ok := semanticChanges(f, oldContent, newContent)
+			if ok && len(semantic) == 0 {
 				continue
 			}
-			for _, f := range files {
-				repoFiles[filepath.Join(relPath, f)] = true
-			}
-		} else {
-			repoFiles[relPath] = true
+			change.Semantic = semantic
 		}
+		result.Changes = append(result.Changes, change)
 	}
 
-	// Find differences
-	// Files in repo but not in profile = added
-	for f := range repoFiles {
-		if !profileFileSet[f] {
-			result.Changes = append(result.Changes, FileChange{Path: f, Type: "added"})
-			result.HasChanges = true
+	sort.SliceStable(result.Changes, func(i, j int) bool {
+		return result.Changes[i].Path < result.Changes[j].Path
+	})
+
+	// Compute line-level hunks, from the left version to the right version
+	for i := range result.Changes {
+		change := &result.Changes[i]
+		if change.Block != "" || change.UserContent {
+			continue // Compared part by part already
+		}
+
+		oldContent, err := readOptional(left, change.Path)
+		if err != nil {
+			return nil, err
+		}
+		newContent, err := readOptional(right, change.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		fillHunks(change, oldContent, newContent, opts.Context)
+		if len(left.Layers) > 1 {
+			change.Owner = left.Owners[change.Path]
 		}
 	}
 
-	// Files in profile but not in repo = removed
-	for f := range profileFileSet {
-		if !repoFiles[f] {
-			result.Changes = append(result.Changes, FileChange{Path: f, Type: "removed"})
-			result.HasChanges = true
+	result.HasChanges = len(result.Changes) > 0
+
+	return result, nil
+}
+
+// blockChanges compares a file holding aipaca blocks part by part: the
+// user's content around the blocks, then each block
+func blockChanges(rel string, oldContent, newContent []byte, context int) []FileChange {
+	oldText, newText := string(oldContent), string(newContent)
+	var changes []FileChange
+
+	oldUser, newUser := blocks.Strip(oldText), blocks.Strip(newText)
+	if oldUser != newUser {
+		change := FileChange{Path: rel, Type: "modified", UserContent: true}
+		fillHunks(&change, []byte(oldUser), []byte(newUser), context)
+		changes = append(changes, change)
+	}
+
+	oldBlocks := make(map[string]string)
+	for _, b := range blocks.Parse(oldText) {
+		oldBlocks[b.Profile] = b.Content
+	}
+	newBlocks := make(map[string]string)
+	for _, b := range blocks.Parse(newText) {
+		newBlocks[b.Profile] = b.Content
+	}
+
+	// Blocks in the order they appear, left first
+	var profiles []string
+	seen := make(map[string]bool)
+	for _, b := range append(blocks.Parse(oldText), blocks.Parse(newText)...) {
+		if !seen[b.Profile] {
+			seen[b.Profile] = true
+			profiles = append(profiles, b.Profile)
 		}
 	}
 
-	// Files in both = check if modified
-	for f := range repoFiles {
-		if profileFileSet[f] {
-			repoFilePath := filepath.Join(repoPath, f)
-			profileFilePath := filepath.Join(profilePath, f)
+	for _, profile := range profiles {
+		oldBlock, inOld := oldBlocks[profile]
+		newBlock, inNew := newBlocks[profile]
 
-			modified, err := filesAreDifferent(repoFilePath, profileFilePath)
-			if err != nil {
-				continue
-			}
-			if modified {
-				result.Changes = append(result.Changes, FileChange{Path: f, Type: "modified"})
-				result.HasChanges = true
-			}
+		change := FileChange{Path: rel, Block: profile}
+		switch {
+		case !inOld:
+			change.Type = "added"
+		case !inNew:
+			change.Type = "removed"
+		case oldBlock == newBlock:
+			continue
+		default:
+			change.Type = "modified"
 		}
+		fillHunks(&change, []byte(oldBlock), []byte(newBlock), context)
+		changes = append(changes, change)
 	}
 
-	return result, nil
+	return changes
+}
+
+// fillHunks computes the line diff of a change
+func fillHunks(change *FileChange, oldContent, newContent []byte, context int) {
+	if isBinary(oldContent) || isBinary(newContent) {
+		change.Binary = true
+		return
+	}
+
+	change.Hunks = textdiff.Hunks(textdiff.SplitLines(string(oldContent)), textdiff.SplitLines(string(newContent)), context)
+}
+
+// semanticChanges compares two versions of a structured file by key path.
+// ok is false when either version fails to parse, in which case the file
+// is compared line by line.
+func semanticChanges(rel string, oldContent, newContent []byte) (changes []structdiff.Change, ok bool) {
+	oldDoc, err := structdiff.Parse(rel, oldContent)
+	if err != nil {
+		return nil, false
+	}
+	newDoc, err := structdiff.Parse(rel, newContent)
+	if err != nil {
+		return nil, false
+	}
+
+	return structdiff.Compare(oldDoc, newDoc), true
+}
+
+// readOptional reads a file of a tree, treating a missing file as empty
+func readOptional(tree *Tree, relPath string) ([]byte, error) {
+	if _, ok := tree.Files[relPath]; !ok {
+		return nil, nil
+	}
+	content, err := tree.Read(relPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", relPath, err)
+	}
+	return content, nil
+}
+
+// isBinary reports whether content looks like binary data
+func isBinary(content []byte) bool {
+	probe := content
+	if len(probe) > 8000 {
+		probe = probe[:8000]
+	}
+	return bytes.IndexByte(probe, 0) >= 0
 }
 
 // filesAreDifferent checks if two files have different content
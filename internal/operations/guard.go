@@ -0,0 +1,244 @@
+package operations
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+	"github.com/HammerSpb/aipaca/pkg/gitutil"
+)
+
+// strippedFile records, in the git directory, the index entries a guard
+// took out of a commit so that the post-commit hook can put them back
+const strippedFile = "aipaca-stripped"
+
+// GuardOptions contains options for checking a commit or push for AI files
+type GuardOptions struct {
+	RepoPath string
+
+	// Push lists the refs being pushed; the files their new commits add or
+	// change are checked instead of the staged files
+	Push []gitutil.PushRef
+
+	// AutoClean takes the AI files out of the commit instead of rejecting
+	// it. They are staged again by RestoreStripped after the commit.
+	AutoClean bool
+}
+
+// GuardResult contains the result of a guard check
+type GuardResult struct {
+	Root     string   // Work tree root
+	Allowed  bool     // The repo lets AI files be committed (commit_ai_files)
+	Files    []string // AI files staged or pushed, relative to Root
+	Stripped bool     // Files were taken out of the commit (AutoClean)
+
+	// OnlyAIFiles is set when AutoClean would have left nothing to commit;
+	// the files are then left staged and the commit rejected
+	OnlyAIFiles bool
+}
+
+// Blocked reports whether the commit or push must not go ahead
+func (r *GuardResult) Blocked() bool {
+	return !r.Allowed && len(r.Files) > 0 && !r.Stripped
+}
+
+// Guard checks the staged files, or the pushed commits, of a repository
+// for AI files: files matching the AI patterns and files aipaca manages
+// there. Repos with commit_ai_files set are allowed to have them.
+func Guard(cfg *config.Config, opts GuardOptions) (*GuardResult, error) {
+	root, err := gitRoot(opts.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+	result := &GuardResult{Root: root, Allowed: cfg.ForRepo(root).CommitAIFiles}
+
+	// A record left by a commit that never completed is out of date
+	if opts.Push == nil {
+		if err := removeStripped(root); err != nil {
+			return nil, err
+		}
+	}
+	if result.Allowed {
+		return result, nil
+	}
+
+	var files []string
+	if opts.Push != nil {
+		for _, ref := range opts.Push {
+			pushed, err := gitutil.PushedFiles(root, ref)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, pushed...)
+		}
+	} else {
+		files, err = gitutil.StagedFiles(root)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	managed, err := managedUnder(cfg, root)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, f := range files {
+		if seen[f] {
+			continue
+		}
+		seen[f] = true
+		if managed[f] || fileutil.IsAIFile(filepath.ToSlash(f), cfg.AIPatterns) {
+			result.Files = append(result.Files, f)
+		}
+	}
+	sort.Strings(result.Files)
+
+	if opts.AutoClean && opts.Push == nil && len(result.Files) > 0 {
+		if err := stripFiles(root, result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// stripFiles takes the AI files of result out of the index, recording
+// their entries for RestoreStripped, unless nothing else is staged
+func stripFiles(root string, result *GuardResult) error {
+	entries, err := gitutil.IndexEntries(root, result.Files)
+	if err != nil {
+		return err
+	}
+	if err := gitutil.Unstage(root, result.Files); err != nil {
+		return err
+	}
+
+	left, err := gitutil.HasStagedChanges(root)
+	if err != nil {
+		return err
+	}
+	if !left {
+		result.OnlyAIFiles = true
+		return gitutil.SetIndexEntries(root, entries)
+	}
+
+	path, err := strippedPath(root)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, entries, 0644); err != nil {
+		if restoreErr := gitutil.SetIndexEntries(root, entries); restoreErr != nil {
+			return fmt.Errorf("failed to record unstaged files: %w (and failed to stage them again: %v)", err, restoreErr)
+		}
+		return fmt.Errorf("failed to record unstaged files: %w", err)
+	}
+	result.Stripped = true
+	return nil
+}
+
+// RestoreStripped stages again the files a guard took out of the last
+// commit with AutoClean, and returns them
+func RestoreStripped(repoPath string) ([]string, error) {
+	root, err := gitRoot(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	path, err := strippedPath(root)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read unstaged files: %w", err)
+	}
+	if err := gitutil.SetIndexEntries(root, entries); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+
+	var files []string
+	for _, entry := range bytes.Split(entries, []byte{0}) {
+		if _, p, ok := bytes.Cut(entry, []byte{'\t'}); ok {
+			files = append(files, filepath.FromSlash(string(p)))
+		}
+	}
+	return files, nil
+}
+
+// removeStripped drops the record of files taken out of a commit
+func removeStripped(root string) error {
+	path, err := strippedPath(root)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	return nil
+}
+
+// strippedPath returns where the files taken out of a commit are recorded
+func strippedPath(root string) (string, error) {
+	gitDir, err := gitutil.GitDir(root)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(gitDir, strippedFile), nil
+}
+
+// managedUnder returns the files aipaca manages inside the work tree at
+// root, relative to root
+func managedUnder(cfg *config.Config, root string) (map[string]bool, error) {
+	states, err := storage.New(cfg).ListRepoStates()
+	if err != nil {
+		return nil, err
+	}
+
+	managed := make(map[string]bool)
+	for repoPath, state := range states {
+		if repoPath != root && !strings.HasPrefix(repoPath, root+string(filepath.Separator)) {
+			continue
+		}
+		for relPath := range state.Managed {
+			rel, err := filepath.Rel(root, filepath.Join(repoPath, relPath))
+			if err != nil {
+				return nil, err
+			}
+			managed[rel] = true
+		}
+	}
+	return managed, nil
+}
+
+// gitRoot returns the root of the work tree holding repoPath (the current
+// directory when empty)
+func gitRoot(repoPath string) (string, error) {
+	if repoPath == "" {
+		var err error
+		repoPath, err = os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("failed to get current directory: %w", err)
+		}
+	}
+
+	root, err := gitutil.FindRoot(repoPath)
+	if err != nil {
+		return "", err
+	}
+	if root == "" {
+		return "", fmt.Errorf("%s is not in a git repository", repoPath)
+	}
+	return root, nil
+}
@@ -0,0 +1,192 @@
+package operations
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/HammerSpb/aipaca/pkg/gitutil"
+)
+
+// HooksOptions contains options for installing the aipaca git hooks. Each
+// kind of hook is installed only when asked for; hooks of a kind not asked
+// for are left as they are.
+type HooksOptions struct {
+	RepoPath   string
+	Executable string // aipaca binary the hooks run, found on PATH if missing
+
+	// Guard installs pre-commit and pre-push hooks running 'aipaca guard'
+	Guard bool
+
+	// AutoClean makes the pre-commit hook take AI files out of commits
+	// instead of rejecting them, with a post-commit hook staging them again
+	AutoClean bool
+
+	// BranchProfiles adds a post-checkout hook running 'aipaca switch', so
+	// the profile of a branch is applied when it is checked out, and
+	// NoBranchProfiles removes it
+	BranchProfiles   bool
+	NoBranchProfiles bool
+}
+
+// HooksResult contains the result of installing or removing git hooks
+type HooksResult struct {
+	Root     string
+	HooksDir string
+	Hooks    []string // Hooks installed or removed
+	Removed  []string // Hooks removed while installing others
+	Chained  []string // Existing hooks the aipaca hooks run afterwards
+}
+
+// InstallHooks installs the hooks opts asks for: pre-commit and pre-push
+// hooks that run 'aipaca guard', and a post-checkout hook that runs
+// 'aipaca switch'. Hooks already there are kept and run afterwards.
+func InstallHooks(opts HooksOptions) (*HooksResult, error) {
+	switch {
+	case opts.AutoClean && !opts.Guard:
+		return nil, fmt.Errorf("auto-clean is a mode of the guard hooks, which are not being installed")
+	case opts.BranchProfiles && opts.NoBranchProfiles:
+		return nil, fmt.Errorf("cannot both install and remove the branch profiles hook")
+	case !opts.Guard && !opts.BranchProfiles && !opts.NoBranchProfiles:
+		return nil, fmt.Errorf("no hooks to install")
+	}
+
+	root, err := gitRoot(opts.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := gitutil.HooksDir(root)
+	if err != nil {
+		return nil, err
+	}
+	result := &HooksResult{Root: root, HooksDir: dir}
+
+	var hooks, remove []string
+	if opts.Guard {
+		hooks = append(hooks, "pre-commit", "pre-push")
+		// The post-commit hook belongs to the guard's auto-clean mode
+		if opts.AutoClean {
+			hooks = append(hooks, "post-commit")
+		} else {
+			remove = append(remove, "post-commit")
+		}
+	}
+	if opts.BranchProfiles {
+		hooks = append(hooks, "post-checkout")
+	}
+	if opts.NoBranchProfiles {
+		remove = append(remove, "post-checkout")
+	}
+
+	for _, name := range remove {
+		removed, err := gitutil.RemoveHook(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		if removed {
+			result.Removed = append(result.Removed, name)
+		}
+	}
+
+	for _, name := range hooks {
+		chained, err := gitutil.InstallHook(dir, name, hookScript(name, opts.Executable, opts.AutoClean))
+		if err != nil {
+			return nil, err
+		}
+		result.Hooks = append(result.Hooks, name)
+		if chained {
+			result.Chained = append(result.Chained, name)
+		}
+	}
+	return result, nil
+}
+
+// UninstallHooks removes the hooks installed by InstallHooks, putting back
+// the hooks they chained to
+func UninstallHooks(repoPath string) (*HooksResult, error) {
+	root, err := gitRoot(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := gitutil.HooksDir(root)
+	if err != nil {
+		return nil, err
+	}
+	result := &HooksResult{Root: root, HooksDir: dir}
+
+	for _, name := range []string{"pre-commit", "pre-push", "post-commit", "post-checkout"} {
+		chainedPath := gitutil.ChainedHookPath(filepath.Join(dir, name))
+		_, statErr := os.Lstat(chainedPath)
+
+		removed, err := gitutil.RemoveHook(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		if removed {
+			result.Hooks = append(result.Hooks, name)
+			if statErr == nil {
+				result.Chained = append(result.Chained, name)
+			}
+		}
+	}
+	return result, nil
+}
+
+// hookScript returns the script of a hook running 'aipaca guard', or
+// 'aipaca switch' for post-checkout. Without aipaca on the machine the
+// hook only warns.
+func hookScript(name, executable string, autoClean bool) string {
+	var sb strings.Builder
+	sb.WriteString("#!/bin/sh\n")
+	fmt.Fprintf(&sb, "%s %s\n", gitutil.HookMarker, name)
+	sb.WriteString("# Installed by 'aipaca git install-hooks'. 'aipaca git uninstall-hooks'\n")
+	sb.WriteString("# removes it and puts back the hook it runs afterwards, if any.\n\n")
+
+	stdin := ""
+	if name == "pre-push" {
+		// Both the guard and the chained hook read the pushed refs
+		sb.WriteString("input=$(mktemp) || exit 1\n")
+		sb.WriteString("trap 'rm -f \"$input\"' EXIT\n")
+		sb.WriteString("cat > \"$input\"\n\n")
+		stdin = ` < "$input"`
+	}
+
+	args := "guard --hook " + name
+	cond := ""
+	missing := "not checking for AI files"
+	check := " || exit 1"
+	switch name {
+	case "pre-commit":
+		if autoClean {
+			args += " --auto-clean"
+		}
+	case "post-commit":
+		check = "" // Too late to stop anything
+	case "post-checkout":
+		// Only branch checkouts switch profiles, not checkouts of files
+		args = "switch --hook " + name
+		cond = ` && [ "$3" = 1 ]`
+		missing = "not switching profiles"
+		check = ""
+	}
+
+	fmt.Fprintf(&sb, "aipaca=%s\n", shellQuote(executable))
+	sb.WriteString("[ -x \"$aipaca\" ] || aipaca=$(command -v aipaca) || aipaca=\n")
+	fmt.Fprintf(&sb, "if [ -n \"$aipaca\" ]%s; then\n", cond)
+	fmt.Fprintf(&sb, "\t\"$aipaca\" %s%s%s\n", args, stdin, check)
+	sb.WriteString("elif [ -z \"$aipaca\" ]; then\n")
+	fmt.Fprintf(&sb, "\techo \"aipaca not found; %s\" >&2\n", missing)
+	sb.WriteString("fi\n\n")
+
+	fmt.Fprintf(&sb, "chained=\"%s\"\n", gitutil.ChainedHookPath("$0"))
+	sb.WriteString("if [ -x \"$chained\" ]; then\n")
+	fmt.Fprintf(&sb, "\t\"$chained\" \"$@\"%s || exit $?\n", stdin)
+	sb.WriteString("fi\n")
+	return sb.String()
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,86 @@
+package operations
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// newTestGitRepo returns a fresh git repository
+func newTestGitRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	repo := t.TempDir()
+	cmd := exec.Command("git", "init", "-q")
+	cmd.Dir = repo
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+	return repo
+}
+
+// installedHooks returns the hooks present in a repo
+func installedHooks(t *testing.T, repo string) []string {
+	t.Helper()
+	var hooks []string
+	for _, name := range []string{"pre-commit", "pre-push", "post-commit", "post-checkout"} {
+		if _, err := os.Stat(filepath.Join(repo, ".git", "hooks", name)); err == nil {
+			hooks = append(hooks, name)
+		}
+	}
+	return hooks
+}
+
+func TestInstallHooks(t *testing.T) {
+	repo := newTestGitRepo(t)
+	steps := []struct {
+		name string
+		opts HooksOptions
+		want []string
+	}{
+		{"branch profiles only", HooksOptions{BranchProfiles: true}, []string{"post-checkout"}},
+		{"guard keeps branch profiles", HooksOptions{Guard: true}, []string{"pre-commit", "pre-push", "post-checkout"}},
+		{"auto-clean", HooksOptions{Guard: true, AutoClean: true}, []string{"pre-commit", "pre-push", "post-commit", "post-checkout"}},
+		{"back to rejecting", HooksOptions{Guard: true}, []string{"pre-commit", "pre-push", "post-checkout"}},
+		{"no branch profiles", HooksOptions{NoBranchProfiles: true}, []string{"pre-commit", "pre-push"}},
+	}
+	for _, step := range steps {
+		step.opts.RepoPath = repo
+		step.opts.Executable = "/usr/local/bin/aipaca"
+		if _, err := InstallHooks(step.opts); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := installedHooks(t, repo); !slices.Equal(got, step.want) {
+			t.Errorf("%s: hooks = %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	result, err := UninstallHooks(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Hooks) != 2 || len(installedHooks(t, repo)) != 0 {
+		t.Errorf("UninstallHooks() removed %v, left %v", result.Hooks, installedHooks(t, repo))
+	}
+}
+
+func TestInstallHooksInvalid(t *testing.T) {
+	repo := newTestGitRepo(t)
+	for _, opts := range []HooksOptions{
+		{},
+		{AutoClean: true},
+		{Guard: true, BranchProfiles: true, NoBranchProfiles: true},
+	} {
+		opts.RepoPath = repo
+		if _, err := InstallHooks(opts); err == nil {
+			t.Errorf("InstallHooks(%+v): want error", opts)
+		}
+	}
+	if got := installedHooks(t, repo); len(got) != 0 {
+		t.Errorf("invalid installs left hooks %v", got)
+	}
+}
@@ -0,0 +1,118 @@
+package operations
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/blocks"
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+)
+
+// managedFiles returns the files aipaca manages in a repo, with their
+// checksums as written. States recorded before files were tracked get the
+// files of the applied profiles, without checksums.
+func managedFiles(cfg *config.Config, store *storage.Storage, repoPath string, state *storage.RepoState) (map[string]string, error) {
+	if state == nil {
+		return nil, nil
+	}
+	if state.Managed != nil || state.AppliedProfile == "" {
+		return state.Managed, nil
+	}
+
+	applied, err := AppliedTree(cfg, store, repoPath, state)
+	if err != nil {
+		return nil, err
+	}
+	managed := make(map[string]string, len(applied.Files))
+	for relPath := range applied.Files {
+		managed[relPath] = ""
+	}
+	return managed, nil
+}
+
+// composedChecksums returns the checksums of the files of a composition as
+// they are written to a repo
+func composedChecksums(comp *storage.Composition) (map[string]string, error) {
+	sums := make(map[string]string, len(comp.Files))
+	for relPath, f := range comp.Files {
+		if !f.Generated() {
+			sum, err := managedChecksum(f.Sources[len(f.Sources)-1])
+			if err != nil {
+				return nil, fmt.Errorf("failed to checksum %s: %w", relPath, err)
+			}
+			sums[relPath] = sum
+			continue
+		}
+
+		data, err := f.Content()
+		if err != nil {
+			return nil, err
+		}
+		sums[relPath] = contentChecksum(data)
+	}
+	return sums, nil
+}
+
+// fileChecksums returns the checksums of files (relative path -> full path)
+func fileChecksums(files map[string]string) (map[string]string, error) {
+	sums := make(map[string]string, len(files))
+	for relPath, fullPath := range files {
+		sum, err := managedChecksum(fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to checksum %s: %w", relPath, err)
+		}
+		sums[relPath] = sum
+	}
+	return sums, nil
+}
+
+// existingManaged returns the managed files still present in the repo, and
+// those of them changed since aipaca wrote them
+func existingManaged(repoPath string, managed map[string]string) (existing, modified []string, err error) {
+	for relPath, want := range managed {
+		fullPath := filepath.Join(repoPath, relPath)
+		if !fileutil.IsFile(fullPath) {
+			continue
+		}
+		existing = append(existing, relPath)
+
+		if want == "" {
+			continue
+		}
+		have, err := managedChecksum(fullPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to checksum %s: %w", relPath, err)
+		}
+		if have != want {
+			modified = append(modified, relPath)
+		}
+	}
+
+	sort.Strings(existing)
+	sort.Strings(modified)
+	return existing, modified, nil
+}
+
+// managedChecksum returns the checksum of the part of a file aipaca manages
+func managedChecksum(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return contentChecksum(data), nil
+}
+
+// contentChecksum returns the checksum of the part of content aipaca
+// manages: the whole of it, or only the aipaca blocks of a file the user
+// otherwise owns
+func contentChecksum(data []byte) string {
+	text := string(data)
+	if blocks.Has(text) {
+		return fileutil.Checksum([]byte(blocks.Update("", blocks.Parse(text))))
+	}
+	return fileutil.Checksum(data)
+}
@@ -0,0 +1,190 @@
+package operations
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/textdiff"
+)
+
+// FileConflict is a file changed differently on both sides of a merge
+type FileConflict struct {
+	Path    string
+	Profile string // Profile the file belongs to
+	Reason  string
+}
+
+// ConflictError reports the files a merge could not combine
+type ConflictError struct {
+	Conflicts []FileConflict
+	Hint      string // How to go ahead anyway
+}
+
+func (e *ConflictError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d file(s) changed both in the repo and in the profile since it was applied:", len(e.Conflicts))
+	for _, c := range e.Conflicts {
+		fmt.Fprintf(&sb, "\n  %s (profile '%s'): %s", c.Path, c.Profile, c.Reason)
+	}
+	if e.Hint != "" {
+		sb.WriteString("\n" + e.Hint)
+	}
+	return sb.String()
+}
+
+// mergeSide is one version of a file in a three-way merge
+type mergeSide struct {
+	path string // Full path; empty when the file does not exist
+	data []byte
+}
+
+// readSide reads the version of relPath in files, if any
+func readSide(files map[string]string, relPath string) (mergeSide, error) {
+	fullPath, ok := files[relPath]
+	if !ok {
+		return mergeSide{}, nil
+	}
+	data, err := os.ReadFile(fullPath)
+	if err != nil {
+		return mergeSide{}, fmt.Errorf("failed to read %s: %w", relPath, err)
+	}
+	return mergeSide{path: fullPath, data: data}, nil
+}
+
+func (s mergeSide) exists() bool {
+	return s.path != ""
+}
+
+func (s mergeSide) equal(other mergeSide) bool {
+	return s.exists() == other.exists() && bytes.Equal(s.data, other.data)
+}
+
+// merge3Files three-way merges two sets of files (relative path -> full
+// path) that both started out as base. Files changed on one side only take
+// that side; text files changed on both are merged line by line, and
+// merged content is written under tmpDir. With markers, conflicting lines
+// are kept between conflict markers and a file deleted on one side but
+// changed on the other keeps its changes. Without markers, out is nil when
+// there are conflicts. Merged lists the files that combine changes of both
+// sides.
+func merge3Files(base, ours, theirs map[string]string, oursLabel, theirsLabel, tmpDir string, markers bool) (out map[string]string, merged []string, conflicts []FileConflict, err error) {
+	paths := make(map[string]bool, len(theirs))
+	for _, files := range []map[string]string{base, ours, theirs} {
+		for relPath := range files {
+			paths[relPath] = true
+		}
+	}
+
+	out = make(map[string]string, len(paths))
+	for relPath := range paths {
+		b, err := readSide(base, relPath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		o, err := readSide(ours, relPath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		t, err := readSide(theirs, relPath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		// Changed on one side only, or the same way on both
+		var take mergeSide
+		switch {
+		case o.equal(t), t.equal(b):
+			take = o
+		case o.equal(b):
+			take = t
+		case !o.exists() || !t.exists():
+			deleted, changed, kept := oursLabel, theirsLabel, t
+			if !t.exists() {
+				deleted, changed, kept = theirsLabel, oursLabel, o
+			}
+			reason := fmt.Sprintf("deleted in %s, changed in %s", deleted, changed)
+			conflicts = append(conflicts, FileConflict{Path: relPath, Reason: reason})
+			take = kept
+		case isBinary(o.data) || isBinary(t.data) || isBinary(b.data):
+			conflicts = append(conflicts, FileConflict{Path: relPath, Reason: "binary file changed on both sides"})
+			take = o
+		default:
+			lines, n := textdiff.Merge3(
+				textdiff.SplitLines(string(b.data)),
+				textdiff.SplitLines(string(o.data)),
+				textdiff.SplitLines(string(t.data)),
+				oursLabel, theirsLabel,
+			)
+			if n > 0 {
+				conflicts = append(conflicts, FileConflict{Path: relPath, Reason: fmt.Sprintf("%d conflicting change(s)", n)})
+			} else {
+				merged = append(merged, relPath)
+			}
+
+			tmpPath := filepath.Join(tmpDir, relPath)
+			if err := os.MkdirAll(filepath.Dir(tmpPath), 0755); err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to create temp directory: %w", err)
+			}
+			if err := os.WriteFile(tmpPath, []byte(strings.Join(lines, "")), 0644); err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to write merged %s: %w", relPath, err)
+			}
+			take = mergeSide{path: tmpPath}
+		}
+
+		if take.exists() {
+			out[relPath] = take.path
+		}
+	}
+
+	sort.Strings(merged)
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Path < conflicts[j].Path })
+	if len(conflicts) > 0 && !markers {
+		return nil, merged, conflicts, nil
+	}
+	return out, merged, conflicts, nil
+}
+
+// mergeProfileChanges merges the changes made to a profile since it was
+// applied (snapshot) into the files about to be saved to it. Without a
+// snapshot, or when the profile is unchanged, files are returned as they
+// are.
+func mergeProfileChanges(store *storage.Storage, profile, snapshot string, files map[string]string, tmpDir string, markers bool) (out map[string]string, merged []string, conflicts []FileConflict, err error) {
+	if !store.SnapshotExists(profile, snapshot) {
+		return files, nil, nil, nil
+	}
+	hash, err := store.ProfileHash(profile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if hash == snapshot {
+		return files, nil, nil, nil
+	}
+
+	base, err := store.SnapshotFiles(profile, snapshot)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	current, err := store.GetProfileFiles(profile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	theirs := make(map[string]string, len(current))
+	for _, relPath := range current {
+		theirs[relPath] = filepath.Join(store.ProfilePath(profile), relPath)
+	}
+
+	mergeDir, err := os.MkdirTemp(tmpDir, "merge-")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	out, merged, conflicts, err = merge3Files(base, files, theirs, "repo", "profile "+profile, mergeDir, markers)
+	for i := range conflicts {
+		conflicts[i].Profile = profile
+	}
+	return out, merged, conflicts, err
+}
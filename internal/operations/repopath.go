@@ -0,0 +1,71 @@
+package operations
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+	"github.com/HammerSpb/aipaca/pkg/gitutil"
+)
+
+// ResolveRepoPath returns the absolute path of the repository at path (the
+// current directory when empty). Inside a git repository that is the root
+// of the work tree, so a command run from a subdirectory works on the
+// whole repo; linked worktrees and submodules are repos of their own.
+// Outside git, or with cfg.NoGitRoot, it is path itself.
+func ResolveRepoPath(cfg *config.Config, path string) (string, error) {
+	if path == "" {
+		var err error
+		path, err = os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("failed to get current directory: %w", err)
+		}
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve repo path: %w", err)
+	}
+	if cfg.NoGitRoot || !fileutil.IsDir(absPath) {
+		return absPath, nil
+	}
+
+	root, err := gitutil.FindRoot(absPath)
+	if err != nil {
+		return "", err
+	}
+	if root == "" {
+		return absPath, nil
+	}
+	warnSubdirStates(cfg, root)
+	return root, nil
+}
+
+// warnSubdirStates warns about the states of a repo without one recorded
+// for its root, kept under its subdirectories by versions that did not
+// resolve the root. Their files are relative to the subdirectory, so they
+// cannot move to the root; --no-git-root still reaches them.
+func warnSubdirStates(cfg *config.Config, root string) {
+	states, err := storage.New(cfg).ListRepoStates()
+	if err != nil || states[root] != nil {
+		return
+	}
+	var subdirs []string
+	for path := range states {
+		if !strings.HasPrefix(path, root+string(filepath.Separator)) || !fileutil.IsDir(path) {
+			continue
+		}
+		// Nested worktrees and submodules are repos of their own
+		if owner, err := gitutil.FindRoot(path); err == nil && owner == root {
+			subdirs = append(subdirs, path)
+		}
+	}
+	sort.Strings(subdirs)
+	for _, path := range subdirs {
+		storage.Warnf("the state of %s is recorded for its subdirectory %s; run commands there with --no-git-root to reach it", root, path)
+	}
+}
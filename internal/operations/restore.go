@@ -2,8 +2,7 @@ package operations
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
+	"sort"
 
 	"github.com/HammerSpb/aipaca/internal/config"
 	"github.com/HammerSpb/aipaca/internal/storage"
@@ -13,16 +12,22 @@ import (
 // RestoreOptions contains options for the restore operation
 type RestoreOptions struct {
 	RepoPath   string
-	BackupName string // Specific backup to restore (empty = latest for this repo)
+	BackupName string // Specific backup to restore (empty = baseline for this repo)
+	Step       bool   // Undo only the most recent operation
 	DryRun     bool
+	All        bool // Remove every AI file first, not only those aipaca manages
 }
 
 // RestoreResult contains the result of a restore operation
 type RestoreResult struct {
-	BackupName     string
-	FilesRestored  []string
-	FilesRemoved   []string
-	PreviousState  string // Previous applied profile
+	BackupName    string
+	FilesRestored []string
+	FilesRemoved  []string
+	Unmanaged     []string // AI files left in place because aipaca does not manage them
+	PreviousState string   // Previous applied profile
+	Step          bool     // Only the most recent operation was undone
+	NowApplied    string   // Profile applied after stepping back
+	LayersLeft    int      // Operations that can still be stepped back
 }
 
 // Restore restores original AI files from backup
@@ -31,56 +36,104 @@ func Restore(cfg *config.Config, opts RestoreOptions) (*RestoreResult, error) {
 	result := &RestoreResult{}
 
 	// Resolve repo path
-	repoPath := opts.RepoPath
-	if repoPath == "" {
-		var err error
-		repoPath, err = os.Getwd()
+	repoPath, err := ResolveRepoPath(cfg, opts.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hold the repo for the whole operation; a dry run only reads
+	if !opts.DryRun {
+		lock, err := store.LockRepo(repoPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get current directory: %w", err)
+			return nil, err
 		}
+		defer lock.Release()
 	}
-	repoPath, err := filepath.Abs(repoPath)
+
+	// Determine which backup to restore. By default that is the baseline
+	// (the original files); --step only undoes the most recent operation.
+	state, err := store.GetRepoState(repoPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve repo path: %w", err)
+		return nil, fmt.Errorf("failed to get repo state: %w", err)
 	}
 
-	// Determine which backup to restore
 	backupName := opts.BackupName
+	var nextState *storage.RepoState
 	if backupName == "" {
-		// Get backup from repo state
-		state, err := store.GetRepoState(repoPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get repo state: %w", err)
-		}
-		if state == nil || state.BackupPath == "" {
+		if state == nil || state.Baseline == nil {
 			return nil, fmt.Errorf("no backup found for this repository")
 		}
-		backupName = state.BackupPath
 		result.PreviousState = state.AppliedProfile
-	}
 
-	result.BackupName = backupName
+		layer := *state.Baseline
+		if opts.Step {
+			layer, nextState = storage.PopRepoState(state)
+			result.Step = true
+			if nextState != nil {
+				result.NowApplied = nextState.AppliedProfile
+				result.LayersLeft = len(nextState.Stack) + 1
+			}
+		}
 
-	// Verify backup exists
-	backup, err := store.GetBackup(backupName)
-	if err != nil {
-		return nil, fmt.Errorf("backup not found: %w", err)
+		if layer.NoBackup {
+			return nil, fmt.Errorf("the %s at %s ran with --no-backup, there is nothing to restore", layer.Operation, layer.At.Format("2006-01-02 15:04:05"))
+		}
+		backupName = layer.Backup
 	}
 
-	// Get files that will be restored
-	restoredFiles, err := fileutil.ListAllFiles(backup.Path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to list backup files: %w", err)
-	}
-	result.FilesRestored = restoredFiles
+	// An empty layer backup means the repo had no AI files at that point
+	if backupName != "" {
+		// Verify backup exists (it may be given by name or manifest ID)
+		backup, err := store.GetBackup(backupName)
+		if err != nil {
+			return nil, fmt.Errorf("backup not found: %w", err)
+		}
+		backupName = backup.Name
 
-	// Get existing AI files that will be removed
-	existingFiles, err := fileutil.ExpandPatterns(repoPath, cfg.AIPatterns)
-	if err != nil {
-		return nil, fmt.Errorf("failed to find existing AI files: %w", err)
+		// Get files that will be restored
+		restoredFiles, err := store.GetBackupFiles(backupName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list backup files: %w", err)
+		}
+		result.FilesRestored = restoredFiles
 	}
-	for relPath := range existingFiles {
-		result.FilesRemoved = append(result.FilesRemoved, relPath)
+	result.BackupName = backupName
+
+	// Get existing files that will be removed: the ones aipaca manages, or
+	// every AI file
+	if opts.All {
+		existingFiles, err := fileutil.ExpandPatterns(repoPath, cfg.AIPatterns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find existing AI files: %w", err)
+		}
+		for relPath := range existingFiles {
+			result.FilesRemoved = append(result.FilesRemoved, relPath)
+		}
+		sort.Strings(result.FilesRemoved)
+	} else {
+		managed, err := managedFiles(cfg, store, repoPath, state)
+		if err != nil {
+			return nil, err
+		}
+		result.FilesRemoved, _, err = existingManaged(repoPath, managed)
+		if err != nil {
+			return nil, err
+		}
+
+		repoTree, err := RepoTree(repoPath, cfg.AIPatterns)
+		if err != nil {
+			return nil, err
+		}
+		restored := make(map[string]bool, len(result.FilesRestored))
+		for _, relPath := range result.FilesRestored {
+			restored[relPath] = true
+		}
+		for relPath := range repoTree.Files {
+			if _, ok := managed[relPath]; !ok && !restored[relPath] {
+				result.Unmanaged = append(result.Unmanaged, relPath)
+			}
+		}
+		sort.Strings(result.Unmanaged)
 	}
 
 	// If dry run, return here
@@ -88,15 +141,28 @@ func Restore(cfg *config.Config, opts RestoreOptions) (*RestoreResult, error) {
 		return result, nil
 	}
 
-	// Restore the backup
-	if err := store.RestoreBackup(backupName, repoPath, cfg.AIPatterns); err != nil {
-		return nil, fmt.Errorf("failed to restore backup: %w", err)
+	// Restore the backup and update the repo state in one transaction
+	txn, err := store.BeginTransaction("restore", repoPath)
+	if err != nil {
+		return nil, err
 	}
+	defer txn.Abort()
 
-	// Clear the repo state
-	if err := store.ClearRepoState(repoPath); err != nil {
-		return nil, fmt.Errorf("failed to clear repo state: %w", err)
+	if backupName != "" {
+		if err := store.RestoreBackup(backupName, txn, result.FilesRemoved); err != nil {
+			return nil, fmt.Errorf("failed to stage backup: %w", err)
+		}
+	} else {
+		for _, relPath := range result.FilesRemoved {
+			txn.Remove(relPath)
+		}
+	}
+	txn.RecordState(repoPath, nextState)
+
+	if err := txn.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to restore backup: %w", err)
 	}
+	fileutil.RemoveEmptyParents(repoPath, result.FilesRemoved)
 
 	return result, nil
 }
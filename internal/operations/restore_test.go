@@ -0,0 +1,118 @@
+package operations
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+)
+
+// readFiles returns the content of every file under dir
+func readFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(relPath)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// newStackedRepo returns a repo with files of its own, and the profiles go
+// and web to apply to it
+func newStackedRepo(t *testing.T, cfg *config.Config) string {
+	t.Helper()
+	newTestProfile(t, cfg, "go", map[string]string{
+		"CLAUDE.md":             "go\n",
+		".claude/settings.json": `{"go": true}`,
+	})
+	newTestProfile(t, cfg, "web", map[string]string{
+		"CLAUDE.md":      "web\n",
+		".cursor/web.md": "web rules\n",
+	})
+	repo := t.TempDir()
+	writeFiles(t, repo, map[string]string{
+		"CLAUDE.md":       "mine\n",
+		".claude/mine.md": "my notes\n",
+		"main.go":         "package main\n",
+	})
+	return repo
+}
+
+func TestRestoreBaseline(t *testing.T) {
+	cfg := newTestConfig(t)
+	repo := newStackedRepo(t, cfg)
+	original := readFiles(t, repo)
+
+	for _, profile := range []string{"go", "web"} {
+		if _, err := Apply(cfg, ApplyOptions{ProfileName: profile, RepoPath: repo}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readFiles(t, repo)["CLAUDE.md"]; got != "web\n" {
+		t.Fatalf("CLAUDE.md after apply = %q", got)
+	}
+
+	if _, err := Restore(cfg, RestoreOptions{RepoPath: repo}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFiles(t, repo); !maps.Equal(got, original) {
+		t.Errorf("files after restore = %v, want %v", got, original)
+	}
+	state, err := storage.New(cfg).GetRepoState(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != nil {
+		t.Errorf("state after restore = %+v, want none", state)
+	}
+}
+
+func TestRestoreStep(t *testing.T) {
+	cfg := newTestConfig(t)
+	repo := newStackedRepo(t, cfg)
+	trees := []map[string]string{readFiles(t, repo)}
+
+	for _, profile := range []string{"go", "web"} {
+		if _, err := Apply(cfg, ApplyOptions{ProfileName: profile, RepoPath: repo}); err != nil {
+			t.Fatal(err)
+		}
+		trees = append(trees, readFiles(t, repo))
+	}
+
+	store := storage.New(cfg)
+	for depth, applied := range []string{"go", ""} {
+		result, err := Restore(cfg, RestoreOptions{RepoPath: repo, Step: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := trees[len(trees)-2-depth]
+		if got := readFiles(t, repo); !maps.Equal(got, want) {
+			t.Errorf("step %d: files = %v, want %v", depth+1, got, want)
+		}
+		if result.NowApplied != applied {
+			t.Errorf("step %d: NowApplied = %q, want %q", depth+1, result.NowApplied, applied)
+		}
+		profile, err := store.GetAppliedProfile(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if profile != applied {
+			t.Errorf("step %d: applied profile in state = %q, want %q", depth+1, profile, applied)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package operations
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+)
+
+// RunOptions contains options for applying profiles around a command
+type RunOptions struct {
+	Profiles []string // Profiles to stack, bottom first
+	RepoPath string
+	Command  []string
+	Set      map[string]string // Template variables overriding all others
+}
+
+// RunSession is a set of profiles applied to a repo for the life of a
+// command
+type RunSession struct {
+	Session *storage.Session
+	Apply   *ApplyResult
+}
+
+// EndRunResult contains the result of ending a run session
+type EndRunResult struct {
+	RepoPath      string
+	Steps         int // Operations undone, the session's apply included
+	FilesRemoved  []string
+	FilesRestored []string
+}
+
+// StartRun applies profiles to a repo, with a backup, for the life of a
+// command. The session is recorded before anything is applied, so that a
+// crash leaves a stale session for the next invocation to end.
+func StartRun(cfg *config.Config, opts RunOptions) (*RunSession, error) {
+	store := storage.New(cfg)
+
+	// Resolve repo path
+	repoPath, err := ResolveRepoPath(cfg, opts.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := store.GetRepoState(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repo state: %w", err)
+	}
+	session := &storage.Session{
+		RepoPath:  repoPath,
+		Profiles:  opts.Profiles,
+		Command:   opts.Command,
+		PID:       os.Getpid(),
+		StartedAt: time.Now(),
+		Depth:     state.Depth(),
+	}
+	if err := store.StartSession(session); err != nil {
+		return nil, err
+	}
+
+	applied, err := Apply(cfg, ApplyOptions{
+		Profiles: opts.Profiles,
+		RepoPath: repoPath,
+		Set:      opts.Set,
+	})
+	if err != nil {
+		store.EndSession(session)
+		return nil, err
+	}
+
+	return &RunSession{Session: session, Apply: applied}, nil
+}
+
+// EndRun returns the repo of a run session to its state before the
+// session, stepping back every operation since, and removes the session.
+// On failure the session is kept, for a later invocation to retry.
+func EndRun(cfg *config.Config, session *storage.Session) (*EndRunResult, error) {
+	result, err := stepBack(cfg, session.RepoPath, session.Depth)
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.New(cfg).EndSession(session); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// stepBack undoes the operations on a repo until its state is back at
+// depth (see RepoState.Depth)
+func stepBack(cfg *config.Config, repoPath string, depth int) (*EndRunResult, error) {
+	store := storage.New(cfg)
+	result := &EndRunResult{RepoPath: repoPath}
+
+	for {
+		state, err := store.GetRepoState(repoPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get repo state: %w", err)
+		}
+		if state.Depth() <= depth {
+			break
+		}
+
+		restored, err := Restore(cfg, RestoreOptions{RepoPath: repoPath, Step: true})
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", repoPath, err)
+		}
+		result.Steps++
+		result.FilesRemoved = append(result.FilesRemoved, restored.FilesRemoved...)
+		result.FilesRestored = append(result.FilesRestored, restored.FilesRestored...)
+	}
+
+	// A file removed by one step may come back with an earlier one
+	result.FilesRestored = dedupe(result.FilesRestored)
+	restored := make(map[string]bool, len(result.FilesRestored))
+	for _, relPath := range result.FilesRestored {
+		restored[relPath] = true
+	}
+	removed := result.FilesRemoved[:0]
+	for _, relPath := range dedupe(result.FilesRemoved) {
+		if !restored[relPath] {
+			removed = append(removed, relPath)
+		}
+	}
+	result.FilesRemoved = removed
+
+	return result, nil
+}
@@ -1,13 +1,18 @@
 package operations
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/HammerSpb/aipaca/internal/config"
 	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/blocks"
 	"github.com/HammerSpb/aipaca/pkg/fileutil"
+	"github.com/HammerSpb/aipaca/pkg/merge"
 )
 
 // SaveOptions contains options for the save operation
@@ -16,7 +21,12 @@ type SaveOptions struct {
 	AsName      string // Save as new profile with this name
 	RepoPath    string
 	DryRun      bool
-	Force       bool
+	Force       bool // Also overwrite changes made to the profile since it was applied
+	NoBackup    bool
+
+	// ConflictMarkers saves files changed both in the repo and in the
+	// profile with conflict markers instead of refusing to save
+	ConflictMarkers bool
 }
 
 // SaveResult contains the result of a save operation
@@ -24,6 +34,33 @@ type SaveResult struct {
 	ProfileName string
 	FilesSaved  []string
 	IsNew       bool
+	BackupName  string
+	Version     int // Profile version after the save
+
+	// Changed is false when the profiles already matched the repo, so the
+	// save had nothing to write
+	Changed bool
+
+	// Merged lists the files that combine repo changes with changes made to
+	// the profile since it was applied; Conflicts those that could not be
+	// combined
+	Merged    []string
+	Conflicts []FileConflict
+
+	// Layers is set when the repo has stacked profiles applied and the
+	// files were saved back to the layers that own them
+	Layers []SavedLayer
+}
+
+// SavedLayer is the part of a layered save that went to one profile
+type SavedLayer struct {
+	Profile    string
+	Files      []string // Repo files owned by this layer
+	Changed    bool     // False when the profile already matched the repo
+	BackupName string
+	Version    int
+	Merged     []string
+	Conflicts  []FileConflict
 }
 
 // Save saves repo AI files to a profile
@@ -32,17 +69,18 @@ func Save(cfg *config.Config, opts SaveOptions) (*SaveResult, error) {
 	result := &SaveResult{}
 
 	// Resolve repo path
-	repoPath := opts.RepoPath
-	if repoPath == "" {
-		var err error
-		repoPath, err = os.Getwd()
+	repoPath, err := ResolveRepoPath(cfg, opts.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hold the repo for the whole operation; a dry run only reads
+	if !opts.DryRun {
+		lock, err := store.LockRepo(repoPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get current directory: %w", err)
+			return nil, err
 		}
-	}
-	repoPath, err := filepath.Abs(repoPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to resolve repo path: %w", err)
+		defer lock.Release()
 	}
 
 	// Determine target profile name
@@ -52,16 +90,20 @@ func Save(cfg *config.Config, opts SaveOptions) (*SaveResult, error) {
 		result.IsNew = true
 	}
 
-	// If no profile specified, use currently applied profile
+	// If no profile specified, use currently applied profile. Stacked
+	// profiles each get back the files they own.
 	if profileName == "" {
-		appliedProfile, err := store.GetAppliedProfile(repoPath)
+		state, err := store.GetRepoState(repoPath)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get applied profile: %w", err)
 		}
-		if appliedProfile == "" {
+		if state == nil || state.AppliedProfile == "" {
 			return nil, fmt.Errorf("no profile specified and no profile currently applied to this repo")
 		}
-		profileName = appliedProfile
+		if layers := state.AppliedLayers(); len(layers) > 1 {
+			return saveLayers(cfg, store, repoPath, state, opts)
+		}
+		profileName = state.AppliedProfile
 	}
 
 	result.ProfileName = profileName
@@ -85,16 +127,417 @@ func Save(cfg *config.Config, opts SaveOptions) (*SaveResult, error) {
 	for relPath := range aiFiles {
 		result.FilesSaved = append(result.FilesSaved, relPath)
 	}
+	sort.Strings(result.FilesSaved)
+
+	// Files of the applied profile that were merged or rendered on apply
+	// go back to the profile's own source (see profileFiles), and changes
+	// made to the profile since it was applied are merged in
+	state, err := store.GetRepoState(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repo state: %w", err)
+	}
+	toApplied := state != nil && state.AppliedProfile == profileName && len(state.Layers) == 0
+	var files, saved map[string]string
+	var repoTree *Tree
+	if toApplied {
+		repoTree, err = RepoTree(repoPath, cfg.AIPatterns)
+		if err != nil {
+			return nil, err
+		}
+		applied, err := AppliedTree(cfg, store, repoPath, state)
+		if err != nil {
+			return nil, err
+		}
+		addBlockFiles(applied, repoTree)
+
+		tmpDir, err := os.MkdirTemp("", "aipaca-save-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		saved, err = profileFiles(applied, profileName, repoTree.Files, tmpDir)
+		if err != nil {
+			return nil, err
+		}
+		// Files skipped for this repo are not in it; keep them
+		for _, skipped := range applied.Skipped {
+			if _, ok := saved[skipped.Path]; !ok {
+				saved[skipped.Path] = filepath.Join(store.ProfilePath(profileName), skipped.Path)
+			}
+		}
+
+		files = saved
+		if !opts.Force {
+			files, result.Merged, result.Conflicts, err = mergeProfileChanges(store, profileName, state.Snapshots[profileName], saved, tmpDir, opts.ConflictMarkers)
+			if err != nil {
+				return nil, err
+			}
+			if files == nil && !opts.DryRun {
+				return nil, saveConflictError(result.Conflicts)
+			}
+		}
+	} else {
+		repoTree, err = RepoTree(repoPath, cfg.AIPatterns)
+		if err != nil {
+			return nil, err
+		}
+		files = repoTree.Files
+	}
+
+	// Conflicting changes (no files) count as a change too
+	result.Changed = true
+	if files != nil && store.ProfileExists(profileName) {
+		current, err := store.GetProfileFiles(profileName)
+		if err != nil {
+			return nil, err
+		}
+		result.Changed, err = profileDiffers(store, profileName, current, files)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// If dry run, return here
 	if opts.DryRun {
 		return result, nil
 	}
 
+	// Back up the profile before it is overwritten (unless --no-backup).
+	// A profile that already matches the repo is left as it is.
+	if result.Changed && store.ProfileExists(profileName) && !opts.NoBackup {
+		backupName, err := store.CreateProfileBackup(profileName, repoPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create backup: %w", err)
+		}
+		result.BackupName = backupName
+	}
+
 	// Save to profile
-	if err := store.SaveToProfile(profileName, repoPath, cfg.AIPatterns, opts.Force || !result.IsNew); err != nil {
-		return nil, fmt.Errorf("failed to save profile: %w", err)
+	if toApplied {
+		if result.Changed {
+			if err := store.SaveFilesToProfile(profileName, files); err != nil {
+				return nil, fmt.Errorf("failed to save profile: %w", err)
+			}
+		}
+		if err := snapshotSaved(store, state, profileName, saved); err != nil {
+			return nil, err
+		}
+		if err := markManaged(store, repoPath, state, repoTree.Files); err != nil {
+			return nil, err
+		}
+	} else if result.Changed {
+		if err := store.SaveToProfile(profileName, repoPath, cfg.AIPatterns); err != nil {
+			return nil, fmt.Errorf("failed to save profile: %w", err)
+		}
+	}
+
+	if manifest, err := store.GetProfileManifest(profileName); err == nil {
+		result.Version = manifest.Version
+	}
+
+	return result, nil
+}
+
+// saveLayers saves repo files back to the stacked profiles they were
+// applied from. Files new to the repo go to the top layer, and files a
+// layer provides but a later layer overrides are kept as they are.
+func saveLayers(cfg *config.Config, store *storage.Storage, repoPath string, state *storage.RepoState, opts SaveOptions) (*SaveResult, error) {
+	layers := state.AppliedLayers()
+	top := layers[len(layers)-1]
+	result := &SaveResult{ProfileName: top}
+
+	repoTree, err := RepoTree(repoPath, cfg.AIPatterns)
+	if err != nil {
+		return nil, err
+	}
+	if len(repoTree.Files) == 0 {
+		return nil, fmt.Errorf("no AI files found in repository")
+	}
+
+	applied, err := AppliedTree(cfg, store, repoPath, state)
+	if err != nil {
+		return nil, err
+	}
+	addBlockFiles(applied, repoTree)
+
+	tmpDir, err := os.MkdirTemp("", "aipaca-save-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Group the repo files by owning layer
+	layerFiles := make(map[string]map[string]string, len(layers))
+	for _, layer := range layers {
+		layerFiles[layer] = make(map[string]string)
+	}
+	for relPath, fullPath := range repoTree.Files {
+		owner := applied.Owners[relPath]
+		if owner == "" {
+			owner = top
+		}
+		layerFiles[owner][relPath] = fullPath
+
+		// Every layer with a block in the file saves its own block
+		if f, ok := applied.generated[relPath]; ok && f.Strategy == merge.Block {
+			for _, layer := range f.Layers() {
+				layerFiles[layer][relPath] = fullPath
+			}
+		}
+		result.FilesSaved = append(result.FilesSaved, relPath)
+	}
+	sort.Strings(result.FilesSaved)
+
+	// Work out every layer's files before touching any profile, so that a
+	// conflict in one layer leaves all of them as they are
+	layerSaves := make([]map[string]string, len(layers))
+	var conflicts []FileConflict
+	for i, layer := range layers {
+		saved := SavedLayer{Profile: layer}
+		for relPath := range layerFiles[layer] {
+			saved.Files = append(saved.Files, relPath)
+		}
+		sort.Strings(saved.Files)
+
+		files, err := profileFiles(applied, layer, layerFiles[layer], tmpDir)
+		if err != nil {
+			return nil, err
+		}
+
+		current, err := store.GetProfileFiles(layer)
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := store.GetProfileManifest(layer)
+		if err != nil {
+			return nil, err
+		}
+
+		// Overridden and skipped files are not visible in the repo; keep them
+		for _, relPath := range current {
+			if _, ok := files[relPath]; ok {
+				continue
+			}
+			if target, _ := manifest.TemplateTarget(relPath); applied.Owners[target] != layer {
+				files[relPath] = filepath.Join(store.ProfilePath(layer), relPath)
+			}
+		}
+		layerSaves[i] = files
+
+		if !opts.Force {
+			files, saved.Merged, saved.Conflicts, err = mergeProfileChanges(store, layer, state.Snapshots[layer], files, tmpDir, opts.ConflictMarkers)
+			if err != nil {
+				return nil, err
+			}
+			conflicts = append(conflicts, saved.Conflicts...)
+		}
+
+		if files != nil {
+			saved.Changed, err = profileDiffers(store, layer, current, files)
+			if err != nil {
+				return nil, err
+			}
+		}
+		layerFiles[layer] = files
+		result.Changed = result.Changed || saved.Changed || len(saved.Conflicts) > 0
+		result.Layers = append(result.Layers, saved)
+	}
+	if len(conflicts) > 0 && !opts.ConflictMarkers && !opts.DryRun {
+		return nil, saveConflictError(conflicts)
+	}
+
+	for i, layer := range layers {
+		saved := &result.Layers[i]
+		if saved.Changed && !opts.DryRun {
+			if !opts.NoBackup {
+				saved.BackupName, err = store.CreateProfileBackup(layer, repoPath)
+				if err != nil {
+					return nil, fmt.Errorf("failed to create backup: %w", err)
+				}
+			}
+
+			if err := store.SaveFilesToProfile(layer, layerFiles[layer]); err != nil {
+				return nil, fmt.Errorf("failed to save profile '%s': %w", layer, err)
+			}
+		}
+		if !opts.DryRun {
+			if err := snapshotSaved(store, state, layer, layerSaves[i]); err != nil {
+				return nil, err
+			}
+		}
+
+		if manifest, err := store.GetProfileManifest(layer); err == nil {
+			saved.Version = manifest.Version
+		}
+	}
+
+	if !opts.DryRun {
+		if err := markManaged(store, repoPath, state, repoTree.Files); err != nil {
+			return nil, err
+		}
 	}
 
 	return result, nil
 }
+
+// saveConflictError reports the files that stop a save to profiles that
+// changed since they were applied
+func saveConflictError(conflicts []FileConflict) error {
+	return &ConflictError{
+		Conflicts: conflicts,
+		Hint:      "Use --conflict-markers to save with conflict markers, or --force to overwrite the profile's changes",
+	}
+}
+
+// snapshotSaved records the files saved from the repo to a profile as its
+// new snapshot, so later merges only see profile changes made after now
+func snapshotSaved(store *storage.Storage, state *storage.RepoState, profile string, files map[string]string) error {
+	id, err := store.CreateSnapshot(profile, files)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot profile '%s': %w", profile, err)
+	}
+	if state.Snapshots == nil {
+		state.Snapshots = make(map[string]string)
+	}
+	state.Snapshots[profile] = id
+	return nil
+}
+
+// markManaged records the saved repo files as managed by the applied
+// profiles, so clean and restore treat them as aipaca's
+func markManaged(store *storage.Storage, repoPath string, state *storage.RepoState, files map[string]string) error {
+	managed, err := fileChecksums(files)
+	if err != nil {
+		return err
+	}
+	state.Managed = managed
+	if err := store.SetRepoState(repoPath, state); err != nil {
+		return fmt.Errorf("failed to update repo state: %w", err)
+	}
+	return nil
+}
+
+// profileDiffers reports whether files (relative path -> full path) differ
+// from the current files of a profile
+func profileDiffers(store *storage.Storage, name string, current []string, files map[string]string) (bool, error) {
+	if len(current) != len(files) {
+		return true, nil
+	}
+
+	for _, relPath := range current {
+		fullPath, ok := files[relPath]
+		if !ok {
+			return true, nil
+		}
+		differs, err := filesAreDifferent(filepath.Join(store.ProfilePath(name), relPath), fullPath)
+		if err != nil {
+			return false, err
+		}
+		if differs {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// addBlockFiles adds the files of a repo tree that the applied profiles
+// keep blocks in but that are not AI files, such as AGENTS.md
+func addBlockFiles(applied *Tree, repoTree *Tree) {
+	for relPath, f := range applied.generated {
+		if _, ok := repoTree.Files[relPath]; ok || f.Strategy != merge.Block {
+			continue
+		}
+		fullPath := filepath.Join(repoTree.Name, relPath)
+		if fileutil.IsFile(fullPath) {
+			repoTree.Files[relPath] = fullPath
+		}
+	}
+}
+
+// profileFiles maps repo files (relative path -> full path) that the
+// applied tree generated back to a layer's sources. Unedited files keep the
+// layer's own version, so content merged in from other sources or rendered
+// variable values are not saved into it. Of a file with blocks only the
+// layer's block is saved. Edited templates are turned back into templates
+// in tmpDir. Edited files merged from several sources cannot be told apart
+// from the other sources' content and are refused.
+func profileFiles(applied *Tree, layer string, files map[string]string, tmpDir string) (map[string]string, error) {
+	out := make(map[string]string, len(files))
+	var merged []string
+	for relPath, fullPath := range files {
+		f, ok := applied.generated[relPath]
+		if !ok {
+			out[relPath] = fullPath
+			continue
+		}
+		source, profilePath, ok := f.LayerSource(layer)
+		if !ok {
+			out[relPath] = fullPath
+			continue
+		}
+
+		have, err := os.ReadFile(fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", relPath, err)
+		}
+
+		if f.Strategy == merge.Block {
+			block, found := blocks.Extract(string(have), layer)
+			if !found {
+				// The block was taken out of the repo file; keep the profile's
+				out[source] = profilePath
+				continue
+			}
+			own, err := f.LayerContent(layer)
+			if err != nil {
+				return nil, err
+			}
+			if strings.TrimRight(block, "\n") == strings.TrimRight(string(own), "\n") {
+				out[source] = profilePath
+				continue
+			}
+			have = []byte(block)
+		} else {
+			want, err := applied.Read(relPath)
+			if err != nil {
+				return nil, err
+			}
+			if bytes.Equal(want, have) {
+				out[source] = profilePath
+				continue
+			}
+			if f.Merged() {
+				// Saved whole, the content of the other sources would be
+				// merged in twice on the next apply
+				merged = append(merged, fmt.Sprintf("%s (%s): edit %s instead", relPath, f.Strategy, profilePath))
+				continue
+			}
+			if !f.Rendered() {
+				out[relPath] = fullPath
+				continue
+			}
+		}
+
+		data, err := f.Reverse(layer, have)
+		if err != nil {
+			return nil, err
+		}
+		tmpPath := filepath.Join(tmpDir, layer, source)
+		if err := os.MkdirAll(filepath.Dir(tmpPath), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+		if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", tmpPath, err)
+		}
+		out[source] = tmpPath
+	}
+
+	if len(merged) > 0 {
+		sort.Strings(merged)
+		return nil, fmt.Errorf("%d edited file(s) are merged from several sources and cannot be saved to profile '%s':\n  %s",
+			len(merged), layer, strings.Join(merged, "\n  "))
+	}
+	return out, nil
+}
@@ -0,0 +1,98 @@
+package operations
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+)
+
+func newTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.Storage.Path = t.TempDir()
+	if err := storage.New(cfg).Init(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for relPath, content := range files {
+		path := filepath.Join(dir, relPath)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// newTestProfile creates a profile with files, extending the profiles in
+// extends
+func newTestProfile(t *testing.T, cfg *config.Config, name string, files map[string]string, extends ...string) {
+	t.Helper()
+	store := storage.New(cfg)
+	if err := store.CreateProfile(name); err != nil {
+		t.Fatal(err)
+	}
+	if len(extends) > 0 {
+		err := store.UpdateProfileManifest(name, func(m *storage.ProfileManifest) { m.Extends = extends })
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFiles(t, store.ProfilePath(name), files)
+}
+
+func TestSaveRefusesEditedMergedFiles(t *testing.T) {
+	cfg := newTestConfig(t)
+	newTestProfile(t, cfg, "base", map[string]string{".claude/settings.json": `{"a": 1}`})
+	newTestProfile(t, cfg, "top", map[string]string{
+		".claude/settings.json": `{"b": 2}`,
+		"CLAUDE.md":             "top\n",
+	}, "base")
+	repo := t.TempDir()
+	if _, err := Apply(cfg, ApplyOptions{ProfileName: "top", RepoPath: repo}); err != nil {
+		t.Fatal(err)
+	}
+	profile := storage.New(cfg).ProfilePath("top")
+
+	// An unedited merged file keeps the profile's own version
+	writeFiles(t, repo, map[string]string{"CLAUDE.md": "top, edited\n"})
+	if _, err := Save(cfg, SaveOptions{RepoPath: repo}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(profile, ".claude/settings.json")); got != `{"b": 2}` {
+		t.Errorf("merged file saved as %q", got)
+	}
+	if got := readFile(t, filepath.Join(profile, "CLAUDE.md")); got != "top, edited\n" {
+		t.Errorf("CLAUDE.md saved as %q", got)
+	}
+
+	writeFiles(t, repo, map[string]string{
+		".claude/settings.json": `{"a": 1, "b": 3}`,
+		"CLAUDE.md":             "top, edited again\n",
+	})
+	_, err := Save(cfg, SaveOptions{RepoPath: repo})
+	if err == nil || !strings.Contains(err.Error(), ".claude/settings.json (union)") {
+		t.Fatalf("Save() of an edited merged file = %v, want it refused", err)
+	}
+	if got := readFile(t, filepath.Join(profile, "CLAUDE.md")); got != "top, edited\n" {
+		t.Errorf("refused save still wrote CLAUDE.md: %q", got)
+	}
+}
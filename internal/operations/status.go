@@ -0,0 +1,247 @@
+package operations
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/gitutil"
+)
+
+// Drift tells which side moved since the profiles were applied to a repo
+type Drift string
+
+// Drift values
+const (
+	DriftNone     Drift = "none"     // Repo and profiles are as applied
+	DriftLocal    Drift = "local"    // Files were edited in the repo
+	DriftUpstream Drift = "upstream" // Profiles were updated
+	DriftBoth     Drift = "both"     // Both of the above
+)
+
+// FileState is the state of one AI file of a repo
+type FileState string
+
+// File states
+const (
+	FileClean     FileState = "managed-clean"    // As aipaca wrote it
+	FileModified  FileState = "managed-modified" // Edited since aipaca wrote it
+	FileDeleted   FileState = "managed-deleted"  // Removed since aipaca wrote it
+	FileUnmanaged FileState = "unmanaged"        // Matches the AI patterns, not from a profile
+	FileIgnored   FileState = "ignored"          // Unmanaged and ignored by git
+)
+
+// FileStatus is the state of one AI file of a repo
+type FileStatus struct {
+	Path    string
+	State   FileState
+	Profile string // Profile a managed file comes from, when known
+}
+
+// StatusOptions contains options for the status operation
+type StatusOptions struct {
+	RepoPath string
+}
+
+// StatusResult describes the AI files of a repo against the profiles
+// applied to it
+type StatusResult struct {
+	RepoPath string
+	State    *storage.RepoState // Nil when aipaca never touched the repo
+
+	Drift    Drift
+	Modified []string // Managed files edited since apply
+	Deleted  []string // Managed files removed since apply
+
+	// Updated lists the applied profiles changed since they were applied,
+	// Untracked those applied before aipaca kept snapshots
+	Updated   []string
+	Untracked []string
+
+	// Files holds every managed file and every other AI file of the repo,
+	// sorted by path
+	Files []FileStatus
+}
+
+// Status works out what changed in a repo and in its applied profiles
+// since they were applied
+func Status(cfg *config.Config, opts StatusOptions) (*StatusResult, error) {
+	store := storage.New(cfg)
+
+	// Resolve repo path
+	repoPath, err := ResolveRepoPath(cfg, opts.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+	result := &StatusResult{RepoPath: repoPath, Drift: DriftNone}
+
+	result.State, err = store.GetRepoState(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repo state: %w", err)
+	}
+	state := result.State
+	if state != nil && state.AppliedProfile != "" {
+		if err := localChanges(cfg, store, repoPath, state, result); err != nil {
+			return nil, err
+		}
+		if err := upstreamChanges(store, state, result); err != nil {
+			return nil, err
+		}
+	}
+	if err := fileStates(cfg, store, repoPath, state, result); err != nil {
+		return nil, err
+	}
+
+	local := len(result.Modified) > 0 || len(result.Deleted) > 0
+	switch {
+	case local && len(result.Updated) > 0:
+		result.Drift = DriftBoth
+	case local:
+		result.Drift = DriftLocal
+	case len(result.Updated) > 0:
+		result.Drift = DriftUpstream
+	}
+
+	return result, nil
+}
+
+// upstreamChanges finds the applied profiles changed since they were
+// applied, by their snapshots
+func upstreamChanges(store *storage.Storage, state *storage.RepoState, result *StatusResult) error {
+	for _, layer := range state.AppliedLayers() {
+		id := state.Snapshots[layer]
+		if id == "" {
+			result.Untracked = append(result.Untracked, layer)
+			continue
+		}
+		if !store.ProfileExists(layer) {
+			result.Updated = append(result.Updated, layer) // Deleted since
+			continue
+		}
+		hash, err := store.ProfileHash(layer)
+		if err != nil {
+			return err
+		}
+		if hash != id {
+			result.Updated = append(result.Updated, layer)
+		}
+	}
+	return nil
+}
+
+// localChanges finds the managed files edited or removed since apply. The
+// checksums recorded at apply tell; states from before they were recorded
+// fall back to comparing with the applied profiles.
+func localChanges(cfg *config.Config, store *storage.Storage, repoPath string, state *storage.RepoState, result *StatusResult) error {
+	if state.Managed == nil {
+		diff, err := Diff(cfg, DiffOptions{RepoPath: repoPath})
+		if err != nil {
+			return err
+		}
+		for _, change := range diff.Changes {
+			switch change.Type {
+			case "modified":
+				result.Modified = append(result.Modified, change.Path)
+			case "removed":
+				result.Deleted = append(result.Deleted, change.Path)
+			}
+		}
+		result.Modified = dedupe(result.Modified)
+		return nil
+	}
+
+	existing, modified, err := existingManaged(repoPath, state.Managed)
+	if err != nil {
+		return err
+	}
+	result.Modified = modified
+
+	present := make(map[string]bool, len(existing))
+	for _, relPath := range existing {
+		present[relPath] = true
+	}
+	for relPath := range state.Managed {
+		if !present[relPath] {
+			result.Deleted = append(result.Deleted, relPath)
+		}
+	}
+	sort.Strings(result.Deleted)
+	return nil
+}
+
+// fileStates sorts the managed files and the other AI files of a repo into
+// their states
+func fileStates(cfg *config.Config, store *storage.Storage, repoPath string, state *storage.RepoState, result *StatusResult) error {
+	states := make(map[string]FileState)
+	var owners map[string]string
+	if state != nil && state.AppliedProfile != "" {
+		managed, err := managedFiles(cfg, store, repoPath, state)
+		if err != nil {
+			return err
+		}
+		for relPath := range managed {
+			states[relPath] = FileClean
+		}
+		for _, relPath := range result.Modified {
+			states[relPath] = FileModified
+		}
+		for _, relPath := range result.Deleted {
+			states[relPath] = FileDeleted
+		}
+
+		// The owning layer only needs working out when profiles are
+		// stacked; a profile deleted since leaves it unknown
+		owners = make(map[string]string)
+		if layers := state.AppliedLayers(); len(layers) > 1 {
+			if applied, err := AppliedTree(cfg, store, repoPath, state); err == nil {
+				owners = applied.Owners
+			}
+		} else {
+			for relPath := range states {
+				owners[relPath] = state.AppliedProfile
+			}
+		}
+	}
+
+	repoTree, err := RepoTree(repoPath, cfg.AIPatterns)
+	if err != nil {
+		return err
+	}
+	var unmanaged []string
+	for relPath := range repoTree.Files {
+		if _, ok := states[relPath]; !ok {
+			unmanaged = append(unmanaged, relPath)
+		}
+	}
+	ignored, err := gitutil.IgnoredPaths(repoPath, unmanaged)
+	if err != nil {
+		return err
+	}
+	for _, relPath := range unmanaged {
+		if ignored[relPath] {
+			states[relPath] = FileIgnored
+		} else {
+			states[relPath] = FileUnmanaged
+		}
+	}
+
+	for relPath, fileState := range states {
+		result.Files = append(result.Files, FileStatus{Path: relPath, State: fileState, Profile: owners[relPath]})
+	}
+	sort.Slice(result.Files, func(i, j int) bool { return result.Files[i].Path < result.Files[j].Path })
+	return nil
+}
+
+// dedupe returns sorted paths without repeats; block files can change in
+// several parts
+func dedupe(paths []string) []string {
+	sort.Strings(paths)
+	out := paths[:0]
+	for i, p := range paths {
+		if i == 0 || p != paths[i-1] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
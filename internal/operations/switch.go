@@ -0,0 +1,245 @@
+package operations
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+	"github.com/HammerSpb/aipaca/pkg/gitutil"
+)
+
+// SwitchOptions contains options for switching a repo to the profile of
+// its branch
+type SwitchOptions struct {
+	RepoPath string
+	Branch   string // Branch checked out (the current one when empty)
+	From     string // Branch left, when known; the last one switched to otherwise
+	DryRun   bool
+}
+
+// SwitchResult contains the result of a switch
+type SwitchResult struct {
+	RepoPath string
+	From     string   // Branch left
+	To       string   // Branch checked out
+	Layers   []string // Profiles for To, bottom first; empty when no rule or record has any
+	Left     []string // Profiles applied before, bottom first
+
+	// Unchanged is set when the repo already has the profiles for To
+	Unchanged bool
+
+	// Edited is set when the files of the profiles applied on From had
+	// edits. They were saved to the profiles (Saved), kept in a backup
+	// (Stash) for when From is checked out again or, when From is not
+	// known, left in the backup of the apply.
+	Edited bool
+	Saved  *SaveResult
+	Stash  string
+
+	Apply     *ApplyResult
+	Unstashed string // Backup of the edits kept for To, put back
+	LostStash string // Backup of the edits kept for To, since deleted
+}
+
+// Switch applies the profile the branch rules pick for the branch checked
+// out, or the profiles it had when it was last left. The edits made to the
+// files of the profiles applied before are saved or stashed first, as
+// branch_edits says, and the edits stashed for the branch are put back.
+func Switch(cfg *config.Config, opts SwitchOptions) (*SwitchResult, error) {
+	store := storage.New(cfg)
+
+	// Resolve repo path
+	repoPath, err := ResolveRepoPath(cfg, opts.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	branch := opts.Branch
+	if branch == "" {
+		if branch, err = gitutil.CurrentBranch(repoPath); err != nil {
+			return nil, err
+		}
+		if branch == "" {
+			return nil, fmt.Errorf("no branch is checked out in %s", repoPath)
+		}
+	}
+	mode, err := cfg.BranchEditsMode()
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := store.GetRepoState(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repo state: %w", err)
+	}
+	var current []string // Profiles applied before the switch
+	var kept storage.BranchState
+	hasKept := false
+	from := opts.From
+	if state != nil {
+		current = state.AppliedLayers()
+		kept, hasKept = state.Branches[branch]
+		if from == "" {
+			from = state.Branch
+		}
+	}
+	if from == branch {
+		from = ""
+	}
+	result := &SwitchResult{RepoPath: repoPath, From: from, To: branch, Left: current}
+
+	profile, err := cfg.BranchProfile(repoPath, branch)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case profile != "":
+		result.Layers = []string{profile}
+	case hasKept:
+		result.Layers = kept.Layers
+	}
+
+	// Edits kept for the branch only fit the profiles they were made to
+	unstash := ""
+	if hasKept && kept.Stash != "" && slices.Equal(kept.Layers, result.Layers) {
+		unstash = kept.Stash
+		if _, err := store.GetBackup(unstash); err != nil {
+			result.LostStash, unstash = unstash, ""
+		}
+	}
+
+	if len(result.Layers) == 0 || (slices.Equal(result.Layers, current) && unstash == "") {
+		result.Unchanged = true
+		if opts.DryRun || state == nil || (state.Branch == branch && !hasKept) {
+			return result, nil
+		}
+		return result, recordSwitch(cfg, store, repoPath, result, nil, "")
+	}
+
+	// Leave the branch: keep the edits to the applied profiles' files
+	var leaving *storage.BranchState
+	if len(current) > 0 {
+		status, err := Status(cfg, StatusOptions{RepoPath: repoPath})
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range status.Files {
+			// Unmanaged files are not the profiles' and stay where they are
+			result.Edited = result.Edited || f.State == FileModified || f.State == FileDeleted
+		}
+		leaving = &storage.BranchState{Layers: current, At: time.Now()}
+	}
+	// A stash is kept for the branch left; when that is not known, the
+	// edits stay in the backup of the apply instead, which restore --step
+	// brings back
+	inBackup := result.Edited && mode != config.BranchEditsSave && from == ""
+	if result.Edited && !opts.DryRun {
+		switch {
+		case mode == config.BranchEditsSave:
+			result.Saved, err = Save(cfg, SaveOptions{RepoPath: repoPath})
+			if err != nil {
+				return nil, fmt.Errorf("failed to save the edits made on %s: %w", orBranch(from), err)
+			}
+		case !inBackup:
+			result.Stash, err = store.CreateBackup(repoPath, cfg.AIPatterns, storage.BackupOptions{
+				Operation: "stash",
+				Profile:   strings.Join(current, "+"),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to stash the edits made on %s: %w", from, err)
+			}
+			leaving.Stash = result.Stash
+		}
+	}
+
+	result.Apply, err = Apply(cfg, ApplyOptions{
+		Profiles: result.Layers,
+		RepoPath: repoPath,
+		DryRun:   opts.DryRun,
+		Switch:   !inBackup, // A replaced switch would keep no backup
+	})
+	if err != nil {
+		if result.Stash != "" {
+			store.DeleteBackup(result.Stash)
+		}
+		return nil, err
+	}
+	if opts.DryRun {
+		return result, nil
+	}
+
+	if err := recordSwitch(cfg, store, repoPath, result, leaving, unstash); err != nil {
+		return nil, err
+	}
+	if unstash != "" {
+		// The edits are back in the repo; a stash left behind only takes
+		// up space
+		result.Unstashed = unstash
+		store.DeleteBackup(unstash)
+	}
+	return result, nil
+}
+
+// recordSwitch records the branch switched to in the repo state, with
+// what was applied on the branch left, putting back the stashed edits of
+// the branch switched to in the same transaction
+func recordSwitch(cfg *config.Config, store *storage.Storage, repoPath string, result *SwitchResult, leaving *storage.BranchState, unstash string) error {
+	txn, err := store.BeginTransaction("switch", repoPath)
+	if err != nil {
+		return err
+	}
+	defer txn.Abort()
+
+	state, err := store.GetRepoState(repoPath)
+	if err != nil {
+		return fmt.Errorf("failed to get repo state: %w", err)
+	}
+	if state == nil {
+		return nil
+	}
+
+	if unstash != "" {
+		existing, err := fileutil.ExpandPatterns(repoPath, cfg.AIPatterns)
+		if err != nil {
+			return fmt.Errorf("failed to find existing AI files: %w", err)
+		}
+		var remove []string
+		for relPath := range existing {
+			remove = append(remove, relPath)
+		}
+		if err := store.RestoreBackup(unstash, txn, remove); err != nil {
+			return fmt.Errorf("failed to stage stashed edits: %w", err)
+		}
+	}
+
+	branches := make(map[string]storage.BranchState)
+	for name, kept := range state.Branches {
+		branches[name] = kept
+	}
+	if leaving != nil && result.From != "" {
+		branches[result.From] = *leaving
+	}
+	delete(branches, result.To)
+	if len(branches) == 0 {
+		branches = nil
+	}
+	state.Branch, state.Branches = result.To, branches
+	txn.RecordState(repoPath, state)
+
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("failed to record switch: %w", err)
+	}
+	return nil
+}
+
+// orBranch names a branch in messages, which may not be known
+func orBranch(branch string) string {
+	if branch == "" {
+		return "the previous branch"
+	}
+	return branch
+}
@@ -0,0 +1,83 @@
+package operations
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+)
+
+// newBranchConfig returns a config applying go on main and web on
+// feature branches
+func newBranchConfig(t *testing.T) *config.Config {
+	t.Helper()
+	cfg := newTestConfig(t)
+	cfg.BranchRules = []config.BranchRule{
+		{Branch: "main", Profile: "go"},
+		{Branch: "feature/**", Profile: "web"},
+	}
+	newTestProfile(t, cfg, "go", map[string]string{"CLAUDE.md": "go\n"})
+	newTestProfile(t, cfg, "web", map[string]string{"CLAUDE.md": "web\n"})
+	return cfg
+}
+
+func TestSwitchStashesEdits(t *testing.T) {
+	cfg := newBranchConfig(t)
+	repo := t.TempDir()
+	claude := filepath.Join(repo, "CLAUDE.md")
+
+	if _, err := Switch(cfg, SwitchOptions{RepoPath: repo, Branch: "main"}); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, repo, map[string]string{"CLAUDE.md": "go, edited\n"})
+
+	result, err := Switch(cfg, SwitchOptions{RepoPath: repo, Branch: "feature/x", From: "main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Edited || result.Stash == "" {
+		t.Errorf("switch away: Edited = %v, Stash = %q; want the edits stashed", result.Edited, result.Stash)
+	}
+	if got := readFile(t, claude); got != "web\n" {
+		t.Errorf("CLAUDE.md on feature/x = %q", got)
+	}
+
+	result, err = Switch(cfg, SwitchOptions{RepoPath: repo, Branch: "main", From: "feature/x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Edited || result.Unstashed == "" {
+		t.Errorf("switch back: Edited = %v, Unstashed = %q; want the stash put back", result.Edited, result.Unstashed)
+	}
+	if got := readFile(t, claude); got != "go, edited\n" {
+		t.Errorf("CLAUDE.md back on main = %q, want the edits", got)
+	}
+}
+
+func TestSwitchFromUnknownBranch(t *testing.T) {
+	cfg := newBranchConfig(t)
+	repo := t.TempDir()
+	claude := filepath.Join(repo, "CLAUDE.md")
+
+	// Applied by hand, so no branch is known yet
+	if _, err := Apply(cfg, ApplyOptions{ProfileName: "go", RepoPath: repo}); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, repo, map[string]string{"CLAUDE.md": "go, edited\n"})
+
+	result, err := Switch(cfg, SwitchOptions{RepoPath: repo, Branch: "feature/x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Edited || result.Stash != "" || result.Apply.BackupName == "" {
+		t.Errorf("Edited = %v, Stash = %q, backup = %q; want the edits only in the apply backup",
+			result.Edited, result.Stash, result.Apply.BackupName)
+	}
+
+	if _, err := Restore(cfg, RestoreOptions{RepoPath: repo, Step: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, claude); got != "go, edited\n" {
+		t.Errorf("CLAUDE.md after restore --step = %q, want the edits", got)
+	}
+}
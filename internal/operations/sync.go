@@ -0,0 +1,106 @@
+package operations
+
+import (
+	"fmt"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+)
+
+// SyncAction is what a sync does to one repo
+type SyncAction string
+
+// Sync actions
+const (
+	SyncUpdate   SyncAction = "update"     // Bring in the profile's changes
+	SyncSkip     SyncAction = "skip"       // Leave alone, see Reason
+	SyncUpToDate SyncAction = "up-to-date" // Already has the profile as it is
+)
+
+// SyncOptions contains options for planning a sync
+type SyncOptions struct {
+	Profile string
+	Force   bool // Also update repos edited since apply, merging the edits
+	Jobs    int  // Repos planned at a time (DefaultJobs when zero)
+}
+
+// SyncRepo is the plan of a sync for one repo
+type SyncRepo struct {
+	RepoPath string
+	Action   SyncAction
+	Reason   string        // Why the repo is skipped
+	Edited   bool          // The repo was edited since apply
+	Update   *UpdateResult // Preview of the update
+}
+
+// PlanSync works out how to bring the current files of a profile into
+// every repo it is applied to. Repos edited since apply are skipped
+// unless opts.Force is set. Nothing is changed; run Update on the repos
+// to update.
+func PlanSync(cfg *config.Config, opts SyncOptions) ([]SyncRepo, error) {
+	store := storage.New(cfg)
+	if !store.ProfileExists(opts.Profile) {
+		return nil, fmt.Errorf("profile '%s' not found", opts.Profile)
+	}
+
+	repos, err := SelectRepos(cfg, RepoSelection{WithProfile: opts.Profile})
+	if err != nil {
+		return nil, err
+	}
+
+	plan := make([]SyncRepo, len(repos))
+	errs := make([]error, len(repos))
+	forEach(len(repos), opts.Jobs, func(i int) {
+		plan[i], errs[i] = planSyncRepo(cfg, repos[i], opts)
+	})
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// planSyncRepo works out what a sync does to one repo
+func planSyncRepo(cfg *config.Config, repoPath string, opts SyncOptions) (SyncRepo, error) {
+	repo := SyncRepo{RepoPath: repoPath, Action: SyncUpToDate}
+	if !fileutil.IsDir(repoPath) {
+		repo.Action, repo.Reason = SyncSkip, "repo not found"
+		return repo, nil
+	}
+
+	status, err := Status(cfg, StatusOptions{RepoPath: repoPath})
+	if err != nil {
+		return repo, fmt.Errorf("failed to get status of %s: %w", repoPath, err)
+	}
+	for _, layer := range status.Untracked {
+		if layer == opts.Profile {
+			repo.Action, repo.Reason = SyncSkip, "applied before aipaca tracked profile changes; apply it again"
+			return repo, nil
+		}
+	}
+	updated := false
+	for _, layer := range status.Updated {
+		updated = updated || layer == opts.Profile
+	}
+	if !updated {
+		return repo, nil
+	}
+
+	repo.Edited = status.Drift == DriftBoth
+	if repo.Edited && !opts.Force {
+		repo.Action, repo.Reason = SyncSkip, "edited since apply (use --force to merge)"
+		return repo, nil
+	}
+
+	repo.Update, err = Update(cfg, UpdateOptions{RepoPath: repoPath, DryRun: true})
+	if err != nil {
+		repo.Action, repo.Reason = SyncSkip, err.Error()
+		return repo, nil
+	}
+	if !repo.Update.UpToDate() {
+		repo.Action = SyncUpdate
+	}
+	return repo, nil
+}
@@ -0,0 +1,264 @@
+package operations
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+)
+
+// Source kinds
+const (
+	SourceProfile = "profile"
+	SourceBackup  = "backup"
+	SourceRepo    = "repo"
+)
+
+// Tree is a set of AI files from a profile, a backup or a repository,
+// keyed by their path relative to the tree
+type Tree struct {
+	Kind  string
+	Name  string            // Profile or backup name, or absolute repo path
+	Files map[string]string // Relative path -> full path
+
+	// Layers lists the stacked profiles of a profile tree, bottom first,
+	// and Owners the layer each file comes from
+	Layers []string
+	Owners map[string]string
+
+	// Skipped lists profile files left out because their conditions
+	// failed for the repo the tree is composed for
+	Skipped []storage.SkippedFile
+
+	// generated holds files whose content is merged from several sources
+	// or rendered from a template
+	generated map[string]*storage.ComposedFile
+}
+
+// Read returns the content of a file of the tree
+func (t *Tree) Read(relPath string) ([]byte, error) {
+	if f, ok := t.generated[relPath]; ok {
+		return f.Content()
+	}
+	return os.ReadFile(t.Files[relPath])
+}
+
+// Label describes the tree for humans
+func (t *Tree) Label() string {
+	switch {
+	case t.Kind == SourceRepo:
+		return "repo " + t.Name
+	case len(t.Layers) > 1:
+		return fmt.Sprintf("profile '%s' (%s)", t.Name, strings.Join(t.Layers, " → "))
+	default:
+		return fmt.Sprintf("%s '%s'", t.Kind, t.Name)
+	}
+}
+
+// IsSourceSpec reports whether arg uses the "kind:value" source syntax
+func IsSourceSpec(arg string) bool {
+	kind, _, ok := strings.Cut(arg, ":")
+	if !ok {
+		return false
+	}
+	switch kind {
+	case SourceProfile, SourceBackup, SourceRepo:
+		return true
+	}
+	return false
+}
+
+// ParseSource splits a source spec into kind and value. A spec without a
+// kind prefix names a profile.
+func ParseSource(spec string) (kind, value string) {
+	if IsSourceSpec(spec) {
+		kind, value, _ = strings.Cut(spec, ":")
+		return kind, value
+	}
+	return SourceProfile, spec
+}
+
+// LoadTree loads the tree named by a source spec such as "profile:default",
+// "backup:api-2026-10-01-120000" or "repo:../other". "repo:" alone is the
+// current directory.
+func LoadTree(cfg *config.Config, spec string) (*Tree, error) {
+	store := storage.New(cfg)
+
+	kind, value := ParseSource(spec)
+	switch kind {
+	case SourceProfile:
+		return ProfileTree(store, value)
+	case SourceBackup:
+		return BackupTree(store, value)
+	default:
+		repoPath, err := ResolveRepoPath(cfg, value)
+		if err != nil {
+			return nil, err
+		}
+		return RepoTree(repoPath, cfg.AIPatterns)
+	}
+}
+
+// ProfileTree returns the files of a profile, stacked on the profiles it
+// extends. Templates are kept as they are stored.
+func ProfileTree(store *storage.Storage, name string) (*Tree, error) {
+	layers, err := store.ResolveProfiles([]string{name})
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := LayersTree(store, layers, storage.ComposeOptions{})
+	if err != nil {
+		return nil, err
+	}
+	tree.Name = name
+
+	return tree, nil
+}
+
+// LayersTree returns the files of stacked profiles (bottom first) as they
+// are applied to a repo (see storage.Compose)
+func LayersTree(store *storage.Storage, layers []string, opts storage.ComposeOptions) (*Tree, error) {
+	comp, err := store.Compose(layers, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list profile files: %w", err)
+	}
+
+	tree := &Tree{
+		Kind:      SourceProfile,
+		Name:      strings.Join(layers, "+"),
+		Files:     make(map[string]string, len(comp.Files)),
+		Layers:    layers,
+		Owners:    comp.Owners(),
+		Skipped:   comp.Skipped,
+		generated: make(map[string]*storage.ComposedFile),
+	}
+	for relPath, f := range comp.Files {
+		tree.Files[relPath] = f.Sources[len(f.Sources)-1]
+		if f.Generated() {
+			tree.generated[relPath] = f
+		}
+	}
+
+	return tree, nil
+}
+
+// AppliedTree returns the files that the profiles applied to a repo put
+// there, merged with the repo's original content where merge rules apply,
+// rendered with the variables recorded on apply and without files whose
+// conditions do not fit the repo
+func AppliedTree(cfg *config.Config, store *storage.Storage, repoPath string, state *storage.RepoState) (*Tree, error) {
+	base, err := baselineFiles(store, state)
+	if err != nil {
+		return nil, err
+	}
+
+	// States recorded before templates existed have no vars
+	vars := state.Vars
+	if vars == nil {
+		vars, err = TemplateVars(cfg, store, repoPath, state.AppliedLayers(), nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return LayersTree(store, state.AppliedLayers(), storage.ComposeOptions{
+		Base:     base,
+		Vars:     vars,
+		RepoPath: repoPath,
+	})
+}
+
+// baselineFiles returns the repo's original AI files, from before the first
+// aipaca operation, as kept in the baseline backup
+func baselineFiles(store *storage.Storage, state *storage.RepoState) (map[string]string, error) {
+	if state == nil || state.Baseline == nil || state.Baseline.Backup == "" {
+		return nil, nil
+	}
+
+	tree, err := BackupTree(store, state.Baseline.Backup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline backup: %w", err)
+	}
+	return tree.Files, nil
+}
+
+// BackupTree returns the files of a backup, given by name or ID
+func BackupTree(store *storage.Storage, name string) (*Tree, error) {
+	backup, err := store.GetBackup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := store.GetBackupFiles(backup.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup files: %w", err)
+	}
+
+	return newTree(SourceBackup, backup.Name, backup.Path, files), nil
+}
+
+// RepoTree returns the AI files of a repository, found by expanding the
+// patterns and walking matched directories
+func RepoTree(repoPath string, patterns []string) (*Tree, error) {
+	if repoPath == "" {
+		var err error
+		repoPath, err = os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get current directory: %w", err)
+		}
+	}
+	repoPath, err := filepath.Abs(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve repo path: %w", err)
+	}
+
+	if !fileutil.IsDir(repoPath) {
+		return nil, fmt.Errorf("repository '%s' not found", repoPath)
+	}
+
+	// Get AI files in repo
+	aiFilesMap, err := fileutil.ExpandPatterns(repoPath, patterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find AI files: %w", err)
+	}
+
+	// Get all files in repo AI directories
+	var files []string
+	for relPath, fullPath := range aiFilesMap {
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			continue
+		}
+		if info.IsDir() {
+			dirFiles, err := fileutil.ListAllFiles(fullPath)
+			if err != nil {
+				continue
+			}
+			for _, f := range dirFiles {
+				files = append(files, filepath.Join(relPath, f))
+			}
+		} else {
+			files = append(files, relPath)
+		}
+	}
+
+	return newTree(SourceRepo, repoPath, repoPath, files), nil
+}
+
+// newTree builds a tree from paths relative to root
+func newTree(kind, name, root string, files []string) *Tree {
+	tree := &Tree{
+		Kind:  kind,
+		Name:  name,
+		Files: make(map[string]string, len(files)),
+	}
+	for _, f := range files {
+		tree.Files[f] = filepath.Join(root, f)
+	}
+	return tree
+}
@@ -0,0 +1,339 @@
+package operations
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+)
+
+// UpdateOptions contains options for the update operation
+type UpdateOptions struct {
+	RepoPath string
+	DryRun   bool
+	NoBackup bool
+}
+
+// UpdateResult contains the result of an update operation
+type UpdateResult struct {
+	Layers  []string // Applied profiles, bottom first
+	Changed []string // Profiles changed since they were applied
+
+	FilesAdded   []string // New in the profiles
+	FilesUpdated []string // Unchanged in the repo, so taken from the profiles
+	FilesRemoved []string // Removed from the profiles and unchanged in the repo
+	Merged       []string // Changed on both sides and merged
+	Conflicts    []FileConflict
+	BackupName   string
+}
+
+// UpToDate reports whether the update found nothing to do
+func (r *UpdateResult) UpToDate() bool {
+	return len(r.FilesAdded) == 0 && len(r.FilesUpdated) == 0 && len(r.FilesRemoved) == 0 &&
+		len(r.Merged) == 0 && len(r.Conflicts) == 0
+}
+
+// Update brings changes made to the applied profiles since they were
+// applied into a repo, keeping the repo's own edits. Files the repo left
+// alone take the profiles' version; files changed on both sides are merged,
+// with conflict markers where the same lines changed.
+func Update(cfg *config.Config, opts UpdateOptions) (*UpdateResult, error) {
+	store := storage.New(cfg)
+	result := &UpdateResult{}
+
+	// Resolve repo path
+	repoPath, err := ResolveRepoPath(cfg, opts.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hold the repo for the whole operation; a dry run only reads
+	if !opts.DryRun {
+		lock, err := store.LockRepo(repoPath)
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Release()
+	}
+
+	state, err := store.GetRepoState(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repo state: %w", err)
+	}
+	if state == nil || state.AppliedProfile == "" {
+		return nil, fmt.Errorf("no profile currently applied to this repo")
+	}
+	result.Layers = state.AppliedLayers()
+
+	// The snapshots taken at apply are the common base of the repo and
+	// the profiles
+	dirs := make(map[string]string, len(result.Layers))
+	for _, layer := range result.Layers {
+		id := state.Snapshots[layer]
+		if !store.SnapshotExists(layer, id) {
+			return nil, fmt.Errorf("no snapshot of profile '%s' was kept when it was applied; apply it again to start tracking its changes", layer)
+		}
+		dirs[layer] = store.SnapshotPath(layer, id)
+
+		hash, err := store.ProfileHash(layer)
+		if err != nil {
+			return nil, err
+		}
+		if hash != id {
+			result.Changed = append(result.Changed, layer)
+		}
+	}
+	if len(result.Changed) == 0 {
+		return result, nil // Up to date
+	}
+
+	base, err := baselineFiles(store, state)
+	if err != nil {
+		return nil, err
+	}
+	vars := state.Vars
+	if vars == nil {
+		vars, err = TemplateVars(cfg, store, repoPath, result.Layers, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	composeOpts := storage.ComposeOptions{Base: base, Vars: vars, RepoPath: repoPath}
+	current, err := store.Compose(result.Layers, composeOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	composeOpts.Dirs = dirs
+	applied, err := store.Compose(result.Layers, composeOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile snapshots: %w", err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "aipaca-update-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	baseFiles, err := writeComposed(applied, filepath.Join(tmpDir, "base"))
+	if err != nil {
+		return nil, err
+	}
+	theirs, err := writeComposed(current, filepath.Join(tmpDir, "profile"))
+	if err != nil {
+		return nil, err
+	}
+	ours := make(map[string]string)
+	for _, files := range []map[string]string{baseFiles, theirs} {
+		for relPath := range files {
+			if fullPath := filepath.Join(repoPath, relPath); fileutil.IsFile(fullPath) {
+				ours[relPath] = fullPath
+			}
+		}
+	}
+
+	out, merged, conflicts, err := merge3Files(baseFiles, ours, theirs, "repo", "profile", filepath.Join(tmpDir, "merged"), true)
+	if err != nil {
+		return nil, err
+	}
+	owners := applied.Owners()
+	for relPath, owner := range current.Owners() {
+		owners[relPath] = owner
+	}
+	for i := range conflicts {
+		conflicts[i].Profile = owners[conflicts[i].Path]
+	}
+	result.Merged = merged
+	result.Conflicts = conflicts
+
+	// Sort the outcome into the files the repo gains, changes and loses
+	handled := make(map[string]bool, len(merged)+len(conflicts))
+	for _, relPath := range merged {
+		handled[relPath] = true
+	}
+	for _, c := range conflicts {
+		handled[c.Path] = true
+	}
+	for relPath, src := range out {
+		oursPath, ok := ours[relPath]
+		switch {
+		case handled[relPath]:
+		case !ok:
+			result.FilesAdded = append(result.FilesAdded, relPath)
+		default:
+			same, err := sameContent(oursPath, src)
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				result.FilesUpdated = append(result.FilesUpdated, relPath)
+			}
+		}
+	}
+	for relPath := range ours {
+		if _, ok := out[relPath]; !ok {
+			result.FilesRemoved = append(result.FilesRemoved, relPath)
+		}
+	}
+	sort.Strings(result.FilesAdded)
+	sort.Strings(result.FilesUpdated)
+	sort.Strings(result.FilesRemoved)
+
+	// If dry run, return here
+	if opts.DryRun {
+		return result, nil
+	}
+
+	// The repo already has the profiles' changes; only the snapshots move on
+	if result.UpToDate() {
+		if state.Snapshots, err = snapshotLayers(store, result.Layers); err != nil {
+			return nil, err
+		}
+		if err := store.SetRepoState(repoPath, state); err != nil {
+			return nil, fmt.Errorf("failed to update repo state: %w", err)
+		}
+		return result, nil
+	}
+
+	txn, err := store.BeginTransaction("update", repoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Abort()
+
+	// Back up the files about to change (unless --no-backup)
+	if !opts.NoBackup {
+		backupName, err := store.CreateBackup(repoPath, cfg.AIPatterns, storage.BackupOptions{
+			Operation: "update",
+			Profile:   state.AppliedProfile,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create backup: %w", err)
+		}
+		result.BackupName = backupName
+	}
+
+	for _, relPath := range result.FilesRemoved {
+		txn.Remove(relPath)
+	}
+	for _, group := range [][]string{result.FilesAdded, result.FilesUpdated, result.Merged, conflictPaths(conflicts)} {
+		for _, relPath := range group {
+			src, ok := out[relPath]
+			if !ok {
+				continue // Deleted in the repo and kept that way
+			}
+			data, err := os.ReadFile(src)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", relPath, err)
+			}
+			if err := txn.PlaceData(relPath, data, filePerm(ours[relPath], theirs[relPath])); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The update is a step of its own, which restore --step can undo
+	nextState := storage.NextRepoState(state, storage.StateLayer{
+		Operation: "update",
+		Backup:    result.BackupName,
+		NoBackup:  opts.NoBackup,
+		At:        time.Now(),
+	}, result.Layers)
+	nextState.Vars = vars
+	nextState.Managed, err = composedChecksums(current)
+	if err != nil {
+		return nil, err
+	}
+	nextState.Snapshots, err = snapshotLayers(store, result.Layers)
+	if err != nil {
+		return nil, err
+	}
+	txn.RecordState(repoPath, nextState)
+
+	if err := txn.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to update repo: %w", err)
+	}
+	fileutil.RemoveEmptyParents(repoPath, result.FilesRemoved)
+
+	return result, nil
+}
+
+// snapshotLayers snapshots the current files of profiles and returns the
+// snapshot ids
+func snapshotLayers(store *storage.Storage, layers []string) (map[string]string, error) {
+	snapshots := make(map[string]string, len(layers))
+	for _, layer := range layers {
+		id, err := store.SnapshotProfile(layer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to snapshot profile '%s': %w", layer, err)
+		}
+		snapshots[layer] = id
+	}
+	return snapshots, nil
+}
+
+// writeComposed writes the content of the generated files of a composition
+// under dir and returns every file (relative path -> full path)
+func writeComposed(comp *storage.Composition, dir string) (map[string]string, error) {
+	files := make(map[string]string, len(comp.Files))
+	for relPath, f := range comp.Files {
+		if !f.Generated() {
+			files[relPath] = f.Sources[len(f.Sources)-1]
+			continue
+		}
+
+		data, err := f.Content()
+		if err != nil {
+			return nil, err
+		}
+		fullPath := filepath.Join(dir, relPath)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		if err := os.WriteFile(fullPath, data, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", relPath, err)
+		}
+		files[relPath] = fullPath
+	}
+	return files, nil
+}
+
+// sameContent reports whether two files have the same content
+func sameContent(a, b string) (bool, error) {
+	sumA, err := fileutil.FileChecksum(a)
+	if err != nil {
+		return false, err
+	}
+	sumB, err := fileutil.FileChecksum(b)
+	if err != nil {
+		return false, err
+	}
+	return sumA == sumB, nil
+}
+
+// filePerm returns the permissions of the first of paths that exists
+func filePerm(paths ...string) os.FileMode {
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if info, err := os.Stat(p); err == nil {
+			return info.Mode().Perm()
+		}
+	}
+	return 0644
+}
+
+// conflictPaths returns the paths of conflicts
+func conflictPaths(conflicts []FileConflict) []string {
+	paths := make([]string, len(conflicts))
+	for i, c := range conflicts {
+		paths[i] = c.Path
+	}
+	return paths
+}
@@ -0,0 +1,52 @@
+package operations
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+)
+
+func TestUpdateAfterManifestChange(t *testing.T) {
+	cfg := newTestConfig(t)
+	newTestProfile(t, cfg, "base", map[string]string{"CLAUDE.md": "# Base\n"})
+	newTestProfile(t, cfg, "top", map[string]string{"CLAUDE.md": "# Top\n"}, "base")
+	repo := t.TempDir()
+	if _, err := Apply(cfg, ApplyOptions{ProfileName: "top", RepoPath: repo}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, repo+"/CLAUDE.md"); got != "# Top\n" {
+		t.Fatalf("CLAUDE.md after apply = %q", got)
+	}
+
+	// Only the merge rules change, not the files
+	err := storage.New(cfg).UpdateProfileManifest("top", func(m *storage.ProfileManifest) {
+		m.Merge = []config.MergeRule{{Path: "CLAUDE.md", Strategy: "sections"}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Update(cfg, UpdateOptions{RepoPath: repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Changed, []string{"top"}) {
+		t.Errorf("Changed = %v, want [top]", result.Changed)
+	}
+	if !slices.Equal(result.FilesUpdated, []string{"CLAUDE.md"}) {
+		t.Errorf("FilesUpdated = %v, want [CLAUDE.md]", result.FilesUpdated)
+	}
+	if got := readFile(t, repo+"/CLAUDE.md"); got != "# Base\n\n# Top\n" {
+		t.Errorf("CLAUDE.md after update = %q", got)
+	}
+
+	again, err := Update(cfg, UpdateOptions{RepoPath: repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Changed) != 0 {
+		t.Errorf("second Update() found %v changed", again.Changed)
+	}
+}
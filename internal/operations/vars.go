@@ -0,0 +1,103 @@
+package operations
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/internal/storage"
+	"github.com/HammerSpb/aipaca/pkg/gitutil"
+)
+
+// TemplateVars returns the variables profile templates are rendered with
+// for a repo. Later sources override earlier ones: the vars of the profile
+// manifests (bottom layer first), the values detected from the repo, the
+// repo's vars in the config, and finally set.
+func TemplateVars(cfg *config.Config, store *storage.Storage, repoPath string, layers []string, set map[string]string) (map[string]string, error) {
+	vars := make(map[string]string)
+
+	for _, layer := range layers {
+		manifest, err := store.GetProfileManifest(layer)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range manifest.Vars {
+			vars[k] = v
+		}
+	}
+
+	for k, v := range repoVars(repoPath) {
+		vars[k] = v
+	}
+	if len(layers) > 0 {
+		vars["profile"] = layers[len(layers)-1]
+	}
+
+	for k, v := range cfg.ForRepo(repoPath).Vars {
+		vars[k] = v
+	}
+	for k, v := range set {
+		vars[k] = v
+	}
+
+	return vars, nil
+}
+
+// repoVars detects template variables from a repo. Values that cannot be
+// found, including ones in files that cannot be read or parsed, are left
+// out, so only templates using them fail to render.
+func repoVars(repoPath string) map[string]string {
+	vars := map[string]string{
+		"repo_name": filepath.Base(repoPath),
+		"repo_path": repoPath,
+	}
+
+	if remote, _ := gitutil.DefaultRemoteURL(repoPath); remote != "" {
+		vars["git_remote"] = remote
+	}
+	if module := goModule(repoPath); module != "" {
+		vars["go_module"] = module
+	}
+	if name := packageName(repoPath); name != "" {
+		vars["package_name"] = name
+	}
+
+	return vars
+}
+
+// goModule returns the module path declared in the repo's go.mod, if any
+func goModule(repoPath string) string {
+	f, err := os.Open(filepath.Join(repoPath, "go.mod"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if rest, ok := strings.CutPrefix(line, "module"); ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t') {
+			return strings.Trim(strings.TrimSpace(rest), `"`)
+		}
+	}
+	return ""
+}
+
+// packageName returns the name declared in the repo's package.json, if any
+func packageName(repoPath string) string {
+	data, err := os.ReadFile(filepath.Join(repoPath, "package.json"))
+	if err != nil {
+		return ""
+	}
+
+	var pkg struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return ""
+	}
+	return pkg.Name
+}
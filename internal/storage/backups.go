@@ -1,16 +1,23 @@
 package storage
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
-	"strings"
 	"time"
 
+	"gopkg.in/yaml.v3"
+
 	"github.com/HammerSpb/aipaca/pkg/fileutil"
+	"github.com/HammerSpb/aipaca/pkg/gitutil"
 )
 
+// BackupManifestFile is the name of the manifest written into every backup
+const BackupManifestFile = "manifest.yaml"
+
 // Backup represents a stored backup
 type Backup struct {
 	Name      string
@@ -18,6 +25,37 @@ type Backup struct {
 	RepoPath  string
 	CreatedAt time.Time
 	FileCount int
+
+	// Fields below come from the manifest and are empty for backups
+	// created by older versions
+	ID        string
+	GitRemote string
+	Operation string
+	Profile   string
+	Files     []BackupFile
+}
+
+// BackupOptions describes the operation a backup is taken for
+type BackupOptions struct {
+	Operation string // "apply", "clean", "update", "save", "switch" or "stash"
+	Profile   string // Profile involved in the operation, if any
+}
+
+// BackupManifest is the manifest.yaml stored in a backup
+type BackupManifest struct {
+	ID        string       `yaml:"id"`
+	CreatedAt time.Time    `yaml:"created_at"`
+	RepoPath  string       `yaml:"repo_path"`
+	GitRemote string       `yaml:"git_remote,omitempty"`
+	Operation string       `yaml:"operation"`
+	Profile   string       `yaml:"profile,omitempty"`
+	Files     []BackupFile `yaml:"files"`
+}
+
+// BackupFile is a file recorded in a backup manifest
+type BackupFile struct {
+	Path     string `yaml:"path"`
+	Checksum string `yaml:"checksum"`
 }
 
 // ListBackups returns all available backups
@@ -38,18 +76,11 @@ func (s *Storage) ListBackups() ([]Backup, error) {
 			continue
 		}
 
-		name := entry.Name()
-		backupPath := filepath.Join(backupsDir, name)
-
-		fileCount, _ := fileutil.CountFiles(backupPath)
-		createdAt := parseBackupTimestamp(name)
-
-		backups = append(backups, Backup{
-			Name:      name,
-			Path:      backupPath,
-			CreatedAt: createdAt,
-			FileCount: fileCount,
-		})
+		backup, err := s.loadBackup(entry.Name())
+		if err != nil {
+			continue
+		}
+		backups = append(backups, *backup)
 	}
 
 	// Sort by creation time (newest first)
@@ -60,40 +91,75 @@ func (s *Storage) ListBackups() ([]Backup, error) {
 	return backups, nil
 }
 
-// GetBackup returns a specific backup by name
+// GetBackup returns a specific backup by name or manifest ID
 func (s *Storage) GetBackup(name string) (*Backup, error) {
-	backupPath := s.BackupPath(name)
+	info, err := os.Stat(s.BackupPath(name))
+	if err == nil {
+		if !info.IsDir() {
+			return nil, fmt.Errorf("backup '%s' is not a directory", name)
+		}
+		return s.loadBackup(name)
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to access backup: %w", err)
+	}
 
-	info, err := os.Stat(backupPath)
+	backups, err := s.ListBackups()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("backup '%s' not found", name)
+		return nil, err
+	}
+	for i := range backups {
+		if backups[i].ID == name {
+			return &backups[i], nil
 		}
-		return nil, fmt.Errorf("failed to access backup: %w", err)
 	}
 
-	if !info.IsDir() {
-		return nil, fmt.Errorf("backup '%s' is not a directory", name)
+	return nil, fmt.Errorf("backup '%s' not found", name)
+}
+
+// loadBackup reads a backup directory and its manifest
+func (s *Storage) loadBackup(name string) (*Backup, error) {
+	backupPath := s.BackupPath(name)
+	backup := &Backup{
+		Name: name,
+		Path: backupPath,
+	}
+
+	manifest, err := readBackupManifest(backupPath)
+	if err != nil {
+		return nil, err
 	}
 
-	fileCount, _ := fileutil.CountFiles(backupPath)
-	createdAt := parseBackupTimestamp(name)
+	if manifest == nil {
+		// Older backups carry no manifest; fall back to the filesystem
+		info, err := os.Stat(backupPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to access backup: %w", err)
+		}
+		backup.CreatedAt = info.ModTime()
+		backup.FileCount, _ = fileutil.CountFiles(backupPath)
+		return backup, nil
+	}
 
-	return &Backup{
-		Name:      name,
-		Path:      backupPath,
-		CreatedAt: createdAt,
-		FileCount: fileCount,
-	}, nil
+	backup.ID = manifest.ID
+	backup.CreatedAt = manifest.CreatedAt
+	backup.RepoPath = manifest.RepoPath
+	backup.GitRemote = manifest.GitRemote
+	backup.Operation = manifest.Operation
+	backup.Profile = manifest.Profile
+	backup.Files = manifest.Files
+	backup.FileCount = len(manifest.Files)
+
+	return backup, nil
 }
 
 // CreateBackup creates a backup of AI files from a repo
-func (s *Storage) CreateBackup(repoPath string, patterns []string) (string, error) {
-	// Generate backup name: reponame-timestamp
-	repoName := filepath.Base(repoPath)
-	timestamp := time.Now().Format("2006-01-02-150405")
-	backupName := fmt.Sprintf("%s-%s", repoName, timestamp)
-	backupPath := s.BackupPath(backupName)
+func (s *Storage) CreateBackup(repoPath string, patterns []string, opts BackupOptions) (string, error) {
+	lock, err := s.LockRepo(repoPath)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Release()
 
 	// Find all AI files in repo
 	aiFiles, err := fileutil.ExpandPatterns(repoPath, patterns)
@@ -106,13 +172,61 @@ func (s *Storage) CreateBackup(repoPath string, patterns []string) (string, erro
 		return "", nil
 	}
 
-	// Create backup directory
-	if err := os.MkdirAll(backupPath, 0755); err != nil {
-		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	return s.writeBackup(filepath.Base(repoPath), repoPath, aiFiles, opts)
+}
+
+// CreateProfileBackup creates a backup of a profile's files before it is
+// overwritten by a save from repoPath
+func (s *Storage) CreateProfileBackup(name, repoPath string) (string, error) {
+	lock, err := s.LockProfile(name)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Release()
+
+	profilePath := s.ProfilePath(name)
+	files, err := listProfileFiles(profilePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read profile: %w", err)
+	}
+
+	if len(files) == 0 {
+		return "", nil
+	}
+
+	items := make(map[string]string, len(files))
+	for _, relPath := range files {
+		items[relPath] = filepath.Join(profilePath, relPath)
 	}
 
+	return s.writeBackup("profile-"+name, repoPath, items, BackupOptions{
+		Operation: "save",
+		Profile:   name,
+	})
+}
+
+// writeBackup copies items (relative path -> full path) into a new backup
+// directory and writes its manifest
+func (s *Storage) writeBackup(prefix, repoPath string, items map[string]string, opts BackupOptions) (string, error) {
+	absRepo, err := filepath.Abs(repoPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve path: %w", err)
+	}
+
+	id, err := newBackupID()
+	if err != nil {
+		return "", err
+	}
+
+	createdAt := time.Now()
+	backupName, err := s.createBackupDir(prefix, createdAt)
+	if err != nil {
+		return "", err
+	}
+	backupPath := s.BackupPath(backupName)
+
 	// Copy each AI file/directory to backup
-	for relPath, fullPath := range aiFiles {
+	for relPath, fullPath := range items {
 		dstPath := filepath.Join(backupPath, relPath)
 		if err := fileutil.CopyPath(fullPath, dstPath); err != nil {
 			// Clean up partial backup
@@ -121,51 +235,122 @@ func (s *Storage) CreateBackup(repoPath string, patterns []string) (string, erro
 		}
 	}
 
+	files, err := fileutil.ListAllFiles(backupPath)
+	if err != nil {
+		os.RemoveAll(backupPath)
+		return "", fmt.Errorf("failed to list backup files: %w", err)
+	}
+
+	manifest := BackupManifest{
+		ID:        id,
+		CreatedAt: createdAt,
+		RepoPath:  absRepo,
+		Operation: opts.Operation,
+		Profile:   opts.Profile,
+	}
+	manifest.GitRemote, _ = gitutil.DefaultRemoteURL(absRepo)
+
+	for _, relPath := range files {
+		checksum, err := fileutil.FileChecksum(filepath.Join(backupPath, relPath))
+		if err != nil {
+			os.RemoveAll(backupPath)
+			return "", fmt.Errorf("failed to checksum %s: %w", relPath, err)
+		}
+		manifest.Files = append(manifest.Files, BackupFile{Path: relPath, Checksum: checksum})
+	}
+
+	// The manifest is written last, so a backup with a manifest is complete
+	data, err := yaml.Marshal(&manifest)
+	if err != nil {
+		os.RemoveAll(backupPath)
+		return "", fmt.Errorf("failed to serialize backup manifest: %w", err)
+	}
+	if err := fileutil.WriteFileAtomic(filepath.Join(backupPath, BackupManifestFile), data, 0644); err != nil {
+		os.RemoveAll(backupPath)
+		return "", fmt.Errorf("failed to write backup manifest: %w", err)
+	}
+
 	return backupName, nil
 }
 
-// RestoreBackup restores a backup to a repo
-func (s *Storage) RestoreBackup(name string, repoPath string, patterns []string) error {
-	backupPath := s.BackupPath(name)
+// createBackupDir creates a new, uniquely named backup directory.
+// Backups taken within the same second get a numeric suffix.
+func (s *Storage) createBackupDir(prefix string, createdAt time.Time) (string, error) {
+	if err := os.MkdirAll(s.cfg.BackupsPath(), 0755); err != nil {
+		return "", fmt.Errorf("failed to create backups directory: %w", err)
+	}
 
-	if !fileutil.Exists(backupPath) {
-		return fmt.Errorf("backup '%s' not found", name)
+	base := fmt.Sprintf("%s-%s", prefix, createdAt.Format("2006-01-02-150405"))
+	name := base
+	for i := 2; ; i++ {
+		err := os.Mkdir(s.BackupPath(name), 0755)
+		if err == nil {
+			return name, nil
+		}
+		if !os.IsExist(err) {
+			return "", fmt.Errorf("failed to create backup directory: %w", err)
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
 	}
+}
 
-	// First, remove existing AI files from repo
-	aiFiles, err := fileutil.ExpandPatterns(repoPath, patterns)
+// RestoreBackup stages the restoration of a backup into a transaction,
+// after removing the given paths of the transaction's target. Backups with
+// a manifest are verified against their checksums first.
+func (s *Storage) RestoreBackup(name string, txn *Transaction, remove []string) error {
+	backup, err := s.GetBackup(name)
 	if err != nil {
-		return fmt.Errorf("failed to find existing AI files: %w", err)
+		return err
 	}
 
-	for _, fullPath := range aiFiles {
-		if err := os.RemoveAll(fullPath); err != nil {
-			return fmt.Errorf("failed to remove %s: %w", fullPath, err)
-		}
+	if err := verifyBackup(backup); err != nil {
+		return err
+	}
+
+	// First, remove the files the backup replaces
+	for _, relPath := range remove {
+		txn.Remove(relPath)
 	}
 
 	// Copy backup contents to repo
-	entries, err := os.ReadDir(backupPath)
+	files, err := s.GetBackupFiles(backup.Name)
 	if err != nil {
-		return fmt.Errorf("failed to read backup: %w", err)
+		return err
 	}
 
-	for _, entry := range entries {
-		srcPath := filepath.Join(backupPath, entry.Name())
-		dstPath := filepath.Join(repoPath, entry.Name())
-
-		if err := fileutil.CopyPath(srcPath, dstPath); err != nil {
-			return fmt.Errorf("failed to restore %s: %w", entry.Name(), err)
+	for _, relPath := range files {
+		if err := txn.Place(relPath, filepath.Join(backup.Path, relPath)); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", relPath, err)
 		}
 	}
 
 	return nil
 }
 
+// verifyBackup checks the files of a backup against its manifest
+func verifyBackup(backup *Backup) error {
+	for _, file := range backup.Files {
+		ok, err := fileutil.VerifyChecksum(filepath.Join(backup.Path, file.Path), file.Checksum)
+		if err != nil {
+			return fmt.Errorf("backup '%s' is damaged: %w", backup.Name, err)
+		}
+		if !ok {
+			return fmt.Errorf("backup '%s' is damaged: checksum mismatch for %s", backup.Name, file.Path)
+		}
+	}
+	return nil
+}
+
 // DeleteBackup deletes a backup
 func (s *Storage) DeleteBackup(name string) error {
 	backupPath := s.BackupPath(name)
 
+	lock, err := s.lockPath(backupPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	if !fileutil.Exists(backupPath) {
 		return fmt.Errorf("backup '%s' not found", name)
 	}
@@ -177,17 +362,37 @@ func (s *Storage) DeleteBackup(name string) error {
 	return nil
 }
 
-// GetBackupsForRepo returns backups for a specific repo
+// GetBackupsForRepo returns backups for a specific repo, matched on the
+// repo path recorded in their manifest. Backups from before manifests
+// existed are matched when the repo state still refers to them.
 func (s *Storage) GetBackupsForRepo(repoPath string) ([]Backup, error) {
-	repoName := filepath.Base(repoPath)
+	absPath, err := filepath.Abs(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve path: %w", err)
+	}
+
 	allBackups, err := s.ListBackups()
 	if err != nil {
 		return nil, err
 	}
 
+	state, err := s.GetRepoState(absPath)
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[string]bool)
+	if state != nil {
+		if state.Baseline != nil {
+			referenced[state.Baseline.Backup] = true
+		}
+		for _, layer := range state.Stack {
+			referenced[layer.Backup] = true
+		}
+	}
+
 	var repoBackups []Backup
 	for _, backup := range allBackups {
-		if strings.HasPrefix(backup.Name, repoName+"-") {
+		if backup.RepoPath == absPath || (backup.RepoPath == "" && referenced[backup.Name]) {
 			repoBackups = append(repoBackups, backup)
 		}
 	}
@@ -209,7 +414,7 @@ func (s *Storage) GetLatestBackupForRepo(repoPath string) (*Backup, error) {
 	return &backups[0], nil // Already sorted newest first
 }
 
-// GetBackupFiles returns the list of files in a backup
+// GetBackupFiles returns the list of files in a backup, excluding its manifest
 func (s *Storage) GetBackupFiles(name string) ([]string, error) {
 	backupPath := s.BackupPath(name)
 
@@ -217,20 +422,54 @@ func (s *Storage) GetBackupFiles(name string) ([]string, error) {
 		return nil, fmt.Errorf("backup '%s' not found", name)
 	}
 
-	return fileutil.ListAllFiles(backupPath)
+	files, err := fileutil.ListAllFiles(backupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, f := range files {
+		if f != BackupManifestFile {
+			result = append(result, f)
+		}
+	}
+	return result, nil
 }
 
-// parseBackupTimestamp extracts timestamp from backup name
-func parseBackupTimestamp(name string) time.Time {
-	// Format: reponame-YYYY-MM-DD-HHMMSS
-	parts := strings.Split(name, "-")
-	if len(parts) >= 4 {
-		// Try to parse the last 4 parts as timestamp
-		timestampStr := strings.Join(parts[len(parts)-4:], "-")
-		t, err := time.Parse("2006-01-02-150405", timestampStr)
-		if err == nil {
-			return t
+// readBackupManifest reads the manifest of a backup, returning nil for
+// backups created before manifests existed
+func readBackupManifest(backupPath string) (*BackupManifest, error) {
+	data, err := os.ReadFile(filepath.Join(backupPath, BackupManifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
 		}
+		return nil, fmt.Errorf("failed to read backup manifest: %w", err)
+	}
+
+	var manifest BackupManifest
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse backup manifest: %w", err)
+	}
+
+	return &manifest, nil
+}
+
+// newBackupID returns a random backup ID
+func newBackupID() (string, error) {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate backup ID: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// sortedKeys returns the keys of a path map in sorted order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
-	return time.Time{}
+	sort.Strings(keys)
+	return keys
 }
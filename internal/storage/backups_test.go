@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestGetBackupsForRepo(t *testing.T) {
+	s := newTestStorage(t)
+	repo := t.TempDir()
+	other := t.TempDir()
+	writeFiles(t, repo, map[string]string{"CLAUDE.md": "repo"})
+	writeFiles(t, other, map[string]string{"CLAUDE.md": "other"})
+
+	current, err := s.CreateBackup(repo, []string{"CLAUDE.md"}, BackupOptions{Operation: "apply"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateBackup(other, []string{"CLAUDE.md"}, BackupOptions{Operation: "apply"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Backups from before manifests existed: only the repo state tells
+	// which repo they belong to
+	for _, name := range []string{"legacy-baseline", "legacy-layer", "legacy-unknown"} {
+		writeFiles(t, filepath.Join(s.cfg.BackupsPath(), name), map[string]string{"CLAUDE.md": name})
+	}
+	err = s.SetRepoState(repo, &RepoState{
+		Baseline: &StateLayer{Operation: "apply", Backup: "legacy-baseline"},
+		Stack:    []StateLayer{{Operation: "apply", Backup: "legacy-layer"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := s.GetBackupsForRepo(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, backup := range backups {
+		got = append(got, backup.Name)
+	}
+	sort.Strings(got)
+
+	want := []string{current, "legacy-baseline", "legacy-layer"}
+	sort.Strings(want)
+	if len(got) != len(want) {
+		t.Fatalf("backups = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("backups = %v, want %v", got, want)
+		}
+	}
+}
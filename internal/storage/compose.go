@@ -0,0 +1,469 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/pkg/blocks"
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+	"github.com/HammerSpb/aipaca/pkg/merge"
+	"github.com/HammerSpb/aipaca/pkg/render"
+)
+
+// ResolveProfiles expands the extends of each named profile and returns
+// the full layer list, bottom first. A profile that appears more than once
+// is applied at its first position.
+func (s *Storage) ResolveProfiles(names []string) ([]string, error) {
+	var layers []string
+	seen := make(map[string]bool)
+
+	var visit func(name string, chain []string) error
+	visit = func(name string, chain []string) error {
+		for _, c := range chain {
+			if c == name {
+				return fmt.Errorf("profile '%s' extends itself (%s)", name, strings.Join(append(chain, name), " → "))
+			}
+		}
+		if seen[name] {
+			return nil
+		}
+
+		manifest, err := s.GetProfileManifest(name)
+		if err != nil {
+			if len(chain) > 0 {
+				return fmt.Errorf("%w (extended by '%s')", err, chain[len(chain)-1])
+			}
+			return err
+		}
+
+		chain = append(chain[:len(chain):len(chain)], name)
+		for _, parent := range manifest.Extends {
+			if err := visit(parent, chain); err != nil {
+				return err
+			}
+		}
+
+		seen[name] = true
+		layers = append(layers, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return layers, nil
+}
+
+// CheckExtends verifies that name can extend parents: every parent exists
+// and none of them leads back to name
+func (s *Storage) CheckExtends(name string, parents []string) error {
+	layers, err := s.ResolveProfiles(parents)
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		if layer == name {
+			return fmt.Errorf("profile '%s' cannot extend %s: it would extend itself", name, strings.Join(parents, ", "))
+		}
+	}
+	return nil
+}
+
+// ProfileOwners returns, for every file provided by the layers, the layer
+// that owns it: the last one providing the file
+func (s *Storage) ProfileOwners(layers []string) (map[string]string, error) {
+	comp, err := s.Compose(layers, ComposeOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return comp.Owners(), nil
+}
+
+// ComposeOptions controls how stacked profiles are combined into the files
+// of a repo
+type ComposeOptions struct {
+	// Base is the repo's own content (relative path -> full path), merged
+	// underneath the layers where a merge rule applies
+	Base map[string]string
+
+	// Vars are the template variables. Templates are only rendered when
+	// Vars is set; otherwise they are kept as they are stored.
+	Vars map[string]string
+
+	// RepoPath is the repo the profiles are applied to. When it is set,
+	// files whose manifest conditions fail for the repo are skipped.
+	RepoPath string
+
+	// Dirs reads layers from other directories than their profiles, such
+	// as snapshots (layer -> directory)
+	Dirs map[string]string
+}
+
+// ComposedFile is a file of stacked profiles as it is applied to a repo
+type ComposedFile struct {
+	Path     string
+	Owner    string         // Top layer providing the file
+	Source   string         // Path of the file in the owner profile, e.g. CLAUDE.md.tmpl
+	Sources  []string       // Full paths of the versions combined, bottom first
+	Strategy merge.Strategy // How Sources are combined
+
+	parts []sourcePart // Details of each of Sources
+	vars  map[string]string
+}
+
+// sourcePart describes one version of a composed file
+type sourcePart struct {
+	layer    string // Empty for the repo's own content
+	relPath  string // Path in the layer's profile
+	template bool
+}
+
+// Merged reports whether the file combines several versions
+func (f *ComposedFile) Merged() bool {
+	return f.Strategy != merge.Replace && len(f.Sources) > 1
+}
+
+// Rendered reports whether any version of the file is a template
+func (f *ComposedFile) Rendered() bool {
+	for _, p := range f.parts {
+		if p.template {
+			return true
+		}
+	}
+	return false
+}
+
+// Generated reports whether the applied content differs from any single
+// stored file, because it is merged, rendered or wrapped in a block
+func (f *ComposedFile) Generated() bool {
+	return f.Merged() || f.Rendered() || f.Strategy == merge.Block
+}
+
+// Layers returns the layers providing a version of the file, bottom first
+func (f *ComposedFile) Layers() []string {
+	var layers []string
+	for _, p := range f.parts {
+		if p.layer != "" {
+			layers = append(layers, p.layer)
+		}
+	}
+	return layers
+}
+
+// LayerSource returns the path of the file in a layer's profile and its
+// full path
+func (f *ComposedFile) LayerSource(layer string) (relPath, fullPath string, ok bool) {
+	for i, p := range f.parts {
+		if p.layer == layer {
+			return p.relPath, f.Sources[i], true
+		}
+	}
+	return "", "", false
+}
+
+// LayerContent returns a layer's version of the file, rendered when it is
+// a template
+func (f *ComposedFile) LayerContent(layer string) ([]byte, error) {
+	for i, p := range f.parts {
+		if p.layer == layer {
+			return f.read(i)
+		}
+	}
+	return nil, fmt.Errorf("profile '%s' does not provide %s", layer, f.Path)
+}
+
+// Content returns the content of the file as applied
+func (f *ComposedFile) Content() ([]byte, error) {
+	versions := make([][]byte, len(f.Sources))
+	for i := range f.Sources {
+		data, err := f.read(i)
+		if err != nil {
+			return nil, err
+		}
+		versions[i] = data
+	}
+
+	if f.Strategy == merge.Block {
+		var base string
+		var want []blocks.Block
+		for i, p := range f.parts {
+			if p.layer == "" {
+				base = string(versions[i])
+			} else {
+				want = append(want, blocks.Block{Profile: p.layer, Content: string(versions[i])})
+			}
+		}
+		return []byte(blocks.Update(base, want)), nil
+	}
+
+	if !f.Merged() {
+		return versions[len(versions)-1], nil
+	}
+
+	data, err := merge.Merge(f.Path, f.Strategy, versions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge %s: %w", f.Path, err)
+	}
+	return data, nil
+}
+
+// Reverse turns an edited copy of a layer's version of the file back into
+// the content of its source. For templates, lines that still render the
+// same keep the template text, and values the template rendered from
+// placeholders become placeholders again.
+func (f *ComposedFile) Reverse(layer string, edited []byte) ([]byte, error) {
+	for i, p := range f.parts {
+		if p.layer != layer {
+			continue
+		}
+		if !p.template {
+			return edited, nil
+		}
+
+		tmpl, err := os.ReadFile(f.Sources[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", f.Sources[i], err)
+		}
+		rendered, err := f.read(i)
+		if err != nil {
+			return nil, err
+		}
+		return render.Reverse(tmpl, rendered, edited, f.vars), nil
+	}
+	return nil, fmt.Errorf("profile '%s' does not provide %s", layer, f.Path)
+}
+
+// read returns version i of the file, rendered when it is a template
+func (f *ComposedFile) read(i int) ([]byte, error) {
+	src := f.Sources[i]
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", src, err)
+	}
+	if f.parts[i].template {
+		return render.Render(filepath.Base(src), data, f.vars)
+	}
+	return data, nil
+}
+
+// Composition is the set of files that stacked profiles put into a repo
+type Composition struct {
+	Layers  []string
+	Files   map[string]*ComposedFile
+	Skipped []SkippedFile // Files left out by their conditions, in layer order
+}
+
+// Owners returns the owning layer of every file
+func (c *Composition) Owners() map[string]string {
+	owners := make(map[string]string, len(c.Files))
+	for path, f := range c.Files {
+		owners[path] = f.Owner
+	}
+	return owners
+}
+
+// Compose works out the files of stacked profiles (bottom first). Files
+// provided by several layers are combined according to the merge rules of
+// the profile manifests (top layer first) and then the config; without a
+// rule the top layer wins. Files in opts.Base are merged underneath the
+// layers when a rule applies to them, and are ignored otherwise. Templates
+// are rendered with opts.Vars, and files are checked against their
+// conditions when opts.RepoPath is set.
+func (s *Storage) Compose(layers []string, opts ComposeOptions) (*Composition, error) {
+	comp := &Composition{
+		Layers: layers,
+		Files:  make(map[string]*ComposedFile),
+	}
+
+	manifests := make(map[string]*ProfileManifest, len(layers))
+	var rules []config.MergeRule
+	for i := len(layers) - 1; i >= 0; i-- {
+		manifest, err := s.layerManifest(layers[i], opts)
+		if err != nil {
+			return nil, err
+		}
+		manifests[layers[i]] = manifest
+		rules = append(rules, manifest.Merge...)
+	}
+	rules = append(rules, s.cfg.MergeRules...)
+
+	var checker *conditionChecker
+	if opts.RepoPath != "" {
+		checker = newConditionChecker(opts.RepoPath)
+	}
+
+	for _, layer := range layers {
+		files, err := s.layerFiles(layer, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, relPath := range files {
+			fullPath := filepath.Join(s.layerDir(layer, opts), relPath)
+
+			target, isTemplate := relPath, false
+			if opts.Vars != nil {
+				target, isTemplate = manifests[layer].TemplateTarget(relPath)
+			}
+
+			if checker != nil {
+				reason, err := checker.check(manifests[layer], relPath, target)
+				if err != nil {
+					return nil, fmt.Errorf("failed to check conditions of %s in profile '%s': %w", relPath, layer, err)
+				}
+				if reason != "" {
+					comp.Skipped = append(comp.Skipped, SkippedFile{Path: relPath, Profile: layer, Reason: reason})
+					continue
+				}
+			}
+
+			f, ok := comp.Files[target]
+			if !ok {
+				f = &ComposedFile{Path: target, vars: opts.Vars}
+				f.Strategy, err = strategyFor(rules, target)
+				if err != nil {
+					return nil, err
+				}
+				if basePath := baseFor(f.Strategy, target, opts); basePath != "" {
+					f.Sources = append(f.Sources, basePath)
+					f.parts = append(f.parts, sourcePart{relPath: target})
+				}
+				comp.Files[target] = f
+			}
+
+			f.Owner = layer
+			f.Source = relPath
+			part := sourcePart{layer: layer, relPath: relPath, template: isTemplate}
+			if f.Strategy == merge.Replace {
+				f.Sources = []string{fullPath}
+				f.parts = []sourcePart{part}
+			} else {
+				f.Sources = append(f.Sources, fullPath)
+				f.parts = append(f.parts, part)
+			}
+		}
+	}
+
+	return comp, nil
+}
+
+// layerDir returns the directory a layer is read from
+func (s *Storage) layerDir(layer string, opts ComposeOptions) string {
+	if dir, ok := opts.Dirs[layer]; ok {
+		return dir
+	}
+	return s.ProfilePath(layer)
+}
+
+// layerManifest returns the manifest of a layer
+func (s *Storage) layerManifest(layer string, opts ComposeOptions) (*ProfileManifest, error) {
+	if dir, ok := opts.Dirs[layer]; ok {
+		return readProfileManifest(dir)
+	}
+	return s.GetProfileManifest(layer)
+}
+
+// layerFiles returns the files of a layer, without its manifest
+func (s *Storage) layerFiles(layer string, opts ComposeOptions) ([]string, error) {
+	if dir, ok := opts.Dirs[layer]; ok {
+		return listProfileFiles(dir)
+	}
+	return s.GetProfileFiles(layer)
+}
+
+// baseFor returns the repo's own version of a file that is merged
+// underneath the layers, if any. Blocks go into the file as it is in the
+// repo now; other strategies merge with the original content in opts.Base.
+func baseFor(strategy merge.Strategy, target string, opts ComposeOptions) string {
+	switch strategy {
+	case merge.Replace:
+		return ""
+	case merge.Block:
+		if opts.RepoPath == "" {
+			return ""
+		}
+		current := filepath.Join(opts.RepoPath, target)
+		if !fileutil.IsFile(current) {
+			return ""
+		}
+		return current
+	default:
+		return opts.Base[target]
+	}
+}
+
+// strategyFor returns the strategy of the first rule matching relPath
+func strategyFor(rules []config.MergeRule, relPath string) (merge.Strategy, error) {
+	slashPath := filepath.ToSlash(relPath)
+	for _, rule := range rules {
+		matched, err := doublestar.Match(rule.Path, slashPath)
+		if err != nil {
+			return "", fmt.Errorf("invalid merge rule path '%s': %w", rule.Path, err)
+		}
+		if matched {
+			return merge.ParseStrategy(rule.Strategy)
+		}
+	}
+	return merge.Replace, nil
+}
+
+// ApplyProfiles stages the files of stacked profiles into a transaction.
+// Later layers override earlier ones per file unless a merge rule combines
+// them (see Compose).
+func (s *Storage) ApplyProfiles(layers []string, opts ComposeOptions, txn *Transaction) error {
+	// Keep the profiles from being rewritten while they are staged
+	for _, layer := range layers {
+		lock, err := s.LockProfile(layer)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+	}
+
+	comp, err := s.Compose(layers, opts)
+	if err != nil {
+		return fmt.Errorf("failed to read profiles: %w", err)
+	}
+
+	files := make([]string, 0, len(comp.Files))
+	for f := range comp.Files {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	for _, relPath := range files {
+		f := comp.Files[relPath]
+		src := f.Sources[len(f.Sources)-1]
+
+		if !f.Generated() {
+			if err := txn.Place(relPath, src); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := f.Content()
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", src, err)
+		}
+		if err := txn.PlaceData(relPath, data, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
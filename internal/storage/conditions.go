@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"gopkg.in/yaml.v3"
+
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+	"github.com/HammerSpb/aipaca/pkg/gitutil"
+)
+
+// FileCondition limits profile files to repos that pass every check it
+// sets. A file matched by several conditions must pass all of them.
+type FileCondition struct {
+	Path string `yaml:"path"` // Profile files the condition applies to (glob)
+
+	Exists string         `yaml:"exists,omitempty"` // Repo path that must exist, e.g. go.mod
+	Glob   string         `yaml:"glob,omitempty"`   // Glob that must match a repo file, e.g. src/**/*.tsx
+	JSON   *JSONCondition `yaml:"json,omitempty"`   // Value that a JSON or YAML file must contain
+	Remote string         `yaml:"remote,omitempty"` // Regular expression a git remote URL must match
+}
+
+// JSONCondition checks a value in a JSON or YAML file of the repo
+type JSONCondition struct {
+	File string `yaml:"file"` // Repo file, e.g. package.json
+	Path string `yaml:"path"` // Dot-separated key path, e.g. dependencies
+
+	// Contains is a key of an object, an element of an array or a
+	// substring of a string at Path. Without it Path only has to exist.
+	Contains string `yaml:"contains,omitempty"`
+}
+
+// SkippedFile is a profile file left out because a condition failed
+type SkippedFile struct {
+	Path    string // Path in the profile
+	Profile string
+	Reason  string
+}
+
+// errGlobMatched stops a glob walk at the first match
+var errGlobMatched = errors.New("glob matched")
+
+// conditionChecker evaluates file conditions against a repo, checking each
+// condition only once
+type conditionChecker struct {
+	repoPath string
+	results  map[*FileCondition]string // Condition -> failure reason ("" passes)
+}
+
+// newConditionChecker returns a checker for the repo at repoPath
+func newConditionChecker(repoPath string) *conditionChecker {
+	return &conditionChecker{
+		repoPath: repoPath,
+		results:  make(map[*FileCondition]string),
+	}
+}
+
+// check returns why a profile file (source and target path) must be
+// skipped, or an empty string when it passes the manifest's conditions
+func (c *conditionChecker) check(manifest *ProfileManifest, relPath, target string) (string, error) {
+	for i := range manifest.Conditions {
+		cond := &manifest.Conditions[i]
+
+		matched, err := cond.matches(relPath, target)
+		if err != nil {
+			return "", err
+		}
+		if !matched {
+			continue
+		}
+
+		reason, ok := c.results[cond]
+		if !ok {
+			reason, err = cond.evaluate(c.repoPath)
+			if err != nil {
+				return "", err
+			}
+			c.results[cond] = reason
+		}
+		if reason != "" {
+			return reason, nil
+		}
+	}
+	return "", nil
+}
+
+// matches reports whether the condition applies to a profile file, given
+// by its path in the profile or in the repo
+func (cond *FileCondition) matches(relPath, target string) (bool, error) {
+	for _, p := range []string{relPath, target} {
+		matched, err := doublestar.Match(cond.Path, filepath.ToSlash(p))
+		if err != nil {
+			return false, fmt.Errorf("invalid condition path '%s': %w", cond.Path, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// evaluate runs the checks of a condition against a repo and returns the
+// reason of the first one that fails
+func (cond *FileCondition) evaluate(repoPath string) (string, error) {
+	if cond.Exists != "" && !fileutil.Exists(filepath.Join(repoPath, cond.Exists)) {
+		return fmt.Sprintf("%s does not exist", cond.Exists), nil
+	}
+
+	if cond.Glob != "" {
+		err := doublestar.GlobWalk(os.DirFS(repoPath), cond.Glob, func(string, fs.DirEntry) error {
+			return errGlobMatched
+		})
+		switch {
+		case errors.Is(err, errGlobMatched):
+		case err != nil:
+			return "", fmt.Errorf("failed to match condition glob '%s': %w", cond.Glob, err)
+		default:
+			return fmt.Sprintf("no files match %s", cond.Glob), nil
+		}
+	}
+
+	if cond.JSON != nil {
+		reason, err := cond.JSON.evaluate(repoPath)
+		if err != nil || reason != "" {
+			return reason, err
+		}
+	}
+
+	if cond.Remote != "" {
+		re, err := regexp.Compile(cond.Remote)
+		if err != nil {
+			return "", fmt.Errorf("invalid condition remote '%s': %w", cond.Remote, err)
+		}
+		remotes, err := gitutil.Remotes(repoPath)
+		if err != nil {
+			return "", err
+		}
+		matched := false
+		for _, url := range remotes {
+			if re.MatchString(url) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Sprintf("no git remote matches %s", cond.Remote), nil
+		}
+	}
+
+	return "", nil
+}
+
+// evaluate checks the value at the key path of the file
+func (cond *JSONCondition) evaluate(repoPath string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(repoPath, cond.File))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Sprintf("%s does not exist", cond.File), nil
+		}
+		return "", fmt.Errorf("failed to read %s: %w", cond.File, err)
+	}
+
+	// YAML is a superset of JSON, so one parser reads both
+	var value any
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %w", cond.File, err)
+	}
+
+	if cond.Path != "" {
+		for _, key := range strings.Split(cond.Path, ".") {
+			var ok bool
+			if value, ok = lookupKey(value, key); !ok {
+				return fmt.Sprintf("%s has no %s", cond.File, cond.Path), nil
+			}
+		}
+	}
+
+	if cond.Contains != "" && !containsValue(value, cond.Contains) {
+		where := cond.File
+		if cond.Path != "" {
+			where += ": " + cond.Path
+		}
+		return fmt.Sprintf("%s does not contain %s", where, cond.Contains), nil
+	}
+
+	return "", nil
+}
+
+// lookupKey returns the value of an object key or array index
+func lookupKey(value any, key string) (any, bool) {
+	switch v := value.(type) {
+	case map[string]any:
+		child, ok := v[key]
+		return child, ok
+	case []any:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil, false
+		}
+		return v[i], true
+	default:
+		return nil, false
+	}
+}
+
+// containsValue reports whether an object has the key want, an array has
+// the element want, or a string has the substring want
+func containsValue(value any, want string) bool {
+	switch v := value.(type) {
+	case map[string]any:
+		_, ok := v[want]
+		return ok
+	case []any:
+		for _, item := range v {
+			if fmt.Sprint(item) == want {
+				return true
+			}
+		}
+		return false
+	case string:
+		return strings.Contains(v, want)
+	default:
+		return fmt.Sprint(v) == want
+	}
+}
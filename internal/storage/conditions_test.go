@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestConditionEvaluate(t *testing.T) {
+	repo := t.TempDir()
+	writeFiles(t, repo, map[string]string{
+		"go.mod":            "module example.com/app\n",
+		"web/src/App.tsx":   "export {}\n",
+		"package.json":      `{"name": "app", "dependencies": {"react": "^19"}, "keywords": ["ui", "web"]}`,
+		"config/tools.yaml": "lint:\n  enabled: true\n",
+	})
+
+	tests := []struct {
+		name string
+		cond FileCondition
+		want string
+	}{
+		{"no checks", FileCondition{}, ""},
+		{"exists", FileCondition{Exists: "go.mod"}, ""},
+		{"missing", FileCondition{Exists: "Cargo.toml"}, "Cargo.toml does not exist"},
+		{"glob", FileCondition{Glob: "**/*.tsx"}, ""},
+		{"glob without match", FileCondition{Glob: "**/*.py"}, "no files match **/*.py"},
+		{"json key", FileCondition{JSON: &JSONCondition{File: "package.json", Path: "dependencies", Contains: "react"}}, ""},
+		{"json missing key", FileCondition{JSON: &JSONCondition{File: "package.json", Path: "dependencies", Contains: "vue"}}, "package.json: dependencies does not contain vue"},
+		{"json array element", FileCondition{JSON: &JSONCondition{File: "package.json", Path: "keywords", Contains: "web"}}, ""},
+		{"json array index", FileCondition{JSON: &JSONCondition{File: "package.json", Path: "keywords.1"}}, ""},
+		{"json missing path", FileCondition{JSON: &JSONCondition{File: "package.json", Path: "devDependencies"}}, "package.json has no devDependencies"},
+		{"json string", FileCondition{JSON: &JSONCondition{File: "package.json", Path: "name", Contains: "ap"}}, ""},
+		{"json missing file", FileCondition{JSON: &JSONCondition{File: "composer.json"}}, "composer.json does not exist"},
+		{"yaml value", FileCondition{JSON: &JSONCondition{File: "config/tools.yaml", Path: "lint.enabled", Contains: "true"}}, ""},
+		{"first failing check", FileCondition{Exists: "go.mod", Glob: "**/*.py"}, "no files match **/*.py"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cond.evaluate(repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("evaluate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConditionRemote(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	repo := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"remote", "add", "origin", "git@github.com:acme/app.git"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	tests := []struct {
+		remote string
+		want   string
+	}{
+		{"github.com[:/]acme/", ""},
+		{"gitlab", "no git remote matches gitlab"},
+	}
+	for _, tt := range tests {
+		got, err := (&FileCondition{Remote: tt.remote}).evaluate(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("remote %s: evaluate() = %q, want %q", tt.remote, got, tt.want)
+		}
+	}
+
+	if _, err := (&FileCondition{Remote: "("}).evaluate(repo); err == nil {
+		t.Error("invalid remote expression: want error")
+	}
+}
+
+func TestConditionCheck(t *testing.T) {
+	repo := t.TempDir()
+	writeFiles(t, repo, map[string]string{"go.mod": "module app\n"})
+
+	manifest := &ProfileManifest{Conditions: []FileCondition{
+		{Path: ".claude/commands/go-*.md", Exists: "go.mod"},
+		{Path: "**/*.tsx.md", Exists: "package.json"},
+		{Path: "rust/**", Exists: "Cargo.toml"},
+	}}
+	tests := []struct {
+		relPath, target string
+		want            string
+	}{
+		{".claude/commands/go-test.md", ".claude/commands/go-test.md", ""},
+		{"docs/react.tsx.md", "docs/react.tsx.md", "package.json does not exist"},
+		{"rust/CLAUDE.md", "CLAUDE.md", "Cargo.toml does not exist"},
+		{"CLAUDE.md", "CLAUDE.md", ""},
+	}
+
+	checker := newConditionChecker(repo)
+	for _, tt := range tests {
+		got, err := checker.check(manifest, tt.relPath, tt.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("check(%s) = %q, want %q", tt.relPath, got, tt.want)
+		}
+	}
+}
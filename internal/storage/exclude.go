@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/HammerSpb/aipaca/pkg/blocks"
+	"github.com/HammerSpb/aipaca/pkg/gitutil"
+)
+
+// syncGitExclude keeps the aipaca blocks in the info/exclude files of a
+// repo in step with the files aipaca manages there, when the config asks
+// for it. Each file goes to the work tree that holds it, so files inside
+// a nested repository go to that repository. Blocks written for the files
+// managed before are emptied, so turning the setting off removes them.
+func (s *Storage) syncGitExclude(repoPath string, prev, next *RepoState) error {
+	roots := make(map[string]string) // Directory -> work tree root
+	rootOf := func(relPath string) (string, error) {
+		dir := filepath.Dir(filepath.Join(repoPath, relPath))
+		if root, ok := roots[dir]; ok {
+			return root, nil
+		}
+		root, err := gitutil.FindRoot(dir)
+		if err != nil {
+			return "", err
+		}
+		roots[dir] = root
+		return root, nil
+	}
+
+	patterns := make(map[string][]string) // Work tree root -> patterns
+	if prev != nil {
+		for relPath := range prev.Managed {
+			root, err := rootOf(relPath)
+			if err != nil {
+				return err
+			}
+			patterns[root] = patterns[root][:0]
+		}
+	}
+	if next != nil && s.cfg.GitExcludeFor(repoPath) {
+		for relPath := range next.Managed {
+			if userContent(filepath.Join(repoPath, relPath)) {
+				continue
+			}
+			root, err := rootOf(relPath)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, filepath.Join(repoPath, relPath))
+			if err != nil {
+				return err
+			}
+			patterns[root] = append(patterns[root], gitutil.ExcludePattern(rel))
+		}
+	}
+
+	for root, list := range patterns {
+		if root == "" {
+			continue // Not in a git repository
+		}
+		sort.Strings(list)
+		if err := gitutil.SetExcludeBlock(root, repoPath, list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userContent reports whether a managed file holds the user's own content
+// next to aipaca blocks; such a file is the user's to commit or not
+func userContent(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	text := string(data)
+	return blocks.Has(text) && strings.TrimSpace(blocks.Strip(text)) != ""
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetRepoStateSyncsGitExclude(t *testing.T) {
+	s := newTestStorage(t)
+	s.cfg.GitExclude = true
+	repo := t.TempDir()
+	writeFiles(t, repo, map[string]string{
+		".git/HEAD":    "ref: refs/heads/main\n",
+		"CLAUDE.md":    "x",
+		".claude/a.md": "y",
+	})
+	exclude := filepath.Join(repo, ".git", "info", "exclude")
+
+	err := s.SetRepoState(repo, &RepoState{Managed: map[string]string{"CLAUDE.md": "", ".claude/a.md": ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("# aipaca:begin %s\n/.claude/a.md\n/CLAUDE.md\n# aipaca:end\n", repo)
+	if string(data) != want {
+		t.Errorf("exclude file =\n%s\nwant\n%s", data, want)
+	}
+
+	// Clearing the state empties the block
+	if err := s.ClearRepoState(repo); err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "" {
+		t.Errorf("exclude file after clearing the state = %q, want it empty", data)
+	}
+}
+
+func TestSetRepoStateWithUnwritableGitExclude(t *testing.T) {
+	s := newTestStorage(t)
+	s.cfg.GitExclude = true
+	repo := t.TempDir()
+	// A file where the info directory belongs cannot be written into,
+	// whoever runs the test
+	writeFiles(t, repo, map[string]string{
+		".git/HEAD": "ref: refs/heads/main\n",
+		".git/info": "not a directory",
+		"CLAUDE.md": "x",
+	})
+
+	var warnings []string
+	defer func(warnf func(string, ...any)) { Warnf = warnf }(Warnf)
+	Warnf = func(format string, args ...any) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	state := &RepoState{AppliedProfile: "go", Managed: map[string]string{"CLAUDE.md": ""}}
+	if err := s.SetRepoState(repo, state); err != nil {
+		t.Fatalf("SetRepoState() = %v, want the exclude file to be skipped", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "git exclude") {
+		t.Errorf("warnings = %q, want one about the exclude file", warnings)
+	}
+
+	got, err := s.GetRepoState(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.AppliedProfile != "go" {
+		t.Errorf("state = %+v, want it recorded", got)
+	}
+}
@@ -0,0 +1,550 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+)
+
+// Journal phases
+const (
+	PhaseStaging    = "staging"
+	PhaseCommitting = "committing"
+	PhaseCommitted  = "committed"
+)
+
+// Journal entry actions
+const (
+	ActionRemove = "remove"
+	ActionPlace  = "place"
+)
+
+const journalFileName = "journal.yaml"
+
+// JournalEntry is a single path swapped by a transaction
+type JournalEntry struct {
+	Path    string `yaml:"path"`
+	Action  string `yaml:"action"`
+	Existed bool   `yaml:"existed,omitempty"`
+}
+
+// Journal is the on-disk record of a transaction. It is written before
+// anything in the target directory is touched, so an interrupted
+// transaction can be rolled forward or back by a later invocation.
+type Journal struct {
+	ID         string         `yaml:"id"`
+	Operation  string         `yaml:"operation"`
+	TargetDir  string         `yaml:"target_dir"`
+	Phase      string         `yaml:"phase"`
+	CreatedAt  time.Time      `yaml:"created_at"`
+	Entries    []JournalEntry `yaml:"entries"`
+	RepoPath   string         `yaml:"repo_path,omitempty"`
+	RepoState  *RepoState     `yaml:"repo_state,omitempty"`
+	ClearState bool           `yaml:"clear_state,omitempty"`
+}
+
+// Transaction stages changes to a directory and swaps them in as a unit.
+//
+// New content is staged under the transactions directory, existing paths
+// are moved aside rather than deleted, and every step is recorded in the
+// journal so the swap can be completed or undone after a crash.
+type Transaction struct {
+	s          *Storage
+	dir        string
+	journal    *Journal
+	done       bool
+	targetLock *Lock
+	txnLock    *os.File
+}
+
+// BeginTransaction starts a new transaction against targetDir. The target
+// stays locked until the transaction is committed or aborted.
+func (s *Storage) BeginTransaction(operation, targetDir string) (*Transaction, error) {
+	absTarget, err := filepath.Abs(targetDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve path: %w", err)
+	}
+
+	targetLock, err := s.lockPath(absTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	txn, err := s.beginTransaction(operation, absTarget)
+	if err != nil {
+		targetLock.Release()
+		return nil, err
+	}
+	txn.targetLock = targetLock
+
+	return txn, nil
+}
+
+// beginTransaction creates the transaction directory and initial journal
+func (s *Storage) beginTransaction(operation, absTarget string) (*Transaction, error) {
+	pending, err := s.PendingTransactions()
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range pending {
+		if j.TargetDir == absTarget {
+			return nil, fmt.Errorf("an interrupted '%s' transaction exists for %s, run 'aipaca recover' first", j.Operation, absTarget)
+		}
+	}
+
+	id, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(s.cfg.TransactionsPath(), id)
+	for _, sub := range []string{"new", "old"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create transaction directory: %w", err)
+		}
+	}
+
+	// Held for the life of the transaction, so others can tell a running
+	// transaction from an interrupted one. Taken before the journal exists.
+	txnLock, err := acquireLockFile(transactionLockPath(dir), 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	txn := &Transaction{
+		s:       s,
+		dir:     dir,
+		txnLock: txnLock,
+		journal: &Journal{
+			ID:        id,
+			Operation: operation,
+			TargetDir: absTarget,
+			Phase:     PhaseStaging,
+			CreatedAt: time.Now(),
+		},
+	}
+
+	if err := txn.writeJournal(); err != nil {
+		txn.release()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return txn, nil
+}
+
+// ID returns the transaction ID
+func (t *Transaction) ID() string {
+	return t.journal.ID
+}
+
+// TargetDir returns the directory the transaction writes to
+func (t *Transaction) TargetDir() string {
+	return t.journal.TargetDir
+}
+
+// Remove schedules relPath in the target directory for removal
+func (t *Transaction) Remove(relPath string) {
+	t.journal.Entries = append(t.journal.Entries, JournalEntry{
+		Path:   filepath.Clean(relPath),
+		Action: ActionRemove,
+	})
+}
+
+// Place stages a copy of srcPath (file or directory) to be put at relPath
+func (t *Transaction) Place(relPath, srcPath string) error {
+	stagePath := t.stagePath(len(t.journal.Entries))
+	if err := fileutil.CopyPath(srcPath, stagePath); err != nil {
+		return fmt.Errorf("failed to stage %s: %w", relPath, err)
+	}
+
+	t.journal.Entries = append(t.journal.Entries, JournalEntry{
+		Path:   filepath.Clean(relPath),
+		Action: ActionPlace,
+	})
+	return nil
+}
+
+// PlaceData stages a file with the given content to be put at relPath
+func (t *Transaction) PlaceData(relPath string, data []byte, perm os.FileMode) error {
+	stagePath := t.stagePath(len(t.journal.Entries))
+	if err := os.WriteFile(stagePath, data, perm); err != nil {
+		return fmt.Errorf("failed to stage %s: %w", relPath, err)
+	}
+
+	t.journal.Entries = append(t.journal.Entries, JournalEntry{
+		Path:   filepath.Clean(relPath),
+		Action: ActionPlace,
+	})
+	return nil
+}
+
+// PlaceDir stages an empty directory to be put at relPath and returns its
+// staging path for the caller to fill
+func (t *Transaction) PlaceDir(relPath string) (string, error) {
+	stagePath := t.stagePath(len(t.journal.Entries))
+	if err := os.MkdirAll(stagePath, 0755); err != nil {
+		return "", fmt.Errorf("failed to stage %s: %w", relPath, err)
+	}
+
+	t.journal.Entries = append(t.journal.Entries, JournalEntry{
+		Path:   filepath.Clean(relPath),
+		Action: ActionPlace,
+	})
+	return stagePath, nil
+}
+
+// RecordState sets the repo state to store once the swap is complete
+func (t *Transaction) RecordState(repoPath string, state *RepoState) {
+	t.journal.RepoPath = repoPath
+	t.journal.RepoState = state
+	t.journal.ClearState = state == nil
+}
+
+// Commit swaps the staged changes into the target directory. If the swap
+// fails part-way, the changes made so far are rolled back.
+func (t *Transaction) Commit() error {
+	if t.done {
+		return fmt.Errorf("transaction %s already finished", t.journal.ID)
+	}
+
+	// Decide which entries displace existing content before touching anything
+	for i := range t.journal.Entries {
+		entry := &t.journal.Entries[i]
+		target := filepath.Join(t.journal.TargetDir, entry.Path)
+		entry.Existed = lexists(target) && !t.coveredByEarlierRemove(i)
+	}
+
+	t.journal.Phase = PhaseCommitting
+	if err := t.writeJournal(); err != nil {
+		return err
+	}
+
+	t.done = true
+	defer t.release()
+
+	if err := rollForward(t.dir, t.journal); err != nil {
+		if rbErr := rollBack(t.dir, t.journal); rbErr != nil {
+			// Keep the journal so the next invocation can recover
+			return fmt.Errorf("%w (rollback also failed: %v; run 'aipaca recover')", err, rbErr)
+		}
+		os.RemoveAll(t.dir)
+		return err
+	}
+
+	return t.s.finishTransaction(t.dir, t.journal)
+}
+
+// Abort discards a transaction that has not been committed. It is safe to
+// call after Commit, which makes it convenient to defer.
+func (t *Transaction) Abort() error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+	t.release()
+	return os.RemoveAll(t.dir)
+}
+
+// release drops the locks held by the transaction
+func (t *Transaction) release() {
+	if t.txnLock != nil {
+		releaseLockFile(t.txnLock)
+		os.Remove(t.txnLock.Name())
+		t.txnLock = nil
+	}
+	t.targetLock.Release()
+	t.targetLock = nil
+}
+
+// coveredByEarlierRemove reports whether entry i lies inside a path that an
+// earlier entry removes, in which case its original content moves with it
+func (t *Transaction) coveredByEarlierRemove(i int) bool {
+	for _, prev := range t.journal.Entries[:i] {
+		if prev.Action == ActionRemove && within(t.journal.Entries[i].Path, prev.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// stagePath returns where new content for entry i is staged
+func (t *Transaction) stagePath(i int) string {
+	return filepath.Join(t.dir, "new", strconv.Itoa(i))
+}
+
+// writeJournal persists the journal
+func (t *Transaction) writeJournal() error {
+	return writeJournal(t.dir, t.journal)
+}
+
+// PendingTransactions returns journals of transactions that were
+// interrupted. Transactions still running in another process are skipped.
+func (s *Storage) PendingTransactions() ([]*Journal, error) {
+	entries, err := os.ReadDir(s.cfg.TransactionsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read transactions directory: %w", err)
+	}
+
+	var journals []*Journal
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(s.cfg.TransactionsPath(), entry.Name())
+		if transactionRunning(dir) {
+			continue
+		}
+
+		journal, err := readJournal(dir)
+		if err != nil {
+			continue
+		}
+		journals = append(journals, journal)
+	}
+
+	sort.Slice(journals, func(i, j int) bool {
+		return journals[i].CreatedAt.Before(journals[j].CreatedAt)
+	})
+
+	return journals, nil
+}
+
+// RecoverTransaction completes (forward) or undoes an interrupted transaction
+func (s *Storage) RecoverTransaction(id string, forward bool) error {
+	dir := filepath.Join(s.cfg.TransactionsPath(), id)
+
+	txnLock, err := acquireLockFile(transactionLockPath(dir), 0)
+	if err != nil {
+		if errors.Is(err, ErrLocked) {
+			return fmt.Errorf("transaction %s is still running in another aipaca process", id)
+		}
+		return err
+	}
+	defer func() {
+		releaseLockFile(txnLock)
+		os.Remove(txnLock.Name())
+	}()
+
+	journal, err := readJournal(dir)
+	if err != nil {
+		return err
+	}
+
+	targetLock, err := s.lockPath(journal.TargetDir)
+	if err != nil {
+		return err
+	}
+	defer targetLock.Release()
+
+	// Nothing in the target was touched while staging, so the only way
+	// forward is to discard it
+	if journal.Phase == PhaseStaging {
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to remove transaction: %w", err)
+		}
+		return nil
+	}
+
+	// Once committed, the swap is complete and only bookkeeping remains
+	if !forward && journal.Phase != PhaseCommitted {
+		if err := rollBack(dir, journal); err != nil {
+			return fmt.Errorf("failed to roll back transaction %s: %w", id, err)
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to remove transaction: %w", err)
+		}
+		return nil
+	}
+
+	if err := rollForward(dir, journal); err != nil {
+		return fmt.Errorf("failed to roll forward transaction %s: %w", id, err)
+	}
+
+	return s.finishTransaction(dir, journal)
+}
+
+// finishTransaction records the resulting repo state and removes the
+// transaction directory
+func (s *Storage) finishTransaction(dir string, journal *Journal) error {
+	journal.Phase = PhaseCommitted
+	if err := writeJournal(dir, journal); err != nil {
+		return err
+	}
+
+	if journal.RepoPath != "" {
+		var state *RepoState
+		if !journal.ClearState {
+			state = journal.RepoState
+		}
+		if err := s.SetRepoState(journal.RepoPath, state); err != nil {
+			return fmt.Errorf("failed to record state: %w", err)
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove transaction: %w", err)
+	}
+
+	return nil
+}
+
+// rollForward applies every entry of a journal. Each step checks what is
+// already on disk, so it can be repeated after an interruption.
+func rollForward(dir string, journal *Journal) error {
+	for i, entry := range journal.Entries {
+		target := filepath.Join(journal.TargetDir, entry.Path)
+		oldPath := filepath.Join(dir, "old", strconv.Itoa(i))
+		newPath := filepath.Join(dir, "new", strconv.Itoa(i))
+
+		// Move the original aside; it only appears under old/ once complete
+		if entry.Existed && !lexists(oldPath) {
+			if err := fileutil.MovePath(target, oldPath); err != nil {
+				return fmt.Errorf("failed to move aside %s: %w", entry.Path, err)
+			}
+		}
+
+		switch entry.Action {
+		case ActionRemove:
+			// Moving the original aside removed it. A path that did not
+			// exist, or moved with an earlier remove, had nothing to remove,
+			// so anything there now was placed by a later entry.
+		case ActionPlace:
+			// A missing staged copy means it was already renamed into place
+			if !lexists(newPath) {
+				continue
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("failed to clear %s: %w", entry.Path, err)
+			}
+			if err := fileutil.PlacePath(newPath, target); err != nil {
+				return fmt.Errorf("failed to place %s: %w", entry.Path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// rollBack undoes the entries of a journal in reverse order
+func rollBack(dir string, journal *Journal) error {
+	for i := len(journal.Entries) - 1; i >= 0; i-- {
+		entry := journal.Entries[i]
+		target := filepath.Join(journal.TargetDir, entry.Path)
+		oldPath := filepath.Join(dir, "old", strconv.Itoa(i))
+
+		switch {
+		case lexists(oldPath):
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("failed to clear %s: %w", entry.Path, err)
+			}
+			if err := fileutil.PlacePath(oldPath, target); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", entry.Path, err)
+			}
+		case !entry.Existed && !originalInPlace(dir, journal, i):
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", entry.Path, err)
+			}
+		}
+		// An existing path with nothing under old/ was never moved
+	}
+
+	return nil
+}
+
+// originalInPlace reports whether the path of entry i still holds original
+// content, because an earlier remove covering it never moved it aside.
+// Entries are swapped in order, so entry i was not reached either.
+func originalInPlace(dir string, journal *Journal, i int) bool {
+	for j, prev := range journal.Entries[:i] {
+		if prev.Action != ActionRemove || !prev.Existed || !within(journal.Entries[i].Path, prev.Path) {
+			continue
+		}
+		if !lexists(filepath.Join(dir, "old", strconv.Itoa(j))) {
+			return true
+		}
+	}
+	return false
+}
+
+// within reports whether path is parent or lies inside it
+func within(path, parent string) bool {
+	return path == parent || strings.HasPrefix(path, parent+string(filepath.Separator))
+}
+
+// readJournal loads the journal from a transaction directory
+func readJournal(dir string) (*Journal, error) {
+	data, err := os.ReadFile(filepath.Join(dir, journalFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	var journal Journal
+	if err := yaml.Unmarshal(data, &journal); err != nil {
+		return nil, fmt.Errorf("failed to parse journal: %w", err)
+	}
+
+	return &journal, nil
+}
+
+// writeJournal atomically writes the journal into a transaction directory
+func writeJournal(dir string, journal *Journal) error {
+	data, err := yaml.Marshal(journal)
+	if err != nil {
+		return fmt.Errorf("failed to serialize journal: %w", err)
+	}
+
+	if err := fileutil.WriteFileAtomic(filepath.Join(dir, journalFileName), data, 0644); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	return nil
+}
+
+// newTransactionID returns a sortable, unique transaction ID
+func newTransactionID() (string, error) {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate transaction ID: %w", err)
+	}
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(buf), nil
+}
+
+// transactionRunning reports whether another process holds the lock of the
+// transaction in dir
+func transactionRunning(dir string) bool {
+	file, err := acquireLockFile(transactionLockPath(dir), 0)
+	if err != nil {
+		return errors.Is(err, ErrLocked)
+	}
+	releaseLockFile(file)
+	return false
+}
+
+// transactionLockPath returns the lock file of the transaction in dir. It
+// lives beside the directory so the directory can be removed while locked.
+func transactionLockPath(dir string) string {
+	return dir + ".lock"
+}
+
+// lexists checks if a path exists without following symlinks
+func lexists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readFiles returns the content of every file under dir
+func readFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(relPath)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func equalFiles(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// crashTransaction stages an apply-like transaction on repo, then stops it
+// after its first steps entries were swapped in, as a crash would
+func crashTransaction(t *testing.T, s *Storage, repo string, steps int) string {
+	t.Helper()
+	txn, err := s.BeginTransaction("apply", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Remove(".claude")
+	txn.Remove("CLAUDE.md")
+	for _, f := range []struct{ path, content string }{
+		{".claude/a.md", "new a"},
+		{".claude/b.md", "new b"},
+		{"CLAUDE.md", "new root"},
+	} {
+		if err := txn.PlaceData(f.path, []byte(f.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range txn.journal.Entries {
+		entry := &txn.journal.Entries[i]
+		entry.Existed = lexists(filepath.Join(txn.journal.TargetDir, entry.Path)) && !txn.coveredByEarlierRemove(i)
+	}
+	txn.journal.Phase = PhaseCommitting
+	if err := txn.writeJournal(); err != nil {
+		t.Fatal(err)
+	}
+
+	partial := *txn.journal
+	partial.Entries = partial.Entries[:steps]
+	if err := rollForward(txn.dir, &partial); err != nil {
+		t.Fatal(err)
+	}
+
+	// The process dies holding its locks, which the OS then drops
+	txn.done = true
+	txn.release()
+	return txn.journal.ID
+}
+
+func TestRecoverTransaction(t *testing.T) {
+	original := map[string]string{
+		".claude/a.md":   "old a",
+		".claude/old.md": "old only",
+		"CLAUDE.md":      "old root",
+	}
+	applied := map[string]string{
+		".claude/a.md": "new a",
+		".claude/b.md": "new b",
+		"CLAUDE.md":    "new root",
+	}
+
+	for steps := 0; steps <= 5; steps++ {
+		for _, forward := range []bool{true, false} {
+			want := original
+			if forward {
+				want = applied
+			}
+
+			s := newTestStorage(t)
+			repo := t.TempDir()
+			writeFiles(t, repo, original)
+			id := crashTransaction(t, s, repo, steps)
+
+			pending, err := s.PendingTransactions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pending) != 1 || pending[0].ID != id {
+				t.Fatalf("steps=%d: pending = %v, want transaction %s", steps, pending, id)
+			}
+
+			if err := s.RecoverTransaction(id, forward); err != nil {
+				t.Fatalf("steps=%d forward=%v: %v", steps, forward, err)
+			}
+			if got := readFiles(t, repo); !equalFiles(got, want) {
+				t.Errorf("steps=%d forward=%v: repo = %v, want %v", steps, forward, got, want)
+			}
+
+			pending, err = s.PendingTransactions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pending) != 0 {
+				t.Errorf("steps=%d forward=%v: %d transactions left", steps, forward, len(pending))
+			}
+		}
+	}
+}
+
+func TestRecoverTransactionTwice(t *testing.T) {
+	// A recovery interrupted in turn is picked up by the next one
+	s := newTestStorage(t)
+	repo := t.TempDir()
+	writeFiles(t, repo, map[string]string{".claude/a.md": "old a"})
+	id := crashTransaction(t, s, repo, 4)
+
+	journal, err := readJournal(filepath.Join(s.cfg.TransactionsPath(), id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rollForward(filepath.Join(s.cfg.TransactionsPath(), id), journal); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecoverTransaction(id, true); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		".claude/a.md": "new a",
+		".claude/b.md": "new b",
+		"CLAUDE.md":    "new root",
+	}
+	if got := readFiles(t, repo); !equalFiles(got, want) {
+		t.Errorf("repo = %v, want %v", got, want)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	tests := []struct {
+		name   string
+		before map[string]string
+		remove []string
+		place  map[string]string
+		want   map[string]string
+	}{
+		{
+			name:   "place into empty repo",
+			before: map[string]string{},
+			place:  map[string]string{".claude/a.md": "a"},
+			want:   map[string]string{".claude/a.md": "a"},
+		},
+		{
+			name:   "replace directory",
+			before: map[string]string{".claude/a.md": "old", ".claude/b.md": "b", "main.go": "go"},
+			remove: []string{".claude"},
+			place:  map[string]string{".claude/a.md": "new"},
+			want:   map[string]string{".claude/a.md": "new", "main.go": "go"},
+		},
+		{
+			name:   "overwrite file",
+			before: map[string]string{"CLAUDE.md": "old"},
+			place:  map[string]string{"CLAUDE.md": "new"},
+			want:   map[string]string{"CLAUDE.md": "new"},
+		},
+		{
+			name:   "remove only",
+			before: map[string]string{"CLAUDE.md": "old", "main.go": "go"},
+			remove: []string{"CLAUDE.md", "missing.md"},
+			want:   map[string]string{"main.go": "go"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStorage(t)
+			repo := t.TempDir()
+			writeFiles(t, repo, tt.before)
+
+			txn, err := s.BeginTransaction("apply", repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer txn.Abort()
+			for _, relPath := range tt.remove {
+				txn.Remove(relPath)
+			}
+			for relPath, content := range tt.place {
+				if err := txn.PlaceData(relPath, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			txn.RecordState(repo, &RepoState{})
+			if err := txn.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readFiles(t, repo); !equalFiles(got, tt.want) {
+				t.Errorf("repo = %v, want %v", got, tt.want)
+			}
+			state, err := s.GetRepoState(repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state == nil {
+				t.Error("repo state was not recorded")
+			}
+		})
+	}
+}
+
+func TestAbort(t *testing.T) {
+	s := newTestStorage(t)
+	repo := t.TempDir()
+	writeFiles(t, repo, map[string]string{"CLAUDE.md": "old"})
+
+	txn, err := s.BeginTransaction("apply", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Remove("CLAUDE.md")
+	if err := txn.PlaceData("CLAUDE.md", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFiles(t, repo); got["CLAUDE.md"] != "old" {
+		t.Errorf("CLAUDE.md = %q after abort, want %q", got["CLAUDE.md"], "old")
+	}
+	txn, err = s.BeginTransaction("apply", repo)
+	if err != nil {
+		t.Fatalf("repo still locked after abort: %v", err)
+	}
+	txn.Abort()
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrLocked is returned when a lock is held by another aipaca process
+var ErrLocked = errors.New("another aipaca process is running")
+
+const (
+	// lockPollInterval is how often a busy lock is retried while waiting
+	lockPollInterval = 100 * time.Millisecond
+
+	// storageLockWait is the minimum wait for the storage lock. It is only
+	// held for short read-modify-write cycles, so waiting is always safe.
+	storageLockWait = 5 * time.Second
+)
+
+// Lock is an advisory lock held by this Storage instance.
+// Locks are re-entrant within a Storage instance, so a storage method can
+// take a lock its caller already holds.
+type Lock struct {
+	s   *Storage
+	key string
+}
+
+// heldLock is an open, locked lock file and its re-entry count
+type heldLock struct {
+	file  *os.File
+	count int
+}
+
+// LockStorage locks the storage directory as a whole. It guards shared
+// files such as repo-states.yaml and should only be held briefly.
+func (s *Storage) LockStorage() (*Lock, error) {
+	wait := s.cfg.LockWait
+	if wait < storageLockWait {
+		wait = storageLockWait
+	}
+	return s.acquire("storage", "storage directory", wait)
+}
+
+// LockRepo locks a repository against concurrent aipaca operations
+func (s *Storage) LockRepo(repoPath string) (*Lock, error) {
+	absPath, err := filepath.Abs(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve path: %w", err)
+	}
+	return s.lockPath(absPath)
+}
+
+// LockProfile locks a profile against concurrent writes
+func (s *Storage) LockProfile(name string) (*Lock, error) {
+	return s.lockPath(s.ProfilePath(name))
+}
+
+// lockPath locks an absolute path. Repos and profiles share this key space,
+// so a transaction on a directory excludes any other lock on it.
+func (s *Storage) lockPath(absPath string) (*Lock, error) {
+	sum := sha256.Sum256([]byte(absPath))
+	return s.acquire("path-"+hex.EncodeToString(sum[:8]), absPath, s.cfg.LockWait)
+}
+
+// acquire takes the named lock, waiting up to wait for it to become free
+func (s *Storage) acquire(key, description string, wait time.Duration) (*Lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if held, ok := s.locks[key]; ok {
+		held.count++
+		return &Lock{s: s, key: key}, nil
+	}
+
+	if err := os.MkdirAll(s.cfg.LocksPath(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create locks directory: %w", err)
+	}
+
+	lockFile := filepath.Join(s.cfg.LocksPath(), key+".lock")
+	file, err := acquireLockFile(lockFile, wait)
+	if err != nil {
+		if errors.Is(err, ErrLocked) {
+			return nil, fmt.Errorf("%w (lock on %s is held; retry or use --wait)", ErrLocked, description)
+		}
+		return nil, err
+	}
+
+	// Note what the lock protects, for anyone inspecting the locks directory
+	file.Truncate(0)
+	file.WriteAt([]byte(fmt.Sprintf("%d %s\n", os.Getpid(), description)), 0)
+
+	s.locks[key] = &heldLock{file: file, count: 1}
+	return &Lock{s: s, key: key}, nil
+}
+
+// Release releases the lock. Releasing a nil lock is a no-op.
+func (l *Lock) Release() error {
+	if l == nil {
+		return nil
+	}
+
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+
+	held, ok := l.s.locks[l.key]
+	if !ok {
+		return nil
+	}
+
+	held.count--
+	if held.count > 0 {
+		return nil
+	}
+
+	delete(l.s.locks, l.key)
+	return releaseLockFile(held.file)
+}
+
+// acquireLockFile opens and exclusively locks path. A busy lock is retried
+// until wait has elapsed, after which ErrLocked is returned.
+func acquireLockFile(path string, wait time.Duration) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		if locked {
+			return file, nil
+		}
+
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, ErrLocked
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// releaseLockFile unlocks and closes a lock file
+func releaseLockFile(file *os.File) error {
+	unlockFile(file)
+	return file.Close()
+}
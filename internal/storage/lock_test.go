@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockRepo(t *testing.T) {
+	s := newTestStorage(t)
+	other := New(s.cfg) // Another aipaca process, as far as the lock files go
+	repo := t.TempDir()
+
+	lock, err := s.LockRepo(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-entrant within a Storage instance
+	again, err := s.LockRepo(repo)
+	if err != nil {
+		t.Fatalf("re-entering a held lock: %v", err)
+	}
+
+	if _, err := other.LockRepo(repo); !errors.Is(err, ErrLocked) {
+		t.Fatalf("lock held elsewhere: got %v, want ErrLocked", err)
+	}
+	if _, err := other.LockRepo(t.TempDir()); err != nil {
+		t.Fatalf("locking another repo: %v", err)
+	}
+
+	// Held until every acquisition is released
+	again.Release()
+	if _, err := other.LockRepo(repo); !errors.Is(err, ErrLocked) {
+		t.Fatalf("after one release: got %v, want ErrLocked", err)
+	}
+	lock.Release()
+	taken, err := other.LockRepo(repo)
+	if err != nil {
+		t.Fatalf("after releasing: %v", err)
+	}
+	taken.Release()
+}
+
+func TestLockWait(t *testing.T) {
+	s := newTestStorage(t)
+	s.cfg.LockWait = 2 * time.Second
+	other := New(s.cfg)
+	repo := t.TempDir()
+
+	lock, err := s.LockRepo(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(3*lockPollInterval, func() { lock.Release() })
+
+	taken, err := other.LockRepo(repo)
+	if err != nil {
+		t.Fatalf("waiting for the lock: %v", err)
+	}
+	taken.Release()
+}
+
+func TestReleaseNilLock(t *testing.T) {
+	var lock *Lock
+	if err := lock.Release(); err != nil {
+		t.Errorf("releasing a nil lock: %v", err)
+	}
+}
+
+func TestTransactionLocksTarget(t *testing.T) {
+	s := newTestStorage(t)
+	other := New(s.cfg)
+	repo := t.TempDir()
+
+	txn, err := s.BeginTransaction("apply", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.LockRepo(repo); !errors.Is(err, ErrLocked) {
+		t.Fatalf("repo of a running transaction: got %v, want ErrLocked", err)
+	}
+
+	// A running transaction is not an interrupted one
+	pending, err := other.PendingTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("running transaction reported as pending")
+	}
+
+	txn.Abort()
+	lock, err := other.LockRepo(repo)
+	if err != nil {
+		t.Fatalf("after abort: %v", err)
+	}
+	lock.Release()
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"gopkg.in/yaml.v3"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+	"github.com/HammerSpb/aipaca/pkg/render"
+)
+
+// ProfileManifestFile is the name of the metadata file kept in every profile.
+// It is never applied to a repo.
+const ProfileManifestFile = "aipaca-profile.yaml"
+
+// ProfileManifest is the aipaca-profile.yaml stored in a profile
+type ProfileManifest struct {
+	Description string   `yaml:"description,omitempty"`
+	Author      string   `yaml:"author,omitempty"`
+	Tags        []string `yaml:"tags,omitempty"`
+	Version     int      `yaml:"version"`           // Bumped on every save
+	Tools       []string `yaml:"tools,omitempty"`   // Target AI tools, e.g. claude, cursor
+	Extends     []string `yaml:"extends,omitempty"` // Profiles applied underneath this one
+
+	// Merge rules for files this profile shares with other sources
+	Merge []config.MergeRule `yaml:"merge,omitempty"`
+
+	// Templates lists files (globs) rendered as templates besides *.tmpl
+	// files, and Vars the default values of template variables
+	Templates []string          `yaml:"templates,omitempty"`
+	Vars      map[string]string `yaml:"vars,omitempty"`
+
+	// Conditions limit files to repos they fit, e.g. only Go repos
+	Conditions []FileCondition `yaml:"conditions,omitempty"`
+
+	Created time.Time `yaml:"created,omitempty"`
+	Updated time.Time `yaml:"updated,omitempty"`
+}
+
+// HasTag reports whether the manifest carries tag (case-insensitive)
+func (m *ProfileManifest) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// TemplateTarget returns the repo path a profile file is applied to and
+// whether it is rendered as a template: *.tmpl files lose their suffix,
+// files listed in Templates keep their name
+func (m *ProfileManifest) TemplateTarget(relPath string) (string, bool) {
+	if strings.HasSuffix(relPath, render.Suffix) {
+		return strings.TrimSuffix(relPath, render.Suffix), true
+	}
+
+	slashPath := filepath.ToSlash(relPath)
+	for _, pattern := range m.Templates {
+		if matched, _ := doublestar.Match(pattern, slashPath); matched {
+			return relPath, true
+		}
+	}
+	return relPath, false
+}
+
+// GetProfileManifest returns the manifest of a profile. Profiles without a
+// manifest get an empty one.
+func (s *Storage) GetProfileManifest(name string) (*ProfileManifest, error) {
+	if !s.ProfileExists(name) {
+		return nil, fmt.Errorf("profile '%s' not found", name)
+	}
+	return readProfileManifest(s.ProfilePath(name))
+}
+
+// UpdateProfileManifest changes the manifest of a profile under its lock
+func (s *Storage) UpdateProfileManifest(name string, update func(m *ProfileManifest)) error {
+	lock, err := s.LockProfile(name)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	manifest, err := s.GetProfileManifest(name)
+	if err != nil {
+		return err
+	}
+
+	update(manifest)
+	manifest.Updated = time.Now()
+	if manifest.Created.IsZero() {
+		manifest.Created = manifest.Updated
+	}
+
+	return writeProfileManifest(s.ProfilePath(name), manifest)
+}
+
+// MigrateProfileDescriptions moves descriptions from the old
+// profile_descriptions config map into profile manifests. Descriptions of
+// profiles that no longer exist are dropped. It returns the number of
+// profiles updated.
+func (s *Storage) MigrateProfileDescriptions(descriptions map[string]string) (int, error) {
+	migrated := 0
+	for name, description := range descriptions {
+		if description == "" || !s.ProfileExists(name) {
+			continue
+		}
+		manifest, err := s.GetProfileManifest(name)
+		if err != nil {
+			return migrated, err
+		}
+		if manifest.Description != "" {
+			continue // Already migrated, or described since
+		}
+
+		err = s.UpdateProfileManifest(name, func(m *ProfileManifest) {
+			if m.Description == "" {
+				m.Description = description
+			}
+		})
+		if err != nil {
+			return migrated, fmt.Errorf("failed to migrate description of '%s': %w", name, err)
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// readProfileManifest reads the manifest in a profile directory
+func readProfileManifest(profilePath string) (*ProfileManifest, error) {
+	data, err := os.ReadFile(filepath.Join(profilePath, ProfileManifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &ProfileManifest{}, nil
+		}
+		return nil, fmt.Errorf("failed to read profile manifest: %w", err)
+	}
+
+	var manifest ProfileManifest
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse profile manifest: %w", err)
+	}
+
+	return &manifest, nil
+}
+
+// writeProfileManifest writes the manifest into a profile directory
+func writeProfileManifest(profilePath string, manifest *ProfileManifest) error {
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to serialize profile manifest: %w", err)
+	}
+
+	if err := fileutil.WriteFileAtomic(filepath.Join(profilePath, ProfileManifestFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write profile manifest: %w", err)
+	}
+
+	return nil
+}
+
+// listProfileFiles lists the files of a profile directory, without its
+// manifest
+func listProfileFiles(profilePath string) ([]string, error) {
+	files, err := fileutil.ListAllFiles(profilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := files[:0]
+	for _, f := range files {
+		if f != ProfileManifestFile {
+			kept = append(kept, f)
+		}
+	}
+	return kept, nil
+}
+
+// detectTools guesses the AI tools a set of profile paths is meant for
+func detectTools(paths []string) []string {
+	found := make(map[string]bool)
+	for _, p := range paths {
+		top := strings.SplitN(filepath.ToSlash(p), "/", 2)[0]
+		switch {
+		case top == ".claude" || filepath.Base(p) == "CLAUDE.md":
+			found["claude"] = true
+		case top == ".cursor" || top == ".cursorrules":
+			found["cursor"] = true
+		}
+	}
+
+	tools := make([]string, 0, len(found))
+	for tool := range found {
+		tools = append(tools, tool)
+	}
+	sort.Strings(tools)
+	return tools
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrateProfileDescriptions(t *testing.T) {
+	s := newTestStorage(t)
+	newTestProfile(t, s, "go", nil)
+	newTestProfile(t, s, "web", nil)
+	err := s.UpdateProfileManifest("web", func(m *ProfileManifest) { m.Description = "Web apps" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	webManifest := filepath.Join(s.ProfilePath("web"), ProfileManifestFile)
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(webManifest, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := s.MigrateProfileDescriptions(map[string]string{
+		"go":      "Go services",
+		"web":     "Old description",
+		"deleted": "Gone",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 1 {
+		t.Errorf("MigrateProfileDescriptions() = %d, want 1", migrated)
+	}
+
+	for name, want := range map[string]string{"go": "Go services", "web": "Web apps"} {
+		m, err := s.GetProfileManifest(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Description != want {
+			t.Errorf("description of %s = %q, want %q", name, m.Description, want)
+		}
+	}
+
+	// A manifest with a description is not rewritten
+	info, err := os.Stat(webManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(old) {
+		t.Error("manifest that already had a description was rewritten")
+	}
+}
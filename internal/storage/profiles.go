@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/HammerSpb/aipaca/pkg/fileutil"
 )
@@ -14,6 +15,7 @@ type Profile struct {
 	Path        string
 	Description string
 	FileCount   int
+	Manifest    ProfileManifest
 }
 
 // ListProfiles returns all available profiles
@@ -34,22 +36,11 @@ func (s *Storage) ListProfiles() ([]Profile, error) {
 			continue
 		}
 
-		name := entry.Name()
-		profilePath := filepath.Join(profilesDir, name)
-
-		fileCount, _ := fileutil.CountFiles(profilePath)
-
-		description := ""
-		if s.cfg.ProfileDescriptions != nil {
-			description = s.cfg.ProfileDescriptions[name]
+		profile, err := loadProfile(entry.Name(), filepath.Join(profilesDir, entry.Name()))
+		if err != nil {
+			return nil, err
 		}
-
-		profiles = append(profiles, Profile{
-			Name:        name,
-			Path:        profilePath,
-			Description: description,
-			FileCount:   fileCount,
-		})
+		profiles = append(profiles, *profile)
 	}
 
 	return profiles, nil
@@ -71,23 +62,35 @@ func (s *Storage) GetProfile(name string) (*Profile, error) {
 		return nil, fmt.Errorf("profile '%s' is not a directory", name)
 	}
 
-	fileCount, _ := fileutil.CountFiles(profilePath)
+	return loadProfile(name, profilePath)
+}
 
-	description := ""
-	if s.cfg.ProfileDescriptions != nil {
-		description = s.cfg.ProfileDescriptions[name]
+// loadProfile reads a profile directory and its manifest
+func loadProfile(name, profilePath string) (*Profile, error) {
+	manifest, err := readProfileManifest(profilePath)
+	if err != nil {
+		return nil, fmt.Errorf("profile '%s': %w", name, err)
 	}
 
+	files, _ := listProfileFiles(profilePath)
+
 	return &Profile{
 		Name:        name,
 		Path:        profilePath,
-		Description: description,
-		FileCount:   fileCount,
+		Description: manifest.Description,
+		FileCount:   len(files),
+		Manifest:    *manifest,
 	}, nil
 }
 
 // CreateProfile creates a new empty profile
 func (s *Storage) CreateProfile(name string) error {
+	lock, err := s.LockProfile(name)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	profilePath := s.ProfilePath(name)
 
 	if fileutil.Exists(profilePath) {
@@ -98,11 +101,22 @@ func (s *Storage) CreateProfile(name string) error {
 		return fmt.Errorf("failed to create profile directory: %w", err)
 	}
 
-	return nil
+	now := time.Now()
+	return writeProfileManifest(profilePath, &ProfileManifest{
+		Version: 1,
+		Created: now,
+		Updated: now,
+	})
 }
 
 // DeleteProfile deletes a profile
 func (s *Storage) DeleteProfile(name string) error {
+	lock, err := s.LockProfile(name)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	profilePath := s.ProfilePath(name)
 
 	if !fileutil.Exists(profilePath) {
@@ -113,11 +127,27 @@ func (s *Storage) DeleteProfile(name string) error {
 		return fmt.Errorf("failed to delete profile: %w", err)
 	}
 
+	// Snapshots of the profile that repos still reference stay
+	if _, err := s.PruneSnapshots(); err != nil {
+		Warnf("failed to prune snapshots: %v", err)
+	}
 	return nil
 }
 
 // CopyProfile copies a profile to a new name
 func (s *Storage) CopyProfile(srcName, dstName string) error {
+	srcLock, err := s.LockProfile(srcName)
+	if err != nil {
+		return err
+	}
+	defer srcLock.Release()
+
+	dstLock, err := s.LockProfile(dstName)
+	if err != nil {
+		return err
+	}
+	defer dstLock.Release()
+
 	srcPath := s.ProfilePath(srcName)
 	dstPath := s.ProfilePath(dstName)
 
@@ -133,19 +163,22 @@ func (s *Storage) CopyProfile(srcName, dstName string) error {
 		return fmt.Errorf("failed to copy profile: %w", err)
 	}
 
-	return nil
-}
-
-// SaveToProfile saves files from a repo to a profile
-func (s *Storage) SaveToProfile(name string, repoPath string, patterns []string, force bool) error {
-	profilePath := s.ProfilePath(name)
-
-	// Check if profile exists
-	exists := fileutil.Exists(profilePath)
-	if exists && !force {
-		// We'll update the existing profile
+	// The copy keeps the metadata but starts its own history
+	manifest, err := readProfileManifest(dstPath)
+	if err != nil {
+		return err
 	}
+	now := time.Now()
+	manifest.Version = 1
+	manifest.Created = now
+	manifest.Updated = now
+
+	return writeProfileManifest(dstPath, manifest)
+}
 
+// SaveToProfile saves the AI files of a repo to a profile, replacing what
+// it had
+func (s *Storage) SaveToProfile(name string, repoPath string, patterns []string) error {
 	// Find all AI files in repo
 	aiFiles, err := fileutil.ExpandPatterns(repoPath, patterns)
 	if err != nil {
@@ -156,57 +189,64 @@ func (s *Storage) SaveToProfile(name string, repoPath string, patterns []string,
 		return fmt.Errorf("no AI files found in repository")
 	}
 
-	// Clear existing profile if it exists
-	if exists {
-		if err := os.RemoveAll(profilePath); err != nil {
-			return fmt.Errorf("failed to clear existing profile: %w", err)
-		}
+	return s.SaveFilesToProfile(name, aiFiles)
+}
+
+// SaveFilesToProfile replaces the contents of a profile with files
+// (relative path -> full path of a file or directory to copy).
+// The new profile contents are staged first and swapped in as a single
+// transaction, so an interrupted save never leaves a half-written profile.
+// The profile manifest is carried over with its version bumped.
+func (s *Storage) SaveFilesToProfile(name string, files map[string]string) error {
+	// The transaction targets the profile directory itself, which also
+	// locks the profile until the new contents are in place
+	txn, err := s.BeginTransaction("save", s.ProfilePath(name))
+	if err != nil {
+		return err
 	}
+	defer txn.Abort()
 
-	// Create profile directory
-	if err := os.MkdirAll(profilePath, 0755); err != nil {
-		return fmt.Errorf("failed to create profile directory: %w", err)
+	// Stage the complete new profile directory
+	stageDir, err := txn.PlaceDir(".")
+	if err != nil {
+		return err
 	}
 
-	// Copy each AI file/directory to profile
-	for relPath, fullPath := range aiFiles {
-		dstPath := filepath.Join(profilePath, relPath)
+	// Copy each file/directory to the staged profile
+	paths := make([]string, 0, len(files))
+	for relPath, fullPath := range files {
+		dstPath := filepath.Join(stageDir, relPath)
 		if err := fileutil.CopyPath(fullPath, dstPath); err != nil {
 			return fmt.Errorf("failed to copy %s: %w", relPath, err)
 		}
+		paths = append(paths, relPath)
 	}
 
-	return nil
-}
-
-// ApplyProfile copies a profile to a repo
-func (s *Storage) ApplyProfile(name string, repoPath string) error {
-	profilePath := s.ProfilePath(name)
-
-	if !fileutil.Exists(profilePath) {
-		return fmt.Errorf("profile '%s' not found", name)
-	}
-
-	// List all items in profile
-	entries, err := os.ReadDir(profilePath)
+	manifest, err := readProfileManifest(s.ProfilePath(name))
 	if err != nil {
-		return fmt.Errorf("failed to read profile: %w", err)
+		return err
+	}
+	manifest.Version++
+	manifest.Updated = time.Now()
+	if manifest.Created.IsZero() {
+		manifest.Created = manifest.Updated
+	}
+	if len(manifest.Tools) == 0 {
+		manifest.Tools = detectTools(paths)
+	}
+	if err := writeProfileManifest(stageDir, manifest); err != nil {
+		return err
 	}
 
-	// Copy each item to repo
-	for _, entry := range entries {
-		srcPath := filepath.Join(profilePath, entry.Name())
-		dstPath := filepath.Join(repoPath, entry.Name())
-
-		if err := fileutil.CopyPath(srcPath, dstPath); err != nil {
-			return fmt.Errorf("failed to copy %s: %w", entry.Name(), err)
-		}
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("failed to write profile: %w", err)
 	}
 
 	return nil
 }
 
-// GetProfileFiles returns the list of files in a profile
+// GetProfileFiles returns the list of files in a profile, without its
+// manifest
 func (s *Storage) GetProfileFiles(name string) ([]string, error) {
 	profilePath := s.ProfilePath(name)
 
@@ -214,5 +254,5 @@ func (s *Storage) GetProfileFiles(name string) ([]string, error) {
 		return nil, fmt.Errorf("profile '%s' not found", name)
 	}
 
-	return fileutil.ListAllFiles(profilePath)
+	return listProfileFiles(profilePath)
 }
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+)
+
+// Session records profiles applied to a repo for the life of a command
+// (aipaca run). Its marker file stays locked while the command runs; a
+// marker left unlocked belongs to a session that crashed, whose profiles
+// are still in the repo.
+type Session struct {
+	RepoPath  string    `yaml:"repo_path"`
+	Profiles  []string  `yaml:"profiles"`
+	Command   []string  `yaml:"command"`
+	PID       int       `yaml:"pid"`
+	StartedAt time.Time `yaml:"started_at"`
+
+	// Depth is the depth of the repo state before the session (see
+	// RepoState.Depth); ending the session steps back to it
+	Depth int `yaml:"depth"`
+
+	lock *os.File
+}
+
+// sessionPath returns the marker file of the session in a repo
+func (s *Storage) sessionPath(repoPath string) string {
+	sum := sha256.Sum256([]byte(repoPath))
+	return filepath.Join(s.cfg.SessionsPath(), hex.EncodeToString(sum[:8])+".yaml")
+}
+
+// sessionLockPath returns the lock file of a session marker
+func sessionLockPath(path string) string {
+	return strings.TrimSuffix(path, ".yaml") + ".lock"
+}
+
+// StartSession records a session and holds its marker until EndSession.
+// It fails if a session already runs in the repo, or one crashed there and
+// was not ended.
+func (s *Storage) StartSession(session *Session) error {
+	absPath, err := filepath.Abs(session.RepoPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve path: %w", err)
+	}
+	session.RepoPath = absPath
+
+	if err := os.MkdirAll(s.cfg.SessionsPath(), 0755); err != nil {
+		return fmt.Errorf("failed to create sessions directory: %w", err)
+	}
+
+	path := s.sessionPath(absPath)
+	lock, err := acquireLockFile(sessionLockPath(path), 0)
+	if err != nil {
+		if errors.Is(err, ErrLocked) {
+			return fmt.Errorf("an 'aipaca run' session is already running in %s", absPath)
+		}
+		return err
+	}
+	if fileutil.IsFile(path) {
+		releaseLockFile(lock)
+		return fmt.Errorf("an 'aipaca run' session in %s was interrupted and not cleaned up", absPath)
+	}
+
+	data, err := yaml.Marshal(session)
+	if err != nil {
+		releaseLockFile(lock)
+		return fmt.Errorf("failed to serialize session: %w", err)
+	}
+	if err := fileutil.WriteFileAtomic(path, data, 0644); err != nil {
+		releaseLockFile(lock)
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+
+	session.lock = lock
+	return nil
+}
+
+// EndSession removes the marker of a session, started here or found
+// stale
+func (s *Storage) EndSession(session *Session) error {
+	path := s.sessionPath(session.RepoPath)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove session: %w", err)
+	}
+	if session.lock != nil {
+		releaseLockFile(session.lock)
+		os.Remove(session.lock.Name())
+		session.lock = nil
+	}
+	return nil
+}
+
+// StaleSessions returns the sessions that crashed before they were ended.
+// Sessions still running in another process are skipped. The stale
+// sessions are locked until EndSession, so only one process cleans each up.
+func (s *Storage) StaleSessions() ([]*Session, error) {
+	entries, err := os.ReadDir(s.cfg.SessionsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read sessions directory: %w", err)
+	}
+
+	var sessions []*Session
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".yaml" {
+			continue
+		}
+
+		path := filepath.Join(s.cfg.SessionsPath(), entry.Name())
+		lock, err := acquireLockFile(sessionLockPath(path), 0)
+		if err != nil {
+			continue // Running, or not ours to look at
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			releaseLockFile(lock)
+			continue // Ended meanwhile
+		}
+		var session Session
+		if err := yaml.Unmarshal(data, &session); err != nil {
+			releaseLockFile(lock)
+			return nil, fmt.Errorf("failed to parse session %s: %w", entry.Name(), err)
+		}
+		session.lock = lock
+		sessions = append(sessions, &session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.Before(sessions[j].StartedAt)
+	})
+
+	return sessions, nil
+}
+
+// ReleaseSession lets go of a stale session without ending it
+func (s *Storage) ReleaseSession(session *Session) {
+	if session.lock != nil {
+		releaseLockFile(session.lock)
+		session.lock = nil
+	}
+}
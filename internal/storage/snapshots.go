@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
+)
+
+// Snapshots keep the files of a profile as they were applied to a repo, so
+// that later saves and updates can tell changes made in the repo from
+// changes made to the profile. A snapshot is named by the hash of its
+// files and manifest, and shared by every repo the same content went to.
+// Snapshots no repo state references any more are pruned.
+
+// snapshotGrace keeps recent snapshots from being pruned, as an operation
+// still running may be about to reference them
+const snapshotGrace = time.Hour
+
+// SnapshotPath returns the full path to a snapshot of a profile
+func (s *Storage) SnapshotPath(profile, id string) string {
+	return filepath.Join(s.cfg.SnapshotsPath(), profile, id)
+}
+
+// SnapshotExists checks if a snapshot of a profile exists
+func (s *Storage) SnapshotExists(profile, id string) bool {
+	return id != "" && fileutil.IsDir(s.SnapshotPath(profile, id))
+}
+
+// ProfileHash returns the snapshot id the current files of a profile have
+func (s *Storage) ProfileHash(name string) (string, error) {
+	files, err := s.profileFileMap(name)
+	if err != nil {
+		return "", err
+	}
+	return s.snapshotHash(name, files)
+}
+
+// SnapshotProfile records the current files of a profile and returns the
+// snapshot id
+func (s *Storage) SnapshotProfile(name string) (string, error) {
+	files, err := s.profileFileMap(name)
+	if err != nil {
+		return "", err
+	}
+	return s.CreateSnapshot(name, files)
+}
+
+// CreateSnapshot records files (relative path -> full path) as a snapshot
+// of a profile, together with the profile's current manifest, and returns
+// the snapshot id. Existing snapshots are reused.
+func (s *Storage) CreateSnapshot(profile string, files map[string]string) (string, error) {
+	id, err := s.snapshotHash(profile, files)
+	if err != nil {
+		return "", err
+	}
+	snapshotPath := s.SnapshotPath(profile, id)
+	if fileutil.IsDir(snapshotPath) {
+		// Reused snapshots get the same grace as new ones
+		now := time.Now()
+		os.Chtimes(snapshotPath, now, now)
+		return id, nil
+	}
+
+	// Stage next to the final location so the rename is atomic
+	parent := filepath.Dir(snapshotPath)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	stageDir, err := os.MkdirTemp(parent, ".stage-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	defer os.RemoveAll(stageDir)
+
+	for relPath, fullPath := range files {
+		if err := fileutil.CopyFile(fullPath, filepath.Join(stageDir, relPath)); err != nil {
+			return "", fmt.Errorf("failed to copy %s: %w", relPath, err)
+		}
+	}
+	manifestPath := filepath.Join(s.ProfilePath(profile), ProfileManifestFile)
+	if fileutil.IsFile(manifestPath) {
+		if err := fileutil.CopyFile(manifestPath, filepath.Join(stageDir, ProfileManifestFile)); err != nil {
+			return "", fmt.Errorf("failed to copy profile manifest: %w", err)
+		}
+	}
+
+	if err := os.Rename(stageDir, snapshotPath); err != nil {
+		// Another process recorded the same snapshot first
+		if fileutil.IsDir(snapshotPath) {
+			return id, nil
+		}
+		return "", fmt.Errorf("failed to save snapshot: %w", err)
+	}
+	return id, nil
+}
+
+// SnapshotFiles returns the files of a snapshot (relative path -> full
+// path), without its manifest
+func (s *Storage) SnapshotFiles(profile, id string) (map[string]string, error) {
+	if !s.SnapshotExists(profile, id) {
+		return nil, fmt.Errorf("snapshot '%s' of profile '%s' not found", id, profile)
+	}
+	snapshotPath := s.SnapshotPath(profile, id)
+	relPaths, err := listProfileFiles(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string, len(relPaths))
+	for _, relPath := range relPaths {
+		files[relPath] = filepath.Join(snapshotPath, relPath)
+	}
+	return files, nil
+}
+
+// PruneSnapshots deletes the snapshots no repo state references and
+// returns how many it deleted
+func (s *Storage) PruneSnapshots() (int, error) {
+	lock, err := s.LockStorage()
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Release()
+
+	state, err := s.loadStateFile()
+	if err != nil {
+		return 0, err
+	}
+	return s.pruneSnapshots(state.Repos)
+}
+
+// pruneSnapshots deletes the snapshots none of repos references, leaving
+// those recorded within snapshotGrace
+func (s *Storage) pruneSnapshots(repos map[string]*RepoState) (int, error) {
+	referenced := make(map[string]bool)
+	for _, repoState := range repos {
+		for ref := range snapshotRefs(repoState) {
+			referenced[ref] = true
+		}
+	}
+
+	root := s.cfg.SnapshotsPath()
+	profiles, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read snapshots directory: %w", err)
+	}
+
+	pruned := 0
+	for _, profile := range profiles {
+		if !profile.IsDir() {
+			continue
+		}
+		profileDir := filepath.Join(root, profile.Name())
+		snapshots, err := os.ReadDir(profileDir)
+		if err != nil {
+			return pruned, fmt.Errorf("failed to read snapshots directory: %w", err)
+		}
+		for _, snapshot := range snapshots {
+			// Stage directories left by an interrupted snapshot go too
+			id := snapshot.Name()
+			if !strings.HasPrefix(id, ".stage-") && referenced[profile.Name()+"/"+id] {
+				continue
+			}
+			info, err := snapshot.Info()
+			if err != nil || time.Since(info.ModTime()) < snapshotGrace {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(profileDir, id)); err != nil {
+				return pruned, fmt.Errorf("failed to delete snapshot: %w", err)
+			}
+			pruned++
+		}
+		os.Remove(profileDir) // Only once empty
+	}
+	return pruned, nil
+}
+
+// snapshotRefs returns the snapshots a repo state references, as
+// profile/id, including those restore --step brings back
+func snapshotRefs(repoState *RepoState) map[string]bool {
+	refs := make(map[string]bool)
+	if repoState == nil {
+		return refs
+	}
+	add := func(snapshots map[string]string) {
+		for profile, id := range snapshots {
+			refs[profile+"/"+id] = true
+		}
+	}
+	add(repoState.Snapshots)
+	for _, layer := range repoState.Stack {
+		add(layer.Snapshots)
+	}
+	return refs
+}
+
+// profileFileMap returns the files of a profile (relative path -> full
+// path), without its manifest
+func (s *Storage) profileFileMap(name string) (map[string]string, error) {
+	relPaths, err := s.GetProfileFiles(name)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string, len(relPaths))
+	for _, relPath := range relPaths {
+		files[relPath] = filepath.Join(s.ProfilePath(name), relPath)
+	}
+	return files, nil
+}
+
+// snapshotHash returns the snapshot id of files kept with the current
+// manifest of a profile, so a changed manifest makes a new snapshot
+func (s *Storage) snapshotHash(profile string, files map[string]string) (string, error) {
+	manifestPath := filepath.Join(s.ProfilePath(profile), ProfileManifestFile)
+	if fileutil.IsFile(manifestPath) {
+		files = maps.Clone(files)
+		files[ProfileManifestFile] = manifestPath
+	}
+	return filesHash(files)
+}
+
+// filesHash returns a short hash of the paths and contents of files
+func filesHash(files map[string]string) (string, error) {
+	relPaths := make([]string, 0, len(files))
+	for relPath := range files {
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+
+	hash := sha256.New()
+	for _, relPath := range relPaths {
+		sum, err := fileutil.FileChecksum(files[relPath])
+		if err != nil {
+			return "", fmt.Errorf("failed to checksum %s: %w", relPath, err)
+		}
+		fmt.Fprintf(hash, "%s\x00%s\n", filepath.ToSlash(relPath), sum)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16], nil
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/HammerSpb/aipaca/internal/config"
+)
+
+func newTestProfile(t *testing.T, s *Storage, name string, files map[string]string) {
+	t.Helper()
+	if err := s.CreateProfile(name); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, s.ProfilePath(name), files)
+}
+
+// ageSnapshot moves a snapshot out of its pruning grace period
+func ageSnapshot(t *testing.T, s *Storage, profile, id string) {
+	t.Helper()
+	old := time.Now().Add(-2 * snapshotGrace)
+	if err := os.Chtimes(s.SnapshotPath(profile, id), old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotFollowsManifest(t *testing.T) {
+	s := newTestStorage(t)
+	newTestProfile(t, s, "go", map[string]string{"CLAUDE.md": "x"})
+
+	first, err := s.SnapshotProfile("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.UpdateProfileManifest("go", func(m *ProfileManifest) {
+		m.Merge = []config.MergeRule{{Path: "CLAUDE.md", Strategy: "append"}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := s.ProfileHash("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == first {
+		t.Fatal("ProfileHash() unchanged by a manifest change")
+	}
+	second, err := s.SnapshotProfile("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != hash {
+		t.Errorf("SnapshotProfile() = %s, want %s", second, hash)
+	}
+	m, err := readProfileManifest(s.SnapshotPath("go", second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Merge) != 1 {
+		t.Errorf("snapshot manifest has merge rules %v, want the new one", m.Merge)
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	s := newTestStorage(t)
+	newTestProfile(t, s, "go", map[string]string{"CLAUDE.md": "v1"})
+	v1, err := s.SnapshotProfile("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, s.ProfilePath("go"), map[string]string{"CLAUDE.md": "v2"})
+	v2, err := s.SnapshotProfile("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, s.ProfilePath("go"), map[string]string{"CLAUDE.md": "v3"})
+	v3, err := s.SnapshotProfile("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, s.ProfilePath("go"), map[string]string{"CLAUDE.md": "v4"})
+	recent, err := s.SnapshotProfile("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{v1, v2, v3} {
+		ageSnapshot(t, s, "go", id)
+	}
+
+	// v1 is applied, v2 comes back with restore --step
+	repo := t.TempDir()
+	err = s.SetRepoState(repo, &RepoState{
+		AppliedProfile: "go",
+		Snapshots:      map[string]string{"go": v1},
+		Baseline:       &StateLayer{Operation: "apply"},
+		Stack:          []StateLayer{{Operation: "apply", Profile: "go", Snapshots: map[string]string{"go": v2}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := s.PruneSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Errorf("PruneSnapshots() = %d, want 1", pruned)
+	}
+	want := map[string]bool{v1: true, v2: true, v3: false, recent: true}
+	for id, kept := range want {
+		if s.SnapshotExists("go", id) != kept {
+			t.Errorf("snapshot %s kept = %v, want %v", id, !kept, kept)
+		}
+	}
+
+	// Clearing the state drops the snapshots it referenced
+	if err := s.ClearRepoState(repo); err != nil {
+		t.Fatal(err)
+	}
+	if s.SnapshotExists("go", v1) || s.SnapshotExists("go", v2) {
+		t.Error("snapshots of a cleared state kept")
+	}
+	if !s.SnapshotExists("go", recent) {
+		t.Error("recent snapshot pruned")
+	}
+}
+
+func TestDeleteProfilePrunesSnapshots(t *testing.T) {
+	s := newTestStorage(t)
+	newTestProfile(t, s, "go", map[string]string{"CLAUDE.md": "x"})
+	id, err := s.SnapshotProfile("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageSnapshot(t, s, "go", id)
+
+	if err := s.DeleteProfile("go"); err != nil {
+		t.Fatal(err)
+	}
+	if s.SnapshotExists("go", id) {
+		t.Error("snapshot of a deleted profile kept")
+	}
+}
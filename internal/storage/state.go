@@ -7,13 +7,175 @@ import (
 	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/HammerSpb/aipaca/pkg/fileutil"
 )
 
 // RepoState represents the state of a repository
 type RepoState struct {
 	AppliedProfile string    `yaml:"applied_profile,omitempty"`
 	AppliedAt      time.Time `yaml:"applied_at,omitempty"`
-	BackupPath     string    `yaml:"backup_path,omitempty"`
+
+	// Layers lists every profile stacked into the repo, bottom first, when
+	// more than one was applied (through extends or several apply
+	// arguments). AppliedProfile is then the top layer.
+	Layers []string `yaml:"layers,omitempty"`
+
+	// Vars are the template variables the profiles were rendered with
+	Vars map[string]string `yaml:"vars,omitempty"`
+
+	// Managed maps the files aipaca wrote into the repo to the checksums
+	// of their content at the time (only of the aipaca blocks, for files
+	// that have them). Clean and restore only touch these.
+	Managed map[string]string `yaml:"managed,omitempty"`
+
+	// Snapshots maps each applied profile to the snapshot of its files
+	// taken at apply time (see CreateSnapshot)
+	Snapshots map[string]string `yaml:"snapshots,omitempty"`
+
+	// Baseline holds the repo's original AI files, from before the first
+	// aipaca operation. Restoring it returns the repo to its true original.
+	Baseline *StateLayer `yaml:"baseline,omitempty"`
+
+	// Stack holds the files displaced by each later operation, oldest
+	// first, so restore can walk back one layer at a time.
+	Stack []StateLayer `yaml:"stack,omitempty"`
+
+	// Branch is the git branch the repo was on at the last switch, and
+	// Branches what was applied on each branch when it was left (see
+	// 'aipaca switch')
+	Branch   string                 `yaml:"branch,omitempty"`
+	Branches map[string]BranchState `yaml:"branches,omitempty"`
+
+	// BackupPath is the single backup recorded by older versions.
+	// It is migrated to Baseline when the state file is loaded.
+	BackupPath string `yaml:"backup_path,omitempty"`
+}
+
+// StateLayer records the AI files an operation displaced from a repo
+type StateLayer struct {
+	Operation string `yaml:"operation"`
+
+	// Profile, Layers, Vars, Managed, Snapshots and AppliedAt describe
+	// what was applied before the operation
+	Profile   string            `yaml:"profile,omitempty"`
+	Layers    []string          `yaml:"layers,omitempty"`
+	Vars      map[string]string `yaml:"vars,omitempty"`
+	Managed   map[string]string `yaml:"managed,omitempty"`
+	Snapshots map[string]string `yaml:"snapshots,omitempty"`
+	AppliedAt time.Time         `yaml:"applied_at,omitempty"`
+
+	// Backup holds the displaced files. It is empty when there were none,
+	// or when the operation ran with --no-backup (NoBackup is then set).
+	Backup   string    `yaml:"backup,omitempty"`
+	NoBackup bool      `yaml:"no_backup,omitempty"`
+	At       time.Time `yaml:"at"`
+}
+
+// BranchState records the profiles applied on a branch when it was left
+type BranchState struct {
+	Layers []string `yaml:"layers,omitempty"` // Bottom first; empty when none was applied
+
+	// Stash is the backup of the repo's AI files, kept when they had edits
+	// to put back once the branch is checked out again
+	Stash string    `yaml:"stash,omitempty"`
+	At    time.Time `yaml:"at"`
+}
+
+// AppliedLayers returns the profiles applied to the repo, bottom first
+func (r *RepoState) AppliedLayers() []string {
+	if len(r.Layers) > 0 {
+		return r.Layers
+	}
+	if r.AppliedProfile != "" {
+		return []string{r.AppliedProfile}
+	}
+	return nil
+}
+
+// Depth returns the number of operations restore --step can undo. A nil
+// state has none.
+func (r *RepoState) Depth() int {
+	if r == nil || r.Baseline == nil {
+		return 0
+	}
+	return len(r.Stack) + 1
+}
+
+// TopOperation returns the operation restore --step undoes next, or an
+// empty string when there is none
+func (r *RepoState) TopOperation() string {
+	switch {
+	case r == nil || r.Baseline == nil:
+		return ""
+	case len(r.Stack) > 0:
+		return r.Stack[len(r.Stack)-1].Operation
+	default:
+		return r.Baseline.Operation
+	}
+}
+
+// NextRepoState returns the state after an operation that displaced the
+// repo's AI files as described by layer and left the profiles in layers
+// (bottom first) in place. The first operation on a repo becomes its
+// baseline; later ones are stacked.
+func NextRepoState(prev *RepoState, layer StateLayer, layers []string) *RepoState {
+	next := &RepoState{}
+	if prev != nil {
+		next.Branch, next.Branches = prev.Branch, prev.Branches
+	}
+	if len(layers) > 0 {
+		next.AppliedProfile = layers[len(layers)-1]
+		next.AppliedAt = layer.At
+	}
+	if len(layers) > 1 {
+		next.Layers = layers
+	}
+
+	if prev == nil || prev.Baseline == nil {
+		layer.Profile = ""
+		layer.Layers = nil
+		layer.Vars = nil
+		layer.Managed = nil
+		layer.Snapshots = nil
+		layer.AppliedAt = time.Time{}
+		next.Baseline = &layer
+		return next
+	}
+
+	layer.Profile = prev.AppliedProfile
+	layer.Layers = prev.Layers
+	layer.Vars = prev.Vars
+	layer.Managed = prev.Managed
+	layer.Snapshots = prev.Snapshots
+	layer.AppliedAt = prev.AppliedAt
+	next.Baseline = prev.Baseline
+	next.Stack = append(append([]StateLayer{}, prev.Stack...), layer)
+	return next
+}
+
+// PopRepoState returns the topmost layer of a state and the state that
+// restoring it leaves behind. Once only the baseline remains, restoring
+// it clears the state entirely.
+func PopRepoState(state *RepoState) (StateLayer, *RepoState) {
+	if len(state.Stack) == 0 {
+		return *state.Baseline, nil
+	}
+
+	top := state.Stack[len(state.Stack)-1]
+	next := &RepoState{
+		AppliedProfile: top.Profile,
+		AppliedAt:      top.AppliedAt,
+		Layers:         top.Layers,
+		Vars:           top.Vars,
+		Managed:        top.Managed,
+		Snapshots:      top.Snapshots,
+		Baseline:       state.Baseline,
+		Stack:          append([]StateLayer{}, state.Stack[:len(state.Stack)-1]...),
+		Branch:         state.Branch,
+		Branches:       state.Branches,
+	}
+	return top, next
 }
 
 // StateFile represents the state file structure
@@ -47,6 +209,18 @@ func (s *Storage) loadStateFile() (*StateFile, error) {
 		state.Repos = make(map[string]*RepoState)
 	}
 
+	// Older versions kept only the backup of the last apply
+	for _, repoState := range state.Repos {
+		if repoState != nil && repoState.Baseline == nil && repoState.BackupPath != "" {
+			repoState.Baseline = &StateLayer{
+				Operation: "apply",
+				Backup:    repoState.BackupPath,
+				At:        repoState.AppliedAt,
+			}
+			repoState.BackupPath = ""
+		}
+	}
+
 	return &state, nil
 }
 
@@ -64,7 +238,7 @@ func (s *Storage) saveStateFile(state *StateFile) error {
 		return fmt.Errorf("failed to serialize state: %w", err)
 	}
 
-	if err := os.WriteFile(statePath, data, 0644); err != nil {
+	if err := fileutil.WriteFileAtomic(statePath, data, 0644); err != nil {
 		return fmt.Errorf("failed to write state file: %w", err)
 	}
 
@@ -92,6 +266,16 @@ func (s *Storage) GetRepoState(repoPath string) (*RepoState, error) {
 	return repoState, nil
 }
 
+// ListRepoStates returns the state of every repository aipaca knows,
+// keyed by repository path
+func (s *Storage) ListRepoStates() (map[string]*RepoState, error) {
+	state, err := s.loadStateFile()
+	if err != nil {
+		return nil, err
+	}
+	return state.Repos, nil
+}
+
 // SetRepoState sets the state for a repository
 func (s *Storage) SetRepoState(repoPath string, repoState *RepoState) error {
 	// Normalize the repo path
@@ -100,18 +284,46 @@ func (s *Storage) SetRepoState(repoPath string, repoState *RepoState) error {
 		return fmt.Errorf("failed to resolve path: %w", err)
 	}
 
+	// Serialize the read-modify-write of the shared state file
+	lock, err := s.LockStorage()
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	state, err := s.loadStateFile()
 	if err != nil {
 		return err
 	}
 
+	prev := state.Repos[absPath]
 	if repoState == nil {
 		delete(state.Repos, absPath)
 	} else {
 		state.Repos[absPath] = repoState
 	}
 
-	return s.saveStateFile(state)
+	if err := s.saveStateFile(state); err != nil {
+		return err
+	}
+
+	// Snapshots the repo stopped referencing may be unused now
+	kept := snapshotRefs(repoState)
+	for ref := range snapshotRefs(prev) {
+		if !kept[ref] {
+			if _, err := s.pruneSnapshots(state.Repos); err != nil {
+				Warnf("failed to prune snapshots: %v", err)
+			}
+			break
+		}
+	}
+
+	// The state is recorded by now, and recovering a transaction records it
+	// again, so an exclude file that cannot be written must not fail it
+	if err := s.syncGitExclude(absPath, prev, repoState); err != nil {
+		Warnf("failed to update the git exclude file of %s: %v", absPath, err)
+	}
+	return nil
 }
 
 // ClearRepoState clears the state for a repository
@@ -119,15 +331,6 @@ func (s *Storage) ClearRepoState(repoPath string) error {
 	return s.SetRepoState(repoPath, nil)
 }
 
-// RecordApply records that a profile was applied to a repo
-func (s *Storage) RecordApply(repoPath, profileName, backupName string) error {
-	return s.SetRepoState(repoPath, &RepoState{
-		AppliedProfile: profileName,
-		AppliedAt:      time.Now(),
-		BackupPath:     backupName,
-	})
-}
-
 // GetAppliedProfile returns the profile currently applied to a repo
 func (s *Storage) GetAppliedProfile(repoPath string) (string, error) {
 	state, err := s.GetRepoState(repoPath)
@@ -140,14 +343,14 @@ func (s *Storage) GetAppliedProfile(repoPath string) (string, error) {
 	return state.AppliedProfile, nil
 }
 
-// GetBackupForRepo returns the backup associated with the current state
+// GetBackupForRepo returns the baseline backup of a repo
 func (s *Storage) GetBackupForRepo(repoPath string) (string, error) {
 	state, err := s.GetRepoState(repoPath)
 	if err != nil {
 		return "", err
 	}
-	if state == nil {
+	if state == nil || state.Baseline == nil {
 		return "", nil
 	}
-	return state.BackupPath, nil
+	return state.Baseline.Backup, nil
 }
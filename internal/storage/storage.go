@@ -4,19 +4,32 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/HammerSpb/aipaca/internal/config"
 	"github.com/HammerSpb/aipaca/pkg/fileutil"
 )
 
+// Warnf reports problems that do not stop an operation, such as a git
+// exclude file that cannot be written
+var Warnf = func(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "aipaca: warning: "+format+"\n", args...)
+}
+
 // Storage manages the AI config storage directory
 type Storage struct {
 	cfg *config.Config
+
+	mu    sync.Mutex
+	locks map[string]*heldLock
 }
 
 // New creates a new Storage instance
 func New(cfg *config.Config) *Storage {
-	return &Storage{cfg: cfg}
+	return &Storage{
+		cfg:   cfg,
+		locks: make(map[string]*heldLock),
+	}
 }
 
 // Init initializes the storage directory structure
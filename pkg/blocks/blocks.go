@@ -0,0 +1,205 @@
+// Package blocks manages marked regions that aipaca owns inside files that
+// otherwise belong to the user:
+//
+//	<!-- aipaca:begin profile=go -->
+//	...
+//	<!-- aipaca:end -->
+package blocks
+
+import (
+	"strings"
+)
+
+const (
+	beginPrefix = "<!-- aipaca:begin"
+	endMarker   = "<!-- aipaca:end -->"
+)
+
+// Block is the content of a marked region and the profile it belongs to
+type Block struct {
+	Profile string
+	Content string // Text between the markers
+}
+
+// region is a block located in a text: start is the offset of its begin
+// marker line, end the offset just past its end marker line
+type region struct {
+	Block
+	start, end int
+}
+
+// Begin returns the line that opens the block of a profile
+func Begin(profile string) string {
+	return beginPrefix + " profile=" + profile + " -->"
+}
+
+// Has reports whether text contains any aipaca block
+func Has(text string) bool {
+	return len(parse(text)) > 0
+}
+
+// Parse returns the blocks of text in order
+func Parse(text string) []Block {
+	regions := parse(text)
+	out := make([]Block, len(regions))
+	for i, r := range regions {
+		out[i] = r.Block
+	}
+	return out
+}
+
+// Extract returns the content of a profile's block
+func Extract(text, profile string) (string, bool) {
+	for _, r := range parse(text) {
+		if r.Profile == profile {
+			return r.Content, true
+		}
+	}
+	return "", false
+}
+
+// Strip removes every block from text, leaving the user's content
+func Strip(text string) string {
+	return Update(text, nil)
+}
+
+// Update makes text hold exactly the given blocks. Blocks already present
+// are updated in place and blocks of other profiles are removed. New blocks
+// take the place of the first removed one, or are appended to the text.
+func Update(text string, want []Block) string {
+	present := make(map[string]bool)
+	regions := parse(text)
+	for _, r := range regions {
+		present[r.Profile] = true
+	}
+
+	wanted := make(map[string]Block, len(want))
+	var added []Block
+	for _, b := range want {
+		wanted[b.Profile] = b
+		if !present[b.Profile] {
+			added = append(added, b)
+		}
+	}
+
+	var out strings.Builder
+	pos := 0
+	done := make(map[string]bool, len(want))
+	for _, r := range regions {
+		before := text[pos:r.start]
+		pos = r.end
+
+		if b, ok := wanted[r.Profile]; ok && !done[r.Profile] {
+			out.WriteString(before)
+			writeBlocks(&out, []Block{b})
+			done[r.Profile] = true
+			continue
+		}
+
+		// A stale block makes room for the new ones
+		if len(added) > 0 {
+			out.WriteString(before)
+			writeBlocks(&out, added)
+			added = nil
+			continue
+		}
+
+		out.WriteString(trimBlankLine(before))
+		if out.Len() == 0 {
+			// Nothing precedes the removed block; drop the blank line after it
+			pos += blankLineLen(text[pos:])
+		}
+	}
+	out.WriteString(text[pos:])
+
+	if len(added) == 0 {
+		return out.String()
+	}
+
+	// Append the new blocks after the user's content
+	body := out.String()
+	out.Reset()
+	if strings.TrimSpace(body) != "" {
+		out.WriteString(strings.TrimRight(body, "\n"))
+		out.WriteString("\n\n")
+	}
+	writeBlocks(&out, added)
+	return out.String()
+}
+
+// writeBlocks writes blocks separated by blank lines
+func writeBlocks(out *strings.Builder, blocks []Block) {
+	for i, b := range blocks {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		out.WriteString(Begin(b.Profile))
+		out.WriteString("\n")
+		out.WriteString(b.Content)
+		if b.Content != "" && !strings.HasSuffix(b.Content, "\n") {
+			out.WriteString("\n")
+		}
+		out.WriteString(endMarker)
+		out.WriteString("\n")
+	}
+}
+
+// parse locates the blocks of text. A begin marker without a matching end
+// marker is left as ordinary text.
+func parse(text string) []region {
+	var regions []region
+	var open *region
+
+	pos := 0
+	for pos < len(text) {
+		lineEnd := strings.IndexByte(text[pos:], '\n')
+		next := len(text)
+		if lineEnd >= 0 {
+			next = pos + lineEnd + 1
+		}
+		line := strings.TrimSpace(text[pos:next])
+
+		switch {
+		case strings.HasPrefix(line, beginPrefix) && strings.HasSuffix(line, "-->"):
+			open = &region{start: pos, end: next}
+			open.Profile = attr(line, "profile")
+		case open != nil && line == endMarker:
+			open.Content = text[open.end:pos]
+			open.end = next
+			regions = append(regions, *open)
+			open = nil
+		}
+
+		pos = next
+	}
+
+	return regions
+}
+
+// attr returns the value of a key=value attribute of a marker line
+func attr(line, key string) string {
+	line = strings.TrimSuffix(strings.TrimPrefix(line, beginPrefix), "-->")
+	for _, field := range strings.Fields(line) {
+		if value, ok := strings.CutPrefix(field, key+"="); ok {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// trimBlankLine drops the blank line that separated text from a block
+// after it. text is empty or ends in a newline.
+func trimBlankLine(text string) string {
+	if text == "\n" || strings.HasSuffix(text, "\n\n") {
+		return text[:len(text)-1]
+	}
+	return text
+}
+
+// blankLineLen returns the length of a blank line at the start of text
+func blankLineLen(text string) int {
+	if strings.HasPrefix(text, "\n") {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,107 @@
+package blocks
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	text := "# Notes\n" +
+		"<!-- aipaca:begin profile=go -->\nUse gofmt.\n<!-- aipaca:end -->\n" +
+		"mine\n" +
+		"  <!-- aipaca:begin profile=\"web\" -->  \n<!-- aipaca:end -->\n" +
+		"<!-- aipaca:begin profile=open -->\nno end\n"
+
+	got := Parse(text)
+	want := []Block{{Profile: "go", Content: "Use gofmt.\n"}, {Profile: "web", Content: ""}}
+	if len(got) != len(want) {
+		t.Fatalf("Parse() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("block %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if content, ok := Extract(text, "go"); !ok || content != "Use gofmt.\n" {
+		t.Errorf("Extract(go) = %q, %v", content, ok)
+	}
+	if _, ok := Extract(text, "open"); ok {
+		t.Error("Extract found a block without an end marker")
+	}
+	if !Has(text) || Has("plain text\n") {
+		t.Error("Has() is wrong")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []Block
+		out  string
+	}{
+		{
+			name: "append to user content",
+			text: "# Mine\n",
+			want: []Block{{Profile: "go", Content: "Use gofmt.\n"}},
+			out:  "# Mine\n\n<!-- aipaca:begin profile=go -->\nUse gofmt.\n<!-- aipaca:end -->\n",
+		},
+		{
+			name: "empty file",
+			text: "",
+			want: []Block{{Profile: "go", Content: "a"}},
+			out:  "<!-- aipaca:begin profile=go -->\na\n<!-- aipaca:end -->\n",
+		},
+		{
+			name: "update in place",
+			text: "top\n<!-- aipaca:begin profile=go -->\nold\n<!-- aipaca:end -->\nbottom\n",
+			want: []Block{{Profile: "go", Content: "new\n"}},
+			out:  "top\n<!-- aipaca:begin profile=go -->\nnew\n<!-- aipaca:end -->\nbottom\n",
+		},
+		{
+			name: "new block replaces a stale one",
+			text: "top\n<!-- aipaca:begin profile=go -->\nold\n<!-- aipaca:end -->\nbottom\n",
+			want: []Block{{Profile: "web", Content: "web\n"}},
+			out:  "top\n<!-- aipaca:begin profile=web -->\nweb\n<!-- aipaca:end -->\nbottom\n",
+		},
+		{
+			name: "several blocks appended",
+			text: "mine\n",
+			want: []Block{{Profile: "a", Content: "1\n"}, {Profile: "b", Content: "2\n"}},
+			out:  "mine\n\n<!-- aipaca:begin profile=a -->\n1\n<!-- aipaca:end -->\n\n<!-- aipaca:begin profile=b -->\n2\n<!-- aipaca:end -->\n",
+		},
+		{
+			name: "strip keeps user content",
+			text: "mine\n\n<!-- aipaca:begin profile=go -->\nx\n<!-- aipaca:end -->\n",
+			want: nil,
+			out:  "mine\n",
+		},
+		{
+			name: "strip block at the top",
+			text: "<!-- aipaca:begin profile=go -->\nx\n<!-- aipaca:end -->\n\nmine\n",
+			want: nil,
+			out:  "mine\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Update(tt.text, tt.want)
+			if got != tt.out {
+				t.Errorf("Update() =\n%q\nwant\n%q", got, tt.out)
+			}
+
+			// Updating again changes nothing
+			if again := Update(got, tt.want); again != got {
+				t.Errorf("second Update() =\n%q\nwant\n%q", again, got)
+			}
+		})
+	}
+}
+
+func TestStripRoundTrip(t *testing.T) {
+	user := "# Mine\n\nKeep this.\n"
+	with := Update(user, []Block{{Profile: "go", Content: "Use gofmt.\n"}})
+	if got := Strip(with); got != user {
+		t.Errorf("Strip(Update(text)) = %q, want %q", got, user)
+	}
+}
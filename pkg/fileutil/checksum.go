@@ -25,6 +25,13 @@ func FileChecksum(path string) (string, error) {
 	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
 }
 
+// Checksum calculates the SHA256 checksum of data, in the form used by
+// FileChecksum
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
 // VerifyChecksum verifies a file's checksum
 func VerifyChecksum(path string, expectedChecksum string) (bool, error) {
 	actualChecksum, err := FileChecksum(path)
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // CopyFile copies a single file from src to dst, preserving permissions
@@ -95,11 +96,99 @@ func CopyPath(src, dst string) error {
 	return CopyFile(src, dst)
 }
 
+// MovePath moves a file or directory from src to dst. It renames when
+// possible and falls back to copy-then-remove across filesystems. The copy
+// is written next to dst and renamed into place, so dst either does not
+// exist or is complete.
+func MovePath(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	if err := copyIntoPlace(src, dst); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(src); err != nil {
+		return fmt.Errorf("failed to remove source: %w", err)
+	}
+
+	return nil
+}
+
+// PlacePath puts src at dst by renaming it, or by copying it when a rename
+// is not possible. Unlike MovePath the source is left in place after a copy.
+func PlacePath(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	return copyIntoPlace(src, dst)
+}
+
+// copyIntoPlace copies src to a temporary sibling of dst and renames it
+func copyIntoPlace(src, dst string) error {
+	tmpPath := dst + ".aipaca-tmp"
+	os.RemoveAll(tmpPath)
+
+	if err := CopyPath(src, tmpPath); err != nil {
+		os.RemoveAll(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, dst); err != nil {
+		os.RemoveAll(tmpPath)
+		return fmt.Errorf("failed to move into place: %w", err)
+	}
+
+	return nil
+}
+
+// WriteFileAtomic writes data to a temporary file and renames it over path
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".aipaca-tmp"
+
+	if err := os.WriteFile(tmpPath, data, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
 // RemoveAll removes a file or directory and all its contents
 func RemoveAll(path string) error {
 	return os.RemoveAll(path)
 }
 
+// RemoveEmptyParents removes the directories above each of relPaths, up to
+// but not including root, that are left empty
+func RemoveEmptyParents(root string, relPaths []string) {
+	for _, relPath := range relPaths {
+		dir := filepath.Dir(filepath.Join(root, relPath))
+		for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			// Remove fails on directories that still have entries
+			if err := os.Remove(dir); err != nil {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+	}
+}
+
 // Exists checks if a path exists
 func Exists(path string) bool {
 	_, err := os.Stat(path)
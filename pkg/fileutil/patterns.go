@@ -207,20 +207,19 @@ func isUnderExistingPath(path string, existing map[string]string) bool {
 	return false
 }
 
-// IsAIFile checks if a path matches any AI file pattern
+// IsAIFile checks if a path matches any AI file pattern. A path inside a
+// matching directory matches too.
 func IsAIFile(path string, patterns []string) bool {
 	for _, pattern := range patterns {
-		// Simple check for direct matches or prefix matches
 		cleanPattern := strings.TrimSuffix(pattern, "/")
-		cleanPattern = strings.TrimSuffix(cleanPattern, "/**")
+		if cleanPattern == "" {
+			continue
+		}
 
-		if strings.HasPrefix(path, cleanPattern) {
+		if matched, _ := doublestar.Match(cleanPattern, path); matched {
 			return true
 		}
-
-		// Check glob pattern
-		matched, _ := doublestar.Match(pattern, path)
-		if matched {
+		if matched, _ := doublestar.Match(cleanPattern+"/**", path); matched {
 			return true
 		}
 	}
@@ -0,0 +1,109 @@
+package gitutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	excludeBegin = "# aipaca:begin "
+	excludeEnd   = "# aipaca:end"
+)
+
+// ExcludePath returns the info/exclude file of the repository whose work
+// tree is rooted at root. Worktrees share the file of their main
+// repository. It returns an empty string if root has no ".git".
+func ExcludePath(root string) (string, error) {
+	gitDir, err := GitDir(root)
+	if err != nil || gitDir == "" {
+		return "", err
+	}
+	return filepath.Join(CommonDir(gitDir), "info", "exclude"), nil
+}
+
+// SetExcludeBlock makes the block of owner in the info/exclude of the
+// repository rooted at root hold patterns, replacing the one there. Each
+// owner has its own block:
+//
+//	# aipaca:begin <owner>
+//	/CLAUDE.md
+//	# aipaca:end
+//
+// No patterns removes the block. The file is only written when it changes.
+func SetExcludeBlock(root, owner string, patterns []string) error {
+	path, err := ExcludePath(root)
+	if err != nil || path == "" {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	text := string(data)
+
+	// Drop the owner's block, remembering where it was
+	var kept []string
+	at := -1
+	inBlock := false
+	for _, line := range strings.SplitAfter(text, "\n") {
+		trimmed := strings.TrimRight(line, "\r\n")
+		switch {
+		case trimmed == excludeBegin+owner:
+			inBlock = true
+			at = len(kept)
+		case inBlock && trimmed == excludeEnd:
+			inBlock = false
+		case !inBlock && line != "":
+			kept = append(kept, line)
+		}
+	}
+
+	var block []string
+	if len(patterns) > 0 {
+		block = append(block, excludeBegin+owner+"\n")
+		for _, p := range patterns {
+			block = append(block, p+"\n")
+		}
+		block = append(block, excludeEnd+"\n")
+	}
+	if at < 0 {
+		at = len(kept)
+		if at > 0 && !strings.HasSuffix(kept[at-1], "\n") {
+			kept[at-1] += "\n"
+		}
+	}
+	lines := append(append(append([]string{}, kept[:at]...), block...), kept[at:]...)
+
+	updated := strings.Join(lines, "")
+	if updated == text {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, []byte(updated), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// ExcludePattern returns the pattern that matches exactly the path
+// relPath (relative to the work tree root) in an exclude file
+func ExcludePattern(relPath string) string {
+	var sb strings.Builder
+	sb.WriteByte('/')
+	for _, r := range filepath.ToSlash(relPath) {
+		if strings.ContainsRune(`\*?[`, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	pattern := sb.String()
+	if strings.HasSuffix(pattern, " ") {
+		pattern = strings.TrimSuffix(pattern, " ") + `\ `
+	}
+	return pattern
+}
@@ -0,0 +1,132 @@
+package gitutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExcludePattern(t *testing.T) {
+	tests := map[string]string{
+		"CLAUDE.md":             "/CLAUDE.md",
+		".claude/settings.json": "/.claude/settings.json",
+		"a*b?[c].md":            `/a\*b\?\[c].md`,
+		`back\slash`:            `/back\\slash`,
+		"trailing ":             `/trailing\ `,
+	}
+	for relPath, want := range tests {
+		if got := ExcludePattern(relPath); got != want {
+			t.Errorf("ExcludePattern(%q) = %q, want %q", relPath, got, want)
+		}
+	}
+}
+
+func TestSetExcludeBlock(t *testing.T) {
+	tests := []struct {
+		name     string
+		before   string
+		owner    string
+		patterns []string
+		want     string
+	}{
+		{
+			name:     "new file",
+			owner:    "/repo",
+			patterns: []string{"/CLAUDE.md"},
+			want:     "# aipaca:begin /repo\n/CLAUDE.md\n# aipaca:end\n",
+		},
+		{
+			name:     "appended after user lines",
+			before:   "*.log",
+			owner:    "/repo",
+			patterns: []string{"/a", "/b"},
+			want:     "*.log\n# aipaca:begin /repo\n/a\n/b\n# aipaca:end\n",
+		},
+		{
+			name:     "replaced in place",
+			before:   "x\n# aipaca:begin /repo\n/old\n# aipaca:end\ny\n",
+			owner:    "/repo",
+			patterns: []string{"/new"},
+			want:     "x\n# aipaca:begin /repo\n/new\n# aipaca:end\ny\n",
+		},
+		{
+			name:     "other owners kept",
+			before:   "# aipaca:begin /other\n/o\n# aipaca:end\n",
+			owner:    "/repo",
+			patterns: []string{"/r"},
+			want:     "# aipaca:begin /other\n/o\n# aipaca:end\n# aipaca:begin /repo\n/r\n# aipaca:end\n",
+		},
+		{
+			name:   "removed",
+			before: "x\n# aipaca:begin /repo\n/old\n# aipaca:end\ny\n",
+			owner:  "/repo",
+			want:   "x\ny\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			exclude := filepath.Join(root, ".git", "info", "exclude")
+			if err := os.MkdirAll(filepath.Join(root, ".git"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if tt.before != "" {
+				if err := os.MkdirAll(filepath.Dir(exclude), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(exclude, []byte(tt.before), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := SetExcludeBlock(root, tt.owner, tt.patterns); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(exclude)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("exclude file =\n%q\nwant\n%q", data, tt.want)
+			}
+
+			// Setting the same block again changes nothing
+			if err := SetExcludeBlock(root, tt.owner, tt.patterns); err != nil {
+				t.Fatal(err)
+			}
+			again, _ := os.ReadFile(exclude)
+			if string(again) != string(data) {
+				t.Errorf("second SetExcludeBlock changed the file to %q", again)
+			}
+		})
+	}
+}
+
+func TestExcludePathOfWorktree(t *testing.T) {
+	// A linked worktree shares the exclude file of its main repository
+	main := t.TempDir()
+	common := filepath.Join(main, ".git")
+	gitDir := filepath.Join(common, "worktrees", "wt")
+	if err := os.MkdirAll(gitDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(gitDir, "commondir"), []byte("../..\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wt := t.TempDir()
+	if err := os.WriteFile(filepath.Join(wt, ".git"), []byte("gitdir: "+gitDir+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ExcludePath(wt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(common, "info", "exclude"); got != want {
+		t.Errorf("ExcludePath() = %s, want %s", got, want)
+	}
+
+	if got, err := ExcludePath(t.TempDir()); err != nil || got != "" {
+		t.Errorf("ExcludePath() outside git = %q, %v; want empty", got, err)
+	}
+}
@@ -0,0 +1,280 @@
+package gitutil
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// GitDir returns the git directory of the repository rooted at repoPath.
+// It follows ".git" files (used by worktrees and submodules) to the real
+// git directory. It returns an empty string if repoPath has no ".git".
+func GitDir(repoPath string) (string, error) {
+	dotGit := filepath.Join(repoPath, ".git")
+
+	info, err := os.Stat(dotGit)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to stat .git: %w", err)
+	}
+
+	if info.IsDir() {
+		return dotGit, nil
+	}
+
+	// A ".git" file contains "gitdir: <path>"
+	data, err := os.ReadFile(dotGit)
+	if err != nil {
+		return "", fmt.Errorf("failed to read .git file: %w", err)
+	}
+
+	line := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(line, "gitdir:") {
+		return "", fmt.Errorf("invalid .git file: %s", dotGit)
+	}
+
+	gitDir := strings.TrimSpace(strings.TrimPrefix(line, "gitdir:"))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(repoPath, gitDir)
+	}
+
+	return filepath.Clean(gitDir), nil
+}
+
+// FindRoot returns the root of the work tree containing path: the nearest
+// directory at or above path with a ".git" directory or a ".git" file
+// pointing to one. Linked worktrees and submodules have a ".git" file, so
+// they are work trees of their own. It returns an empty string outside git
+// repositories. Git itself is not run.
+func FindRoot(path string) (string, error) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve path: %w", err)
+	}
+
+	for {
+		// Anything else named .git, such as a broken .git file, is skipped
+		if gitDir, err := GitDir(dir); err == nil && gitDir != "" {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// CurrentBranch returns the branch checked out in the work tree holding
+// path. It returns an empty string on a detached HEAD or outside git
+// repositories.
+func CurrentBranch(path string) (string, error) {
+	root, err := FindRoot(path)
+	if err != nil || root == "" {
+		return "", err
+	}
+	gitDir, err := GitDir(root)
+	if err != nil || gitDir == "" {
+		return "", err
+	}
+
+	data, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read HEAD: %w", err)
+	}
+	ref, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "ref:")
+	if !ok {
+		return "", nil
+	}
+	return strings.TrimPrefix(strings.TrimSpace(ref), "refs/heads/"), nil
+}
+
+// PreviousBranch returns the branch checked out before the current one in
+// the work tree rooted at root, as "git checkout -" would pick it. It
+// returns an empty string when there is none, or it was a detached HEAD.
+func PreviousBranch(root string) string {
+	out, err := git(root, nil, "rev-parse", "--symbolic-full-name", "@{-1}")
+	if err != nil {
+		return ""
+	}
+	branch, ok := strings.CutPrefix(strings.TrimSpace(string(out)), "refs/heads/")
+	if !ok {
+		return ""
+	}
+	return branch
+}
+
+// CommonDir returns the directory holding data shared by all worktrees of
+// a repository (config, hooks, info). For the main worktree this is the git
+// directory itself.
+func CommonDir(gitDir string) string {
+	data, err := os.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err != nil {
+		return gitDir
+	}
+
+	commonDir := strings.TrimSpace(string(data))
+	if !filepath.IsAbs(commonDir) {
+		commonDir = filepath.Join(gitDir, commonDir)
+	}
+	return filepath.Clean(commonDir)
+}
+
+// RemoteURL returns the URL of a named remote, or an empty string if the
+// repository or the remote does not exist
+func RemoteURL(repoPath, remote string) (string, error) {
+	remotes, err := Remotes(repoPath)
+	if err != nil {
+		return "", err
+	}
+	return remotes[remote], nil
+}
+
+// DefaultRemoteURL returns the URL of "origin", falling back to any other
+// remote when there is no origin
+func DefaultRemoteURL(repoPath string) (string, error) {
+	remotes, err := Remotes(repoPath)
+	if err != nil {
+		return "", err
+	}
+
+	if url, ok := remotes["origin"]; ok {
+		return url, nil
+	}
+
+	// Pick deterministically among the other remotes
+	best := ""
+	for name := range remotes {
+		if best == "" || name < best {
+			best = name
+		}
+	}
+	return remotes[best], nil
+}
+
+// Remotes returns the remote name -> URL map from the repository config
+func Remotes(repoPath string) (map[string]string, error) {
+	gitDir, err := GitDir(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	if gitDir == "" {
+		return map[string]string{}, nil
+	}
+
+	sections, err := ReadConfig(filepath.Join(CommonDir(gitDir), "config"))
+	if err != nil {
+		return nil, err
+	}
+
+	remotes := make(map[string]string)
+	for section, values := range sections {
+		name, ok := strings.CutPrefix(section, `remote "`)
+		if !ok {
+			continue
+		}
+		name = strings.TrimSuffix(name, `"`)
+		if url := values["url"]; url != "" {
+			remotes[name] = url
+		}
+	}
+
+	return remotes, nil
+}
+
+// ReadConfig parses a git config file into section -> key -> value.
+// Sections are keyed as written without brackets, e.g. `remote "origin"`.
+// Keys are lower-cased; for repeated keys the last value wins.
+func ReadConfig(path string) (map[string]map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]map[string]string{}, nil
+		}
+		return nil, fmt.Errorf("failed to read git config: %w", err)
+	}
+	defer file.Close()
+
+	sections := make(map[string]map[string]string)
+	current := ""
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.LastIndex(line, "]")
+			if end < 0 {
+				continue
+			}
+			current = strings.TrimSpace(line[1:end])
+			if sections[current] == nil {
+				sections[current] = make(map[string]string)
+			}
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		if sections[current] == nil {
+			sections[current] = make(map[string]string)
+		}
+		sections[current][key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read git config: %w", err)
+	}
+
+	return sections, nil
+}
+
+// IgnoredPaths returns which of paths (relative to repoPath) git ignores.
+// Tracked files are never ignored. Outside a git repository, or without
+// git installed, nothing is ignored.
+func IgnoredPaths(repoPath string, paths []string) (map[string]bool, error) {
+	ignored := make(map[string]bool)
+	if len(paths) == 0 {
+		return ignored, nil
+	}
+	gitDir, err := GitDir(repoPath)
+	if err != nil || gitDir == "" {
+		return ignored, err
+	}
+
+	cmd := exec.Command("git", "-C", repoPath, "check-ignore", "-z", "--stdin")
+	var input strings.Builder
+	for _, p := range paths {
+		input.WriteString(filepath.ToSlash(p) + "\x00")
+	}
+	cmd.Stdin = strings.NewReader(input.String())
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		switch {
+		case errors.Is(err, exec.ErrNotFound):
+			return ignored, nil
+		case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+			return ignored, nil // None of the paths is ignored
+		default:
+			return nil, fmt.Errorf("failed to check ignored files: %w", err)
+		}
+	}
+
+	for _, p := range strings.Split(string(out), "\x00") {
+		if p != "" {
+			ignored[filepath.FromSlash(p)] = true
+		}
+	}
+	return ignored, nil
+}
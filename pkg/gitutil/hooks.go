@@ -0,0 +1,96 @@
+package gitutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// HookMarker starts the second line of every hook aipaca installs
+	HookMarker = "# aipaca:hook"
+
+	// chainedSuffix is appended to the name of a hook aipaca moved aside
+	// to install its own; the aipaca hook runs it afterwards
+	chainedSuffix = ".aipaca-chained"
+)
+
+// HooksDir returns the directory git runs the hooks of the repository
+// rooted at root from, following core.hooksPath
+func HooksDir(root string) (string, error) {
+	out, err := git(root, nil, "rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return "", fmt.Errorf("failed to find hooks directory: %w", err)
+	}
+	dir := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	return filepath.Clean(dir), nil
+}
+
+// ChainedHookPath returns where InstallHook moves an existing hook
+func ChainedHookPath(hookPath string) string {
+	return hookPath + chainedSuffix
+}
+
+// IsAipacaHook reports whether the hook at path was installed by aipaca
+func IsAipacaHook(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(data), "\n"+HookMarker)
+}
+
+// InstallHook writes script as the hook name in dir. A hook there that
+// aipaca did not install is moved to ChainedHookPath for the script to
+// run; chained reports whether that happened now or before.
+func InstallHook(dir, name, script string) (chained bool, err error) {
+	path := filepath.Join(dir, name)
+	chainedPath := ChainedHookPath(path)
+
+	if _, err := os.Lstat(path); err == nil && !IsAipacaHook(path) {
+		if _, err := os.Lstat(chainedPath); err == nil {
+			return false, fmt.Errorf("cannot chain %s: %s already exists", path, chainedPath)
+		}
+		if err := os.Rename(path, chainedPath); err != nil {
+			return false, fmt.Errorf("failed to move aside %s: %w", path, err)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	// WriteFile keeps the mode of an existing file
+	if err := os.Chmod(path, 0755); err != nil {
+		return false, fmt.Errorf("failed to make %s executable: %w", path, err)
+	}
+
+	_, err = os.Lstat(chainedPath)
+	return err == nil, nil
+}
+
+// RemoveHook removes the hook name from dir if aipaca installed it, and
+// puts back the hook it chained to. It reports whether there was one.
+func RemoveHook(dir, name string) (removed bool, err error) {
+	path := filepath.Join(dir, name)
+	if !IsAipacaHook(path) {
+		return false, nil
+	}
+
+	if err := os.Remove(path); err != nil {
+		return false, fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	chainedPath := ChainedHookPath(path)
+	if _, err := os.Lstat(chainedPath); err == nil {
+		if err := os.Rename(chainedPath, path); err != nil {
+			return true, fmt.Errorf("failed to put back %s: %w", path, err)
+		}
+	}
+	return true, nil
+}
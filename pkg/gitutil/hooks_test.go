@@ -0,0 +1,171 @@
+package gitutil
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testScript = "#!/bin/sh\n" + HookMarker + " pre-commit\nexit 0\n"
+
+func readHook(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestInstallHook(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "hooks")
+	path := filepath.Join(dir, "pre-commit")
+
+	chained, err := InstallHook(dir, "pre-commit", testScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chained {
+		t.Error("nothing to chain, but chained reported")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0100 == 0 {
+		t.Errorf("hook mode = %v, want executable", info.Mode())
+	}
+	if !IsAipacaHook(path) {
+		t.Error("installed hook not recognized")
+	}
+
+	// Installing again rewrites the aipaca hook in place
+	if _, err := InstallHook(dir, "pre-commit", testScript+"# v2\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(ChainedHookPath(path)); err == nil {
+		t.Error("own hook was chained")
+	}
+
+	removed, err := RemoveHook(dir, "pre-commit")
+	if err != nil || !removed {
+		t.Fatalf("RemoveHook() = %v, %v", removed, err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Error("hook still there after RemoveHook")
+	}
+}
+
+func TestInstallHookChainsExisting(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pre-commit")
+	existing := "#!/bin/sh\necho lint\n"
+	if err := os.WriteFile(path, []byte(existing), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	chained, err := InstallHook(dir, "pre-commit", testScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chained {
+		t.Error("existing hook not reported as chained")
+	}
+	if got := readHook(t, ChainedHookPath(path)); got != existing {
+		t.Errorf("chained hook = %q, want %q", got, existing)
+	}
+
+	// Reinstalling keeps the chain
+	if chained, err := InstallHook(dir, "pre-commit", testScript); err != nil || !chained {
+		t.Errorf("reinstall: chained = %v, err = %v", chained, err)
+	}
+
+	if removed, err := RemoveHook(dir, "pre-commit"); err != nil || !removed {
+		t.Fatalf("RemoveHook() = %v, %v", removed, err)
+	}
+	if got := readHook(t, path); got != existing {
+		t.Errorf("hook after RemoveHook = %q, want the original back", got)
+	}
+}
+
+func TestInstallHookWithChainTaken(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pre-commit")
+	for _, p := range []string{path, ChainedHookPath(path)} {
+		if err := os.WriteFile(p, []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := InstallHook(dir, "pre-commit", testScript); err == nil {
+		t.Error("InstallHook() over a taken chain: want error")
+	}
+}
+
+func TestRemoveHookLeavesOthers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pre-commit")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\necho mine\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := RemoveHook(dir, "pre-commit")
+	if err != nil || removed {
+		t.Errorf("RemoveHook() of a foreign hook = %v, %v", removed, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error("foreign hook removed")
+	}
+}
+
+func TestHooksDir(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	root := t.TempDir()
+	run := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = root
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	run("init", "-q")
+
+	got, err := HooksDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, ".git", "hooks"); got != want {
+		t.Errorf("HooksDir() = %s, want %s", got, want)
+	}
+
+	run("config", "core.hooksPath", ".githooks")
+	got, err = HooksDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, ".githooks"); got != want {
+		t.Errorf("HooksDir() with core.hooksPath = %s, want %s", got, want)
+	}
+}
+
+func TestParsePushRefs(t *testing.T) {
+	zero := strings.Repeat("0", 40)
+	input := "refs/heads/main 1111 refs/heads/main 2222\n\nrefs/heads/old " + zero + " refs/heads/old 3333\n"
+
+	refs, err := ParsePushRefs(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 {
+		t.Fatalf("got %d refs, want 2", len(refs))
+	}
+	if refs[0].Deleted() || !refs[1].Deleted() {
+		t.Errorf("Deleted() = %v, %v; want false, true", refs[0].Deleted(), refs[1].Deleted())
+	}
+
+	if _, err := ParsePushRefs(strings.NewReader("refs/heads/main 1111\n")); err == nil {
+		t.Error("ParsePushRefs() of a short line: want error")
+	}
+}
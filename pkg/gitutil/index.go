@@ -0,0 +1,199 @@
+package gitutil
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// PushRef is one ref being pushed, as git passes it to a pre-push hook
+type PushRef struct {
+	LocalRef  string
+	LocalSHA  string
+	RemoteRef string
+	RemoteSHA string
+}
+
+// Deleted reports whether the push deletes the remote ref
+func (r PushRef) Deleted() bool {
+	return strings.Trim(r.LocalSHA, "0") == ""
+}
+
+// ParsePushRefs reads the refs git passes to a pre-push hook on stdin,
+// one "<local ref> <local sha> <remote ref> <remote sha>" per line
+func ParsePushRefs(r io.Reader) ([]PushRef, error) {
+	var refs []PushRef
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid pre-push line: %s", scanner.Text())
+		}
+		refs = append(refs, PushRef{fields[0], fields[1], fields[2], fields[3]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read pushed refs: %w", err)
+	}
+	return refs, nil
+}
+
+// StagedFiles returns the files added or changed in the index of the
+// repository rooted at root, relative to root. Deletions are left out.
+func StagedFiles(root string) ([]string, error) {
+	out, err := git(root, nil, "diff", "--cached", "--name-only", "--no-renames", "--diff-filter=d", "-z")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list staged files: %w", err)
+	}
+	return splitPaths(out), nil
+}
+
+// HasStagedChanges reports whether the index differs from HEAD
+func HasStagedChanges(root string) (bool, error) {
+	out, err := git(root, nil, "diff", "--cached", "--name-only", "-z")
+	if err != nil {
+		return false, fmt.Errorf("failed to list staged files: %w", err)
+	}
+	return len(out) > 0, nil
+}
+
+// PushedFiles returns the files added or changed by the commits a push
+// sends that no remote has yet, relative to root
+func PushedFiles(root string, ref PushRef) ([]string, error) {
+	if ref.Deleted() {
+		return nil, nil
+	}
+
+	args := []string{"log", "--format=", "--name-only", "--no-renames", "--diff-filter=d", "-z", ref.LocalSHA}
+	if strings.Trim(ref.RemoteSHA, "0") != "" {
+		// The remote may have commits this clone has never fetched
+		if _, err := git(root, nil, "cat-file", "-e", ref.RemoteSHA+"^{commit}"); err == nil {
+			args = append(args, "^"+ref.RemoteSHA)
+		}
+	}
+	args = append(args, "--not", "--remotes")
+
+	out, err := git(root, nil, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pushed files: %w", err)
+	}
+	return dedupePaths(splitPaths(out)), nil
+}
+
+// IndexEntries returns the index entries of paths in the format
+// SetIndexEntries takes back
+func IndexEntries(root string, paths []string) ([]byte, error) {
+	args := append([]string{"ls-files", "--stage", "-z", "--"}, slashPaths(paths)...)
+	out, err := git(root, nil, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index entries: %w", err)
+	}
+	return out, nil
+}
+
+// SetIndexEntries writes entries read by IndexEntries back to the index
+func SetIndexEntries(root string, entries []byte) error {
+	if _, err := git(root, entries, "update-index", "-z", "--index-info"); err != nil {
+		return fmt.Errorf("failed to update index: %w", err)
+	}
+	return nil
+}
+
+// Unstage resets paths in the index to their content in HEAD, taking out
+// paths HEAD does not have. The work tree is left alone.
+func Unstage(root string, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	var inHead []byte
+	if _, err := git(root, nil, "rev-parse", "--verify", "--quiet", "HEAD"); err == nil {
+		args := append([]string{"ls-tree", "-r", "-z", "--full-tree", "HEAD", "--"}, slashPaths(paths)...)
+		if inHead, err = git(root, nil, args...); err != nil {
+			return fmt.Errorf("failed to read HEAD: %w", err)
+		}
+	}
+
+	known := make(map[string]bool)
+	for _, entry := range bytes.Split(inHead, []byte{0}) {
+		if _, path, ok := bytes.Cut(entry, []byte{'\t'}); ok {
+			known[string(path)] = true
+		}
+	}
+	var added []byte
+	for _, p := range slashPaths(paths) {
+		if !known[p] {
+			added = append(added, p+"\x00"...)
+		}
+	}
+
+	if len(inHead) > 0 {
+		if err := SetIndexEntries(root, inHead); err != nil {
+			return err
+		}
+	}
+	if len(added) > 0 {
+		if _, err := git(root, added, "update-index", "-z", "--force-remove", "--stdin"); err != nil {
+			return fmt.Errorf("failed to update index: %w", err)
+		}
+	}
+	return nil
+}
+
+// git runs a git command in root with literal pathspecs and returns its
+// output. Error messages from git end up in the error.
+func git(root string, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", root, "--literal-pathspecs"}, args...)...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// splitPaths splits NUL-terminated git output into native paths
+func splitPaths(out []byte) []string {
+	var paths []string
+	for _, p := range strings.Split(string(out), "\x00") {
+		if p != "" {
+			paths = append(paths, filepath.FromSlash(p))
+		}
+	}
+	return paths
+}
+
+// slashPaths converts native paths to the form git expects
+func slashPaths(paths []string) []string {
+	slashed := make([]string, len(paths))
+	for i, p := range paths {
+		slashed[i] = filepath.ToSlash(p)
+	}
+	return slashed
+}
+
+// dedupePaths drops repeated paths, keeping the first of each
+func dedupePaths(paths []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, p := range paths {
+		if !seen[p] {
+			seen[p] = true
+			unique = append(unique, p)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,362 @@
+// Package merge combines several versions of a file into one: JSON and
+// YAML documents key by key, Markdown by appending or by section
+package merge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Strategy is a way of combining versions of a file
+type Strategy string
+
+// Merge strategies
+const (
+	Replace   Strategy = "replace"    // The last version wins (default)
+	DeepMerge Strategy = "deep-merge" // Merge JSON/YAML objects; later arrays replace earlier ones
+	Union     Strategy = "union"      // Like deep-merge, but arrays keep the elements of every version
+	Append    Strategy = "append"     // Concatenate text, skipping versions already contained
+	Sections  Strategy = "sections"   // Merge Markdown by heading; later sections replace earlier ones
+
+	// Block keeps the repo's own file and puts each profile's version in a
+	// marked block inside it (see package blocks). Merge cannot do this
+	// without knowing the profiles, so callers handle it themselves.
+	Block Strategy = "block"
+)
+
+// ParseStrategy validates a strategy name
+func ParseStrategy(name string) (Strategy, error) {
+	switch s := Strategy(name); s {
+	case Replace, DeepMerge, Union, Append, Sections, Block:
+		return s, nil
+	case "":
+		return Replace, nil
+	default:
+		return "", fmt.Errorf("unknown merge strategy '%s' (use replace, deep-merge, union, append, sections or block)", name)
+	}
+}
+
+// Merge combines versions of the file at path, earliest first
+func Merge(path string, strategy Strategy, versions [][]byte) ([]byte, error) {
+	if len(versions) == 0 {
+		return nil, nil
+	}
+
+	switch strategy {
+	case DeepMerge, Union:
+		return mergeStructured(path, versions, strategy == Union)
+	case Append:
+		return mergeAppend(versions), nil
+	case Sections:
+		return mergeSections(versions), nil
+	default:
+		return versions[len(versions)-1], nil
+	}
+}
+
+// mergeStructured deep-merges JSON or YAML documents, keeping the key
+// order of the first version that has each key
+func mergeStructured(path string, versions [][]byte, union bool) ([]byte, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".json" && ext != ".yaml" && ext != ".yml" {
+		return nil, fmt.Errorf("cannot merge %s as structured data: not a JSON or YAML file", path)
+	}
+
+	var merged *yaml.Node
+	for _, version := range versions {
+		if len(bytes.TrimSpace(version)) == 0 {
+			continue
+		}
+
+		var doc yaml.Node
+		if err := yaml.Unmarshal(version, &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+
+		if merged == nil {
+			merged = doc.Content[0]
+		} else {
+			merged = mergeNodes(merged, doc.Content[0], union)
+		}
+	}
+
+	if merged == nil {
+		return versions[len(versions)-1], nil
+	}
+
+	if ext == ".json" {
+		var compact bytes.Buffer
+		if err := writeJSON(&compact, merged); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		var out bytes.Buffer
+		if err := json.Indent(&out, compact.Bytes(), "", "  "); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		out.WriteByte('\n')
+		return out.Bytes(), nil
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(merged); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return out.Bytes(), nil
+}
+
+// mergeNodes merges src over dst. Objects are merged key by key; with
+// union, arrays gain the elements of src they do not already have.
+// Anything else is replaced by src.
+func mergeNodes(dst, src *yaml.Node, union bool) *yaml.Node {
+	dst, src = resolveAlias(dst), resolveAlias(src)
+
+	switch {
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode:
+		out := *dst
+		out.Content = append([]*yaml.Node{}, dst.Content...)
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			key, value := src.Content[i], src.Content[i+1]
+
+			found := false
+			for j := 0; j+1 < len(out.Content); j += 2 {
+				if out.Content[j].Value == key.Value {
+					out.Content[j+1] = mergeNodes(out.Content[j+1], value, union)
+					found = true
+					break
+				}
+			}
+			if !found {
+				out.Content = append(out.Content, key, value)
+			}
+		}
+		return &out
+
+	case union && dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode:
+		out := *dst
+		out.Content = append([]*yaml.Node{}, dst.Content...)
+		seen := make(map[string]bool, len(dst.Content))
+		for _, item := range dst.Content {
+			seen[canonical(item)] = true
+		}
+		for _, item := range src.Content {
+			if key := canonical(item); !seen[key] {
+				seen[key] = true
+				out.Content = append(out.Content, item)
+			}
+		}
+		return &out
+
+	default:
+		return src
+	}
+}
+
+// resolveAlias follows a YAML alias to the node it refers to
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+// canonical renders a node as compact JSON, for comparing array elements
+func canonical(n *yaml.Node) string {
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, n); err != nil {
+		return n.Value
+	}
+	return buf.String()
+}
+
+// writeJSON writes a YAML node tree as compact JSON, keeping key order
+func writeJSON(buf *bytes.Buffer, n *yaml.Node) error {
+	n = resolveAlias(n)
+
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			buf.WriteString("null")
+			return nil
+		}
+		return writeJSON(buf, n.Content[0])
+
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(n.Content[i].Value)
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err := writeJSON(buf, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, item := range n.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+
+	default:
+		switch n.ShortTag() {
+		case "!!null":
+			buf.WriteString("null")
+			return nil
+		case "!!int", "!!float":
+			// Keep numbers as written when they are valid JSON
+			if json.Valid([]byte(n.Value)) {
+				buf.WriteString(n.Value)
+				return nil
+			}
+		case "!!str":
+			data, _ := json.Marshal(n.Value)
+			buf.Write(data)
+			return nil
+		}
+
+		var value any
+		if err := n.Decode(&value); err != nil {
+			return err
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		return nil
+	}
+}
+
+// mergeAppend concatenates versions separated by a blank line, skipping
+// empty versions and ones whose text is already present
+func mergeAppend(versions [][]byte) []byte {
+	var out string
+	for _, version := range versions {
+		text := strings.TrimSpace(string(version))
+		if text == "" || strings.Contains(out, text) {
+			continue
+		}
+		if out != "" {
+			out += "\n\n"
+		}
+		out += text
+	}
+
+	if out == "" {
+		return nil
+	}
+	return []byte(out + "\n")
+}
+
+// section is a Markdown heading line and the lines below it, up to the
+// next heading. The text before the first heading has an empty heading.
+type section struct {
+	heading string
+	lines   []string
+}
+
+// mergeSections merges Markdown documents by heading. A section whose
+// heading appears again later is replaced in place; new sections are
+// appended.
+func mergeSections(versions [][]byte) []byte {
+	var merged []section
+	index := make(map[string]int)
+
+	for _, version := range versions {
+		for _, sec := range splitSections(string(version)) {
+			key := strings.TrimSpace(sec.heading)
+			if i, ok := index[key]; ok {
+				// Keep an existing preamble when a later one is blank
+				if key == "" && strings.TrimSpace(strings.Join(sec.lines, "")) == "" {
+					continue
+				}
+				merged[i] = sec
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, sec)
+		}
+	}
+
+	var out strings.Builder
+	for _, sec := range merged {
+		body := strings.TrimRight(sec.heading+strings.Join(sec.lines, ""), "\n")
+		if strings.TrimSpace(body) == "" {
+			continue
+		}
+		if out.Len() > 0 {
+			out.WriteString("\n\n")
+		}
+		out.WriteString(body)
+	}
+
+	if out.Len() == 0 {
+		return nil
+	}
+	out.WriteString("\n")
+	return []byte(out.String())
+}
+
+// splitSections splits Markdown at ATX headings, ignoring lines inside
+// fenced code blocks
+func splitSections(text string) []section {
+	sections := []section{{}}
+	inFence := false
+
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line == "" {
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+		}
+
+		if !inFence && isHeading(trimmed) {
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			sections = append(sections, section{heading: line})
+			continue
+		}
+
+		last := &sections[len(sections)-1]
+		last.lines = append(last.lines, line)
+	}
+
+	return sections
+}
+
+// isHeading reports whether a trimmed line is an ATX heading
+func isHeading(line string) bool {
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	return level > 0 && level <= 6 && (level == len(line) || line[level] == ' ')
+}
@@ -0,0 +1,157 @@
+package merge
+
+import (
+	"testing"
+)
+
+func TestParseStrategy(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Strategy
+		wantErr bool
+	}{
+		{"", Replace, false},
+		{"replace", Replace, false},
+		{"deep-merge", DeepMerge, false},
+		{"union", Union, false},
+		{"append", Append, false},
+		{"sections", Sections, false},
+		{"block", Block, false},
+		{"concat", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseStrategy(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseStrategy(%q) = %q, %v; want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		strategy Strategy
+		versions []string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "replace keeps the last version",
+			path:     "CLAUDE.md",
+			strategy: Replace,
+			versions: []string{"a\n", "b\n"},
+			want:     "b\n",
+		},
+		{
+			name:     "deep-merge json",
+			path:     "settings.json",
+			strategy: DeepMerge,
+			versions: []string{
+				`{"model": "a", "permissions": {"allow": ["x"], "deny": ["y"]}}`,
+				`{"permissions": {"allow": ["z"]}, "env": {"A": "1"}}`,
+			},
+			want: "{\n  \"model\": \"a\",\n  \"permissions\": {\n    \"allow\": [\n      \"z\"\n    ],\n    \"deny\": [\n      \"y\"\n    ]\n  },\n  \"env\": {\n    \"A\": \"1\"\n  }\n}\n",
+		},
+		{
+			name:     "union json keeps array elements of every version",
+			path:     "settings.json",
+			strategy: Union,
+			versions: []string{
+				`{"allow": ["x", "y"], "n": 1}`,
+				`{"allow": ["y", "z"], "n": 2.50}`,
+			},
+			want: "{\n  \"allow\": [\n    \"x\",\n    \"y\",\n    \"z\"\n  ],\n  \"n\": 2.50\n}\n",
+		},
+		{
+			name:     "union yaml",
+			path:     "config.yml",
+			strategy: Union,
+			versions: []string{
+				"servers:\n  - a\nname: one\n",
+				"servers:\n  - b\n",
+			},
+			want: "servers:\n  - a\n  - b\nname: one\n",
+		},
+		{
+			name:     "empty versions are skipped",
+			path:     "settings.json",
+			strategy: DeepMerge,
+			versions: []string{"", `{"a": 1}`, "  \n"},
+			want:     "{\n  \"a\": 1\n}\n",
+		},
+		{
+			name:     "not structured",
+			path:     "CLAUDE.md",
+			strategy: DeepMerge,
+			versions: []string{"a", "b"},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid json",
+			path:     "settings.json",
+			strategy: Union,
+			versions: []string{`{"a": 1}`, `{"a": [}`},
+			wantErr:  true,
+		},
+		{
+			name:     "append skips text already present",
+			path:     "CLAUDE.md",
+			strategy: Append,
+			versions: []string{"# Rules\n\nBe brief.\n", "\n", "Be brief.", "Test first.\n"},
+			want:     "# Rules\n\nBe brief.\n\nTest first.\n",
+		},
+		{
+			name:     "sections replace by heading",
+			path:     "CLAUDE.md",
+			strategy: Sections,
+			versions: []string{
+				"Intro\n\n# Style\nTabs\n\n# Tests\nTable tests\n",
+				"# Style\nSpaces\n\n# Docs\nShort\n",
+			},
+			want: "Intro\n\n# Style\nSpaces\n\n# Tests\nTable tests\n\n# Docs\nShort\n",
+		},
+		{
+			name:     "sections ignore headings in code",
+			path:     "CLAUDE.md",
+			strategy: Sections,
+			versions: []string{
+				"# Build\n```sh\n# not a heading\nmake\n```\n",
+				"# Other\nx\n",
+			},
+			want: "# Build\n```sh\n# not a heading\nmake\n```\n\n# Other\nx\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var versions [][]byte
+			for _, v := range tt.versions {
+				versions = append(versions, []byte(v))
+			}
+
+			got, err := Merge(tt.path, tt.strategy, versions)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Merge() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("Merge() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsHeading(t *testing.T) {
+	tests := map[string]bool{
+		"# Title":   true,
+		"###### h6": true,
+		"#":         true,
+		"####### 7": false,
+		"#hashtag":  false,
+		"text":      false,
+	}
+	for line, want := range tests {
+		if got := isHeading(line); got != want {
+			t.Errorf("isHeading(%q) = %v, want %v", line, got, want)
+		}
+	}
+}
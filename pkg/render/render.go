@@ -0,0 +1,281 @@
+// Package render renders profile templates with text/template and maps
+// rendered text back to template form
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/HammerSpb/aipaca/pkg/textdiff"
+)
+
+// Suffix marks a profile file as a template. It is dropped from the name
+// of the rendered file.
+const Suffix = ".tmpl"
+
+// minValueLen is the shortest variable value that Reverse maps back to a
+// placeholder; shorter values match too much unrelated text
+const minValueLen = 3
+
+// Render executes a template with vars as its data. Referring to a variable
+// that is not set is an error.
+func Render(name string, text []byte, vars map[string]string) ([]byte, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template %s: %w", name, err)
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, vars); err != nil {
+		return nil, fmt.Errorf("failed to render template %s: %w", name, err)
+	}
+	return out.Bytes(), nil
+}
+
+// Reverse turns an edited copy of a rendered template back into template
+// form. When the template renders line for line, lines that were not
+// edited are taken from the template unchanged; otherwise the whole text
+// is used. In edited text, a variable value becomes its placeholder again
+// only where the template rendered that placeholder and the value was left
+// as it was.
+func Reverse(tmpl, rendered, edited []byte, vars map[string]string) []byte {
+	tmplLines := textdiff.SplitLines(string(tmpl))
+	renderedLines := textdiff.SplitLines(string(rendered))
+	m, marked := markPlaceholders(tmpl, rendered, vars)
+
+	if len(tmplLines) != len(renderedLines) {
+		if !marked {
+			return []byte(Placeholders(string(edited), usedVars(string(tmpl), vars)))
+		}
+		return []byte(m.reverse(string(edited)))
+	}
+
+	// Line offsets of the rendered text, in runes
+	starts := make([]int, len(renderedLines)+1)
+	for i, line := range renderedLines {
+		starts[i+1] = starts[i] + utf8.RuneCountInString(line)
+	}
+
+	var out strings.Builder
+	i := 0
+	script := textdiff.Diff(renderedLines, textdiff.SplitLines(string(edited)))
+	for j := 0; j < len(script); {
+		if script[j].Op == textdiff.Equal {
+			out.WriteString(tmplLines[i])
+			i++
+			j++
+			continue
+		}
+
+		// A run of changed lines replaces rendered lines [from, i)
+		from := i
+		var inserted strings.Builder
+		for ; j < len(script) && script[j].Op != textdiff.Equal; j++ {
+			if script[j].Op == textdiff.Delete {
+				i++
+			} else {
+				inserted.WriteString(script[j].Text)
+			}
+		}
+
+		if !marked {
+			out.WriteString(Placeholders(inserted.String(), usedVars(strings.Join(tmplLines[from:i], ""), vars)))
+			continue
+		}
+		out.WriteString(m.slice(starts[from], starts[i]).reverse(inserted.String()))
+	}
+	return []byte(out.String())
+}
+
+// marks is rendered text with, for every rune, the placeholder it was
+// rendered by: an index into names, or -1 for template text
+type marks struct {
+	runes []rune
+	owner []int
+	names []string
+}
+
+// markPlaceholders finds where the template rendered its placeholders, by
+// rendering it again with a marker in place of every value. It fails for
+// templates that do more with a value than print it, such as comparing or
+// formatting it.
+func markPlaceholders(tmpl, rendered []byte, vars map[string]string) (*marks, bool) {
+	keys := make([]string, 0, len(vars))
+	markers := make(map[string]string, len(vars))
+	for k := range vars {
+		markers[k] = "\x00" + strconv.Itoa(len(keys)) + "\x00"
+		keys = append(keys, k)
+	}
+	out, err := Render("reverse", tmpl, markers)
+	if err != nil {
+		return nil, false
+	}
+
+	m := &marks{}
+	text := string(out)
+	for text != "" {
+		marker, rest, found := strings.Cut(text, "\x00")
+		for _, r := range marker {
+			m.runes = append(m.runes, r)
+			m.owner = append(m.owner, -1)
+		}
+		if !found {
+			break
+		}
+
+		index, rest, found := strings.Cut(rest, "\x00")
+		n, err := strconv.Atoi(index)
+		if !found || err != nil || n >= len(keys) {
+			return nil, false
+		}
+		for _, r := range vars[keys[n]] {
+			m.runes = append(m.runes, r)
+			m.owner = append(m.owner, len(m.names))
+		}
+		m.names = append(m.names, keys[n])
+		text = rest
+	}
+
+	if string(m.runes) != string(rendered) {
+		return nil, false
+	}
+	return m, true
+}
+
+// slice returns the marks of runes [from, to)
+func (m *marks) slice(from, to int) *marks {
+	return &marks{runes: m.runes[from:to], owner: m.owner[from:to], names: m.names}
+}
+
+// reverse maps edited text back onto the marked text it was edited from.
+// A placeholder whose value is still there in one piece is put back; any
+// other text is kept as edited.
+func (m *marks) reverse(edited string) string {
+	a := make([]string, len(m.runes))
+	for i, r := range m.runes {
+		a[i] = string(r)
+	}
+	var b []string
+	for _, r := range edited {
+		b = append(b, string(r))
+	}
+	script := textdiff.Diff(a, b)
+
+	// A placeholder is intact when its runes were all kept, with nothing
+	// inserted between them
+	first := make(map[int]int)
+	kept := make(map[int]int)
+	i := 0
+	for j, line := range script {
+		if line.Op == textdiff.Insert {
+			continue
+		}
+		if p := m.owner[i]; p >= 0 && line.Op == textdiff.Equal {
+			if kept[p] == 0 {
+				first[p] = j
+			}
+			if first[p]+kept[p] == j {
+				kept[p]++
+			}
+		}
+		i++
+	}
+	size := make(map[int]int)
+	for _, p := range m.owner {
+		size[p]++
+	}
+	intact := func(p int) bool {
+		return kept[p] == size[p]
+	}
+
+	var out strings.Builder
+	i = 0
+	for j, line := range script {
+		switch line.Op {
+		case textdiff.Insert:
+			out.WriteString(line.Text)
+			continue
+		case textdiff.Equal:
+			p := m.owner[i]
+			switch {
+			case p < 0 || !intact(p):
+				out.WriteString(line.Text)
+			case first[p] == j:
+				out.WriteString("{{." + m.names[p] + "}}")
+			}
+		}
+		i++
+	}
+	return out.String()
+}
+
+// usedVars returns the variables a template refers to
+func usedVars(tmpl string, vars map[string]string) map[string]string {
+	used := make(map[string]string)
+	for k, v := range vars {
+		if strings.Contains(tmpl, "."+k) {
+			used[k] = v
+		}
+	}
+	return used
+}
+
+// Placeholders replaces variable values in text with template placeholders
+// such as {{.repo_name}}. Longer values are replaced first, and only where
+// they are not part of a longer word.
+func Placeholders(text string, vars map[string]string) string {
+	keys := make([]string, 0, len(vars))
+	for k, v := range vars {
+		if len(v) >= minValueLen {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(vars[keys[i]]) != len(vars[keys[j]]) {
+			return len(vars[keys[i]]) > len(vars[keys[j]])
+		}
+		return keys[i] < keys[j]
+	})
+
+	for _, k := range keys {
+		text = replaceWord(text, vars[k], "{{."+k+"}}")
+	}
+	return text
+}
+
+// replaceWord replaces occurrences of value that are not surrounded by
+// letters or digits, and not already inside a placeholder
+func replaceWord(text, value, placeholder string) string {
+	var out strings.Builder
+	for {
+		i := strings.Index(text, value)
+		if i < 0 {
+			out.WriteString(text)
+			return out.String()
+		}
+
+		done := out.String() + text[:i]
+		before, _ := utf8.DecodeLastRuneInString(done)
+		after, _ := utf8.DecodeRuneInString(text[i+len(value):])
+		inPlaceholder := strings.Count(done, "{{") > strings.Count(done, "}}")
+
+		out.WriteString(text[:i])
+		if isWordRune(before) || isWordRune(after) || inPlaceholder {
+			out.WriteString(value)
+		} else {
+			out.WriteString(placeholder)
+		}
+		text = text[i+len(value):]
+	}
+}
+
+// isWordRune reports whether r can be part of a word
+func isWordRune(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_')
+}
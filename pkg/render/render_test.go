@@ -0,0 +1,139 @@
+package render
+
+import (
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	vars := map[string]string{"repo_name": "app", "profile": "go"}
+
+	got, err := Render("CLAUDE.md.tmpl", []byte("# {{.repo_name}} ({{.profile}})\n"), vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "# app (go)\n" {
+		t.Errorf("Render() = %q", got)
+	}
+
+	if _, err := Render("CLAUDE.md.tmpl", []byte("{{.missing}}"), vars); err == nil {
+		t.Error("Render() with a variable that is not set: want error")
+	}
+	if _, err := Render("CLAUDE.md.tmpl", []byte("{{.repo_name"), vars); err == nil {
+		t.Error("Render() of a broken template: want error")
+	}
+}
+
+func TestReverse(t *testing.T) {
+	vars := map[string]string{
+		"profile":   "default",
+		"repo_name": "app",
+		"short":     "go",
+	}
+
+	tests := []struct {
+		name   string
+		tmpl   string
+		edited string
+		want   string
+	}{
+		{
+			name:   "unchanged",
+			tmpl:   "# {{.repo_name}}\n{{if .short}}Uses {{.short}}{{end}}\n",
+			edited: "# app\nUses go\n",
+			want:   "# {{.repo_name}}\n{{if .short}}Uses {{.short}}{{end}}\n",
+		},
+		{
+			name:   "edited line keeps its placeholder",
+			tmpl:   "# {{.profile}} settings\nother\n",
+			edited: "# default settings!\nother\n",
+			want:   "# {{.profile}} settings!\nother\n",
+		},
+		{
+			name:   "literal text equal to a value stays literal",
+			tmpl:   "# {{.profile}} settings\ndefault settings\n",
+			edited: "# default settings\ndefault settings apply\n",
+			want:   "# {{.profile}} settings\ndefault settings apply\n",
+		},
+		{
+			name:   "new lines stay literal",
+			tmpl:   "# {{.repo_name}}\n",
+			edited: "# app\nThe app is written in go\n",
+			want:   "# {{.repo_name}}\nThe app is written in go\n",
+		},
+		{
+			name:   "short values are mapped where rendered",
+			tmpl:   "Language: {{.short}}\n",
+			edited: "Language: go, mostly\n",
+			want:   "Language: {{.short}}, mostly\n",
+		},
+		{
+			name:   "changed value becomes literal",
+			tmpl:   "Repo: {{.repo_name}}\n",
+			edited: "Repo: other\n",
+			want:   "Repo: other\n",
+		},
+		{
+			name:   "deleted placeholder",
+			tmpl:   "Repo: {{.repo_name}} ({{.profile}})\n",
+			edited: "Repo: (default)\n",
+			want:   "Repo: ({{.profile}})\n",
+		},
+		{
+			name:   "template not rendering line for line",
+			tmpl:   "{{.profile}}\n{{if eq .short \"rust\"}}\nRust\n{{end}}default text\n",
+			edited: "default\ndefault text!\n",
+			want:   "{{.profile}}\ndefault text!\n",
+		},
+		{
+			name:   "value used in a comparison",
+			tmpl:   "{{if eq .profile \"default\"}}app uses defaults{{end}}\n{{.repo_name}}\n",
+			edited: "app uses defaults\napp!\n",
+			want:   "{{if eq .profile \"default\"}}app uses defaults{{end}}\n{{.repo_name}}!\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered, err := Render("test", []byte(tt.tmpl), vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := Reverse([]byte(tt.tmpl), rendered, []byte(tt.edited), vars)
+			if string(got) != tt.want {
+				t.Errorf("Reverse() = %q, want %q", got, tt.want)
+			}
+
+			// What was reversed renders to the edited text again
+			again, err := Render("test", got, vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(again) != tt.edited {
+				t.Errorf("reversed template renders %q, want %q", again, tt.edited)
+			}
+		})
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	vars := map[string]string{
+		"repo_name":  "app",
+		"git_remote": "github.com/org/app",
+		"short":      "go",
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"app", "{{.repo_name}}"},
+		{"see github.com/org/app", "see {{.git_remote}}"},
+		{"apps and mapping", "apps and mapping"},
+		{"written in go", "written in go"},
+		{"{{.repo_name}} app", "{{.repo_name}} {{.repo_name}}"},
+	}
+	for _, tt := range tests {
+		if got := Placeholders(tt.text, vars); got != tt.want {
+			t.Errorf("Placeholders(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
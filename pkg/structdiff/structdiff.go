@@ -0,0 +1,281 @@
+// Package structdiff compares JSON and YAML documents by key path, so that
+// reformatting or reordering keys does not count as a change
+package structdiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/HammerSpb/aipaca/pkg/textdiff"
+)
+
+// Kind is the kind of a structural change
+type Kind string
+
+// Change kinds
+const (
+	Added    Kind = "added"    // Key added to an object
+	Removed  Kind = "removed"  // Key removed from an object
+	Changed  Kind = "changed"  // Value replaced
+	Inserted Kind = "inserted" // Element inserted into an array
+	Deleted  Kind = "deleted"  // Element deleted from an array
+)
+
+// Change is a single difference between two documents
+type Change struct {
+	Path string // Key path, e.g. mcpServers.github.env.TOKEN or permissions.allow
+	Kind Kind
+	Old  any
+	New  any
+}
+
+// String formats the change, e.g. `permissions.allow[+] "Bash(go test:*)"`
+func (c Change) String() string {
+	path := c.Path
+	if path == "" {
+		path = "(root)"
+	}
+
+	switch c.Kind {
+	case Added:
+		return fmt.Sprintf("%s added: %s", path, FormatValue(c.New))
+	case Removed:
+		return fmt.Sprintf("%s removed: %s", path, FormatValue(c.Old))
+	case Inserted:
+		return fmt.Sprintf("%s[+] %s", path, FormatValue(c.New))
+	case Deleted:
+		return fmt.Sprintf("%s[-] %s", path, FormatValue(c.Old))
+	default:
+		return fmt.Sprintf("%s changed: %s → %s", path, FormatValue(c.Old), FormatValue(c.New))
+	}
+}
+
+// IsStructured reports whether a file is compared structurally, based on
+// its extension
+func IsStructured(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// Parse decodes a JSON or YAML document, chosen by the file extension.
+// Numbers are normalized to float64 and objects to map[string]any.
+func Parse(path string, data []byte) (any, error) {
+	var doc any
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		if len(bytes.TrimSpace(data)) == 0 {
+			return nil, nil
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", path)
+	}
+
+	return normalize(doc), nil
+}
+
+// Compare returns the changes from document a to document b, visiting
+// object keys in sorted order
+func Compare(a, b any) []Change {
+	var changes []Change
+	compare("", normalize(a), normalize(b), &changes)
+	return changes
+}
+
+// compare appends the changes between two values at path
+func compare(path string, a, b any, changes *[]Change) {
+	switch av := a.(type) {
+	case map[string]any:
+		if bv, ok := b.(map[string]any); ok {
+			compareObjects(path, av, bv, changes)
+			return
+		}
+	case []any:
+		if bv, ok := b.([]any); ok {
+			compareArrays(path, av, bv, changes)
+			return
+		}
+	}
+
+	if canonical(a) != canonical(b) {
+		*changes = append(*changes, Change{Path: path, Kind: Changed, Old: a, New: b})
+	}
+}
+
+// compareObjects reports added and removed keys and recurses into shared ones
+func compareObjects(path string, a, b map[string]any, changes *[]Change) {
+	keys := make(map[string]bool, len(a)+len(b))
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	for _, k := range sorted {
+		av, inA := a[k]
+		bv, inB := b[k]
+		keyPath := joinKey(path, k)
+
+		switch {
+		case !inA:
+			*changes = append(*changes, Change{Path: keyPath, Kind: Added, New: bv})
+		case !inB:
+			*changes = append(*changes, Change{Path: keyPath, Kind: Removed, Old: av})
+		default:
+			compare(keyPath, av, bv, changes)
+		}
+	}
+}
+
+// compareArrays reports inserted and deleted elements, using a line diff
+// over the canonical form of each element so that order is respected
+func compareArrays(path string, a, b []any, changes *[]Change) {
+	// Arrays of equal length that differ in place are compared per index,
+	// so a changed field inside an object element gets its own path
+	if len(a) == len(b) {
+		inPlace := true
+		for i := range a {
+			if canonical(a[i]) != canonical(b[i]) && !sameShape(a[i], b[i]) {
+				inPlace = false
+				break
+			}
+		}
+		if inPlace {
+			for i := range a {
+				compare(fmt.Sprintf("%s[%d]", path, i), a[i], b[i], changes)
+			}
+			return
+		}
+	}
+
+	keysA := make([]string, len(a))
+	for i, v := range a {
+		keysA[i] = canonical(v)
+	}
+	keysB := make([]string, len(b))
+	for i, v := range b {
+		keysB[i] = canonical(v)
+	}
+
+	ai, bi := 0, 0
+	for _, line := range textdiff.Diff(keysA, keysB) {
+		switch line.Op {
+		case textdiff.Equal:
+			ai++
+			bi++
+		case textdiff.Delete:
+			*changes = append(*changes, Change{Path: path, Kind: Deleted, Old: a[ai]})
+			ai++
+		case textdiff.Insert:
+			*changes = append(*changes, Change{Path: path, Kind: Inserted, New: b[bi]})
+			bi++
+		}
+	}
+}
+
+// sameShape reports whether two values are both objects
+func sameShape(a, b any) bool {
+	_, aObj := a.(map[string]any)
+	_, bObj := b.(map[string]any)
+	return aObj && bObj
+}
+
+// joinKey appends an object key to a path, quoting keys that are not
+// plain identifiers
+func joinKey(path, key string) string {
+	plain := key != ""
+	for _, r := range key {
+		if !(r == '_' || r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			plain = false
+			break
+		}
+	}
+
+	if !plain {
+		return path + "[" + strconv.Quote(key) + "]"
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// FormatValue renders a value as compact JSON, shortened when long
+func FormatValue(v any) string {
+	const maxLen = 80
+
+	s := canonical(v)
+	if len([]rune(s)) > maxLen {
+		s = string([]rune(s)[:maxLen-1]) + "…"
+	}
+	return s
+}
+
+// canonical renders a value as compact JSON with sorted keys
+func canonical(v any) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// normalize converts decoded YAML and JSON into the same representation
+func normalize(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, val := range t {
+			out[k] = normalize(val)
+		}
+		return out
+	case map[any]any:
+		out := make(map[string]any, len(t))
+		for k, val := range t {
+			out[fmt.Sprintf("%v", k)] = normalize(val)
+		}
+		return out
+	case []any:
+		out := make([]any, len(t))
+		for i, val := range t {
+			out[i] = normalize(val)
+		}
+		return out
+	case int:
+		return float64(t)
+	case int64:
+		return float64(t)
+	case uint64:
+		return float64(t)
+	case float32:
+		return float64(t)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,149 @@
+package structdiff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string // JSON documents
+		want []string
+	}{
+		{
+			name: "reformatted and reordered",
+			a:    `{"a": 1, "b": {"c": [1, 2]}}`,
+			b:    `{"b":{"c":[1,2]},"a":1.0}`,
+		},
+		{
+			name: "added and removed keys",
+			a:    `{"a": 1, "b": 2}`,
+			b:    `{"b": 2, "c": 3}`,
+			want: []string{"a removed: 1", "c added: 3"},
+		},
+		{
+			name: "nested value changed",
+			a:    `{"mcpServers": {"github": {"env": {"TOKEN": "x"}}}}`,
+			b:    `{"mcpServers": {"github": {"env": {"TOKEN": "y"}}}}`,
+			want: []string{`mcpServers.github.env.TOKEN changed: "x" → "y"`},
+		},
+		{
+			name: "array element inserted",
+			a:    `{"allow": ["a", "b"]}`,
+			b:    `{"allow": ["a", "x", "b"]}`,
+			want: []string{`allow[+] "x"`},
+		},
+		{
+			name: "array element deleted",
+			a:    `{"allow": ["a", "b", "c"]}`,
+			b:    `{"allow": ["a", "c"]}`,
+			want: []string{`allow[-] "b"`},
+		},
+		{
+			name: "object elements compared in place",
+			a:    `[{"name": "a", "on": true}, {"name": "b"}]`,
+			b:    `[{"name": "a", "on": false}, {"name": "b"}]`,
+			want: []string{"[0].on changed: true → false"},
+		},
+		{
+			name: "type changed",
+			a:    `{"a": [1]}`,
+			b:    `{"a": {"b": 1}}`,
+			want: []string{`a changed: [1] → {"b":1}`},
+		},
+		{
+			name: "quoted keys",
+			a:    `{"Bash(go test:*)": 1}`,
+			b:    `{"Bash(go test:*)": 2}`,
+			want: []string{`["Bash(go test:*)"] changed: 1 → 2`},
+		},
+		{
+			name: "root replaced",
+			a:    `1`,
+			b:    `"x"`,
+			want: []string{`(root) changed: 1 → "x"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := Parse("a.json", []byte(tt.a))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := Parse("b.json", []byte(tt.b))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, c := range Compare(a, b) {
+				got = append(got, c.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Compare() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseYAMLMatchesJSON(t *testing.T) {
+	j, err := Parse("settings.json", []byte(`{"a": 1, "b": {"c": ["x", "y"]}, "d": null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, err := Parse("settings.yaml", []byte("b:\n  c: [x, y]\na: 1\nd:\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := Compare(j, y); len(changes) != 0 {
+		t.Errorf("YAML and JSON differ: %v", changes)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		path    string
+		data    string
+		wantErr bool
+	}{
+		{"a.json", "", false},
+		{"a.json", "  \n", false},
+		{"a.json", "{", true},
+		{"a.yml", "a: [", true},
+		{"a.YAML", "a: 1", false},
+		{"a.toml", "a = 1", true},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.path, []byte(tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q, %q) error = %v, want error %v", tt.path, tt.data, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIsStructured(t *testing.T) {
+	tests := map[string]bool{
+		".claude/settings.json": true,
+		"config.YML":            true,
+		"a.yaml":                true,
+		"CLAUDE.md":             false,
+		"json":                  false,
+	}
+	for path, want := range tests {
+		if got := IsStructured(path); got != want {
+			t.Errorf("IsStructured(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	got := FormatValue(long)
+	if len([]rune(got)) != 80 || !strings.HasSuffix(got, "…") {
+		t.Errorf("FormatValue of a long string = %q, want 80 runes ending in …", got)
+	}
+	if got := FormatValue(map[string]any{"b": 1.0, "a": "<x>"}); got != `{"a":"<x>","b":1}` {
+		t.Errorf("FormatValue = %s", got)
+	}
+}
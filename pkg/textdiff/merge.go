@@ -0,0 +1,149 @@
+package textdiff
+
+import "strings"
+
+// Conflict marker lines written around the two sides of a conflict
+const (
+	MarkerOurs   = "<<<<<<<"
+	MarkerSep    = "======="
+	MarkerTheirs = ">>>>>>>"
+)
+
+// change replaces the base lines [start, end) with lines
+type change struct {
+	start, end int
+	lines      []string
+}
+
+// Merge3 merges the changes that ours and theirs each made to base.
+// Changes to separate parts of base are combined; where both sides changed
+// the same lines differently, both versions are kept between conflict
+// markers labelled with oursLabel and theirsLabel. It returns the merged
+// lines and the number of conflicts.
+func Merge3(base, ours, theirs []string, oursLabel, theirsLabel string) ([]string, int) {
+	a := changes(Diff(base, ours))
+	b := changes(Diff(base, theirs))
+
+	var merged []string
+	conflicts := 0
+	pos := 0
+	for len(a) > 0 || len(b) > 0 {
+		// Start a group with the earliest change and pull in every change
+		// of either side that overlaps or touches it
+		var groupA, groupB []change
+		var start, end int
+		if len(b) == 0 || (len(a) > 0 && a[0].start <= b[0].start) {
+			start, end = a[0].start, a[0].end
+			groupA, a = append(groupA, a[0]), a[1:]
+		} else {
+			start, end = b[0].start, b[0].end
+			groupB, b = append(groupB, b[0]), b[1:]
+		}
+		for {
+			if len(a) > 0 && a[0].start <= end {
+				end = max(end, a[0].end)
+				groupA, a = append(groupA, a[0]), a[1:]
+				continue
+			}
+			if len(b) > 0 && b[0].start <= end {
+				end = max(end, b[0].end)
+				groupB, b = append(groupB, b[0]), b[1:]
+				continue
+			}
+			break
+		}
+
+		merged = append(merged, base[pos:start]...)
+		pos = end
+
+		switch {
+		case len(groupB) == 0:
+			merged = append(merged, apply(base, start, end, groupA)...)
+		case len(groupA) == 0:
+			merged = append(merged, apply(base, start, end, groupB)...)
+		default:
+			oursLines := apply(base, start, end, groupA)
+			theirsLines := apply(base, start, end, groupB)
+			if equalLines(oursLines, theirsLines) {
+				merged = append(merged, oursLines...)
+				continue
+			}
+			conflicts++
+			merged = append(merged, MarkerOurs+" "+oursLabel+"\n")
+			merged = append(merged, terminated(oursLines)...)
+			merged = append(merged, MarkerSep+"\n")
+			merged = append(merged, terminated(theirsLines)...)
+			merged = append(merged, MarkerTheirs+" "+theirsLabel+"\n")
+		}
+	}
+	merged = append(merged, base[pos:]...)
+
+	return merged, conflicts
+}
+
+// changes collects the edits of a script as replacements of base ranges
+func changes(script []Line) []change {
+	var out []change
+	var current *change
+	pos := 0
+	for _, l := range script {
+		if l.Op == Equal {
+			if current != nil {
+				out = append(out, *current)
+				current = nil
+			}
+			pos++
+			continue
+		}
+
+		if current == nil {
+			current = &change{start: pos, end: pos}
+		}
+		if l.Op == Delete {
+			current.end++
+			pos++
+		} else {
+			current.lines = append(current.lines, l.Text)
+		}
+	}
+	if current != nil {
+		out = append(out, *current)
+	}
+	return out
+}
+
+// apply returns the base lines [start, end) with the changes made to them
+func apply(base []string, start, end int, changes []change) []string {
+	var out []string
+	pos := start
+	for _, c := range changes {
+		out = append(out, base[pos:c.start]...)
+		out = append(out, c.lines...)
+		pos = c.end
+	}
+	return append(out, base[pos:end]...)
+}
+
+// equalLines reports whether two line slices are the same
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// terminated returns lines with a newline after the last one, so that a
+// conflict marker following them starts on its own line
+func terminated(lines []string) []string {
+	if len(lines) == 0 || strings.HasSuffix(lines[len(lines)-1], "\n") {
+		return lines
+	}
+	out := append([]string{}, lines...)
+	out[len(out)-1] += "\n"
+	return out
+}
@@ -0,0 +1,94 @@
+package textdiff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      string
+		ours      string
+		theirs    string
+		want      string
+		conflicts int
+	}{
+		{
+			name:   "no changes",
+			base:   "a\nb\n",
+			ours:   "a\nb\n",
+			theirs: "a\nb\n",
+			want:   "a\nb\n",
+		},
+		{
+			name:   "only ours changed",
+			base:   "a\nb\nc\n",
+			ours:   "a\nB\nc\n",
+			theirs: "a\nb\nc\n",
+			want:   "a\nB\nc\n",
+		},
+		{
+			name:   "only theirs changed",
+			base:   "a\nb\nc\n",
+			ours:   "a\nb\nc\n",
+			theirs: "a\nb\nc\nd\n",
+			want:   "a\nb\nc\nd\n",
+		},
+		{
+			name:   "separate changes",
+			base:   "1\n2\n3\n4\n5\n",
+			ours:   "one\n2\n3\n4\n5\n",
+			theirs: "1\n2\n3\n4\nfive\n",
+			want:   "one\n2\n3\n4\nfive\n",
+		},
+		{
+			name:   "same change on both sides",
+			base:   "a\nb\nc\n",
+			ours:   "a\nx\nc\n",
+			theirs: "a\nx\nc\n",
+			want:   "a\nx\nc\n",
+		},
+		{
+			name:      "conflict",
+			base:      "a\nb\nc\n",
+			ours:      "a\nours\nc\n",
+			theirs:    "a\ntheirs\nc\n",
+			want:      "a\n<<<<<<< repo\nours\n=======\ntheirs\n>>>>>>> profile\nc\n",
+			conflicts: 1,
+		},
+		{
+			name:      "conflict without final newline",
+			base:      "a",
+			ours:      "b",
+			theirs:    "c",
+			want:      "<<<<<<< repo\nb\n=======\nc\n>>>>>>> profile\n",
+			conflicts: 1,
+		},
+		{
+			name:   "deletion and separate edit",
+			base:   "a\nb\nc\nd\ne\n",
+			ours:   "a\nc\nd\ne\n",
+			theirs: "a\nb\nc\nd\nE\n",
+			want:   "a\nc\nd\nE\n",
+		},
+		{
+			name:   "both append the same line",
+			base:   "a\n",
+			ours:   "a\nb\n",
+			theirs: "a\nb\n",
+			want:   "a\nb\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, conflicts := Merge3(SplitLines(tt.base), SplitLines(tt.ours), SplitLines(tt.theirs), "repo", "profile")
+			if got := strings.Join(merged, ""); got != tt.want {
+				t.Errorf("Merge3() =\n%q\nwant\n%q", got, tt.want)
+			}
+			if conflicts != tt.conflicts {
+				t.Errorf("conflicts = %d, want %d", conflicts, tt.conflicts)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package textdiff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Op is the kind of a line in an edit script
+type Op byte
+
+// Edit operations, using the unified diff line prefixes
+const (
+	Equal  Op = ' '
+	Insert Op = '+'
+	Delete Op = '-'
+)
+
+// Line is a single line of an edit script. Text keeps its trailing newline,
+// so a missing newline at the end of a file counts as a difference.
+type Line struct {
+	Op   Op
+	Text string
+}
+
+// Hunk is a group of changed lines with surrounding context
+type Hunk struct {
+	OldStart int // 1-based; 0 when the hunk covers an empty old file
+	OldLines int
+	NewStart int
+	NewLines int
+	Lines    []Line
+}
+
+// Header returns the "@@ -a,b +c,d @@" line of the hunk
+func (h Hunk) Header() string {
+	return fmt.Sprintf("@@ -%s +%s @@", hunkRange(h.OldStart, h.OldLines), hunkRange(h.NewStart, h.NewLines))
+}
+
+// Stats returns the number of inserted and deleted lines in the hunk
+func (h Hunk) Stats() (inserted, deleted int) {
+	for _, l := range h.Lines {
+		switch l.Op {
+		case Insert:
+			inserted++
+		case Delete:
+			deleted++
+		}
+	}
+	return inserted, deleted
+}
+
+// SplitLines splits text into lines, keeping the trailing newline of each
+func SplitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// maxEditCost bounds the number of inserted and deleted lines Diff looks
+// for a shortest script with. Its trace takes memory quadratic in the cost,
+// so past the bound the differing lines are replaced as a whole.
+const maxEditCost = 2048
+
+// Diff returns the shortest edit script turning a into b (Myers' algorithm).
+// Scripts costing more than maxEditCost replace the lines between the common
+// prefix and suffix instead.
+func Diff(a, b []string) []Line {
+	if len(a)+len(b) == 0 {
+		return nil
+	}
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var script []Line
+	for _, text := range a[:prefix] {
+		script = append(script, Line{Op: Equal, Text: text})
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if mid, ok := shortestScript(midA, midB); ok {
+		script = append(script, mid...)
+	} else {
+		for _, text := range midA {
+			script = append(script, Line{Op: Delete, Text: text})
+		}
+		for _, text := range midB {
+			script = append(script, Line{Op: Insert, Text: text})
+		}
+	}
+	for _, text := range a[len(a)-suffix:] {
+		script = append(script, Line{Op: Equal, Text: text})
+	}
+	return script
+}
+
+// shortestScript runs Myers' algorithm on a and b. It gives up once the
+// script would cost more than maxEditCost.
+func shortestScript(a, b []string) ([]Line, bool) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil, true
+	}
+
+	// v[k+offset] is the furthest x reached on diagonal k. Round d only
+	// reaches diagonals -d..d, so trace[d] keeps just that window of v,
+	// with diagonal k at trace[d][k+d].
+	offset := max
+	v := make([]int, 2*max+2)
+	var trace [][]int
+
+	for d := 0; d <= max && d <= maxEditCost; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1+offset] < v[k+1+offset]) {
+				x = v[k+1+offset]
+			} else {
+				x = v[k-1+offset] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+offset] = x
+
+			if x >= n && y >= m {
+				return backtrack(a, b, trace, d), true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// backtrack walks the saved frontiers back from the end to build the script
+func backtrack(a, b []string, trace [][]int, d int) []Line {
+	x, y := len(a), len(b)
+	var script []Line
+
+	for ; d > 0; d-- {
+		// Round d started from the frontier of round d-1
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[k-1+d] < v[k+1+d]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[prevK+d]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			script = append(script, Line{Op: Equal, Text: a[x]})
+		}
+
+		if x == prevX {
+			y--
+			script = append(script, Line{Op: Insert, Text: b[y]})
+		} else {
+			x--
+			script = append(script, Line{Op: Delete, Text: a[x]})
+		}
+	}
+
+	for x > 0 && y > 0 {
+		x--
+		y--
+		script = append(script, Line{Op: Equal, Text: a[x]})
+	}
+
+	// Reverse into forward order
+	for i, j := 0, len(script)-1; i < j; i, j = i+1, j-1 {
+		script[i], script[j] = script[j], script[i]
+	}
+	return script
+}
+
+// Hunks groups the changes between a and b into hunks with the given
+// number of context lines around each change
+func Hunks(a, b []string, context int) []Hunk {
+	if context < 0 {
+		context = 0
+	}
+
+	script := Diff(a, b)
+
+	var hunks []Hunk
+	var current *Hunk
+	oldLine, newLine := 1, 1
+	lastChange := -1
+
+	for i, line := range script {
+		if line.Op != Equal {
+			if current == nil || i-lastChange-1 > 2*context {
+				// Close the previous hunk and start a new one with leading context
+				if current != nil {
+					hunks = append(hunks, withTrailingContext(*current, script, lastChange, context))
+				}
+				start := i - context
+				if start < 0 {
+					start = 0
+				}
+				current = &Hunk{}
+				o, n := oldLine, newLine
+				for j := start; j < i; j++ {
+					current.Lines = append(current.Lines, script[j])
+					o--
+					n--
+				}
+				current.OldStart, current.NewStart = o, n
+			} else {
+				// Join with the previous hunk, including the context in between
+				for j := lastChange + 1; j < i; j++ {
+					current.Lines = append(current.Lines, script[j])
+				}
+			}
+			current.Lines = append(current.Lines, line)
+			lastChange = i
+		}
+
+		switch line.Op {
+		case Equal:
+			oldLine++
+			newLine++
+		case Delete:
+			oldLine++
+		case Insert:
+			newLine++
+		}
+	}
+
+	if current != nil {
+		hunks = append(hunks, withTrailingContext(*current, script, lastChange, context))
+	}
+
+	for i := range hunks {
+		countLines(&hunks[i])
+	}
+	return hunks
+}
+
+// withTrailingContext appends up to context unchanged lines following the
+// last change of a hunk
+func withTrailingContext(h Hunk, script []Line, lastChange, context int) Hunk {
+	for j := lastChange + 1; j < len(script) && j <= lastChange+context; j++ {
+		h.Lines = append(h.Lines, script[j])
+	}
+	return h
+}
+
+// countLines fills in the line counts of a hunk and adjusts the start
+// lines of empty ranges to match unified diff conventions
+func countLines(h *Hunk) {
+	h.OldLines, h.NewLines = 0, 0
+	for _, l := range h.Lines {
+		if l.Op != Insert {
+			h.OldLines++
+		}
+		if l.Op != Delete {
+			h.NewLines++
+		}
+	}
+	if h.OldLines == 0 {
+		h.OldStart--
+	}
+	if h.NewLines == 0 {
+		h.NewStart--
+	}
+}
+
+// Unified renders hunks as a unified diff body (without file headers)
+func Unified(hunks []Hunk) string {
+	var sb strings.Builder
+	for _, h := range hunks {
+		sb.WriteString(h.Header())
+		sb.WriteByte('\n')
+		for _, l := range h.Lines {
+			sb.WriteString(FormatLine(l))
+		}
+	}
+	return sb.String()
+}
+
+// FormatLine renders a single diff line with its prefix and newline
+func FormatLine(l Line) string {
+	if strings.HasSuffix(l.Text, "\n") {
+		return string(l.Op) + l.Text
+	}
+	return string(l.Op) + l.Text + "\n\\ No newline at end of file\n"
+}
+
+// hunkRange formats the start,count part of a hunk header
+func hunkRange(start, lines int) string {
+	if lines == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, lines)
+}
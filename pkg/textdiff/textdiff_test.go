@@ -0,0 +1,182 @@
+package textdiff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// sides rebuilds the old and new text from an edit script
+func sides(script []Line) (string, string) {
+	var a, b strings.Builder
+	for _, l := range script {
+		if l.Op != Insert {
+			a.WriteString(l.Text)
+		}
+		if l.Op != Delete {
+			b.WriteString(l.Text)
+		}
+	}
+	return a.String(), b.String()
+}
+
+// cost counts the inserted and deleted lines of a script
+func cost(script []Line) int {
+	n := 0
+	for _, l := range script {
+		if l.Op != Equal {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a\n", []string{"a\n"}},
+		{"a\nb", []string{"a\n", "b"}},
+		{"a\n\nb\n", []string{"a\n", "\n", "b\n"}},
+	}
+	for _, tt := range tests {
+		got := SplitLines(tt.text)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) || len(got) != len(tt.want) {
+			t.Errorf("SplitLines(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		cost int
+	}{
+		{"both empty", "", "", 0},
+		{"equal", "a\nb\nc\n", "a\nb\nc\n", 0},
+		{"from empty", "", "a\nb\n", 2},
+		{"to empty", "a\nb\n", "", 2},
+		{"insert middle", "a\nc\n", "a\nb\nc\n", 1},
+		{"delete middle", "a\nb\nc\n", "a\nc\n", 1},
+		{"replace line", "a\nb\nc\n", "a\nx\nc\n", 2},
+		{"missing final newline", "a\nb\n", "a\nb", 2},
+		{"classic", "a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n", 5},
+		{"repeated lines", "x\nx\nx\n", "x\nx\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := Diff(SplitLines(tt.a), SplitLines(tt.b))
+			a, b := sides(script)
+			if a != tt.a || b != tt.b {
+				t.Errorf("script turns %q into %q, want %q into %q", a, b, tt.a, tt.b)
+			}
+			if got := cost(script); got != tt.cost {
+				t.Errorf("cost = %d, want %d", got, tt.cost)
+			}
+		})
+	}
+}
+
+func TestDiffLarge(t *testing.T) {
+	// Unrelated files cost more than maxEditCost and are replaced whole,
+	// keeping the lines they share at both ends
+	var a, b []string
+	a = append(a, "shared head\n")
+	b = append(b, "shared head\n")
+	for i := 0; i < 5000; i++ {
+		a = append(a, fmt.Sprintf("old %d\n", i))
+		b = append(b, fmt.Sprintf("new %d\n", i))
+	}
+	a = append(a, "shared tail\n")
+	b = append(b, "shared tail\n")
+
+	script := Diff(a, b)
+	gotA, gotB := sides(script)
+	if gotA != strings.Join(a, "") || gotB != strings.Join(b, "") {
+		t.Fatal("script does not turn a into b")
+	}
+	if got := cost(script); got != 10000 {
+		t.Errorf("cost = %d, want 10000", got)
+	}
+	if script[0].Op != Equal || script[len(script)-1].Op != Equal {
+		t.Errorf("shared lines at the ends are not kept")
+	}
+
+	// Few changes in large files still get the shortest script
+	c := append([]string{}, a...)
+	c[2500] = "changed\n"
+	if got := cost(Diff(a, c)); got != 2 {
+		t.Errorf("cost of one changed line = %d, want 2", got)
+	}
+}
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		context int
+		want    string
+	}{
+		{
+			name:    "no changes",
+			a:       "a\nb\n",
+			b:       "a\nb\n",
+			context: 3,
+			want:    "",
+		},
+		{
+			name:    "single change",
+			a:       "a\nb\nc\n",
+			b:       "a\nx\nc\n",
+			context: 3,
+			want:    "@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n",
+		},
+		{
+			name:    "new file",
+			a:       "",
+			b:       "a\nb\n",
+			context: 3,
+			want:    "@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name:    "deleted file",
+			a:       "a\n",
+			b:       "",
+			context: 3,
+			want:    "@@ -1 +0,0 @@\n-a\n",
+		},
+		{
+			name:    "separate hunks",
+			a:       "1\n2\n3\n4\n5\n6\n7\n8\n",
+			b:       "x\n2\n3\n4\n5\n6\n7\ny\n",
+			context: 1,
+			want:    "@@ -1,2 +1,2 @@\n-1\n+x\n 2\n@@ -7,2 +7,2 @@\n 7\n-8\n+y\n",
+		},
+		{
+			name:    "joined hunks",
+			a:       "1\n2\n3\n4\n",
+			b:       "x\n2\n3\ny\n",
+			context: 1,
+			want:    "@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n-4\n+y\n",
+		},
+		{
+			name:    "no newline at end",
+			a:       "a\n",
+			b:       "a",
+			context: 3,
+			want:    "@@ -1 +1 @@\n-a\n+a\n\\ No newline at end of file\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Unified(Hunks(SplitLines(tt.a), SplitLines(tt.b), tt.context))
+			if got != tt.want {
+				t.Errorf("Unified() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}